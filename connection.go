@@ -15,7 +15,11 @@
 package netpoll
 
 import (
+	"context"
+	"io"
 	"net"
+	"os"
+	"syscall"
 	"time"
 )
 
@@ -23,6 +27,14 @@ import (
 // Return: error is unused which will be ignored directly.
 type CloseCallback func(connection Connection) error
 
+// CloseReasonCallback is the same as CloseCallback, but it's also called with the reason of closing.
+// The reason is nil if the connection is closed by the user, otherwise it's the error that the connection is closed for,
+// e.g. ErrEOF if closed by the peer, syscall.ECONNRESET if reset by the peer,
+// syscall.ETIMEDOUT if the keepalive of SetIdleTimeout times out, ErrWriteTimeout if the flush times out,
+// and ctx.Err() if rejected by OnConnect returning a canceled ctx.
+// Return: error is unused which will be ignored directly.
+type CloseReasonCallback func(connection Connection, reason error) error
+
 // Connection supports reading and writing simultaneously,
 // but does not support simultaneous reading or writing by multiple goroutines.
 // It maintains its own input/output buffer, and provides nocopy API for reading and writing.
@@ -38,6 +50,14 @@ type Connection interface {
 	// so it will return an error only when the connection isn't Active.
 	Writer() Writer
 
+	// AsReader returns an io.Reader of the connection for the standard decoders, e.g. json.NewDecoder(conn.AsReader()).
+	// Its Read blocks until some data is received like Read of net.Conn, and returns io.EOF itself instead of ErrEOF
+	// once the peer closed and all the data has been read. It reads from the same buffer as Reader without allocation.
+	AsReader() io.Reader
+	// AsWriter returns an io.Writer of the connection for the standard encoders, e.g. json.NewEncoder(conn.AsWriter()),
+	// whose Write flushes p after the pending data in Writer like Write of net.Conn.
+	AsWriter() io.Writer
+
 	// IsActive checks whether the connection is active or not.
 	IsActive() bool
 
@@ -47,11 +67,90 @@ type Connection interface {
 
 	// SetWriteTimeout sets the timeout for future Write calls wait.
 	// A zero value for timeout means Writer will not timeout.
+	// If Flush cannot send all data within timeout, it returns ErrWriteTimeout and the connection will be closed.
 	SetWriteTimeout(timeout time.Duration) error
 
+	// SetWriteCoalesce enables write coalescing if window is positive, or disables it if zero.
+	// When enabled, the Flush and Write calls within the window are merged into the batches sent by the poller,
+	// which reduces the syscalls when many goroutines write small messages to the connection.
+	// Each call still returns after its own bytes have been written, the bytes are sent in the order of the calls,
+	// and Write and Flush can be called by multiple goroutines. Writer must still not be used concurrently.
+	// The callers don't share a lock, but queue their calls by a CAS, and p of Write is copied when it's queued.
+	// Sendfile, Splice, etc. return ErrConcurrentAccess while a batch is being sent. Datagrams cannot be coalesced.
+	SetWriteCoalesce(window time.Duration) error
+
+	// CloseWrite flushes the pending data in Writer and shuts down the write side of the connection,
+	// the peer will read EOF, while the read side is still open until the peer closes.
+	// The connection is still active in the half-closed state, and Close should be called as usual.
+	CloseWrite() error
+
+	// InterruptRead makes the read blocked in Reader, e.g. Next, return ErrInterrupted without closing the connection.
+	// No data is consumed by the interrupted read, and the following reads work as usual.
+	// It only interrupts the read waiting for data at the moment, and does nothing if no read is blocked.
+	// It returns ErrUnsupported for the TLS and compressed connections, whose streams can't be resumed.
+	InterruptRead() error
+
+	// WriteAndClose writes data after the pending data in Writer, and then flushes, shuts down the write side
+	// and closes the connection in order, so that the peer reads the whole response before EOF.
+	// Before closing, it discards the input until the peer closes too, or for at most 500ms, since closing
+	// with unread input sends a RST, which may make the peer drop the response that it has not read yet.
+	// It must not be called concurrently with the reads, and the connection is closed even if it fails.
+	WriteAndClose(data []byte) error
+
+	// CloseWithReset closes the connection with a TCP RST instead of a graceful FIN, by setting SO_LINGER
+	// with a zero timeout, and the unsent data is discarded. The peer reads ECONNRESET instead of EOF.
+	// Since the socket skips TIME_WAIT, it helps to drop abusive connections without exhausting the fds and ports.
+	CloseWithReset() error
+
+	// WriteMmap appends data to the current write stream without copying like WritevDirect, e.g. a region of a mmap'd file,
+	// and calls release once data is no longer referenced by the connection, i.e. it has been written to the socket
+	// after Flush, or the connection is closed, so that the caller can munmap it there.
+	// data must not be changed or unmapped until release is called, and release is called exactly once in any case:
+	// at once if data is empty, or with ErrConnClosed if the connection is closed, and by the close at the latest.
+	// The TLS and compressed connections copy data and call release at once, since they transform it on Flush.
+	WriteMmap(data []byte, release func()) error
+
+	// SetReadBufferThreshold sets the threshold of the input buffer, a zero value means no limit.
+	// Once the unread data exceeds the threshold, the connection stops reading from the socket,
+	// and the peer will be blocked when the kernel buffers are full, as a backpressure.
+	// Reading is resumed automatically when the unread data drops below the threshold by Next, Skip, etc.,
+	// or a read call waits for more data than the threshold.
+	SetReadBufferThreshold(bytes int) error
+
+	// SetReadChunkSize fixes the size of each read from the socket into the input buffer, a zero value restores the default,
+	// which starts from the buffer size of Config and doubles when a read fills it up to 8MB.
+	// A large size, e.g. 1MB, reduces the syscalls of bulk transfers, while a small size, e.g. 4KB,
+	// saves the memory of the connections which only exchange small messages.
+	// The size is limited in [1KB, 8MB], and a read may still be shorter if the current buffer node has less space.
+	SetReadChunkSize(bytes int) error
+
+	// SetReadLimit limits the rate of reading from the socket to bytesPerSec, a zero value means no limit.
+	// The reads are metered by a token bucket holding up to 100ms of the rate (at least 4KB),
+	// and the connection stops reading once the tokens run out until they are refilled,
+	// so the peer will be blocked when the kernel buffers are full, the same as SetReadBufferThreshold.
+	// The limit also applies when a read call is waiting for more data, but not to the direct reads
+	// of Feature.AlwaysNoCopyRead.
+	SetReadLimit(bytesPerSec int) error
+
+	// SetUntilLimit sets the maximum length of the line returned by Reader.Until, a zero value means no limit.
+	// If the delimiter is not found within the limit, Until returns ErrLineTooLong without consuming any data,
+	// instead of buffering the data endlessly, and the caller can skip the data or close the connection.
+	SetUntilLimit(bytes int) error
+
+	// SetMaxReadSize sets the maximum size of a single read of Reader, e.g. Next, Peek and ReadFrame,
+	// a zero value means no limit, as a defense against the memory exhaustion by a malicious length prefix.
+	// A read of more than bytes returns ErrMessageTooLarge at once, before waiting for or allocating the data,
+	// and nothing is consumed, so the caller can drop the data by Discard or close the connection.
+	// Until also returns it once the line without the delimiter exceeds bytes.
+	SetMaxReadSize(bytes int) error
+
 	// SetIdleTimeout sets the idle timeout of connections.
 	// Idle connections that exceed the set timeout are no longer guaranteed to be active,
 	// but can be checked by calling IsActive.
+	// It only enables TCP keepalive and sets both TCP_KEEPIDLE and TCP_KEEPINTVL to timeout truncated to seconds,
+	// and a positive timeout under one second is rounded up to one second, while there is no timer in user space.
+	// So a peer which is idle but alive is never closed, and a dead peer is only detected after
+	// idle + TCP_KEEPCNT * interval, where TCP_KEEPCNT is the system default, e.g. 9 on Linux.
 	SetIdleTimeout(timeout time.Duration) error
 
 	// SetOnRequest can set or replace the OnRequest method for a connection, but can't be set to nil.
@@ -60,6 +159,7 @@ type Connection interface {
 	// Generally, the server side should uniformly set the OnRequest method for each connection via NewEventLoop,
 	// which is set when the connection is initialized.
 	// On the client side, if necessary, make sure that OnRequest is set before sending data.
+	// It can also be called in OnConnect to replace the OnRequest of EventLoop for the connection.
 	SetOnRequest(on OnRequest) error
 
 	// AddCloseCallback can add hangup callback for a connection, which will be called when connection closing.
@@ -67,6 +167,170 @@ type Connection interface {
 	// the local resources, which bound to the idle connection, when hangup by the peer. No need another goroutine
 	// to polling check connection status.
 	AddCloseCallback(callback CloseCallback) error
+
+	// AddCloseReasonCallback adds a callback like AddCloseCallback, which also receives the reason of closing,
+	// so that the cleanup can tell the timeouts, the resets by the peer and the closes by the user apart.
+	AddCloseReasonCallback(callback CloseReasonCallback) error
+
+	// SetUserData stores an opaque value on the connection, e.g. the per-connection state created in OnConnect,
+	// which can be got by GetUserData in OnRequest without context keys and type assertion of context values.
+	// It's safe to be called from any goroutine, and the value will be cleared after the connection closed.
+	SetUserData(v interface{})
+
+	// GetUserData returns the value stored by SetUserData, or nil if not set or the connection has been closed.
+	GetUserData() interface{}
+
+	// SetTag labels the connection with value for key, e.g. the tenant for the accounting by EventLoop.RangeByTag,
+	// which replaces the previous value of key. It's safe to be called from any goroutine,
+	// and the tags will be cleared after the connection closed, the same as SetUserData.
+	SetTag(key, value string)
+
+	// Tag returns the value of key set by SetTag, and whether it's set.
+	Tag(key string) (value string, ok bool)
+
+	// SetLogger routes the lifecycle events of the connection to fn for diagnosing a single connection,
+	// e.g. registered into the poller, the bytes read from the socket, flush errors and closed with the reason,
+	// and the level is one of LogLevelDebug, LogLevelInfo, LogLevelWarn and LogLevelError.
+	// fn is called synchronously by the poller and the reader or writer, so it must not block and must not call Close.
+	// A nil fn removes the logger, and the events are not formatted at all without a logger.
+	SetLogger(fn func(level int, format string, args ...interface{}))
+
+	// InputBytes returns the total number of bytes read from the socket since the connection was established.
+	// It's monotonic and never reset, so it's safe to be called from any goroutine.
+	InputBytes() uint64
+
+	// OutputBytes returns the total number of bytes written to the socket since the connection was established.
+	// It's monotonic and never reset, so it's safe to be called from any goroutine.
+	OutputBytes() uint64
+
+	// EstablishedAt returns the time when the connection was established, i.e. accepted by EventLoop or connected by Dialer.
+	EstablishedAt() time.Time
+
+	// FirstByteAt returns the time when the first bytes were read from the socket, or the zero time if nothing is read yet,
+	// so that FirstByteAt().Sub(EstablishedAt()) is the latency from the handshake to the first request.
+	FirstByteAt() time.Time
+
+	// RecvBufSize returns SO_RCVBUF of the socket, which is doubled by Linux, see WithRecvBuf.
+	RecvBufSize() (bytes int, err error)
+
+	// SendBufSize returns SO_SNDBUF of the socket, which is doubled by Linux, see WithSendBuf.
+	SendBufSize() (bytes int, err error)
+
+	// SetTOS sets IP_TOS for IPv4 or IPV6_TCLASS for IPv6 of the socket to tos in [0, 255], see WithTOS.
+	// ErrUnsupported is returned if the connection is not IP, e.g. a Unix socket.
+	SetTOS(tos int) error
+
+	// TCPInfo returns the diagnostics of the TCP connection by getsockopt(TCP_INFO), e.g. RTT and retransmits.
+	// It's only supported on Linux, and ErrUnsupported is returned elsewhere.
+	TCPInfo() (info *TCPInfo, err error)
+
+	// OriginalDst returns the destination address of the TCP connection before it was redirected
+	// by the iptables REDIRECT or DNAT target, by getsockopt(SO_ORIGINAL_DST) or IP6T_SO_ORIGINAL_DST for IPv6,
+	// so that a transparent proxy can forward it to where the client intended.
+	// ErrNotRedirected is returned if the connection is not redirected, e.g. the connections of TPROXY,
+	// whose LocalAddr is already the original destination.
+	// It's only supported on Linux, and ErrUnsupported is returned elsewhere.
+	OriginalDst() (addr net.Addr, err error)
+
+	// PendingOutputBytes returns the number of bytes flushed to Writer but not yet written to the socket,
+	// which grows when the peer reads slowly, so the producers can slow down as a backpressure.
+	// It's decreased as the data is written on writable events, and safe to be called from any goroutine.
+	PendingOutputBytes() int
+
+	// SetOnWriteReady registers fn to be called once PendingOutputBytes drops below threshold,
+	// so the producers paused by the backpressure can resume without polling PendingOutputBytes.
+	// It's checked as the pending output is written on writable events, and fn is called immediately
+	// if the pending output is already below threshold. fn is run by the runner in another goroutine,
+	// at most once per registration, so it should be registered again for the next backpressure.
+	// A later call replaces the previous fn, and a non-positive threshold or nil fn clears it.
+	// The registered fn is dropped without being called after the connection closed.
+	SetOnWriteReady(threshold int, fn func())
+
+	// FlushResult returns the result of the last flush by Flush or Write, where written is the number of bytes
+	// written to the socket by the flush, including the bytes written later by the poller on writable events.
+	// After a failed flush, e.g. reset by the peer, written is the offset of the pending output up to which
+	// the data has been sent, which can be used to resume the transfer. Note that the bytes written to the socket
+	// are accepted by the kernel, while the peer may not receive all of them if the connection is broken.
+	FlushResult() (written int, err error)
+
+	// MigrateToPoller moves the connection to the index-th poller, which is in the same order as Stats().Pollers,
+	// e.g. to rebalance the pollers when some connections are much busier than others.
+	// The monitored events are moved together, so no readiness is lost, and the buffered data are kept.
+	// It can be called while the connection is reading or writing, e.g. during a blocking Next or Flush,
+	// which are not failed but only wait for the events from the new poller.
+	MigrateToPoller(index int) error
+
+	// Sendfile sends count bytes of f from offset to the connection, and returns the number of bytes sent.
+	// The pending data in Writer will be flushed first, then the file is sent by sendfile(2) without copying,
+	// or by a buffered copy if sendfile is not supported.
+	// It returns early without error if the file reaches EOF, and it's also limited by SetWriteTimeout.
+	Sendfile(f *os.File, offset, count int64) (written int64, err error)
+
+	// Readv reads into bufs by a single readv(2), bypassing Reader, and returns the number of bytes read.
+	// The data already in Reader is read first, and readv(2) is only called for the rest of bufs.
+	// The poller stops reading the socket into Reader while calling Readv, and resumes after that,
+	// so the data arrived later will be in Reader as usual. If no data is available at all,
+	// Readv waits for the poller to read any data like Reader, which is limited by SetReadTimeout.
+	// Reader must not be used concurrently with Readv.
+	Readv(bufs [][]byte) (n int, err error)
+
+	// Splice moves n bytes read from the connection to dst, and returns the number of bytes moved.
+	// On Linux, if both the connections are stream sockets managed by netpoll, the data is moved by splice(2)
+	// through a pipe in the kernel, otherwise it falls back to a buffered copy.
+	// The data already in Reader is moved first, and the pending data in dst's Writer is flushed first.
+	// It returns ErrEOF if the connection is closed by peer before n bytes and is limited by
+	// SetReadTimeout of the connection and SetWriteTimeout of dst.
+	// Reader of the connection must not be used concurrently with Splice.
+	Splice(dst Connection, n int) (written int64, err error)
+
+	// PeekInitial returns the first n bytes of the connection without consuming them, which is used to sniff the protocol,
+	// and the bytes will still be delivered by Reader. It's designed to be called in OnPrepare or OnConnect before any read.
+	// The data not yet read by the poller is peeked by recv(2) with MSG_PEEK, so it even works in OnPrepare,
+	// when the connection has not been registered into the poller.
+	// It never blocks, and returns the available bytes and ErrNotEnough if fewer than n bytes have arrived,
+	// in that case call it later, or use Reader().Peek to wait in OnConnect.
+	PeekInitial(n int) (p []byte, err error)
+
+	// SyscallConn returns a raw connection for the socket options, diagnostics and so on,
+	// and the fd is guaranteed not to be closed while the function passed to Control is running,
+	// which only delays the close of the connection, not the reads and writes.
+	// Control returns ErrConnClosed once the connection is closed, and Read and Write are unsupported,
+	// since the socket can only be read and written by netpoll.
+	//
+	// PLEASE NOTE: the fd is non-blocking and managed by the poller, changing its blocking mode,
+	// closing or reading it will break the connection.
+	SyscallConn() (syscall.RawConn, error)
+}
+
+// writeAndCloseLinger is the longest wait of WriteAndClose for the peer to close.
+const writeAndCloseLinger = 500 * time.Millisecond
+
+// writeAndClose implements Connection.WriteAndClose over the Writer and CloseWrite of c.
+func writeAndClose(c Connection, data []byte) error {
+	if !c.IsActive() {
+		return Exception(ErrConnClosed, "when write and close")
+	}
+	_, err := c.Writer().WriteBinary(data)
+	if err == nil {
+		err = c.CloseWrite()
+	}
+	if err == nil {
+		// the read deadline doesn't matter anymore since the connection is closed after
+		c.SetReadDeadline(time.Now().Add(writeAndCloseLinger))
+		for r := c.Reader(); ; {
+			if n := r.Len(); n > 0 {
+				r.Skip(n)
+				r.Release()
+			}
+			if r.WaitReadSize(1) != nil {
+				break
+			}
+		}
+	}
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 // Conn extends net.Conn, but supports getting the conn's fd.
@@ -77,6 +341,14 @@ type Conn interface {
 	Fd() (fd int)
 }
 
+// The levels of the events logged by Connection.SetLogger.
+const (
+	LogLevelDebug = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
 // Listener extends net.Listener, but supports getting the listener's fd.
 type Listener interface {
 	net.Listener
@@ -91,5 +363,45 @@ type Listener interface {
 type Dialer interface {
 	DialConnection(network, address string, timeout time.Duration) (connection Connection, err error)
 
+	// DialContext dials the address until ctx is done, and the half-open socket is closed if ctx is done
+	// before the connection is established. The deadline of ctx works like the timeout of DialConnection.
+	DialContext(ctx context.Context, network, address string) (connection Connection, err error)
+
 	DialTimeout(network, address string, timeout time.Duration) (conn net.Conn, err error)
+
+	// DialWithData dials the address and writes data before returning the connection.
+	// With WithFastOpen, data is sent with the SYN by TCP Fast Open if possible, see WithFastOpen,
+	// otherwise it's written once the connection is established. The timeout is only for dialing as DialConnection.
+	DialWithData(network, address string, data []byte, timeout time.Duration) (connection Connection, err error)
+
+	// DialMany dials count connections to the address concurrently, e.g. to warm up a pool at startup,
+	// and the timeout is shared by all of them as DialConnection. The non-blocking connects are issued at once,
+	// and each connection is registered into a poller picked by the load balance once it's established.
+	// All the connections established are returned, with a *DialManyError if any of them failed.
+	DialMany(network, address string, count int, timeout time.Duration) (connections []Connection, err error)
+}
+
+// Resolver resolves the host names for Dialer, see WithResolver.
+// It's implemented by *net.Resolver, and can be replaced to resolve the backends from a registry other than DNS.
+type Resolver interface {
+	// LookupIPAddr returns the IP addresses of host, which must not be empty if err is nil.
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// TCPInfo is the diagnostics of a TCP connection, see Connection.TCPInfo.
+// The counters of segments are the same as struct tcp_info of Linux.
+type TCPInfo struct {
+	State        uint8         // the TCP state, e.g. 1 for ESTABLISHED
+	RTT          time.Duration // the smoothed round trip time
+	RTTVar       time.Duration // the mean deviation of RTT
+	RTO          time.Duration // the retransmission timeout
+	SndMSS       uint32        // the maximum segment size to send
+	RcvMSS       uint32        // the maximum segment size estimated to receive
+	SndCwnd      uint32        // the congestion window in segments
+	SndSsthresh  uint32        // the slow start threshold in segments
+	Unacked      uint32        // the segments sent but not acknowledged
+	Lost         uint32        // the segments regarded as lost
+	Retransmits  uint8         // the retransmissions of the timeout in a row
+	Retrans      uint32        // the segments retransmitted and not acknowledged
+	TotalRetrans uint32        // the total segments retransmitted
 }
@@ -0,0 +1,373 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package netpoll
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// writeCoalescer merges the Flush and Write calls into the batches sent by the poller.
+// The callers push their requests to a lock-free stack, where p of Write is copied into the request by the push,
+// and the one who schedules a batch enables the writable events. The poller is the single consumer,
+// which takes the requests in the order of the pushes and sends the segments of the requests together.
+// The data written to Writer is flushed when the poller reaches the request of Flush, since Writer is not used
+// while its caller is waiting, so it's sent after the requests pushed before the Flush.
+type writeCoalescer struct {
+	window    int64          // time.Duration, coalescing is disabled if zero
+	head      unsafe.Pointer // *coalescedWrite, the latest request pushed
+	rounds    uint64         // the batches enabled, updated atomically
+	scheduled int32          // a batch is scheduled or being sent, updated atomically
+	active    int32          // the requests are sent by the poller with the flushing key held, updated atomically
+
+	// locked protects the fields below between the poller and coalesceAbort
+	locked   int32
+	queue    *coalescedWrite // the requests taken by the poller in the order of the pushes
+	tail     *coalescedWrite
+	dones    *coalescedWrite // the finished requests to be notified after unlocking
+	sent     int             // the sent bytes of the segment of queue
+	returned int             // the bytes returned by the last outputs
+	flushed  bool            // the data of Writer has been flushed for the request of Flush at queue
+}
+
+// coalescedWrite is a request of Write or Flush, which is reused after its caller is notified by done.
+type coalescedWrite struct {
+	seg   []byte // the copy of p of Write
+	flush bool   // the request of Flush, which sends the data written to Writer
+	err   error
+	next  *coalescedWrite
+	done  chan error
+}
+
+var coalescedWritePool = sync.Pool{
+	New: func() interface{} {
+		return &coalescedWrite{done: make(chan error, 1)}
+	},
+}
+
+// SetWriteCoalesce implements Connection.
+func (c *connection) SetWriteCoalesce(window time.Duration) error {
+	if window > 0 && c.datagrams != nil {
+		return Exception(ErrUnsupported, "when coalesce datagrams")
+	}
+	if window >= 0 {
+		atomic.StoreInt64(&c.coalescer.window, int64(window))
+	}
+	return nil
+}
+
+func (c *connection) coalescing() bool {
+	return atomic.LoadInt64(&c.coalescer.window) > 0
+}
+
+// coalesceWrite pushes the request of p, or the request of Flush if flush, and waits until it's sent by the poller.
+func (c *connection) coalesceWrite(p []byte, flush bool) (n int, err error) {
+	if !c.IsActive() {
+		return 0, Exception(ErrConnClosed, "when flush")
+	}
+	size := len(p)
+	if flush {
+		size = c.outputBuffer.MallocLen()
+	}
+	wc := &c.coalescer
+	w := coalescedWritePool.Get().(*coalescedWrite)
+	w.seg, w.flush = append(w.seg[:0], p...), flush
+	for {
+		head := atomic.LoadPointer(&wc.head)
+		w.next = (*coalescedWrite)(head)
+		if atomic.CompareAndSwapPointer(&wc.head, head, unsafe.Pointer(w)) {
+			break
+		}
+	}
+	// the request pushed after the connection is closed will not be sent
+	if !c.IsActive() {
+		c.coalesceAbort(Exception(ErrConnClosed, "when flush"))
+	} else if atomic.CompareAndSwapInt32(&wc.scheduled, 0, 1) {
+		// the others wait on their pushes within the window to join the batch
+		time.Sleep(time.Duration(atomic.LoadInt64(&wc.window)))
+		c.coalesceLead()
+	}
+	err = c.coalesceWait(w)
+	if cap(w.seg) > block4k {
+		w.seg = nil
+	}
+	w.next, w.err = nil, nil
+	coalescedWritePool.Put(w)
+
+	if err != nil {
+		size = 0
+		c.lastFlushErr.Store(flushError{err: err})
+	} else {
+		c.lastFlushErr.Store(noFlushError)
+	}
+	atomic.StoreInt64(&c.lastWritten, int64(size))
+	c.closeIfWriteTimeout(err)
+	if err != nil || flush {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// coalesceWait waits for the request w with the write timeout, and all the requests fail if it times out.
+func (c *connection) coalesceWait(w *coalescedWrite) (err error) {
+	timeout, expired := deadlineTimeout(c.writeTimeout, atomic.LoadInt64(&c.writeDeadline))
+	if timeout == 0 && !expired {
+		return <-w.done
+	}
+	if expired {
+		select {
+		case err = <-w.done:
+			return err
+		default:
+		}
+	} else {
+		timer := time.NewTimer(timeout)
+		select {
+		case err = <-w.done:
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+	c.coalesceAbort(Exception(ErrWriteTimeout, c.remoteAddr.String()))
+	return <-w.done
+}
+
+// coalesceLead waits for the flushing key and enables the poller to send the requests.
+func (c *connection) coalesceLead() {
+	wc := &c.coalescer
+	// the flushing key may be held by Sendfile, Splice, etc. for a while
+	for {
+		lock(&wc.locked)
+		if c.coalesceStart() {
+			c.coalesceNotify()
+			return
+		}
+		if !c.IsActive() {
+			c.coalesceFail(Exception(ErrConnClosed, "when flush"))
+			c.coalesceNotify()
+			return
+		}
+		c.coalesceNotify()
+		runtime.Gosched()
+	}
+}
+
+// coalesceStart enables the writable events with the flushing key held, so that the poller sends the requests.
+// The caller must hold the locked of coalescer.
+func (c *connection) coalesceStart() bool {
+	if !c.lock(flushing) {
+		return false
+	}
+	wc := &c.coalescer
+	atomic.AddUint64(&wc.rounds, 1)
+	atomic.StoreInt32(&wc.active, 1)
+	if !c.IsActive() {
+		c.coalesceFail(Exception(ErrConnClosed, "when flush"))
+	} else if err := c.operator.Control(PollR2RW); err != nil {
+		c.coalesceFail(Exception(err, "when flush"))
+	}
+	return true
+}
+
+// coalesceEnd disables the writable events and releases the flushing key after all the requests are sent,
+// and it starts the next batch if any request is pushed meanwhile. The caller must hold the locked of coalescer.
+func (c *connection) coalesceEnd() {
+	wc := &c.coalescer
+	atomic.StoreInt32(&wc.active, 0)
+	c.operator.Control(PollRW2R)
+	c.unlock(flushing)
+	atomic.StoreInt32(&wc.scheduled, 0)
+	if atomic.LoadPointer(&wc.head) != nil && atomic.CompareAndSwapInt32(&wc.scheduled, 0, 1) {
+		if !c.coalesceStart() {
+			go c.coalesceLead()
+		}
+	}
+}
+
+// coalesceOutputs returns the data to send in the order of the requests, it's called by the poller.
+func (c *connection) coalesceOutputs(vs [][]byte) (rs [][]byte) {
+	wc := &c.coalescer
+	lock(&wc.locked)
+	defer c.coalesceNotify()
+	wc.returned = 0
+	if atomic.LoadInt32(&wc.active) == 0 {
+		return nil
+	}
+	for {
+		wc.take()
+		// the data flushed before coalescing is sent first
+		if !c.outputBuffer.IsEmpty() {
+			rs = c.outputBuffer.GetBytes(vs)
+			break
+		}
+		for wc.queue != nil {
+			if w := wc.queue; w.flush {
+				if !wc.flushed {
+					// the caller of Flush is waiting, so Writer is not used concurrently
+					c.outputBuffer.Flush()
+					wc.flushed = true
+				}
+				if !c.outputBuffer.IsEmpty() {
+					break
+				}
+			} else if wc.sent < len(w.seg) {
+				break
+			}
+			wc.complete(nil)
+		}
+		if wc.queue != nil && wc.queue.flush {
+			rs = c.outputBuffer.GetBytes(vs)
+			break
+		}
+		// the segments of the Writes until the next Flush
+		rs = vs[:0]
+		for w := wc.queue; w != nil && !w.flush && len(rs) < len(vs); w = w.next {
+			seg := w.seg
+			if w == wc.queue {
+				seg = seg[wc.sent:]
+			}
+			if len(seg) > 0 {
+				rs = append(rs, seg)
+			}
+		}
+		if len(rs) > 0 {
+			break
+		}
+		if atomic.LoadPointer(&wc.head) == nil {
+			c.coalesceEnd()
+			return nil
+		}
+	}
+	for i := range rs {
+		wc.returned += len(rs[i])
+	}
+	return rs
+}
+
+// coalesceOutputAck finishes the sent requests, it's called by the poller.
+func (c *connection) coalesceOutputAck(n int) {
+	wc := &c.coalescer
+	lock(&wc.locked)
+	defer c.coalesceNotify()
+	if atomic.LoadInt32(&wc.active) == 0 {
+		return
+	}
+	all := n == wc.returned
+	if n > 0 {
+		atomic.AddUint64(&c.outputBytes, uint64(n))
+	}
+	if !c.outputBuffer.IsEmpty() {
+		c.outputBuffer.Skip(n)
+		c.outputBuffer.Release()
+		c.checkWriteReady()
+		if c.outputBuffer.IsEmpty() && wc.flushed {
+			wc.complete(nil)
+		}
+	} else {
+		for wc.queue != nil && !wc.queue.flush {
+			left := len(wc.queue.seg) - wc.sent
+			if n < left {
+				wc.sent += n
+				break
+			}
+			n -= left
+			wc.complete(nil)
+		}
+	}
+	if wc.queue == nil && c.outputBuffer.IsEmpty() && atomic.LoadPointer(&wc.head) == nil {
+		c.coalesceEnd()
+		return
+	}
+	// the edge-triggered writable event will not be reported again if the socket is still writable
+	if all {
+		c.operator.Control(PollR2RW)
+	}
+}
+
+// coalesceAbort fails all the requests with err, e.g. when the connection is closed or the write times out.
+func (c *connection) coalesceAbort(err error) {
+	lock(&c.coalescer.locked)
+	c.coalesceFail(err)
+	c.coalesceNotify()
+}
+
+// coalesceFail is coalesceAbort with the locked of coalescer held.
+func (c *connection) coalesceFail(err error) {
+	wc := &c.coalescer
+	wc.take()
+	for wc.queue != nil {
+		wc.complete(err)
+	}
+	if atomic.CompareAndSwapInt32(&wc.active, 1, 0) {
+		c.operator.Control(PollRW2R)
+		c.unlock(flushing)
+		atomic.StoreInt32(&wc.scheduled, 0)
+	}
+}
+
+// coalesceNotify unlocks the coalescer and notifies the callers of the finished requests.
+func (c *connection) coalesceNotify() {
+	wc := &c.coalescer
+	dones := wc.dones
+	wc.dones = nil
+	unlock(&wc.locked)
+	for w := dones; w != nil; {
+		// w is reused once its caller is notified
+		next := w.next
+		w.done <- w.err
+		w = next
+	}
+}
+
+// take moves the pushed requests to the tail of queue in the order of the pushes.
+func (wc *writeCoalescer) take() {
+	// the stack is in the reverse order of the pushes
+	var reqs, last *coalescedWrite
+	for w := (*coalescedWrite)(atomic.SwapPointer(&wc.head, nil)); w != nil; {
+		next := w.next
+		w.next, reqs = reqs, w
+		if last == nil {
+			last = w
+		}
+		w = next
+	}
+	if reqs == nil {
+		return
+	}
+	if wc.tail == nil {
+		wc.queue = reqs
+	} else {
+		wc.tail.next = reqs
+	}
+	wc.tail = last
+}
+
+// complete moves the request at queue to dones with err.
+func (wc *writeCoalescer) complete(err error) {
+	w := wc.queue
+	wc.queue = w.next
+	if wc.queue == nil {
+		wc.tail = nil
+	}
+	wc.sent, wc.flushed = 0, false
+	w.err, w.next, wc.dones = err, wc.dones, w
+}
@@ -0,0 +1,667 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netpoll
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// flateWindowSize is the window size of flate, the decompressed data pending in flate never exceeds it,
+// so that a read of this size drains all the data decompressed so far.
+const flateWindowSize = 32 * 1024
+
+// flushMarker is the LEN and NLEN of the empty stored block written by flate.Writer.Flush.
+var flushMarker = []byte{0x00, 0x00, 0xff, 0xff}
+
+// NewCompressedConnection returns a Connection whose Reader and Writer transfer the uncompressed data,
+// while the data carried by conn is compressed by flate (RFC 1951) at level in both directions,
+// so the peer must wrap its connection in the same way, or use compress/flate over a raw socket.
+// The level is one of flate.BestSpeed to flate.BestCompression, or flate.DefaultCompression etc.,
+// and an invalid level falls back to flate.DefaultCompression.
+//
+// Each Flush compresses the malloc data and ends it with a sync flush marker, so that the message
+// can be decompressed by the peer as soon as it's received, and the message boundaries are kept.
+// It can be called in OnConnect, and the OnRequest set by SetOnRequest of the returned Connection
+// will be called with it, the same as NewTLSConnection. Closing the returned Connection finishes the
+// compressed stream with the final block before closing conn, so the peer reads ErrEOF after all the data,
+// and the close callbacks added to it will be called with itself.
+func NewCompressedConnection(conn Connection, level int) Connection {
+	c := &compressedConnection{
+		Connection:   conn,
+		inputBuffer:  NewLinkBuffer(),
+		outputBuffer: NewLinkBuffer(),
+	}
+	w := &flateConnWriter{Connection: conn}
+	fw, err := flate.NewWriter(w, level)
+	if err != nil {
+		fw, _ = flate.NewWriter(w, flate.DefaultCompression)
+	}
+	c.fw = fw
+	c.fr = flate.NewReader(&flateConnReader{Connection: conn})
+	return c
+}
+
+var _ Connection = &compressedConnection{}
+
+// compressedConnection implements Connection over compress/flate,
+// the buffers hold the uncompressed data and the embedded Connection carries the compressed data.
+type compressedConnection struct {
+	Connection
+	fw           *flate.Writer
+	fr           io.ReadCloser
+	inputBuffer  *LinkBuffer
+	outputBuffer *LinkBuffer
+	autoFlush    autoFlusher // the state of SetAutoFlush, for the uncompressed data
+	untilLimit   int64       // the maximum length of the line returned by Until
+	maxReadSize  int64       // the maximum size of a single read by SetMaxReadSize
+	finished     int32       // the compressed stream has been finished by Close or CloseWrite
+}
+
+// Reader implements Connection.
+func (c *compressedConnection) Reader() Reader {
+	return c
+}
+
+// Writer implements Connection.
+func (c *compressedConnection) Writer() Writer {
+	return c
+}
+
+// ------------------------------------------ implement zero-copy reader ------------------------------------------
+
+// Next implements Connection.
+func (c *compressedConnection) Next(n int) (p []byte, err error) {
+	if err = c.waitRead(n); err != nil {
+		return p, err
+	}
+	return c.inputBuffer.Next(n)
+}
+
+// TryNext implements Connection.
+// Only the decompressed data is checked, even if there is compressed data in the underlying connection.
+func (c *compressedConnection) TryNext(n int) (p []byte, err error) {
+	return c.inputBuffer.TryNext(n)
+}
+
+// ReadFrame implements Connection.
+func (c *compressedConnection) ReadFrame(header int, bigEndian bool, maxSize int) (p []byte, err error) {
+	return readFrame(c, header, bigEndian, maxSize)
+}
+
+// Peek implements Connection.
+func (c *compressedConnection) Peek(n int) (buf []byte, err error) {
+	if err = c.waitRead(n); err != nil {
+		return buf, err
+	}
+	return c.inputBuffer.Peek(n)
+}
+
+// Skip implements Connection.
+func (c *compressedConnection) Skip(n int) (err error) {
+	if err = c.waitRead(n); err != nil {
+		return err
+	}
+	return c.inputBuffer.Skip(n)
+}
+
+// Discard implements Connection.
+func (c *compressedConnection) Discard(n int) (skipped int, err error) {
+	for skipped < n {
+		if err = c.waitRead(1); err != nil {
+			return skipped, err
+		}
+		l := c.inputBuffer.Len()
+		if l > n-skipped {
+			l = n - skipped
+		}
+		c.inputBuffer.Skip(l)
+		c.inputBuffer.Release()
+		skipped += l
+	}
+	return skipped, nil
+}
+
+// DiscardAll implements Connection, which discards the buffered uncompressed data.
+func (c *compressedConnection) DiscardAll() (skipped int, err error) {
+	return c.inputBuffer.DiscardAll()
+}
+
+// WriteTo implements Connection.
+func (c *compressedConnection) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		if err = c.waitRead(1); err != nil {
+			if errors.Is(err, ErrEOF) {
+				err = nil
+			}
+			return n, err
+		}
+		m, err := c.inputBuffer.WriteTo(w)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// SetUntilLimit implements Connection.
+func (c *compressedConnection) SetUntilLimit(bytes int) error {
+	if bytes >= 0 {
+		atomic.StoreInt64(&c.untilLimit, int64(bytes))
+	}
+	return nil
+}
+
+// SetMaxReadSize implements Connection, which limits the reads of the uncompressed data.
+func (c *compressedConnection) SetMaxReadSize(bytes int) error {
+	if bytes >= 0 {
+		atomic.StoreInt64(&c.maxReadSize, int64(bytes))
+	}
+	return nil
+}
+
+// Until implements Connection.
+func (c *compressedConnection) Until(delim byte) (line []byte, err error) {
+	var n int
+	limit := int(atomic.LoadInt64(&c.untilLimit))
+	for {
+		if err = c.waitRead(n + 1); err != nil {
+			if errors.Is(err, ErrMessageTooLarge) {
+				return nil, err
+			}
+			// return all the data in the buffer
+			line, _ = c.inputBuffer.Next(c.inputBuffer.Len())
+			return
+		}
+		i := c.inputBuffer.indexByte(delim, n)
+		if limit > 0 && (i >= limit || i < 0 && c.inputBuffer.Len() >= limit) {
+			return nil, Exception(ErrLineTooLong, fmt.Sprintf("when compressed until, limit[%d]", limit))
+		}
+		if i < 0 {
+			n = c.inputBuffer.Len() // skip all exists bytes
+			continue
+		}
+		return c.inputBuffer.Next(i + 1)
+	}
+}
+
+// ReadString implements Connection.
+func (c *compressedConnection) ReadString(n int) (s string, err error) {
+	if err = c.waitRead(n); err != nil {
+		return s, err
+	}
+	return c.inputBuffer.ReadString(n)
+}
+
+// ReadBinary implements Connection.
+func (c *compressedConnection) ReadBinary(n int) (p []byte, err error) {
+	if err = c.waitRead(n); err != nil {
+		return p, err
+	}
+	return c.inputBuffer.ReadBinary(n)
+}
+
+// ReadFull implements Connection.
+func (c *compressedConnection) ReadFull(p []byte) (n int, err error) {
+	if err = c.waitRead(len(p)); err != nil {
+		return 0, err
+	}
+	return c.inputBuffer.ReadFull(p)
+}
+
+// ReadByte implements Connection.
+func (c *compressedConnection) ReadByte() (b byte, err error) {
+	if err = c.waitRead(1); err != nil {
+		return b, err
+	}
+	return c.inputBuffer.ReadByte()
+}
+
+// Slice implements Connection.
+func (c *compressedConnection) Slice(n int) (r Reader, err error) {
+	if err = c.waitRead(n); err != nil {
+		return nil, err
+	}
+	return c.inputBuffer.Slice(n)
+}
+
+// Clone implements Connection, the data not read into the buffer yet is not cloned.
+func (c *compressedConnection) Clone() (r Reader) {
+	return c.inputBuffer.Clone()
+}
+
+// Release implements Connection.
+func (c *compressedConnection) Release() (err error) {
+	return c.inputBuffer.Release()
+}
+
+// Len implements Connection.
+func (c *compressedConnection) Len() (length int) {
+	return c.inputBuffer.Len()
+}
+
+// WaitReadSize implements Connection.
+func (c *compressedConnection) WaitReadSize(n int) (err error) {
+	return c.waitRead(n)
+}
+
+// ------------------------------------------ implement zero-copy writer ------------------------------------------
+
+// Malloc implements Connection.
+func (c *compressedConnection) Malloc(n int) (buf []byte, err error) {
+	c.autoFlush.malloc()
+	return c.outputBuffer.Malloc(n)
+}
+
+// TryMalloc implements Connection.
+func (c *compressedConnection) TryMalloc(n int) (buf []byte) {
+	c.autoFlush.malloc()
+	return c.outputBuffer.TryMalloc(n)
+}
+
+// MallocLen implements Connection.
+func (c *compressedConnection) MallocLen() (length int) {
+	return c.outputBuffer.MallocLen()
+}
+
+// MallocAck implements Connection.
+func (c *compressedConnection) MallocAck(n int) (err error) {
+	return c.outputBuffer.MallocAck(n)
+}
+
+// Append implements Connection.
+func (c *compressedConnection) Append(w Writer) (err error) {
+	return c.autoFlush.flushIfFull(c, c.outputBuffer.Append(w))
+}
+
+// AppendBuffer implements Connection.
+func (c *compressedConnection) AppendBuffer(r Reader, n int) (err error) {
+	return c.autoFlush.flushIfFull(c, c.outputBuffer.AppendBuffer(r, n))
+}
+
+// WriteString implements Connection.
+func (c *compressedConnection) WriteString(s string) (n int, err error) {
+	n, err = c.outputBuffer.WriteString(s)
+	return n, c.autoFlush.flushIfFull(c, err)
+}
+
+// WriteBinary implements Connection.
+func (c *compressedConnection) WriteBinary(b []byte) (n int, err error) {
+	n, err = c.outputBuffer.WriteBinary(b)
+	return n, c.autoFlush.flushIfFull(c, err)
+}
+
+// WriteDirect implements Connection.
+func (c *compressedConnection) WriteDirect(p []byte, remainCap int) (err error) {
+	return c.outputBuffer.WriteDirect(p, remainCap)
+}
+
+// WritevDirect implements Connection.
+func (c *compressedConnection) WritevDirect(bufs [][]byte) (err error) {
+	return c.outputBuffer.WritevDirect(bufs)
+}
+
+// WriteMmap implements Connection, data is copied and released at once,
+// since it's compressed by Flush anyway, and the uncompressed buffer is not recycled by Close.
+func (c *compressedConnection) WriteMmap(data []byte, release func()) (err error) {
+	defer release()
+	if !c.IsActive() {
+		return Exception(ErrConnClosed, "when write mmap")
+	}
+	_, err = c.outputBuffer.WriteBinary(data)
+	return err
+}
+
+// WriteByte implements Connection.
+func (c *compressedConnection) WriteByte(b byte) (err error) {
+	return c.autoFlush.flushIfFull(c, c.outputBuffer.WriteByte(b))
+}
+
+// Flush compresses all the malloc data with a sync flush marker and writes it to the underlying connection.
+func (c *compressedConnection) Flush() (err error) {
+	c.autoFlush.flush()
+	c.outputBuffer.Flush()
+	n := c.outputBuffer.Len()
+	if n == 0 {
+		return nil
+	}
+	if atomic.LoadInt32(&c.finished) > 0 {
+		return Exception(ErrConnClosed, "when compressed flush")
+	}
+	p, _ := c.outputBuffer.Next(n)
+	_, err = c.fw.Write(p)
+	c.outputBuffer.Release()
+	if err == nil {
+		err = c.fw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	return c.Connection.Writer().Flush()
+}
+
+// SetAutoFlush implements Writer.
+func (c *compressedConnection) SetAutoFlush(threshold int) error {
+	c.autoFlush.set(threshold)
+	return nil
+}
+
+// ReadFrom implements Connection.
+func (c *compressedConnection) ReadFrom(r io.Reader) (n int64, err error) {
+	return readFrom(c, r)
+}
+
+// FlushSync implements Connection.
+func (c *compressedConnection) FlushSync() (err error) {
+	if err = c.Flush(); err != nil {
+		return err
+	}
+	return c.Connection.Writer().FlushSync()
+}
+
+// ------------------------------------------ implement net.Conn ------------------------------------------
+
+// Read behavior is the same as Connection.Read.
+func (c *compressedConnection) Read(p []byte) (n int, err error) {
+	l := len(p)
+	if l == 0 {
+		return 0, nil
+	}
+	if err = c.waitRead(1); err != nil {
+		return 0, err
+	}
+	if has := c.inputBuffer.Len(); has < l {
+		l = has
+	}
+	src, err := c.inputBuffer.Next(l)
+	n = copy(p, src)
+	if err == nil {
+		err = c.inputBuffer.Release()
+	}
+	return n, err
+}
+
+// Readv implements Connection, which reads the decompressed data into bufs.
+func (c *compressedConnection) Readv(bufs [][]byte) (n int, err error) {
+	if err = c.waitRead(1); err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(bufs) && c.inputBuffer.Len() > 0; i++ {
+		size := c.inputBuffer.Len()
+		if l := len(bufs[i]); size > l {
+			size = l
+		}
+		p, _ := c.inputBuffer.Next(size)
+		n += copy(bufs[i], p)
+	}
+	return n, c.inputBuffer.Release()
+}
+
+// Write behavior is the same as Connection.Write.
+func (c *compressedConnection) Write(p []byte) (n int, err error) {
+	dst, _ := c.outputBuffer.Malloc(len(p))
+	n = copy(dst, p)
+	return n, c.Flush()
+}
+
+// Close finishes the compressed stream and closes the underlying connection.
+func (c *compressedConnection) Close() error {
+	if c.Connection.IsActive() {
+		c.finish()
+	}
+	return c.Connection.Close()
+}
+
+// CloseWrite finishes the compressed stream and shuts down the write side of the underlying connection.
+func (c *compressedConnection) CloseWrite() error {
+	if err := c.finish(); err != nil {
+		return err
+	}
+	return c.Connection.CloseWrite()
+}
+
+// finish flushes the malloc data and writes the final block, only the first call takes effect.
+func (c *compressedConnection) finish() (err error) {
+	if err = c.Flush(); err != nil {
+		return err
+	}
+	if !atomic.CompareAndSwapInt32(&c.finished, 0, 1) {
+		return nil
+	}
+	if err = c.fw.Close(); err != nil {
+		return err
+	}
+	return c.Connection.Writer().Flush()
+}
+
+// AsReader implements Connection.
+func (c *compressedConnection) AsReader() io.Reader {
+	return &eofReader{r: c}
+}
+
+// AsWriter implements Connection.
+func (c *compressedConnection) AsWriter() io.Writer {
+	return c
+}
+
+// InterruptRead implements Connection, it's unsupported since the compressed stream can't be resumed after an error.
+func (c *compressedConnection) InterruptRead() error {
+	return Exception(ErrUnsupported, "when interrupt compressed read")
+}
+
+// WriteAndClose implements Connection.
+func (c *compressedConnection) WriteAndClose(data []byte) error {
+	return writeAndClose(c, data)
+}
+
+// SetOnRequest implements Connection, and OnRequest will be called with the compressed connection.
+// The received data is decompressed before calling OnRequest, and OnRequest is called again
+// until all the decompressed data is read, or only the sync flush marker is left in the underlying connection.
+func (c *compressedConnection) SetOnRequest(on OnRequest) error {
+	if on == nil {
+		return nil
+	}
+	return c.Connection.SetOnRequest(func(ctx context.Context, _ Connection) (err error) {
+		for {
+			if c.inputBuffer.Len() == 0 {
+				if c.onlyFlushMarker() {
+					return nil
+				}
+				if err = c.waitRead(1); err != nil {
+					return err
+				}
+			}
+			err = on(ctx, c)
+			if err != nil || !c.IsActive() {
+				return err
+			}
+		}
+	})
+}
+
+// onlyFlushMarker reports whether the unread compressed data is nothing or only the rest of a sync flush marker,
+// which is an empty stored block ending with 0x00 0x00 0xff 0xff, so that no data can be decompressed without blocking.
+func (c *compressedConnection) onlyFlushMarker() bool {
+	reader := c.Connection.Reader()
+	n := reader.Len()
+	if n == 0 {
+		return true
+	}
+	if n > 5 || n < 4 {
+		return false
+	}
+	p, err := reader.Peek(n)
+	return err == nil && bytes.HasSuffix(p, flushMarker)
+}
+
+// AddCloseCallback implements Connection, and the callback will be called with the compressed connection.
+func (c *compressedConnection) AddCloseCallback(callback CloseCallback) error {
+	if callback == nil {
+		return nil
+	}
+	return c.Connection.AddCloseCallback(func(Connection) error {
+		return callback(c)
+	})
+}
+
+// AddCloseReasonCallback implements Connection, and the callback will be called with the compressed connection.
+func (c *compressedConnection) AddCloseReasonCallback(callback CloseReasonCallback) error {
+	if callback == nil {
+		return nil
+	}
+	return c.Connection.AddCloseReasonCallback(func(_ Connection, reason error) error {
+		return callback(c, reason)
+	})
+}
+
+// Sendfile implements Connection, the file is compressed by a buffered copy.
+func (c *compressedConnection) Sendfile(f *os.File, offset, count int64) (written int64, err error) {
+	if err = c.Flush(); err != nil {
+		return 0, err
+	}
+	for written < count {
+		size := count - written
+		if size > flateWindowSize {
+			size = flateWindowSize
+		}
+		buf, _ := c.outputBuffer.Malloc(int(size))
+		n, rerr := f.ReadAt(buf, offset+written)
+		c.outputBuffer.MallocAck(n)
+		if err = c.Flush(); err != nil {
+			return written, err
+		}
+		written += int64(n)
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+	return written, nil
+}
+
+// Splice implements Connection, the decompressed data is moved by a buffered copy.
+func (c *compressedConnection) Splice(dst Connection, n int) (written int64, err error) {
+	w := dst.Writer()
+	for written < int64(n) {
+		if err = c.waitRead(1); err != nil {
+			return written, err
+		}
+		size := c.inputBuffer.Len()
+		if left := n - int(written); size > left {
+			size = left
+		}
+		p, _ := c.inputBuffer.Next(size)
+		buf, err := w.Malloc(size)
+		if err != nil {
+			return written, err
+		}
+		copy(buf, p)
+		c.inputBuffer.Release()
+		if err = w.Flush(); err != nil {
+			return written, err
+		}
+		written += int64(size)
+	}
+	return written, nil
+}
+
+// waitRead decompresses the data until n bytes are available.
+func (c *compressedConnection) waitRead(n int) (err error) {
+	if err = checkReadSize(n, &c.maxReadSize); err != nil {
+		return err
+	}
+	for c.inputBuffer.Len() < n {
+		buf, _ := c.inputBuffer.Malloc(flateWindowSize)
+		m, err := c.fr.Read(buf)
+		c.inputBuffer.MallocAck(m)
+		c.inputBuffer.Flush()
+		if err != nil && (m == 0 || c.inputBuffer.Len() < n) {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return Exception(ErrEOF, "compressed read")
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// flateConnWriter is the io.Writer under flate.Writer, which copies the compressed data into the Connection,
+// since flate reuses its buffer after Write.
+type flateConnWriter struct {
+	Connection
+}
+
+// Write implements io.Writer, the data will be sent by the Flush of compressedConnection.
+func (w *flateConnWriter) Write(p []byte) (n int, err error) {
+	buf, err := w.Connection.Writer().Malloc(len(p))
+	if err != nil {
+		return 0, err
+	}
+	return copy(buf, p), nil
+}
+
+// flateConnReader is the io.Reader under flate.Reader, which implements io.ByteReader,
+// so that flate reads only the bytes it needs and the rest are still left in the Connection.
+type flateConnReader struct {
+	Connection
+}
+
+// Read implements io.Reader.
+func (r *flateConnReader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	reader := r.Connection.Reader()
+	if reader.Len() == 0 {
+		if _, err = reader.Peek(1); err != nil {
+			return 0, r.convertErr(err)
+		}
+	}
+	n = reader.Len()
+	if n > len(p) {
+		n = len(p)
+	}
+	buf, err := reader.Next(n)
+	if err != nil {
+		return 0, r.convertErr(err)
+	}
+	copy(p, buf)
+	return n, reader.Release()
+}
+
+// ReadByte implements io.ByteReader.
+func (r *flateConnReader) ReadByte() (b byte, err error) {
+	b, err = r.Connection.Reader().ReadByte()
+	if err != nil {
+		return 0, r.convertErr(err)
+	}
+	return b, nil
+}
+
+// convertErr converts ErrEOF to io.EOF, which is expected by flate when the peer closed.
+func (r *flateConnReader) convertErr(err error) error {
+	if errors.Is(err, ErrEOF) {
+		return io.EOF
+	}
+	return err
+}
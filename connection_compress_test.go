@@ -0,0 +1,158 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package netpoll
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestCompressedConnection(t *testing.T) {
+	p1, p2, err := Pipe()
+	MustNil(t, err)
+	c1 := NewCompressedConnection(p1, flate.BestSpeed)
+	c2 := NewCompressedConnection(p2, 100) // invalid level falls back to the default
+	defer c2.Close()
+
+	closed := make(chan Connection, 1)
+	MustNil(t, c2.AddCloseCallback(func(connection Connection) error {
+		closed <- connection
+		return nil
+	}))
+
+	// several messages of random sizes, each flushed, keep the boundaries
+	msgs := make([][]byte, 16)
+	for i := range msgs {
+		msgs[i] = make([]byte, 1+rand.Intn(256*1024))
+		rand.Read(msgs[i])
+		_, err = c1.Writer().WriteBinary(msgs[i])
+		MustNil(t, err)
+		MustNil(t, c1.Writer().Flush())
+	}
+	for i := range msgs {
+		p, err := c2.Reader().Next(len(msgs[i]))
+		MustNil(t, err)
+		MustTrue(t, bytes.Equal(p, msgs[i]))
+		MustNil(t, c2.Reader().Release())
+	}
+	Equal(t, c2.Reader().Len(), 0)
+
+	// the other direction by Until
+	_, err = c2.Write([]byte("hello\nworld\n"))
+	MustNil(t, err)
+	line, err := c1.Reader().Until('\n')
+	MustNil(t, err)
+	Equal(t, string(line), "hello\n")
+	line, err = c1.Reader().Until('\n')
+	MustNil(t, err)
+	Equal(t, string(line), "world\n")
+
+	// closing finishes the stream after the pending data
+	_, err = c1.Writer().WriteString("bye")
+	MustNil(t, err)
+	MustNil(t, c1.Close())
+	s, err := c2.Reader().ReadString(3)
+	MustNil(t, err)
+	Equal(t, s, "bye")
+	_, err = c2.Reader().Next(1)
+	MustTrue(t, errors.Is(err, ErrEOF))
+	MustNil(t, c2.Close())
+	Assert(t, <-closed == c2)
+}
+
+func TestCompressedConnectionServer(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	onRequest := func(ctx context.Context, connection Connection) error {
+		// echo the decompressed data
+		reader, writer := connection.Reader(), connection.Writer()
+		for reader.Len() > 0 {
+			p, err := reader.Next(reader.Len())
+			if err != nil {
+				return err
+			}
+			_, err = writer.WriteBinary(p)
+			MustNil(t, err)
+			MustNil(t, writer.Flush())
+			MustNil(t, reader.Release())
+		}
+		return nil
+	}
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			t.Fatal("replaced in OnConnect")
+			return nil
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			conn := NewCompressedConnection(connection, flate.DefaultCompression)
+			MustNil(t, conn.SetOnRequest(onRequest))
+			return ctx
+		}))
+	defer loop.Shutdown(context.Background())
+
+	// the client uses compress/flate over a raw socket
+	raw, err := net.Dial(network, address)
+	MustNil(t, err)
+	defer raw.Close()
+	counter := &countingReader{Reader: raw}
+	fw, err := flate.NewWriter(raw, flate.BestCompression)
+	MustNil(t, err)
+	fr := flate.NewReader(counter)
+
+	// the compressible data is smaller on the wire
+	payload := bytes.Repeat([]byte("netpoll compressed connection "), 4096)
+	_, err = fw.Write(payload)
+	MustNil(t, err)
+	MustNil(t, fw.Flush())
+	buf := make([]byte, len(payload))
+	_, err = io.ReadFull(fr, buf)
+	MustNil(t, err)
+	MustTrue(t, bytes.Equal(buf, payload))
+	MustTrue(t, counter.n < len(payload)/10)
+
+	// the random data still works
+	for i := 0; i < 8; i++ {
+		payload = make([]byte, 1+rand.Intn(64*1024))
+		rand.Read(payload)
+		_, err = fw.Write(payload)
+		MustNil(t, err)
+		MustNil(t, fw.Flush())
+		buf = make([]byte, len(payload))
+		_, err = io.ReadFull(fr, buf)
+		MustNil(t, err)
+		MustTrue(t, bytes.Equal(buf, payload))
+	}
+
+	MustNil(t, fw.Close())
+}
+
+type countingReader struct {
+	io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	r.n += n
+	return n, err
+}
@@ -0,0 +1,199 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package netpoll
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// maxDatagramSize is the maximum size of a datagram read at once, the exceeded part will be truncated.
+const maxDatagramSize = 1<<16 - 1
+
+// datagram records the size and the sender of a datagram in inputBuffer.
+type datagram struct {
+	size int
+	from syscall.Sockaddr
+}
+
+// datagrams keeps the boundaries of datagrams for connections on packet sockets, like UDP.
+// The poller pushes the received datagrams, and the reader pops them when the data is consumed.
+type datagrams struct {
+	mux    sync.Mutex
+	queue  []datagram
+	offset int              // the consumed size of queue[0]
+	remote syscall.Sockaddr // the sender of the latest consumed datagram
+	addr   net.Addr         // the converted remote
+	toAddr func(syscall.Sockaddr) net.Addr
+}
+
+func (d *datagrams) push(size int, from syscall.Sockaddr) {
+	d.mux.Lock()
+	d.queue = append(d.queue, datagram{size: size, from: from})
+	d.mux.Unlock()
+}
+
+// consume pops the datagrams which have been read n bytes.
+func (d *datagrams) consume(n int) {
+	d.mux.Lock()
+	for n > 0 && len(d.queue) > 0 {
+		dg := d.queue[0]
+		if dg.from != nil && d.offset == 0 {
+			d.remote, d.addr = dg.from, nil
+		}
+		if left := dg.size - d.offset; n < left {
+			d.offset += n
+			break
+		} else {
+			n -= left
+		}
+		d.offset = 0
+		d.queue[0] = datagram{}
+		d.queue = d.queue[1:]
+	}
+	d.mux.Unlock()
+}
+
+// headLen returns the unread size of the first datagram.
+func (d *datagrams) headLen() (length int) {
+	d.mux.Lock()
+	if len(d.queue) > 0 {
+		length = d.queue[0].size - d.offset
+	}
+	d.mux.Unlock()
+	return length
+}
+
+// remoteAddr returns the sender of the latest consumed datagram, it's converted lazily.
+func (d *datagrams) remoteAddr() (addr net.Addr) {
+	d.mux.Lock()
+	if d.addr == nil && d.remote != nil {
+		d.addr = d.toAddr(d.remote)
+	}
+	addr = d.addr
+	d.mux.Unlock()
+	return addr
+}
+
+// destination returns the sender of the latest consumed datagram.
+func (d *datagrams) destination() (to syscall.Sockaddr) {
+	d.mux.Lock()
+	to = d.remote
+	d.mux.Unlock()
+	return to
+}
+
+// initDatagram makes the connection preserve datagram boundaries.
+// The poller will call inputDatagram and outputDatagram instead of inputs and outputs.
+func (c *connection) initDatagram() {
+	c.datagrams = &datagrams{addr: c.remoteAddr, toAddr: c.addrFunc()}
+	c.operator.Inputs, c.operator.InputAck = nil, nil
+	c.operator.Outputs, c.operator.OutputAck = nil, nil
+	c.operator.OnRead, c.operator.OnWrite = c.inputDatagram, c.outputDatagram
+}
+
+// RemoteAddr implements Connection.
+// For packet sockets, it returns the sender of the datagram most recently read.
+func (c *connection) RemoteAddr() (addr net.Addr) {
+	if c.datagrams != nil {
+		return c.datagrams.remoteAddr()
+	}
+	return c.remoteAddr
+}
+
+// inputDatagram implements FDOperator.OnRead, it's called by the poller when the packet socket is readable.
+func (c *connection) inputDatagram(p Poll) error {
+	buf := malloc(maxDatagramSize, maxDatagramSize)
+	defer free(buf)
+	for i := 0; i < maxReadCycle; i++ {
+		n, from, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			// other errors (like ECONNREFUSED) are reported only once by the socket and will not break the connection
+			return err
+		}
+		if n <= 0 {
+			continue
+		}
+		c.addInputBytes(n)
+		dst, _ := c.inputBuffer.Malloc(n)
+		copy(dst, buf[:n])
+		c.datagrams.push(n, from)
+		c.inputBuffer.Flush()
+		c.controlRead()
+
+		length := c.inputBuffer.Len()
+		needTrigger := true
+		if length == n { // first start onRequest
+			needTrigger = c.onRequest()
+		}
+		if needTrigger && length >= int(atomic.LoadInt64(&c.waitReadSize)) {
+			c.triggerRead(nil)
+		}
+	}
+	return nil
+}
+
+// outputDatagram implements FDOperator.OnWrite, it's called by the poller when the packet socket is writable.
+func (c *connection) outputDatagram(p Poll) error {
+	err := c.sendDatagram(c.datagrams.destination())
+	if err == syscall.EAGAIN {
+		return nil
+	}
+	c.operator.Control(PollRW2R)
+	if err != nil {
+		c.triggerWrite(Exception(err, "when flush"))
+		return err
+	}
+	c.triggerWrite(nil)
+	return nil
+}
+
+// flushDatagram sends all the data in outputBuffer as exactly one datagram.
+func (c *connection) flushDatagram() error {
+	err := c.sendDatagram(c.datagrams.destination())
+	if err == nil {
+		return nil
+	}
+	if err != syscall.EAGAIN {
+		return Exception(err, "when flush")
+	}
+	if err = c.operator.Control(PollR2RW); err != nil {
+		return Exception(err, "when flush")
+	}
+	return c.waitFlush()
+}
+
+// sendDatagram sends outputBuffer to the peer, the address is ignored if the socket is connected.
+func (c *connection) sendDatagram(to syscall.Sockaddr) (err error) {
+	if c.outputBuffer.IsEmpty() {
+		return nil
+	}
+	if c.isConnected {
+		to = nil
+	}
+	p := c.outputBuffer.Bytes()
+	if err = syscall.Sendto(c.fd, p, 0, to); err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.outputBytes, uint64(len(p)))
+	c.outputBuffer.Skip(len(p))
+	c.outputBuffer.Release()
+	return nil
+}
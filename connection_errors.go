@@ -16,6 +16,7 @@ package netpoll
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"syscall"
 )
@@ -38,6 +39,22 @@ const (
 	ErrWriteTimeout = syscall.Errno(0x107)
 	// Concurrent connection access error
 	ErrConcurrentAccess = syscall.Errno(0x108)
+	// Not enough data in the buffer, calling by Reader.TryNext
+	ErrNotEnough = syscall.Errno(0x109)
+	// The declared frame length exceeds the limit, calling by Reader.ReadFrame
+	ErrFrameTooLarge = syscall.Errno(0x10A)
+	// The delimiter is not found within the limit, calling by Reader.Until
+	ErrLineTooLong = syscall.Errno(0x10B)
+	// The connection reset by peer, which is matched by the errors of ECONNRESET and EPIPE
+	ErrConnReset = syscall.Errno(0x10C)
+	// The fixed output buffer would overflow, calling by Connection.Writer with WithFixedOutputBuffer
+	ErrBufferFull = syscall.Errno(0x10D)
+	// The connection is not redirected by NAT, calling by Connection.OriginalDst
+	ErrNotRedirected = syscall.Errno(0x10E)
+	// The blocked read is interrupted, calling by Connection.InterruptRead
+	ErrInterrupted = syscall.Errno(0x10F)
+	// The size of a single read exceeds the limit, calling by Reader with Connection.SetMaxReadSize
+	ErrMessageTooLarge = syscall.Errno(0x110)
 )
 
 const ErrnoMask = 0xFF
@@ -83,7 +100,10 @@ func (e *exception) Is(target error) bool {
 		return true
 	}
 	// TODO: ErrConnClosed contains ErrEOF
-	if e.no == ErrEOF && target == ErrConnClosed {
+	if e.no == ErrEOF && (target == ErrConnClosed || target == io.EOF) {
+		return true
+	}
+	if target == ErrConnReset && (e.no == syscall.ECONNRESET || e.no == syscall.EPIPE) {
 		return true
 	}
 	return e.no.Is(target)
@@ -105,6 +125,35 @@ func (e *exception) Temporary() bool {
 	return e.no.Temporary()
 }
 
+// ShutdownError is returned by EventLoop.Shutdown with WithGracefulShutdown,
+// when some connections are still active after the deadline and have been closed forcibly.
+type ShutdownError struct {
+	Forced int   // number of connections closed forcibly
+	Err    error // the error of the shutdown context
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("%s, %d active connections closed forcibly", e.Err.Error(), e.Forced)
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+// DialManyError is returned by Dialer.DialMany when some of the connections failed to dial.
+type DialManyError struct {
+	Failed int   // number of connections failed
+	Err    error // the first error of the failed connections
+}
+
+func (e *DialManyError) Error() string {
+	return fmt.Sprintf("%d connections failed to dial, the first error: %s", e.Failed, e.Err.Error())
+}
+
+func (e *DialManyError) Unwrap() error {
+	return e.Err
+}
+
 // Errors defined in netpoll
 var errnos = [...]string{
 	ErrnoMask & ErrConnClosed:       "connection has been closed",
@@ -115,4 +164,12 @@ var errnos = [...]string{
 	ErrnoMask & ErrEOF:              "EOF",
 	ErrnoMask & ErrWriteTimeout:     "connection write timeout",
 	ErrnoMask & ErrConcurrentAccess: "concurrent connection access",
+	ErrnoMask & ErrNotEnough:        "not enough data",
+	ErrnoMask & ErrFrameTooLarge:    "frame too large",
+	ErrnoMask & ErrLineTooLong:      "line too long",
+	ErrnoMask & ErrConnReset:        "connection reset by peer",
+	ErrnoMask & ErrBufferFull:       "buffer is full",
+	ErrnoMask & ErrNotRedirected:    "connection is not redirected",
+	ErrnoMask & ErrInterrupted:      "read is interrupted",
+	ErrnoMask & ErrMessageTooLarge:  "message too large",
 }
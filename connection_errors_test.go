@@ -19,6 +19,8 @@ package netpoll
 
 import (
 	"errors"
+	"io"
+	"net"
 	"syscall"
 	"testing"
 )
@@ -34,3 +36,42 @@ func TestErrno(t *testing.T) {
 	Equal(t, err2.Error(), "broken pipe when flush")
 	t.Logf("error2=%s", err2)
 }
+
+func TestErrnoSentinels(t *testing.T) {
+	// EOF is also a closed connection
+	var err error = Exception(ErrEOF, "when next")
+	MustTrue(t, errors.Is(err, ErrEOF))
+	MustTrue(t, errors.Is(err, io.EOF))
+	MustTrue(t, errors.Is(err, ErrConnClosed))
+	MustTrue(t, !errors.Is(Exception(ErrConnClosed, "when next"), io.EOF))
+
+	// timeouts are reported by net.Error
+	for _, no := range []syscall.Errno{ErrReadTimeout, ErrWriteTimeout, ErrDialTimeout} {
+		err = Exception(no, "when wait")
+		MustTrue(t, errors.Is(err, no))
+		var ne net.Error
+		MustTrue(t, errors.As(err, &ne))
+		MustTrue(t, ne.Timeout())
+	}
+	var ne net.Error
+	MustTrue(t, errors.As(Exception(ErrConnClosed, ""), &ne))
+	MustTrue(t, !ne.Timeout())
+
+	// the write to a closed peer fails with EPIPE
+	r, w := GetSysFdPairs()
+	MustNil(t, syscall.Close(r))
+	_, werr := syscall.Write(w, []byte("hello"))
+	syscall.Close(w)
+	MustTrue(t, werr != nil)
+	err = Exception(werr, "when flush")
+	MustTrue(t, errors.Is(err, syscall.EPIPE))
+	MustTrue(t, errors.Is(err, ErrConnReset))
+	MustTrue(t, !errors.Is(err, ErrEOF))
+
+	err = Exception(syscall.ECONNRESET, "when read")
+	MustTrue(t, errors.Is(err, ErrConnReset))
+	MustTrue(t, errors.Is(err, syscall.ECONNRESET))
+	Equal(t, err.Error(), "connection reset by peer when read")
+	MustTrue(t, !errors.Is(Exception(ErrConnClosed, ""), ErrConnReset))
+	Equal(t, Exception(ErrConnReset, "when flush").Error(), "connection reset by peer when flush")
+}
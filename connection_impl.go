@@ -18,6 +18,12 @@
 package netpoll
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -29,6 +35,16 @@ type connState = int32
 const (
 	defaultZeroCopyTimeoutSec = 60
 
+	// the bounds of SetReadChunkSize
+	minReadChunkSize = block1k
+	maxReadChunkSize = mallocMax
+
+	// the polling interval of the socket send queue by FlushSync
+	minSendQueueInterval = 50 * time.Microsecond
+	maxSendQueueInterval = 10 * time.Millisecond
+	// the wait of FlushSync for the send queue if no write timeout is set
+	maxSendQueueWait = 5 * time.Second
+
 	connStateNone         = 0
 	connStateConnected    = 1
 	connStateDisconnected = 2
@@ -41,16 +57,53 @@ type connection struct {
 	locker
 	operator        *FDOperator
 	readTimeout     time.Duration
+	readDeadline    int64 // the absolute deadline of read in unix nano, zero means no deadline
 	readTimer       *time.Timer
 	readTrigger     chan error
 	waitReadSize    int64
+	readWaiter      int32        // 1 if a read is waiting in waitRead, 2 if it's interrupted by InterruptRead, updated atomically
+	readThreshold   int64        // the threshold of input buffer, reading is paused when exceeded
+	readChunkSize   int64        // the fixed size of each read by SetReadChunkSize, zero means auto sizing
+	readMux         sync.Mutex   // protects the pause and resume of reading
+	readLimit       int64        // the bytes per second of SetReadLimit, zero means no limit, updated atomically
+	readThrottled   int32        // reading is paused by SetReadLimit until the tokens are refilled, updated atomically
+	readLimiter     readLimiter  // the token bucket of SetReadLimit
+	untilLimit      int64        // the maximum length of the line returned by Until
+	maxReadSize     int64        // the maximum size of a single read by SetMaxReadSize, zero means no limit
+	userData        atomic.Value // value is userData
+	connLogger      atomic.Value // value is connLogger
+	inputBytes      uint64       // total bytes read from the socket, updated atomically
+	outputBytes     uint64       // total bytes written to the socket, updated atomically
+	writeCalls      uint64       // total syscalls writing to the socket by flush and the poller, updated atomically
 	writeTimeout    time.Duration
+	writeDeadline   int64 // the absolute deadline of write in unix nano, zero means no deadline
 	writeTimer      *time.Timer
 	writeTrigger    chan error
 	inputBuffer     *LinkBuffer
 	outputBuffer    *LinkBuffer
 	outputBarrier   *barrier
+	lastWritten     int64        // the written bytes of the last flush, updated atomically
+	autoFlush       autoFlusher  // the state of SetAutoFlush
+	lastFlushErr    atomic.Value // value is flushError
+	writeReadyAt    int64        // the threshold of SetOnWriteReady, zero means no callback, updated atomically
+	writeReadyMux   sync.Mutex   // protects writeReadyFn
+	writeReadyFn    func()
+	mmapMux         sync.Mutex     // protects mmaps and mmapClosed
+	mmaps           []*mmapRelease // the releases of WriteMmap that may not be called yet, in the order of writes
+	mmapClosed      bool           // the pending releases have been called by close
+	tagsMux         sync.RWMutex   // protects tags
+	tags            map[string]string
+	coalescer       writeCoalescer
+	datagrams       *datagrams  // only used by packet sockets to keep datagram boundaries
+	rights          *unixRights // only used by UnixConnection to receive the passed fds
+	fdRefs          int32       // the running raw controls using fd, -1 once fd is being closed, updated atomically
 	supportZeroCopy bool
+	connectTimeout  time.Duration
+	panicHandler    func(ctx context.Context, connection Connection, r interface{}, stack []byte)
+	establishedAt   time.Time
+	firstByteAt     int64
+	onState         func(addr net.Addr, state ConnState)
+	proxyHeader     bool      // the PROXY protocol header is expected by WithProxyProtocol
 	maxSize         int       // The maximum size of data between two Release().
 	bookSize        int       // The size of data that can be read at once.
 	state           connState // Connection state should be changed sequentially.
@@ -62,6 +115,171 @@ var (
 	_ Writer     = &connection{}
 )
 
+// userData wraps the value of SetUserData, since atomic.Value cannot store nil or different types.
+type userData struct {
+	v interface{}
+}
+
+// SetUserData implements Connection.
+func (c *connection) SetUserData(v interface{}) {
+	c.userData.Store(userData{v: v})
+}
+
+// GetUserData implements Connection.
+func (c *connection) GetUserData() interface{} {
+	data, _ := c.userData.Load().(userData)
+	return data.v
+}
+
+// SetTag implements Connection.
+func (c *connection) SetTag(key, value string) {
+	c.tagsMux.Lock()
+	if c.tags == nil {
+		c.tags = make(map[string]string, 1)
+	}
+	c.tags[key] = value
+	c.tagsMux.Unlock()
+}
+
+// Tag implements Connection.
+func (c *connection) Tag(key string) (value string, ok bool) {
+	c.tagsMux.RLock()
+	value, ok = c.tags[key]
+	c.tagsMux.RUnlock()
+	return value, ok
+}
+
+// clearTags removes all the tags after closed.
+func (c *connection) clearTags() {
+	c.tagsMux.Lock()
+	c.tags = nil
+	c.tagsMux.Unlock()
+}
+
+// InputBytes implements Connection.
+func (c *connection) InputBytes() uint64 {
+	return atomic.LoadUint64(&c.inputBytes)
+}
+
+// EstablishedAt implements Connection.
+func (c *connection) EstablishedAt() time.Time {
+	return c.establishedAt
+}
+
+// FirstByteAt implements Connection.
+func (c *connection) FirstByteAt() time.Time {
+	if at := atomic.LoadInt64(&c.firstByteAt); at > 0 {
+		return time.Unix(0, at)
+	}
+	return time.Time{}
+}
+
+// addInputBytes counts n bytes read from the socket, and records the time of the first ones.
+func (c *connection) addInputBytes(n int) {
+	if n > 0 && atomic.AddUint64(&c.inputBytes, uint64(n)) == uint64(n) {
+		atomic.StoreInt64(&c.firstByteAt, time.Now().UnixNano())
+	}
+}
+
+// OutputBytes implements Connection.
+func (c *connection) OutputBytes() uint64 {
+	return atomic.LoadUint64(&c.outputBytes)
+}
+
+// RecvBufSize implements Connection.
+func (c *connection) RecvBufSize() (bytes int, err error) {
+	return getSockBuf(c.fd, syscall.SO_RCVBUF)
+}
+
+// SetTOS implements Connection.
+func (c *connection) SetTOS(tos int) error {
+	return setTOS(c.fd, tos)
+}
+
+// SendBufSize implements Connection.
+func (c *connection) SendBufSize() (bytes int, err error) {
+	return getSockBuf(c.fd, syscall.SO_SNDBUF)
+}
+
+// TCPInfo implements Connection.
+func (c *connection) TCPInfo() (info *TCPInfo, err error) {
+	if info, err = getTCPInfo(c.fd); err != nil {
+		return nil, Exception(err, "when get TCP_INFO")
+	}
+	return info, nil
+}
+
+// OriginalDst implements Connection.
+func (c *connection) OriginalDst() (addr net.Addr, err error) {
+	if addr, err = getOriginalDst(c.fd); err != nil {
+		return nil, Exception(err, "when get SO_ORIGINAL_DST")
+	}
+	return addr, nil
+}
+
+// connLogger is the logger of SetLogger, which can be stored as nil in atomic.Value.
+type connLogger func(level int, format string, args ...interface{})
+
+// SetLogger implements Connection.
+func (c *connection) SetLogger(fn func(level int, format string, args ...interface{})) {
+	c.connLogger.Store(connLogger(fn))
+}
+
+// getLogger returns the logger of SetLogger, the callers check it before preparing the arguments to avoid allocations.
+func (c *connection) getLogger() connLogger {
+	fn, _ := c.connLogger.Load().(connLogger)
+	return fn
+}
+
+// flushError is the error of the last flush returned by FlushResult, since atomic.Value cannot store nil.
+type flushError struct {
+	err error
+}
+
+// noFlushError is boxed once, so that the successful flushes don't allocate.
+var noFlushError interface{} = flushError{}
+
+// FlushResult implements Connection.
+func (c *connection) FlushResult() (written int, err error) {
+	r, _ := c.lastFlushErr.Load().(flushError)
+	return int(atomic.LoadInt64(&c.lastWritten)), r.err
+}
+
+// PendingOutputBytes implements Connection.
+func (c *connection) PendingOutputBytes() int {
+	return c.outputBuffer.Len()
+}
+
+// SetOnWriteReady implements Connection.
+func (c *connection) SetOnWriteReady(threshold int, fn func()) {
+	if threshold <= 0 || fn == nil {
+		threshold, fn = 0, nil
+	}
+	c.writeReadyMux.Lock()
+	c.writeReadyFn = fn
+	atomic.StoreInt64(&c.writeReadyAt, int64(threshold))
+	c.writeReadyMux.Unlock()
+	if fn != nil && c.IsActive() {
+		c.checkWriteReady()
+	}
+}
+
+// checkWriteReady runs the callback of SetOnWriteReady if the pending output has dropped below the threshold.
+func (c *connection) checkWriteReady() {
+	threshold := atomic.LoadInt64(&c.writeReadyAt)
+	if threshold <= 0 || int64(c.outputBuffer.Len()) >= threshold {
+		return
+	}
+	c.writeReadyMux.Lock()
+	fn := c.writeReadyFn
+	c.writeReadyFn = nil
+	atomic.StoreInt64(&c.writeReadyAt, 0)
+	c.writeReadyMux.Unlock()
+	if fn != nil {
+		runTask(c.ctx, fn)
+	}
+}
+
 // Reader implements Connection.
 func (c *connection) Reader() Reader {
 	return c
@@ -80,7 +298,12 @@ func (c *connection) IsActive() bool {
 // SetIdleTimeout implements Connection.
 func (c *connection) SetIdleTimeout(timeout time.Duration) error {
 	if timeout > 0 {
-		return c.SetKeepAlive(int(timeout.Seconds()))
+		// the keepalive options are in seconds, and zero is invalid
+		secs := int(timeout.Seconds())
+		if secs < 1 {
+			secs = 1
+		}
+		return c.SetKeepAlive(secs)
 	}
 	return nil
 }
@@ -93,6 +316,69 @@ func (c *connection) SetReadTimeout(timeout time.Duration) error {
 	return nil
 }
 
+// SetReadBufferThreshold implements Connection.
+func (c *connection) SetReadBufferThreshold(bytes int) error {
+	if bytes >= 0 {
+		atomic.StoreInt64(&c.readThreshold, int64(bytes))
+		c.controlRead()
+	}
+	return nil
+}
+
+// SetAutoFlush implements Writer.
+func (c *connection) SetAutoFlush(threshold int) error {
+	c.autoFlush.set(threshold)
+	return nil
+}
+
+// SetReadChunkSize implements Connection.
+func (c *connection) SetReadChunkSize(bytes int) error {
+	if bytes < 0 {
+		return nil
+	}
+	if bytes > 0 && bytes < minReadChunkSize {
+		bytes = minReadChunkSize
+	} else if bytes > maxReadChunkSize {
+		bytes = maxReadChunkSize
+	}
+	atomic.StoreInt64(&c.readChunkSize, int64(bytes))
+	return nil
+}
+
+// SetReadLimit implements Connection.
+func (c *connection) SetReadLimit(bytesPerSec int) error {
+	if bytesPerSec < 0 {
+		return nil
+	}
+	c.readLimiter.mux.Lock()
+	c.readLimiter.limit, c.readLimiter.burst = float64(bytesPerSec), float64(bytesPerSec/10)
+	if c.readLimiter.burst < block4k {
+		c.readLimiter.burst = block4k
+	}
+	c.readLimiter.tokens, c.readLimiter.refilled = c.readLimiter.burst, time.Now()
+	atomic.StoreInt64(&c.readLimit, int64(bytesPerSec))
+	atomic.StoreInt32(&c.readThrottled, 0)
+	c.readLimiter.mux.Unlock()
+	c.controlRead()
+	return nil
+}
+
+// SetUntilLimit implements Connection.
+func (c *connection) SetUntilLimit(bytes int) error {
+	if bytes >= 0 {
+		atomic.StoreInt64(&c.untilLimit, int64(bytes))
+	}
+	return nil
+}
+
+// SetMaxReadSize implements Connection.
+func (c *connection) SetMaxReadSize(bytes int) error {
+	if bytes >= 0 {
+		atomic.StoreInt64(&c.maxReadSize, int64(bytes))
+	}
+	return nil
+}
+
 // SetWriteTimeout implements Connection.
 func (c *connection) SetWriteTimeout(timeout time.Duration) error {
 	if timeout >= 0 {
@@ -101,6 +387,29 @@ func (c *connection) SetWriteTimeout(timeout time.Duration) error {
 	return nil
 }
 
+// SetDeadline implements net.Conn.
+func (c *connection) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn.
+// The deadline works with SetReadTimeout together, and the earlier one limits the read calls waiting,
+// while a zero value of t means no deadline. It doesn't affect SetIdleTimeout.
+func (c *connection) SetReadDeadline(t time.Time) error {
+	atomic.StoreInt64(&c.readDeadline, unixNano(t))
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.
+// The deadline works with SetWriteTimeout together, and the earlier one limits the flush waiting,
+// while a zero value of t means no deadline. Same as SetWriteTimeout, the connection will be closed
+// if the data cannot be sent before the deadline.
+func (c *connection) SetWriteDeadline(t time.Time) error {
+	atomic.StoreInt64(&c.writeDeadline, unixNano(t))
+	return nil
+}
+
 // ------------------------------------------ implement zero-copy reader ------------------------------------------
 
 // Next implements Connection.
@@ -108,7 +417,23 @@ func (c *connection) Next(n int) (p []byte, err error) {
 	if err = c.waitRead(n); err != nil {
 		return p, err
 	}
-	return c.inputBuffer.Next(n)
+	if p, err = c.inputBuffer.Next(n); err == nil {
+		c.consume(n)
+	}
+	return p, err
+}
+
+// TryNext implements Connection.
+func (c *connection) TryNext(n int) (p []byte, err error) {
+	if p, err = c.inputBuffer.TryNext(n); err == nil {
+		c.consume(n)
+	}
+	return p, err
+}
+
+// ReadFrame implements Connection.
+func (c *connection) ReadFrame(header int, bigEndian bool, maxSize int) (p []byte, err error) {
+	return readFrame(c, header, bigEndian, maxSize)
 }
 
 // Peek implements Connection.
@@ -124,7 +449,65 @@ func (c *connection) Skip(n int) (err error) {
 	if err = c.waitRead(n); err != nil {
 		return err
 	}
-	return c.inputBuffer.Skip(n)
+	if err = c.inputBuffer.Skip(n); err == nil {
+		c.consume(n)
+	}
+	return err
+}
+
+// Discard implements Connection.
+// It waits for any data instead of n bytes, and releases the buffer after each skip,
+// so the skipped data never accumulates in the input buffer.
+func (c *connection) Discard(n int) (skipped int, err error) {
+	for skipped < n {
+		if err = c.waitRead(1); err != nil {
+			return skipped, err
+		}
+		l := c.inputBuffer.Len()
+		if l > n-skipped {
+			l = n - skipped
+		}
+		if err = c.inputBuffer.Skip(l); err != nil {
+			return skipped, err
+		}
+		c.consume(l)
+		skipped += l
+		c.Release()
+	}
+	return skipped, nil
+}
+
+// DiscardAll implements Connection.
+// For packet sockets, all the buffered datagrams are discarded.
+func (c *connection) DiscardAll() (skipped int, err error) {
+	if skipped = c.inputBuffer.Len(); skipped > 0 {
+		if err = c.inputBuffer.Skip(skipped); err != nil {
+			return 0, err
+		}
+		c.consume(skipped)
+	}
+	c.Release()
+	return skipped, nil
+}
+
+// WriteTo implements Connection.
+// The input buffer is released after each write, so the data never accumulates while copying.
+func (c *connection) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		if err = c.waitRead(1); err != nil {
+			if errors.Is(err, ErrEOF) {
+				err = nil
+			}
+			return n, err
+		}
+		m, err := c.inputBuffer.writeTo(w)
+		c.consume(int(m))
+		c.Release()
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
 }
 
 // Release implements Connection.
@@ -155,26 +538,51 @@ func (c *connection) Slice(n int) (r Reader, err error) {
 	if err = c.waitRead(n); err != nil {
 		return nil, err
 	}
-	return c.inputBuffer.Slice(n)
+	if r, err = c.inputBuffer.Slice(n); err == nil {
+		c.consume(n)
+	}
+	return r, err
+}
+
+// Clone implements Connection, the data not read into the buffer yet is not cloned.
+func (c *connection) Clone() (r Reader) {
+	return c.inputBuffer.Clone()
 }
 
 // Len implements Connection.
+// For packet sockets, it returns the unread size of the first datagram.
 func (c *connection) Len() (length int) {
+	if c.datagrams != nil {
+		return c.datagrams.headLen()
+	}
 	return c.inputBuffer.Len()
 }
 
+// WaitReadSize implements Connection.
+func (c *connection) WaitReadSize(n int) (err error) {
+	return c.waitRead(n)
+}
+
 // Until implements Connection.
 func (c *connection) Until(delim byte) (line []byte, err error) {
 	var n, l int
+	limit := int(atomic.LoadInt64(&c.untilLimit))
 	for {
 		if err = c.waitRead(n + 1); err != nil {
+			if errors.Is(err, ErrMessageTooLarge) {
+				return nil, err
+			}
 			// return all the data in the buffer
 			line, _ = c.inputBuffer.Next(c.inputBuffer.Len())
+			c.consume(len(line))
 			return
 		}
 
 		l = c.inputBuffer.Len()
 		i := c.inputBuffer.indexByte(delim, n)
+		if limit > 0 && (i >= limit || i < 0 && l >= limit) {
+			return nil, Exception(ErrLineTooLong, fmt.Sprintf("when until, limit[%d]", limit))
+		}
 		if i < 0 {
 			n = l // skip all exists bytes
 			continue
@@ -188,7 +596,10 @@ func (c *connection) ReadString(n int) (s string, err error) {
 	if err = c.waitRead(n); err != nil {
 		return s, err
 	}
-	return c.inputBuffer.ReadString(n)
+	if s, err = c.inputBuffer.ReadString(n); err == nil {
+		c.consume(n)
+	}
+	return s, err
 }
 
 // ReadBinary implements Connection.
@@ -196,7 +607,30 @@ func (c *connection) ReadBinary(n int) (p []byte, err error) {
 	if err = c.waitRead(n); err != nil {
 		return p, err
 	}
-	return c.inputBuffer.ReadBinary(n)
+	if p, err = c.inputBuffer.ReadBinary(n); err == nil {
+		c.consume(n)
+	}
+	return p, err
+}
+
+// ReadFull implements Connection.
+func (c *connection) ReadFull(p []byte) (n int, err error) {
+	for n < len(p) {
+		// copy the buffered data first, so that the buffer doesn't have to hold all of p
+		if err = c.waitRead(1); err != nil {
+			return n, err
+		}
+		m := c.inputBuffer.Len()
+		if m > len(p)-n {
+			m = len(p) - n
+		}
+		if _, err = c.inputBuffer.ReadFull(p[n : n+m]); err != nil {
+			return n, err
+		}
+		c.consume(m)
+		n += m
+	}
+	return n, nil
 }
 
 // ReadByte implements Connection.
@@ -204,16 +638,26 @@ func (c *connection) ReadByte() (b byte, err error) {
 	if err = c.waitRead(1); err != nil {
 		return b, err
 	}
-	return c.inputBuffer.ReadByte()
+	if b, err = c.inputBuffer.ReadByte(); err == nil {
+		c.consume(1)
+	}
+	return b, err
 }
 
 // ------------------------------------------ implement zero-copy writer ------------------------------------------
 
 // Malloc implements Connection.
 func (c *connection) Malloc(n int) (buf []byte, err error) {
+	c.autoFlush.malloc()
 	return c.outputBuffer.Malloc(n)
 }
 
+// TryMalloc implements Connection.
+func (c *connection) TryMalloc(n int) (buf []byte) {
+	c.autoFlush.malloc()
+	return c.outputBuffer.TryMalloc(n)
+}
+
 // MallocLen implements Connection.
 func (c *connection) MallocLen() (length int) {
 	return c.outputBuffer.MallocLen()
@@ -226,17 +670,41 @@ func (c *connection) MallocLen() (length int) {
 // If empty, it will call syscall.Write to send data directly,
 // otherwise the buffer will be sent asynchronously by the epoll trigger.
 func (c *connection) Flush() error {
+	c.autoFlush.flush()
 	if !c.IsActive() {
 		return Exception(ErrConnClosed, "when flush")
 	}
+	if c.coalescing() {
+		_, err := c.coalesceWrite(nil, true)
+		return err
+	}
 
 	if !c.lock(flushing) {
 		return Exception(ErrConcurrentAccess, "when flush")
 	}
-	defer c.unlock(flushing)
 
 	c.outputBuffer.Flush()
-	return c.flush()
+	err := c.flushRecorded()
+	c.unlock(flushing)
+	c.closeIfWriteTimeout(err)
+	return err
+}
+
+// FlushSync implements Connection.
+func (c *connection) FlushSync() error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	return c.waitSendQueue()
+}
+
+// ReadFrom implements Connection.
+// The reads are limited to a quarter of the fixed output buffer, so that they fit in the ring.
+func (c *connection) ReadFrom(r io.Reader) (n int64, err error) {
+	if ring := len(c.outputBuffer.ring); ring > 0 && ring/4 < readFromSize {
+		return readFromSized(c, r, ring/4+1)
+	}
+	return readFrom(c, r)
 }
 
 // MallocAck implements Connection.
@@ -246,17 +714,24 @@ func (c *connection) MallocAck(n int) (err error) {
 
 // Append implements Connection.
 func (c *connection) Append(w Writer) (err error) {
-	return c.outputBuffer.Append(w)
+	return c.autoFlush.flushIfFull(c, c.outputBuffer.Append(w))
+}
+
+// AppendBuffer implements Connection.
+func (c *connection) AppendBuffer(r Reader, n int) (err error) {
+	return c.autoFlush.flushIfFull(c, c.outputBuffer.AppendBuffer(r, n))
 }
 
 // WriteString implements Connection.
 func (c *connection) WriteString(s string) (n int, err error) {
-	return c.outputBuffer.WriteString(s)
+	n, err = c.outputBuffer.WriteString(s)
+	return n, c.autoFlush.flushIfFull(c, err)
 }
 
 // WriteBinary implements Connection.
 func (c *connection) WriteBinary(b []byte) (n int, err error) {
-	return c.outputBuffer.WriteBinary(b)
+	n, err = c.outputBuffer.WriteBinary(b)
+	return n, c.autoFlush.flushIfFull(c, err)
 }
 
 // WriteDirect implements Connection.
@@ -264,14 +739,65 @@ func (c *connection) WriteDirect(p []byte, remainCap int) (err error) {
 	return c.outputBuffer.WriteDirect(p, remainCap)
 }
 
+// WritevDirect implements Connection.
+func (c *connection) WritevDirect(bufs [][]byte) (err error) {
+	return c.outputBuffer.WritevDirect(bufs)
+}
+
+// WriteMmap implements Connection.
+func (c *connection) WriteMmap(data []byte, release func()) (err error) {
+	c.mmapMux.Lock()
+	if c.mmapClosed || !c.IsActive() {
+		c.mmapMux.Unlock()
+		release()
+		return Exception(ErrConnClosed, "when write mmap")
+	}
+	r := &mmapRelease{fn: release}
+	// the data is released in the order of writes, so the released ones are at the head
+	for len(c.mmaps) > 0 && atomic.LoadInt32(&c.mmaps[0].done) > 0 {
+		c.mmaps[0] = nil
+		c.mmaps = c.mmaps[1:]
+	}
+	c.mmaps = append(c.mmaps, r)
+	c.mmapMux.Unlock()
+	c.outputBuffer.writeRelease(data, r.release)
+	return nil
+}
+
+// releaseMmaps calls the releases of WriteMmap that are not called yet when the connection is closed,
+// since the output buffer is not always recycled by closeBuffer.
+func (c *connection) releaseMmaps() {
+	c.mmapMux.Lock()
+	mmaps := c.mmaps
+	c.mmaps, c.mmapClosed = nil, true
+	c.mmapMux.Unlock()
+	for _, r := range mmaps {
+		r.release()
+	}
+}
+
+// mmapRelease makes sure the release of WriteMmap is called only once,
+// either by the output buffer or by the close of connection.
+type mmapRelease struct {
+	done int32 // updated atomically
+	fn   func()
+}
+
+func (r *mmapRelease) release() {
+	if atomic.CompareAndSwapInt32(&r.done, 0, 1) {
+		r.fn()
+	}
+}
+
 // WriteByte implements Connection.
 func (c *connection) WriteByte(b byte) (err error) {
-	return c.outputBuffer.WriteByte(b)
+	return c.autoFlush.flushIfFull(c, c.outputBuffer.WriteByte(b))
 }
 
 // ------------------------------------------ implement net.Conn ------------------------------------------
 
 // Read behavior is the same as net.Conn, it will return io.EOF if buffer is empty.
+// For packet sockets, Read reads at most one datagram and discards the rest of it if p is too small.
 func (c *connection) Read(p []byte) (n int, err error) {
 	l := len(p)
 	if l == 0 {
@@ -280,32 +806,241 @@ func (c *connection) Read(p []byte) (n int, err error) {
 	if err = c.waitRead(1); err != nil {
 		return 0, err
 	}
-	if has := c.inputBuffer.Len(); has < l {
+	has := c.Len()
+	if has < l {
 		l = has
 	}
 	src, err := c.inputBuffer.Next(l)
 	n = copy(p, src)
+	if err == nil && c.datagrams != nil && has > l {
+		err = c.inputBuffer.Skip(has - l)
+		l = has
+	}
 	if err == nil {
+		c.consume(l)
 		err = c.inputBuffer.Release()
 	}
 	return n, err
 }
 
+// Readv implements Connection.
+func (c *connection) Readv(bufs [][]byte) (n int, err error) {
+	if c.datagrams != nil {
+		return 0, Exception(ErrUnsupported, "readv on datagram")
+	}
+	if !c.lockRead() {
+		return 0, Exception(ErrConcurrentAccess, "when readv")
+	}
+	n, err = c.readv(bufs)
+	c.unlockRead()
+	return n, err
+}
+
+func (c *connection) readv(bufs [][]byte) (n int, err error) {
+	// bufs will be trimmed when reading
+	bufs = append(make([][]byte, 0, len(bufs)), bufs...)
+	// the buffered data must be read first
+	c.waitInputs()
+	bufs, n = c.readBuffered(bufs)
+	if len(bufs) == 0 {
+		return n, nil
+	}
+	// readv resets the slices after syscall, so bufs is copied to vs
+	vs, ivs := make([][]byte, len(bufs)), make([]syscall.Iovec, len(bufs))
+	for {
+		if c.isCloseBy(user) {
+			return n, Exception(ErrConnClosed, "when readv")
+		}
+		copy(vs, bufs)
+		m, err := readv(c.fd, vs, ivs)
+		switch err {
+		case nil:
+			if m > 0 {
+				c.addInputBytes(m)
+				return n + m, nil
+			}
+			if n > 0 {
+				return n, nil
+			}
+			return 0, Exception(ErrEOF, "when readv")
+		case syscall.EINTR:
+		case syscall.EAGAIN:
+			if n > 0 {
+				return n, nil
+			}
+			// let the poller read into inputBuffer until any data arrives
+			if err = c.waitRead(1); err != nil {
+				return 0, err
+			}
+			c.waitInputs()
+			_, n = c.readBuffered(bufs)
+			return n, nil
+		default:
+			return n, Exception(err, "when readv")
+		}
+	}
+}
+
+// readBuffered copies the data in inputBuffer to bufs, and returns the rest of bufs to be filled.
+func (c *connection) readBuffered(bufs [][]byte) (rest [][]byte, n int) {
+	for len(bufs) > 0 && len(bufs[0]) == 0 {
+		bufs = bufs[1:]
+	}
+	for len(bufs) > 0 && c.inputBuffer.Len() > 0 {
+		size := c.inputBuffer.Len()
+		if l := len(bufs[0]); size > l {
+			size = l
+		}
+		p, _ := c.inputBuffer.Next(size)
+		copy(bufs[0], p)
+		bufs[0] = bufs[0][size:]
+		n += size
+		for len(bufs) > 0 && len(bufs[0]) == 0 {
+			bufs = bufs[1:]
+		}
+	}
+	if n > 0 {
+		c.consume(n)
+		c.inputBuffer.Release()
+	}
+	return bufs, n
+}
+
+// PeekInitial implements Connection.
+func (c *connection) PeekInitial(n int) (p []byte, err error) {
+	if c.datagrams != nil {
+		return nil, Exception(ErrUnsupported, "peek initial on packet connection")
+	}
+	if !c.IsActive() {
+		return nil, Exception(ErrConnClosed, "when peek initial")
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	p = make([]byte, n)
+	for {
+		// the data read by poller is ahead of the socket
+		buffered := c.inputBuffer.Len()
+		if buffered >= n {
+			buf, err := c.inputBuffer.Peek(n)
+			if err != nil {
+				return nil, err
+			}
+			copy(p, buf)
+			return p, nil
+		}
+		if buffered > 0 {
+			buf, err := c.inputBuffer.Peek(buffered)
+			if err != nil {
+				return nil, err
+			}
+			copy(p, buf)
+		}
+		m, _, err := syscall.Recvfrom(c.fd, p[buffered:], syscall.MSG_PEEK)
+		if err == syscall.EINTR {
+			continue
+		}
+		// retry if the poller has read more data in the meantime
+		if c.inputBuffer.Len() != buffered {
+			continue
+		}
+		switch {
+		case err == syscall.EAGAIN:
+			m = 0
+		case err != nil:
+			return p[:buffered], Exception(err, "when peek initial")
+		case m == 0:
+			return p[:buffered], Exception(ErrEOF, "when peek initial")
+		}
+		if buffered+m < n {
+			return p[:buffered+m], Exception(ErrNotEnough, fmt.Sprintf("peek initial[%d]", n))
+		}
+		return p, nil
+	}
+}
+
+// SyscallConn implements Connection.
+func (c *connection) SyscallConn() (syscall.RawConn, error) {
+	if !c.IsActive() {
+		return nil, Exception(ErrConnClosed, "when syscall conn")
+	}
+	return &rawConn{c: c}, nil
+}
+
+var _ syscall.RawConn = &rawConn{}
+
+// rawConn implements syscall.RawConn.
+type rawConn struct {
+	c *connection
+}
+
+// Control implements syscall.RawConn.
+func (rc *rawConn) Control(f func(fd uintptr)) error {
+	// the reference makes sure that the fd will not be closed, without blocking the reads and writes
+	if !rc.c.refFd() {
+		return Exception(ErrConnClosed, "when control")
+	}
+	defer rc.c.unrefFd()
+	if !rc.c.IsActive() {
+		return Exception(ErrConnClosed, "when control")
+	}
+	f(uintptr(rc.c.fd))
+	return nil
+}
+
+// refFd marks fd in use by a raw control, it fails if fd is being closed.
+func (c *connection) refFd() bool {
+	for {
+		n := atomic.LoadInt32(&c.fdRefs)
+		if n < 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&c.fdRefs, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (c *connection) unrefFd() {
+	atomic.AddInt32(&c.fdRefs, -1)
+}
+
+// stopFd waits for the running raw controls and rejects the new ones, before fd is closed.
+func (c *connection) stopFd() {
+	for !atomic.CompareAndSwapInt32(&c.fdRefs, 0, -1) {
+		runtime.Gosched()
+	}
+}
+
+// Read implements syscall.RawConn.
+func (rc *rawConn) Read(f func(fd uintptr) (done bool)) error {
+	return Exception(ErrUnsupported, "raw read")
+}
+
+// Write implements syscall.RawConn.
+func (rc *rawConn) Write(f func(fd uintptr) (done bool)) error {
+	return Exception(ErrUnsupported, "raw write")
+}
+
 // Write will Flush soon.
 func (c *connection) Write(p []byte) (n int, err error) {
 	if !c.IsActive() {
 		return 0, Exception(ErrConnClosed, "when write")
 	}
+	if c.coalescing() {
+		return c.coalesceWrite(p, false)
+	}
 
 	if !c.lock(flushing) {
 		return 0, Exception(ErrConcurrentAccess, "when write")
 	}
-	defer c.unlock(flushing)
 
 	dst, _ := c.outputBuffer.Malloc(len(p))
 	n = copy(dst, p)
 	c.outputBuffer.Flush()
-	err = c.flush()
+	err = c.flushRecorded()
+	c.unlock(flushing)
+	c.closeIfWriteTimeout(err)
 	return n, err
 }
 
@@ -314,12 +1049,110 @@ func (c *connection) Close() error {
 	return c.onClose()
 }
 
+// CloseWrite implements Connection.
+func (c *connection) CloseWrite() error {
+	if !c.IsActive() {
+		return Exception(ErrConnClosed, "when close write")
+	}
+	if !c.lock(flushing) {
+		return Exception(ErrConcurrentAccess, "when close write")
+	}
+
+	c.outputBuffer.Flush()
+	err := c.flush()
+	if err == nil {
+		if serr := syscall.Shutdown(c.fd, syscall.SHUT_WR); serr != nil {
+			err = Exception(serr, "when close write")
+		}
+	}
+	c.unlock(flushing)
+	c.closeIfWriteTimeout(err)
+	return err
+}
+
+// AsReader implements Connection.
+func (c *connection) AsReader() io.Reader {
+	return &eofReader{r: c}
+}
+
+// AsWriter implements Connection.
+func (c *connection) AsWriter() io.Writer {
+	return c
+}
+
+// InterruptRead implements Connection.
+func (c *connection) InterruptRead() error {
+	if !c.IsActive() {
+		return Exception(ErrConnClosed, "when interrupt read")
+	}
+	// only the waiting read is interrupted, and the waiter may have been woken up without data, it checks in any case
+	if atomic.CompareAndSwapInt32(&c.readWaiter, 1, 2) {
+		c.triggerRead(nil)
+	}
+	return nil
+}
+
+// WriteAndClose implements Connection.
+func (c *connection) WriteAndClose(data []byte) error {
+	return writeAndClose(c, data)
+}
+
+// CloseWithReset implements Connection.
+func (c *connection) CloseWithReset() error {
+	if !c.IsActive() {
+		return Exception(ErrConnClosed, "when close with reset")
+	}
+	// the connection is closed anyway even if the socket doesn't support SO_LINGER
+	serr := syscall.SetsockoptLinger(c.fd, syscall.SOL_SOCKET, syscall.SO_LINGER, &syscall.Linger{Onoff: 1, Linger: 0})
+	err := c.Close()
+	if serr != nil {
+		return Exception(serr, "when close with reset")
+	}
+	return err
+}
+
 // Detach detaches the connection from poller but doesn't close it.
 func (c *connection) Detach() error {
 	c.detaching = true
 	return c.onClose()
 }
 
+// MigrateToPoller implements Connection.
+func (c *connection) MigrateToPoller(index int) error {
+	if !c.IsActive() {
+		return Exception(ErrConnClosed, "when migrate")
+	}
+	poll, err := pollmanager.Poller(index)
+	if err != nil {
+		return Exception(err, "when migrate")
+	}
+	to, ok := poll.(*defaultPoll)
+	if !ok {
+		return Exception(ErrUnsupported, "when migrate")
+	}
+	op := c.operator
+	// hold the operator, so that it's not handled by pollers during the migration
+	for !op.do() {
+		if op.isUnused() {
+			return Exception(ErrConnClosed, "when migrate")
+		}
+		runtime.Gosched()
+	}
+	defer op.done()
+	// the controls by the running reads and writes are excluded by op.mux in migrate, and redirected afterwards
+	from, ok := op.getPoll().(*defaultPoll)
+	if !ok {
+		return Exception(ErrUnsupported, "when migrate")
+	}
+	if from == to {
+		return nil
+	}
+	if err = from.migrate(op, to); err != nil {
+		return Exception(err, "when migrate")
+	}
+	return nil
+}
+
 // ------------------------------------------ private ------------------------------------------
 
 var barrierPool = sync.Pool{
@@ -338,18 +1171,49 @@ func (c *connection) init(conn Conn, opts *options) (err error) {
 	c.writeTrigger = make(chan error, 1)
 	c.bookSize, c.maxSize = defaultLinkBufferSize, defaultLinkBufferSize
 	c.inputBuffer, c.outputBuffer = NewLinkBuffer(defaultLinkBufferSize), NewLinkBuffer()
+	if opts != nil && opts.fixedOutput > 0 {
+		c.outputBuffer = newFixedLinkBuffer(opts.fixedOutput)
+	}
 	c.outputBarrier = barrierPool.Get().(*barrier)
 	c.state = connStateNone
+	c.establishedAt = time.Now()
 
 	c.initNetFD(conn) // conn must be *netFD{}
 	c.initFDOperator()
+	c.operator.edge = opts != nil && opts.triggerMode == EdgeTriggered
+	if c.sotype == syscall.SOCK_DGRAM {
+		c.initDatagram()
+	} else if c.rights != nil {
+		c.initRights()
+	}
 	c.initFinalizer()
 
 	syscall.SetNonblock(c.fd, true)
 	// enable TCP_NODELAY by default
 	switch c.network {
 	case "tcp", "tcp4", "tcp6":
-		setTCPNoDelay(c.fd, true)
+		setTCPNoDelay(c.fd, opts == nil || opts.tcpNoDelay)
+		if opts != nil && opts.keepAlive != nil {
+			ka := opts.keepAlive
+			if err := setKeepAliveConfig(c.fd, ka.idle, ka.interval, ka.count); err != nil {
+				logger.Printf("NETPOLL: set keepalive failed: %v\n", err)
+			}
+		}
+	}
+	if opts != nil && opts.recvBuf > 0 {
+		if err := setSockBuf(c.fd, syscall.SO_RCVBUF, opts.recvBuf); err != nil {
+			logger.Printf("NETPOLL: set SO_RCVBUF failed: %v\n", err)
+		}
+	}
+	if opts != nil && opts.sendBuf > 0 {
+		if err := setSockBuf(c.fd, syscall.SO_SNDBUF, opts.sendBuf); err != nil {
+			logger.Printf("NETPOLL: set SO_SNDBUF failed: %v\n", err)
+		}
+	}
+	if opts != nil && opts.tos != 0 {
+		if err := setTOS(c.fd, opts.tos); err != nil {
+			logger.Printf("NETPOLL: set TOS failed: %v\n", err)
+		}
 	}
 	// check zero-copy
 	if setZeroCopy(c.fd) == nil && setBlockZeroCopySend(c.fd, defaultZeroCopyTimeoutSec, 0) == nil {
@@ -385,11 +1249,17 @@ func (c *connection) initFDOperator() {
 func (c *connection) initFinalizer() {
 	c.AddCloseCallback(func(connection Connection) (err error) {
 		c.stop(flushing)
+		c.stop(reading)
+		c.stopFd()
 		c.operator.Free()
 		if err = c.netFD.Close(); err != nil {
 			logger.Printf("NETPOLL: netFD close failed: %v", err)
 		}
 		c.closeBuffer()
+		c.releaseMmaps()
+		if c.onState != nil {
+			c.onState(c.remoteAddr, StateClosed)
+		}
 		return nil
 	})
 }
@@ -410,13 +1280,24 @@ func (c *connection) triggerWrite(err error) {
 
 // waitRead will wait full n bytes.
 func (c *connection) waitRead(n int) (err error) {
+	if err = checkReadSize(n, &c.maxReadSize); err != nil {
+		return err
+	}
 	if n <= c.inputBuffer.Len() {
 		return nil
 	}
 	atomic.StoreInt64(&c.waitReadSize, int64(n))
 	defer atomic.StoreInt64(&c.waitReadSize, 0)
-	if c.readTimeout > 0 {
-		return c.waitReadWithTimeout(n)
+	atomic.StoreInt32(&c.readWaiter, 1)
+	defer atomic.StoreInt32(&c.readWaiter, 0)
+	// resume reading if waiting for more data than the threshold
+	c.controlRead()
+	timeout, expired := deadlineTimeout(c.readTimeout, atomic.LoadInt64(&c.readDeadline))
+	if expired {
+		return Exception(ErrReadTimeout, c.remoteAddr.String())
+	}
+	if timeout > 0 {
+		return c.waitReadWithTimeout(n, timeout)
 	}
 	// wait full n
 	for c.inputBuffer.Len() < n {
@@ -426,6 +1307,9 @@ func (c *connection) waitRead(n int) (err error) {
 		case user:
 			return Exception(ErrConnClosed, "wait read")
 		default:
+			if atomic.LoadInt32(&c.readWaiter) == 2 {
+				return Exception(ErrInterrupted, "wait read")
+			}
 			err = <-c.readTrigger
 			if err != nil {
 				return err
@@ -436,12 +1320,12 @@ func (c *connection) waitRead(n int) (err error) {
 }
 
 // waitReadWithTimeout will wait full n bytes or until timeout.
-func (c *connection) waitReadWithTimeout(n int) (err error) {
+func (c *connection) waitReadWithTimeout(n int, timeout time.Duration) (err error) {
 	// set read timeout
 	if c.readTimer == nil {
-		c.readTimer = time.NewTimer(c.readTimeout)
+		c.readTimer = time.NewTimer(timeout)
 	} else {
-		c.readTimer.Reset(c.readTimeout)
+		c.readTimer.Reset(timeout)
 	}
 
 	for c.inputBuffer.Len() < n {
@@ -455,6 +1339,10 @@ func (c *connection) waitReadWithTimeout(n int) (err error) {
 			err = Exception(ErrConnClosed, "wait read")
 			goto RET
 		default:
+			if atomic.LoadInt32(&c.readWaiter) == 2 {
+				err = Exception(ErrInterrupted, "wait read")
+				goto RET
+			}
 			select {
 			case <-c.readTimer.C:
 				// double check if there is enough data to be read
@@ -478,23 +1366,53 @@ RET:
 	return err
 }
 
+// flushRecorded calls flush and records the result for FlushResult.
+func (c *connection) flushRecorded() error {
+	start := atomic.LoadUint64(&c.outputBytes)
+	err := c.flush()
+	atomic.StoreInt64(&c.lastWritten, int64(atomic.LoadUint64(&c.outputBytes)-start))
+	if err == nil {
+		c.lastFlushErr.Store(noFlushError)
+	} else {
+		c.lastFlushErr.Store(flushError{err: err})
+		if log := c.getLogger(); log != nil {
+			log(LogLevelWarn, "flush failed: %v", err)
+		}
+	}
+	return err
+}
+
+// consume must be called after reading n bytes from inputBuffer.
+func (c *connection) consume(n int) {
+	if c.datagrams != nil {
+		c.datagrams.consume(n)
+	}
+	c.controlRead()
+}
+
 // flush writes data directly.
 func (c *connection) flush() error {
 	if c.outputBuffer.IsEmpty() {
 		return nil
 	}
+	if c.datagrams != nil {
+		return c.flushDatagram()
+	}
 	// TODO: Let the upper layer pass in whether to use ZeroCopy.
 	bs := c.outputBuffer.GetBytes(c.outputBarrier.bs)
 	n, err := sendmsg(c.fd, bs, c.outputBarrier.ivs, false && c.supportZeroCopy)
+	atomic.AddUint64(&c.writeCalls, 1)
 	if err != nil && err != syscall.EAGAIN {
 		return Exception(err, "when flush")
 	}
 	if n > 0 {
+		atomic.AddUint64(&c.outputBytes, uint64(n))
 		err = c.outputBuffer.Skip(n)
 		c.outputBuffer.Release()
 		if err != nil {
 			return Exception(err, "when flush")
 		}
+		c.checkWriteReady()
 	}
 	// return if write all buffer.
 	if c.outputBuffer.IsEmpty() {
@@ -502,6 +1420,10 @@ func (c *connection) flush() error {
 	}
 	err = c.operator.Control(PollR2RW)
 	if err != nil {
+		// the operator has been detached concurrently, e.g. by the poller when the peer closed
+		if atomic.LoadInt32(&c.operator.detached) > 0 {
+			return Exception(ErrConnClosed, "when flush")
+		}
 		return Exception(err, "when flush")
 	}
 
@@ -509,15 +1431,25 @@ func (c *connection) flush() error {
 }
 
 func (c *connection) waitFlush() (err error) {
-	if c.writeTimeout == 0 {
+	timeout, expired := deadlineTimeout(c.writeTimeout, atomic.LoadInt64(&c.writeDeadline))
+	if expired {
+		select {
+		case err = <-c.writeTrigger:
+			return err
+		default:
+		}
+		c.operator.Control(PollRW2R)
+		return Exception(ErrWriteTimeout, c.remoteAddr.String())
+	}
+	if timeout == 0 {
 		return <-c.writeTrigger
 	}
 
 	// set write timeout
 	if c.writeTimer == nil {
-		c.writeTimer = time.NewTimer(c.writeTimeout)
+		c.writeTimer = time.NewTimer(timeout)
 	} else {
-		c.writeTimer.Reset(c.writeTimeout)
+		c.writeTimer.Reset(timeout)
 	}
 
 	select {
@@ -540,6 +1472,72 @@ func (c *connection) waitFlush() (err error) {
 	}
 }
 
+// deadlineTimeout returns the shorter one of timeout and the duration until deadline, zero means no timeout,
+// and expired reports whether the deadline has passed.
+func deadlineTimeout(timeout time.Duration, deadline int64) (d time.Duration, expired bool) {
+	if deadline == 0 {
+		return timeout, false
+	}
+	d = time.Until(time.Unix(0, deadline))
+	if d <= 0 {
+		return 0, true
+	}
+	if timeout > 0 && timeout < d {
+		d = timeout
+	}
+	return d, false
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// waitSendQueue polls the socket until the send queue is empty, with a backoff up to maxSendQueueInterval.
+// The poller can't drive it since there is no event for the send queue, so the wait is limited by the write timeout,
+// or maxSendQueueWait if not set, otherwise a peer never reading or acknowledging would block it forever.
+func (c *connection) waitSendQueue() error {
+	timeout, expired := deadlineTimeout(c.writeTimeout, atomic.LoadInt64(&c.writeDeadline))
+	if timeout <= 0 && !expired {
+		timeout = maxSendQueueWait
+	}
+	stop := time.Now().Add(timeout)
+	interval := minSendQueueInterval
+	for {
+		if !c.IsActive() {
+			return Exception(ErrConnClosed, "when flush sync")
+		}
+		n, err := sendQueueLen(c.fd)
+		if err != nil {
+			return Exception(err, "when flush sync")
+		}
+		if n == 0 {
+			return nil
+		}
+		if expired || time.Now().After(stop) {
+			return Exception(ErrWriteTimeout, c.remoteAddr.String())
+		}
+		time.Sleep(interval)
+		if interval < maxSendQueueInterval {
+			interval <<= 1
+		}
+	}
+}
+
+// closeIfWriteTimeout closes the connection when flush timeout, since the peer cannot know how much data has been sent.
+// It must be called after unlocking flushing, because the close callback will wait for flushing finished.
+func (c *connection) closeIfWriteTimeout(err error) {
+	if err != nil && errors.Is(err, ErrWriteTimeout) {
+		c.setCloseReason(err)
+		if log := c.getLogger(); log != nil {
+			log(LogLevelWarn, "closing for write timeout")
+		}
+		c.Close()
+	}
+}
+
 func (c *connection) getState() connState {
 	return atomic.LoadInt32(&c.state)
 }
@@ -40,7 +40,8 @@ type key int32
 
 - "processing" locks onRequest handler, and doesn't exist in dialer.
 - "flushing" locks outputBuffer
-- "closing" should wait for flushing finished and call the closeCallback after that.
+- "reading" locks reading the socket directly, e.g. by splice or readv, which pauses the reading of poller
+- "closing" should wait for flushing and reading finished and call the closeCallback after that.
 */
 
 const (
@@ -48,6 +49,7 @@ const (
 	connecting
 	processing
 	flushing
+	reading
 	// total must be at the bottom.
 	total
 )
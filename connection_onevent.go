@@ -19,7 +19,10 @@ package netpoll
 
 import (
 	"context"
+	"runtime/debug"
 	"sync/atomic"
+	"time"
+	"unsafe"
 
 	"github.com/bytedance/gopkg/util/gopool"
 )
@@ -52,7 +55,9 @@ type onEvent struct {
 	onConnectCallback    atomic.Value
 	onDisconnectCallback atomic.Value
 	onRequestCallback    atomic.Value
-	closeCallbacks       atomic.Value // value is latest *callbackNode
+	closeCallbacks       atomic.Value   // value is latest *callbackNode
+	closeReason          unsafe.Pointer // value is *closeReason, set by the first one closing the connection
+	scheduler            func(task func())
 }
 
 type callbackNode struct {
@@ -103,6 +108,34 @@ func (c *connection) AddCloseCallback(callback CloseCallback) error {
 	return nil
 }
 
+// AddCloseReasonCallback adds a CloseReasonCallback to this connection.
+func (c *connection) AddCloseReasonCallback(callback CloseReasonCallback) error {
+	if callback == nil {
+		return nil
+	}
+	return c.AddCloseCallback(func(connection Connection) error {
+		return callback(connection, c.loadCloseReason())
+	})
+}
+
+// closeReason wraps the reason of closing, since a nil reason must be recorded too.
+type closeReason struct {
+	err error
+}
+
+// setCloseReason records the reason of closing unless one has been recorded.
+// It must be called before closeBy, so that the reason is visible to closeCallback no matter who calls it.
+func (c *connection) setCloseReason(err error) {
+	atomic.CompareAndSwapPointer(&c.closeReason, nil, unsafe.Pointer(&closeReason{err: err}))
+}
+
+func (c *connection) loadCloseReason() error {
+	if reason := (*closeReason)(atomic.LoadPointer(&c.closeReason)); reason != nil {
+		return reason.err
+	}
+	return nil
+}
+
 // onPrepare supports close connection, but not read/write data.
 // connection will be registered by this call after preparing.
 func (c *connection) onPrepare(opts *options) (err error) {
@@ -113,6 +146,7 @@ func (c *connection) onPrepare(opts *options) (err error) {
 		c.SetReadTimeout(opts.readTimeout)
 		c.SetWriteTimeout(opts.writeTimeout)
 		c.SetIdleTimeout(opts.idleTimeout)
+		c.scheduler = opts.scheduler
 
 		// calling prepare first and then register.
 		if opts.onPrepare != nil {
@@ -180,8 +214,8 @@ func (c *connection) onRequest() (needTrigger bool) {
 	}
 	// wait onConnect finished first
 	if c.getState() == connStateNone && c.onConnectCallback.Load() != nil {
-		// let onConnect to call onRequest
-		return
+		// let onConnect to call onRequest, but wake up the reads in onConnect, e.g. the PROXY protocol header
+		return true
 	}
 	processed := c.onProcess(nil, onRequest)
 	// if not processed, should trigger read
@@ -202,7 +236,12 @@ func (c *connection) onProcess(onConnect OnConnect, onRequest OnRequest) (proces
 			if !panicked {
 				return
 			}
-			// cannot use recover() here, since we don't want to break the panic stack
+			// recover only if WithPanicHandler is set, otherwise we don't want to break the panic stack
+			if c.panicHandler != nil {
+				if r := recover(); r != nil {
+					c.panicHandler(c.ctx, c, r, debug.Stack())
+				}
+			}
 			c.unlock(processing)
 			if c.IsActive() {
 				c.Close()
@@ -210,10 +249,39 @@ func (c *connection) onProcess(onConnect OnConnect, onRequest OnRequest) (proces
 				c.closeCallback(false, false)
 			}
 		}()
+		// close the connection if the PROXY protocol header and OnConnect are not finished in time
+		var connectTimer *time.Timer
+		if c.connectTimeout > 0 && (c.proxyHeader || onConnect != nil) {
+			connectTimer = time.AfterFunc(c.connectTimeout, func() {
+				c.Close()
+			})
+			c.connectTimeout = 0
+		}
+		// read the PROXY protocol header before any callback, and close the connection if it's malformed
+		if c.proxyHeader {
+			c.proxyHeader = false
+			if err := c.readProxyHeader(); err != nil {
+				c.Close()
+				if onConnect != nil {
+					c.unlock(connecting)
+				}
+				onConnect, onRequest = nil, nil
+			}
+		}
 		// trigger onConnect first
 		if onConnect != nil && c.changeState(connStateNone, connStateConnected) {
 			c.ctx = onConnect(c.ctx, c)
-			if !c.IsActive() && c.changeState(connStateConnected, connStateDisconnected) {
+			// OnRequest may be replaced by SetOnRequest in OnConnect
+			if replaced, ok := c.onRequestCallback.Load().(OnRequest); ok {
+				onRequest = replaced
+			}
+			if c.ctx != nil && c.ctx.Err() != nil && c.IsActive() {
+				// rejected by OnConnect, OnRequest will not be called since it's closed by user
+				c.setCloseReason(c.ctx.Err())
+				c.Close()
+			}
+			// only the peer close should trigger onDisconnect, but not the user close, e.g. rejected
+			if c.isCloseBy(poller) && c.changeState(connStateConnected, connStateDisconnected) {
 				// since we hold connecting lock, so we should help to call onDisconnect here
 				onDisconnect, _ := c.onDisconnectCallback.Load().(OnDisconnect)
 				if onDisconnect != nil {
@@ -222,10 +290,14 @@ func (c *connection) onProcess(onConnect OnConnect, onRequest OnRequest) (proces
 			}
 			c.unlock(connecting)
 		}
+		if connectTimer != nil {
+			connectTimer.Stop()
+		}
 	START:
 		// The `onRequest` must be executed at least once if conn have any readable data,
 		// which is in order to cover the `send & close by peer` case.
-		if onRequest != nil && c.Reader().Len() > 0 {
+		// But it should not be executed if conn has been closed by user, e.g. rejected in onConnect.
+		if onRequest != nil && c.status(closing) != user && c.Reader().Len() > 0 {
 			_ = onRequest(c.ctx, c)
 		}
 		// The processing loop must ensure that the connection meets `IsActive`.
@@ -272,7 +344,11 @@ func (c *connection) onProcess(onConnect OnConnect, onRequest OnRequest) (proces
 	} // end of task closure func
 
 	// add new task
-	runTask(c.ctx, task)
+	if c.scheduler != nil {
+		c.scheduler(task)
+	} else {
+		runTask(c.ctx, task)
+	}
 	return true
 }
 
@@ -289,6 +365,10 @@ func (c *connection) closeCallback(needLock, needDetach bool) (err error) {
 			logger.Printf("NETPOLL: closeCallback[%v,%v] detach operator failed: %v", needLock, needDetach, err)
 		}
 	}
+	// user data and tags are cleared after close callbacks, which may still use them
+	defer c.clearTags()
+	defer c.SetUserData(nil)
+	c.SetOnWriteReady(0, nil)
 	latest := c.closeCallbacks.Load()
 	if latest == nil {
 		return nil
@@ -307,6 +387,9 @@ func (c *connection) register() (err error) {
 		c.Close()
 		return Exception(ErrConnClosed, err.Error())
 	}
+	if log := c.getLogger(); log != nil {
+		log(LogLevelDebug, "registered into poller, fd=%d", c.fd)
+	}
 	return nil
 }
 
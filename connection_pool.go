@@ -0,0 +1,287 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package netpoll
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PoolConfig is the config of ConnectionPool, and the zero value means no limit.
+type PoolConfig struct {
+	MaxIdle     int           // max number of idle connections kept in the pool
+	MaxActive   int           // max number of connections created by the pool, including the idle ones
+	IdleTTL     time.Duration // idle connections exceeding IdleTTL are closed
+	DialTimeout time.Duration // timeout of dialing if ctx has no earlier deadline, the default is 1s
+}
+
+// ConnectionPool maintains the connections to an address, which are dialed by DialConnection.
+// Connections got by Get should be returned by Put after use, or just closed if they are broken.
+//
+// The connections closed by either side are removed from the pool by close callbacks,
+// and the idle connections are checked by IsActive again before handed out.
+type ConnectionPool struct {
+	network, address string
+	config           PoolConfig
+
+	mu      sync.Mutex
+	closed  bool
+	conns   map[Connection]bool // all the living connections created by the pool, value is whether it's idle
+	dialing int                 // number of connections being dialed
+	idles   []idleConn          // idle connections, the most recently used is at the tail
+	waiters []chan struct{}     // Get callers blocked by MaxActive
+	stop    chan struct{}
+}
+
+type idleConn struct {
+	conn Connection
+	t    time.Time // the time put into the pool
+}
+
+// NewConnectionPool creates a ConnectionPool to the address.
+func NewConnectionPool(network, address string, config PoolConfig) *ConnectionPool {
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = time.Second
+	}
+	p := &ConnectionPool{
+		network: network,
+		address: address,
+		config:  config,
+		conns:   make(map[Connection]bool),
+		stop:    make(chan struct{}),
+	}
+	if config.IdleTTL > 0 {
+		go p.evictLoop()
+	}
+	return p
+}
+
+// Get returns an idle connection, or dials a new one if there is no idle connection.
+// If MaxActive is reached, Get waits until any connection is returned or closed, or ctx is done.
+func (p *ConnectionPool) Get(ctx context.Context) (Connection, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, Exception(ErrConnClosed, "connection pool closed")
+		}
+		conn, stale := p.popIdle()
+		if conn != nil {
+			p.mu.Unlock()
+			closeConnections(stale)
+			return conn, nil
+		}
+		if p.config.MaxActive <= 0 || len(p.conns)+p.dialing < p.config.MaxActive {
+			p.dialing++
+			p.mu.Unlock()
+			closeConnections(stale)
+			return p.dial(ctx)
+		}
+		wait := make(chan struct{}, 1)
+		p.waiters = append(p.waiters, wait)
+		p.mu.Unlock()
+		closeConnections(stale)
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			p.mu.Lock()
+			p.removeWaiter(wait)
+			p.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Put returns the connection got by Get to the pool.
+// The connection is closed if it's inactive, or MaxIdle is reached, or the pool has been closed.
+func (p *ConnectionPool) Put(conn Connection) {
+	p.mu.Lock()
+	idle, ok := p.conns[conn]
+	if !ok || idle {
+		// not created by the pool, or has been removed or put
+		p.mu.Unlock()
+		return
+	}
+	if p.closed || !conn.IsActive() || (p.config.MaxIdle > 0 && len(p.idles) >= p.config.MaxIdle) {
+		p.mu.Unlock()
+		conn.Close()
+		return
+	}
+	p.conns[conn] = true
+	p.idles = append(p.idles, idleConn{conn: conn, t: time.Now()})
+	p.notify()
+	p.mu.Unlock()
+}
+
+// Close closes all the idle connections, and the connections in use will be closed when they are put back.
+func (p *ConnectionPool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.stop)
+	stale := make([]Connection, 0, len(p.idles))
+	for _, idle := range p.idles {
+		stale = append(stale, idle.conn)
+	}
+	p.idles = nil
+	// wake up all the waiters to return
+	for _, wait := range p.waiters {
+		wait <- struct{}{}
+	}
+	p.waiters = nil
+	p.mu.Unlock()
+	closeConnections(stale)
+	return nil
+}
+
+func (p *ConnectionPool) dial(ctx context.Context) (Connection, error) {
+	timeout := p.config.DialTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if d := time.Until(deadline); d < timeout {
+			timeout = d
+		}
+	}
+	var conn Connection
+	var err error
+	if timeout > 0 {
+		conn, err = DialConnection(p.network, p.address, timeout)
+	} else {
+		err = Exception(ErrDialTimeout, p.address)
+	}
+	if err == nil {
+		// remove the connection once closed
+		conn.AddCloseCallback(func(Connection) error {
+			p.remove(conn)
+			return nil
+		})
+	}
+
+	p.mu.Lock()
+	p.dialing--
+	if err != nil || p.closed {
+		p.notify()
+		p.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		conn.Close()
+		return nil, Exception(ErrConnClosed, "connection pool closed")
+	}
+	p.conns[conn] = false
+	p.mu.Unlock()
+	// the close callback may have been called before added
+	if !conn.IsActive() {
+		p.remove(conn)
+	}
+	return conn, nil
+}
+
+// remove deletes the closed connection from the pool.
+func (p *ConnectionPool) remove(conn Connection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	idle, ok := p.conns[conn]
+	if !ok {
+		return
+	}
+	delete(p.conns, conn)
+	if idle {
+		for i := range p.idles {
+			if p.idles[i].conn == conn {
+				p.idles = append(p.idles[:i], p.idles[i+1:]...)
+				break
+			}
+		}
+	}
+	p.notify()
+}
+
+// popIdle returns the most recently used idle connection which is available,
+// and the inactive or expired ones are returned as stale to be closed.
+func (p *ConnectionPool) popIdle() (conn Connection, stale []Connection) {
+	now := time.Now()
+	for len(p.idles) > 0 {
+		idle := p.idles[len(p.idles)-1]
+		p.idles = p.idles[:len(p.idles)-1]
+		p.conns[idle.conn] = false
+		if idle.conn.IsActive() && !p.expired(idle, now) {
+			return idle.conn, stale
+		}
+		stale = append(stale, idle.conn)
+	}
+	return nil, stale
+}
+
+func (p *ConnectionPool) expired(idle idleConn, now time.Time) bool {
+	return p.config.IdleTTL > 0 && now.Sub(idle.t) >= p.config.IdleTTL
+}
+
+// evictLoop closes the expired idle connections periodically.
+func (p *ConnectionPool) evictLoop() {
+	ticker := time.NewTicker(p.config.IdleTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-ticker.C:
+			p.mu.Lock()
+			// the oldest is at the head
+			var stale []Connection
+			for len(p.idles) > 0 && p.expired(p.idles[0], now) {
+				stale = append(stale, p.idles[0].conn)
+				p.conns[p.idles[0].conn] = false
+				p.idles = p.idles[1:]
+			}
+			p.mu.Unlock()
+			closeConnections(stale)
+		}
+	}
+}
+
+// notify wakes up the first waiter of Get.
+func (p *ConnectionPool) notify() {
+	if len(p.waiters) == 0 {
+		return
+	}
+	wait := p.waiters[0]
+	p.waiters = p.waiters[1:]
+	wait <- struct{}{}
+}
+
+// removeWaiter removes the waiter which gives up, and passes on the notification if it has been notified.
+func (p *ConnectionPool) removeWaiter(wait chan struct{}) {
+	for i := range p.waiters {
+		if p.waiters[i] == wait {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			return
+		}
+	}
+	p.notify()
+}
+
+func closeConnections(conns []Connection) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
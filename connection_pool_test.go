@@ -0,0 +1,134 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package netpoll
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnectionPoolConcurrentGetPut(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			buf, err := connection.Reader().Next(connection.Reader().Len())
+			if err != nil {
+				return err
+			}
+			connection.Writer().WriteBinary(buf)
+			return connection.Writer().Flush()
+		})
+	defer loop.Shutdown(context.Background())
+
+	maxActive := 4
+	pool := NewConnectionPool(network, address, PoolConfig{MaxIdle: 2, MaxActive: maxActive})
+	defer pool.Close()
+	var wg sync.WaitGroup
+	var inuse, peak int32
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				conn, err := pool.Get(context.Background())
+				MustNil(t, err)
+				n := atomic.AddInt32(&inuse, 1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+						break
+					}
+				}
+				_, err = conn.Writer().WriteString("ping")
+				MustNil(t, err)
+				MustNil(t, conn.Writer().Flush())
+				buf, err := conn.Reader().Next(4)
+				MustNil(t, err)
+				Equal(t, string(buf), "ping")
+				MustNil(t, conn.Reader().Release())
+				atomic.AddInt32(&inuse, -1)
+				pool.Put(conn)
+			}
+		}()
+	}
+	wg.Wait()
+	MustTrue(t, atomic.LoadInt32(&peak) <= int32(maxActive))
+	pool.mu.Lock()
+	MustTrue(t, len(pool.idles) <= 2)
+	MustTrue(t, len(pool.conns) <= maxActive)
+	pool.mu.Unlock()
+
+	// Get is blocked by MaxActive until ctx done
+	var conns []Connection
+	for i := 0; i < maxActive; i++ {
+		conn, err := pool.Get(context.Background())
+		MustNil(t, err)
+		conns = append(conns, conn)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := pool.Get(ctx)
+	Equal(t, err, context.DeadlineExceeded)
+	// closed connections are removed and release the places
+	go conns[0].Close()
+	conn, err := pool.Get(context.Background())
+	MustNil(t, err)
+	MustTrue(t, conn != conns[0])
+}
+
+func TestConnectionPoolIdleTTL(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			return nil
+		})
+	defer loop.Shutdown(context.Background())
+
+	ttl := 50 * time.Millisecond
+	pool := NewConnectionPool(network, address, PoolConfig{IdleTTL: ttl})
+	defer pool.Close()
+	conn1, err := pool.Get(context.Background())
+	MustNil(t, err)
+	pool.Put(conn1)
+	// reused before expired
+	conn2, err := pool.Get(context.Background())
+	MustNil(t, err)
+	Assert(t, conn1 == conn2)
+	pool.Put(conn2)
+
+	// evicted after expired
+	time.Sleep(3 * ttl)
+	MustTrue(t, !conn1.IsActive())
+	pool.mu.Lock()
+	Equal(t, len(pool.idles), 0)
+	Equal(t, len(pool.conns), 0)
+	pool.mu.Unlock()
+	conn3, err := pool.Get(context.Background())
+	MustNil(t, err)
+	Assert(t, conn3 != conn1)
+
+	// closed pool
+	MustNil(t, pool.Close())
+	pool.Put(conn3)
+	MustTrue(t, !conn3.IsActive())
+	_, err = pool.Get(context.Background())
+	MustTrue(t, err != nil)
+}
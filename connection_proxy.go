@@ -0,0 +1,181 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package netpoll
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultProxyHeaderTimeout limits the time of reading the PROXY protocol header if no read timeout is set.
+const defaultProxyHeaderTimeout = 5 * time.Second
+
+const (
+	proxyV1MaxLen = 107 // the maximum length of the v1 line including CRLF
+	proxyV2MinLen = 16  // the signature, version and command, family and protocol, and length
+)
+
+// proxyV2Signature is the first 12 bytes of the v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeader = errors.New("malformed PROXY protocol header")
+
+// readProxyHeader reads and skips the PROXY protocol header, and replaces the addresses by it.
+func (c *connection) readProxyHeader() (err error) {
+	if c.readTimeout <= 0 && atomic.LoadInt64(&c.readDeadline) == 0 {
+		deadline := time.Now().Add(defaultProxyHeaderTimeout).UnixNano()
+		atomic.StoreInt64(&c.readDeadline, deadline)
+		// restore no deadline, unless changed
+		defer atomic.CompareAndSwapInt64(&c.readDeadline, deadline, 0)
+	}
+	first, err := c.Peek(1)
+	if err != nil {
+		return err
+	}
+	var n int
+	var src, dst net.Addr
+	switch first[0] {
+	case 'P':
+		n, src, dst, err = c.readProxyV1()
+	case proxyV2Signature[0]:
+		n, src, dst, err = c.readProxyV2()
+	default:
+		return errProxyHeader
+	}
+	if err != nil {
+		return err
+	}
+	if err = c.Skip(n); err != nil {
+		return err
+	}
+	c.Release()
+	if src != nil && dst != nil {
+		c.remoteAddr, c.localAddr = src, dst
+	}
+	return nil
+}
+
+// readProxyV1 parses the line like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+// and returns the length of the header and the addresses, which are nil for UNKNOWN.
+func (c *connection) readProxyV1() (n int, src, dst net.Addr, err error) {
+	var line []byte
+	for n = 1; ; n++ {
+		if n > proxyV1MaxLen {
+			return 0, nil, nil, errProxyHeader
+		}
+		if line, err = c.Peek(n); err != nil {
+			return 0, nil, nil, err
+		}
+		if line[n-1] == '\n' {
+			break
+		}
+	}
+	if !bytes.HasPrefix(line, []byte("PROXY ")) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return 0, nil, nil, errProxyHeader
+	}
+	fields := strings.Split(string(line[len("PROXY "):n-2]), " ")
+	if fields[0] == "UNKNOWN" {
+		return n, nil, nil, nil
+	}
+	if len(fields) != 5 || fields[0] != "TCP4" && fields[0] != "TCP6" {
+		return 0, nil, nil, errProxyHeader
+	}
+	srcIP, dstIP := net.ParseIP(fields[1]), net.ParseIP(fields[2])
+	srcPort, serr := strconv.ParseUint(fields[3], 10, 16)
+	dstPort, derr := strconv.ParseUint(fields[4], 10, 16)
+	if srcIP == nil || dstIP == nil || serr != nil || derr != nil ||
+		(srcIP.To4() != nil) != (fields[0] == "TCP4") || (dstIP.To4() != nil) != (fields[0] == "TCP4") {
+		return 0, nil, nil, errProxyHeader
+	}
+	src = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	dst = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return n, src, dst, nil
+}
+
+// readProxyV2 parses the binary header, and returns the length of the header and the addresses,
+// which are nil for the LOCAL command and the unspecified family. The TLVs are skipped.
+func (c *connection) readProxyV2() (n int, src, dst net.Addr, err error) {
+	hdr, err := c.Peek(proxyV2MinLen)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Signature) || hdr[12]>>4 != 2 {
+		return 0, nil, nil, errProxyHeader
+	}
+	cmd, family, proto := hdr[12]&0x0f, hdr[13]>>4, hdr[13]&0x0f
+	size := int(binary.BigEndian.Uint16(hdr[14:16]))
+	n = proxyV2MinLen + size
+	if cmd > 1 {
+		return 0, nil, nil, errProxyHeader
+	}
+	if hdr, err = c.Peek(n); err != nil {
+		return 0, nil, nil, err
+	}
+	// LOCAL, e.g. the health checks of the proxy itself
+	if cmd == 0 {
+		return n, nil, nil, nil
+	}
+	addrs := hdr[proxyV2MinLen:]
+	switch family {
+	case 0x1, 0x2: // AF_INET, AF_INET6
+		ipLen := net.IPv4len
+		if family == 0x2 {
+			ipLen = net.IPv6len
+		}
+		if len(addrs) < 2*ipLen+4 || proto != 0x1 && proto != 0x2 {
+			return 0, nil, nil, errProxyHeader
+		}
+		srcIP := net.IP(append([]byte{}, addrs[:ipLen]...))
+		dstIP := net.IP(append([]byte{}, addrs[ipLen:2*ipLen]...))
+		srcPort := int(binary.BigEndian.Uint16(addrs[2*ipLen:]))
+		dstPort := int(binary.BigEndian.Uint16(addrs[2*ipLen+2:]))
+		if proto == 0x1 { // STREAM
+			return n, &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+		}
+		return n, &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}, nil
+	case 0x3: // AF_UNIX
+		const pathLen = 108
+		if len(addrs) < 2*pathLen || proto != 0x1 && proto != 0x2 {
+			return 0, nil, nil, errProxyHeader
+		}
+		network := "unix"
+		if proto == 0x2 {
+			network = "unixgram"
+		}
+		src = &net.UnixAddr{Name: unixPath(addrs[:pathLen]), Net: network}
+		dst = &net.UnixAddr{Name: unixPath(addrs[pathLen : 2*pathLen]), Net: network}
+		return n, src, dst, nil
+	case 0x0: // AF_UNSPEC
+		return n, nil, nil, nil
+	}
+	return 0, nil, nil, errProxyHeader
+}
+
+// unixPath returns the path before the first NUL.
+func unixPath(p []byte) string {
+	if i := bytes.IndexByte(p, 0); i >= 0 {
+		p = p[:i]
+	}
+	return string(p)
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package netpoll
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newProxyTestServer serves an echo server with WithProxyProtocol,
+// and sends the addresses seen by OnRequest to addrs.
+func newProxyTestServer(t *testing.T, address string, addrs chan [2]net.Addr, opts ...Option) EventLoop {
+	onRequest := func(ctx context.Context, connection Connection) error {
+		select {
+		case addrs <- [2]net.Addr{connection.RemoteAddr(), connection.LocalAddr()}:
+		default:
+		}
+		p, err := connection.Reader().Next(connection.Reader().Len())
+		if err != nil {
+			return err
+		}
+		_, err = connection.Writer().WriteBinary(p)
+		MustNil(t, err)
+		return connection.Writer().Flush()
+	}
+	return newTestEventLoop("tcp", address, onRequest, append(opts, WithProxyProtocol(true))...)
+}
+
+// sendProxyHeader writes the header and "hello", and checks the echo.
+func sendProxyHeader(t *testing.T, address string, header []byte) net.Conn {
+	conn, err := net.Dial("tcp", address)
+	MustNil(t, err)
+	_, err = conn.Write(append(header, "hello"...))
+	MustNil(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	MustNil(t, err)
+	Equal(t, string(buf), "hello")
+	return conn
+}
+
+func TestProxyProtocolV1(t *testing.T) {
+	address := getTestAddress()
+	addrs := make(chan [2]net.Addr, 1)
+	connected := make(chan [2]net.Addr, 1)
+	loop := newProxyTestServer(t, address, addrs,
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			// the header is parsed before OnConnect
+			connected <- [2]net.Addr{connection.RemoteAddr(), connection.LocalAddr()}
+			return ctx
+		}))
+	defer loop.Shutdown(context.Background())
+
+	conn := sendProxyHeader(t, address, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	defer conn.Close()
+	for _, got := range [][2]net.Addr{<-connected, <-addrs} {
+		Equal(t, got[0].String(), "192.0.2.1:56324")
+		Equal(t, got[1].String(), "198.51.100.1:443")
+		Equal(t, got[0].Network(), "tcp")
+	}
+
+	// the addresses are kept for UNKNOWN
+	conn = sendProxyHeader(t, address, []byte("PROXY UNKNOWN\r\n"))
+	defer conn.Close()
+	<-connected
+	got := <-addrs
+	Equal(t, got[0].String(), conn.LocalAddr().String())
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	address := getTestAddress()
+	addrs := make(chan [2]net.Addr, 1)
+	loop := newProxyTestServer(t, address, addrs)
+	defer loop.Shutdown(context.Background())
+
+	// PROXY TCP over IPv6 with a TLV, sent in several writes
+	src, dst := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	body := append(append([]byte{}, src...), dst...)
+	body = append(body, 0xdc, 0x04, 0x01, 0xbb) // 56324, 443
+	body = append(body, 0x04, 0x00, 0x01, 0xff) // PP2_TYPE_NOOP
+	header := append(append([]byte{}, proxyV2Signature...), 0x21, 0x21)
+	header = append(header, byte(len(body)>>8), byte(len(body)))
+	header = append(header, body...)
+
+	conn, err := net.Dial("tcp", address)
+	MustNil(t, err)
+	defer conn.Close()
+	for _, p := range [][]byte{header[:10], header[10:20], append(header[20:], "hello"...)} {
+		_, err = conn.Write(p)
+		MustNil(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	MustNil(t, err)
+	Equal(t, string(buf), "hello")
+	got := <-addrs
+	Equal(t, got[0].String(), "[2001:db8::1]:56324")
+	Equal(t, got[1].String(), "[2001:db8::2]:443")
+
+	// the addresses are kept for LOCAL
+	local := append(append([]byte{}, proxyV2Signature...), 0x20, 0x00, 0x00, 0x00)
+	conn = sendProxyHeader(t, address, local)
+	defer conn.Close()
+	got = <-addrs
+	Equal(t, got[0].String(), conn.LocalAddr().String())
+}
+
+func TestProxyProtocolMalformed(t *testing.T) {
+	address := getTestAddress()
+	addrs := make(chan [2]net.Addr, 1)
+	loop := newProxyTestServer(t, address, addrs)
+	defer loop.Shutdown(context.Background())
+
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.0.2.1 56324 443\r\n",
+		"PROXY TCP4 2001:db8::1 192.0.2.1 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n",
+		string(append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0x00, 0x0c)), // version 1
+		string(append(append([]byte{}, proxyV2Signature...), 0x21, 0x11, 0x00, 0x04, 1, 2, 3, 4)),
+	} {
+		conn, err := net.Dial("tcp", address)
+		MustNil(t, err)
+		_, err = conn.Write([]byte(header + "hello"))
+		MustNil(t, err)
+		// closed without calling OnRequest
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		Assert(t, err == io.EOF, header, err)
+		conn.Close()
+	}
+	Equal(t, len(addrs), 0)
+}
@@ -18,18 +18,30 @@
 package netpoll
 
 import (
+	"errors"
+	"runtime"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // ------------------------------------------ implement FDOperator ------------------------------------------
 
 // onHup means close by poller.
 func (c *connection) onHup(p Poll) error {
+	c.setCloseReason(hupReason(c.operator.getHupErr()))
 	if !c.closeBy(poller) {
 		return nil
 	}
+	if c.onState != nil {
+		c.onState(c.remoteAddr, StateClosing)
+	}
 	c.triggerRead(Exception(ErrEOF, "peer close"))
 	c.triggerWrite(Exception(ErrConnClosed, "peer close"))
+	c.coalesceAbort(Exception(ErrConnClosed, "peer close"))
+	if log := c.getLogger(); log != nil {
+		log(LogLevelInfo, "closed by peer")
+	}
 
 	// call Disconnect callback first
 	c.onDisconnect()
@@ -50,9 +62,17 @@ func (c *connection) onHup(p Poll) error {
 // onClose means close by user.
 func (c *connection) onClose() error {
 	// user code close the connection
+	c.setCloseReason(nil)
 	if c.closeBy(user) {
+		if c.onState != nil {
+			c.onState(c.remoteAddr, StateClosing)
+		}
 		c.triggerRead(Exception(ErrConnClosed, "self close"))
 		c.triggerWrite(Exception(ErrConnClosed, "self close"))
+		c.coalesceAbort(Exception(ErrConnClosed, "self close"))
+		if log := c.getLogger(); log != nil {
+			log(LogLevelInfo, "closed by user")
+		}
 		// Detach from poller when processing finished, otherwise it will cause race
 		c.closeCallback(true, true)
 		return nil
@@ -67,6 +87,14 @@ func (c *connection) onClose() error {
 	return c.closeCallback(true, false)
 }
 
+// hupReason returns the reason of closing by poller from the error that the poller hangs up with.
+func hupReason(err error) error {
+	if err == nil || errors.Is(err, ErrEOF) {
+		return Exception(ErrEOF, "peer close")
+	}
+	return Exception(err, "")
+}
+
 // closeBuffer recycle input & output LinkBuffer.
 func (c *connection) closeBuffer() {
 	onConnect, _ := c.onConnectCallback.Load().(OnConnect)
@@ -84,7 +112,34 @@ func (c *connection) closeBuffer() {
 
 // inputs implements FDOperator.
 func (c *connection) inputs(vs [][]byte) (rs [][]byte) {
-	vs[0] = c.inputBuffer.book(c.bookSize, c.maxSize)
+	// the socket is read directly, poller must not read it concurrently
+	if !c.isUnlock(reading) && !c.readable() {
+		return vs[:0]
+	}
+	// the read is limited to the tokens of SetReadLimit
+	limit := -1
+	if atomic.LoadInt64(&c.readLimit) > 0 {
+		limit = c.readLimiter.available()
+	}
+	if limit == 0 {
+		// pause until refilled, otherwise the poller will be woken up again
+		c.takeReadTokens(0)
+		c.controlRead()
+		return vs[:0]
+	}
+	if chunk := int(atomic.LoadInt64(&c.readChunkSize)); chunk > 0 {
+		// the new node is large enough for a full chunk
+		maxSize := c.maxSize
+		if maxSize < chunk {
+			maxSize = chunk
+		}
+		vs[0] = c.inputBuffer.book(chunk, maxSize)
+	} else {
+		vs[0] = c.inputBuffer.book(c.bookSize, c.maxSize)
+	}
+	if limit > 0 && len(vs[0]) > limit {
+		vs[0] = vs[0][:limit]
+	}
 	return vs[:1]
 }
 
@@ -94,6 +149,10 @@ func (c *connection) inputAck(n int) (err error) {
 		c.inputBuffer.bookAck(0)
 		return nil
 	}
+	c.addInputBytes(n)
+	if log := c.getLogger(); log != nil {
+		log(LogLevelDebug, "read %d bytes from socket", n)
+	}
 
 	// Auto size bookSize.
 	if n == c.bookSize && c.bookSize < mallocMax {
@@ -101,6 +160,10 @@ func (c *connection) inputAck(n int) (err error) {
 	}
 
 	length, _ := c.inputBuffer.bookAck(n)
+	if atomic.LoadInt64(&c.readLimit) > 0 {
+		c.takeReadTokens(n)
+	}
+	c.controlRead()
 	if c.maxSize < length {
 		c.maxSize = length
 	}
@@ -118,8 +181,131 @@ func (c *connection) inputAck(n int) (err error) {
 	return nil
 }
 
+// readable reports whether the connection should keep reading from the socket under the read buffer threshold.
+// While reading directly, the socket is only read by poller when the reader is waiting for data.
+func (c *connection) readable() bool {
+	if atomic.LoadInt32(&c.readThrottled) > 0 && c.isUnlock(reading) {
+		return false
+	}
+	if !c.isUnlock(reading) {
+		return int64(c.inputBuffer.Len()) < atomic.LoadInt64(&c.waitReadSize)
+	}
+	threshold := atomic.LoadInt64(&c.readThreshold)
+	if threshold <= 0 {
+		return true
+	}
+	length := int64(c.inputBuffer.Len())
+	return length < threshold || length < atomic.LoadInt64(&c.waitReadSize)
+}
+
+// readLimiter is the token bucket of SetReadLimit, refilled by limit bytes per second up to burst.
+type readLimiter struct {
+	mux      sync.Mutex
+	limit    float64 // zero means no limit
+	burst    float64
+	tokens   float64
+	refilled time.Time
+}
+
+// available returns the number of bytes that can be read now, or -1 if no limit.
+func (l *readLimiter) available() int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.limit <= 0 {
+		return -1
+	}
+	l.refill(time.Now())
+	if l.tokens < 1 {
+		return 0
+	}
+	return int(l.tokens)
+}
+
+// refill must be called with l.mux locked.
+func (l *readLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.refilled).Seconds() * l.limit
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.refilled = now
+}
+
+// takeReadTokens takes n tokens of SetReadLimit, and pauses reading until the next token is available if they run out.
+func (c *connection) takeReadTokens(n int) {
+	l := &c.readLimiter
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.limit <= 0 {
+		return
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 1 || !atomic.CompareAndSwapInt32(&c.readThrottled, 0, 1) {
+		return
+	}
+	// resume after a quarter of the burst refilled, so that the reads are not too small
+	wait := time.Duration((l.burst/4 - l.tokens) / l.limit * float64(time.Second))
+	limit := l.limit
+	time.AfterFunc(wait, func() {
+		l.mux.Lock()
+		// not changed by SetReadLimit
+		throttled := l.limit == limit && atomic.CompareAndSwapInt32(&c.readThrottled, 1, 0)
+		l.mux.Unlock()
+		if throttled {
+			c.controlRead()
+		}
+	})
+}
+
+// controlRead pauses or resumes reading from the socket according to the read buffer threshold.
+// The state is evaluated under readMux, so that the concurrent poller and reader will not override each other.
+func (c *connection) controlRead() {
+	// the reading key is stopped after closed, and the operator may have been freed
+	if !c.IsActive() {
+		return
+	}
+	if atomic.LoadInt64(&c.readThreshold) <= 0 && atomic.LoadInt32(&c.readThrottled) == 0 &&
+		c.isUnlock(reading) && !c.operator.isPaused() {
+		return
+	}
+	c.readMux.Lock()
+	if readable, paused := c.readable(), c.operator.isPaused(); readable && paused {
+		c.operator.Control(PollHup2R)
+	} else if !readable && !paused {
+		c.operator.Control(PollR2Hup)
+	}
+	c.readMux.Unlock()
+}
+
+// lockRead stops the poller reading the socket into inputBuffer, so that the socket can be read directly.
+// It returns false if the socket is being read directly by others.
+func (c *connection) lockRead() bool {
+	if !c.lock(reading) {
+		return false
+	}
+	c.controlRead()
+	return true
+}
+
+// unlockRead resumes the reading of poller.
+func (c *connection) unlockRead() {
+	c.unlock(reading)
+	c.controlRead()
+}
+
+// waitInputs waits for the reading of poller in progress,
+// so that the data in inputBuffer is always ahead of the socket when reading directly.
+func (c *connection) waitInputs() {
+	for atomic.LoadInt32(&c.operator.state) == 2 {
+		runtime.Gosched()
+	}
+}
+
 // outputs implements FDOperator.
 func (c *connection) outputs(vs [][]byte) (rs [][]byte, supportZeroCopy bool) {
+	if atomic.LoadInt32(&c.coalescer.active) == 1 {
+		return c.coalesceOutputs(vs), c.supportZeroCopy
+	}
 	if c.outputBuffer.IsEmpty() {
 		c.rw2r()
 		return rs, c.supportZeroCopy
@@ -130,9 +316,16 @@ func (c *connection) outputs(vs [][]byte) (rs [][]byte, supportZeroCopy bool) {
 
 // outputAck implements FDOperator.
 func (c *connection) outputAck(n int) (err error) {
+	atomic.AddUint64(&c.writeCalls, 1)
+	if atomic.LoadInt32(&c.coalescer.active) == 1 {
+		c.coalesceOutputAck(n)
+		return nil
+	}
 	if n > 0 {
+		atomic.AddUint64(&c.outputBytes, uint64(n))
 		c.outputBuffer.Skip(n)
 		c.outputBuffer.Release()
+		c.checkWriteReady()
 	}
 	if c.outputBuffer.IsEmpty() {
 		c.rw2r()
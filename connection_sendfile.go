@@ -0,0 +1,122 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package netpoll
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+)
+
+// maxSendfileSize is the largest chunk size of a single sendfile call, the same as the std library.
+const maxSendfileSize = 4 << 20
+
+// Sendfile implements Connection.
+func (c *connection) Sendfile(f *os.File, offset, count int64) (written int64, err error) {
+	if !c.IsActive() {
+		return 0, Exception(ErrConnClosed, "when sendfile")
+	}
+	if !c.lock(flushing) {
+		return 0, Exception(ErrConcurrentAccess, "when sendfile")
+	}
+
+	written, err = c.sendfile(f, offset, count)
+	c.unlock(flushing)
+	c.closeIfWriteTimeout(err)
+	return written, err
+}
+
+func (c *connection) sendfile(f *os.File, offset, count int64) (written int64, err error) {
+	// the pending output must be sent before the file
+	c.outputBuffer.Flush()
+	if err = c.flush(); err != nil {
+		return 0, err
+	}
+	if count <= 0 {
+		return 0, nil
+	}
+	// datagrams cannot be sent by sendfile
+	if c.datagrams != nil {
+		return c.copyFile(f, offset, count)
+	}
+
+	src := int(f.Fd())
+	defer runtime.KeepAlive(f)
+	for written < count {
+		size := count - written
+		if size > maxSendfileSize {
+			size = maxSendfileSize
+		}
+		pos := offset + written
+		n, err := syscall.Sendfile(c.fd, src, &pos, int(size))
+		if n > 0 {
+			written += int64(n)
+			atomic.AddUint64(&c.outputBytes, uint64(n))
+		}
+		switch err {
+		case nil:
+			if n == 0 { // EOF
+				return written, nil
+			}
+		case syscall.EINTR:
+		case syscall.EAGAIN:
+			if err = c.operator.Control(PollR2RW); err != nil {
+				return written, Exception(err, "when sendfile")
+			}
+			if err = c.waitFlush(); err != nil {
+				return written, err
+			}
+		case syscall.ENOSYS, syscall.EINVAL, syscall.EOPNOTSUPP, syscall.ENOTSOCK:
+			// sendfile is not supported by the platform or the fds, fallback to copy
+			if written == 0 {
+				return c.copyFile(f, offset, count)
+			}
+			return written, Exception(err, "when sendfile")
+		default:
+			return written, Exception(err, "when sendfile")
+		}
+	}
+	return written, nil
+}
+
+// copyFile sends the file through outputBuffer, it's the fallback of sendfile.
+func (c *connection) copyFile(f *os.File, offset, count int64) (written int64, err error) {
+	for written < count {
+		size := count - written
+		if size > block32k {
+			size = block32k
+		}
+		buf, _ := c.outputBuffer.Malloc(int(size))
+		n, rerr := f.ReadAt(buf, offset+written)
+		c.outputBuffer.MallocAck(n)
+		c.outputBuffer.Flush()
+		if err = c.flush(); err != nil {
+			return written, err
+		}
+		written += int64(n)
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package netpoll
+
+// Splice implements Connection.
+func (c *connection) Splice(dst Connection, n int) (written int64, err error) {
+	// the left data can still be moved after closed by peer
+	if c.isCloseBy(user) {
+		return 0, Exception(ErrConnClosed, "when splice")
+	}
+	if n <= 0 {
+		return 0, nil
+	}
+	// datagrams and the connections not managed by netpoll cannot be spliced
+	d, ok := dst.(*connection)
+	if !ok || c.datagrams != nil || d.datagrams != nil {
+		return c.copyN(dst, n)
+	}
+	written, err = c.splice(d, n)
+	if err == errSpliceUnsupported {
+		var copied int64
+		copied, err = c.copyN(dst, n-int(written))
+		written += copied
+	}
+	return written, err
+}
+
+// copyN moves n bytes to dst through the buffers, it's the fallback of splice.
+func (c *connection) copyN(dst Connection, n int) (written int64, err error) {
+	w := dst.Writer()
+	for written < int64(n) {
+		if err = c.waitRead(1); err != nil {
+			return written, err
+		}
+		size := c.inputBuffer.Len()
+		if left := n - int(written); size > left {
+			size = left
+		}
+		if err = c.copyTo(w, size); err != nil {
+			return written, err
+		}
+		if err = w.Flush(); err != nil {
+			return written, err
+		}
+		written += int64(size)
+	}
+	return written, nil
+}
+
+// copyTo copies the next size bytes of inputBuffer to w.
+// The data is copied rather than referenced, so that inputBuffer can be released at once.
+func (c *connection) copyTo(w Writer, size int) error {
+	p, err := c.inputBuffer.Next(size)
+	if err != nil {
+		return err
+	}
+	buf, err := w.Malloc(size)
+	if err != nil {
+		return err
+	}
+	copy(buf, p)
+	c.consume(size)
+	return c.Release()
+}
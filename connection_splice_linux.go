@@ -0,0 +1,140 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netpoll
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSpliceSize is the largest chunk size of a single splice call and the pipe size, the same as the std library.
+const maxSpliceSize = 1 << 20
+
+var errSpliceUnsupported = errors.New("splice is not supported")
+
+// splice moves the data from c to dst through a pipe, and returns errSpliceUnsupported
+// if the remaining data should be moved by copyN.
+func (c *connection) splice(dst *connection, n int) (written int64, err error) {
+	if !dst.IsActive() {
+		return 0, Exception(ErrConnClosed, "when splice")
+	}
+	if !c.lockRead() {
+		return 0, Exception(ErrConcurrentAccess, "when splice")
+	}
+	if !dst.lock(flushing) {
+		c.unlockRead()
+		return 0, Exception(ErrConcurrentAccess, "when splice")
+	}
+
+	written, err = c.spliceTo(dst, n)
+	dst.unlock(flushing)
+	c.unlockRead()
+	dst.closeIfWriteTimeout(err)
+	return written, err
+}
+
+func (c *connection) spliceTo(dst *connection, n int) (written int64, err error) {
+	// the pending output must be sent before the spliced data
+	dst.outputBuffer.Flush()
+	if err = dst.flush(); err != nil {
+		return 0, err
+	}
+	var fds [2]int
+	if err = unix.Pipe2(fds[:], unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+		return 0, errSpliceUnsupported
+	}
+	rfd, wfd := fds[0], fds[1]
+	defer syscall.Close(rfd)
+	defer syscall.Close(wfd)
+	// best effort, the default pipe size is 64KB
+	unix.FcntlInt(uintptr(wfd), unix.F_SETPIPE_SZ, maxSpliceSize)
+
+	for written < int64(n) {
+		if c.isCloseBy(user) {
+			return written, Exception(ErrConnClosed, "when splice")
+		}
+		c.waitInputs()
+		left := n - int(written)
+		if size := c.inputBuffer.Len(); size > 0 {
+			if size > left {
+				size = left
+			}
+			if err = c.copyTo(dst.outputBuffer, size); err != nil {
+				return written, err
+			}
+			dst.outputBuffer.Flush()
+			if err = dst.flush(); err != nil {
+				return written, err
+			}
+			written += int64(size)
+			continue
+		}
+
+		if left > maxSpliceSize {
+			left = maxSpliceSize
+		}
+		m, err := unix.Splice(c.fd, nil, wfd, nil, left, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+		switch err {
+		case nil:
+			if m == 0 {
+				return written, Exception(ErrEOF, "when splice")
+			}
+			c.addInputBytes(int(m))
+			moved, err := dst.spliceFrom(rfd, int(m))
+			written += int64(moved)
+			if err != nil {
+				return written, err
+			}
+		case syscall.EINTR:
+		case syscall.EAGAIN:
+			// let the poller read into inputBuffer until any data arrives
+			if err = c.waitRead(1); err != nil {
+				return written, err
+			}
+		case syscall.ENOSYS, syscall.EINVAL, syscall.EOPNOTSUPP:
+			return written, errSpliceUnsupported
+		default:
+			return written, Exception(err, "when splice")
+		}
+	}
+	return written, nil
+}
+
+// spliceFrom moves all the size bytes in the pipe to the connection.
+func (c *connection) spliceFrom(rfd, size int) (moved int, err error) {
+	for moved < size {
+		m, err := unix.Splice(rfd, nil, c.fd, nil, size-moved, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+		if m > 0 {
+			moved += int(m)
+			atomic.AddUint64(&c.outputBytes, uint64(m))
+		}
+		switch err {
+		case nil, syscall.EINTR:
+		case syscall.EAGAIN:
+			if err = c.operator.Control(PollR2RW); err != nil {
+				return moved, Exception(err, "when splice")
+			}
+			if err = c.waitFlush(); err != nil {
+				return moved, err
+			}
+		default:
+			return moved, Exception(err, "when splice")
+		}
+	}
+	return moved, nil
+}
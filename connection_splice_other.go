@@ -0,0 +1,27 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package netpoll
+
+import "errors"
+
+var errSpliceUnsupported = errors.New("splice is not supported")
+
+// splice is only supported on Linux, other platforms fallback to copy.
+func (c *connection) splice(dst *connection, n int) (written int64, err error) {
+	return 0, errSpliceUnsupported
+}
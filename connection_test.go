@@ -18,11 +18,18 @@
 package netpoll
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
@@ -56,6 +63,83 @@ func BenchmarkConnectionIO(b *testing.B) {
 	}
 }
 
+func BenchmarkConnectionReadChunkSize(b *testing.B) {
+	streamSize := 1 << 30
+	for _, chunk := range []int{0, block4k, 64 * block1k, 1024 * block1k} {
+		b.Run(fmt.Sprintf("chunk=%d", chunk), func(b *testing.B) {
+			r, w := GetSysFdPairs()
+			rconn := &connection{}
+			rconn.init(&netFD{fd: r}, &options{})
+			defer rconn.Close()
+			defer syscall.Close(w)
+			rconn.SetReadChunkSize(chunk)
+			// each ack is a read syscall, it's replaced before any data is written
+			var reads int64
+			inputAck := rconn.operator.InputAck
+			rconn.operator.InputAck = func(n int) error {
+				atomic.AddInt64(&reads, 1)
+				return inputAck(n)
+			}
+			go func() {
+				msg := make([]byte, 256*block1k)
+				for {
+					if _, err := syscall.Write(w, msg); err != nil && err != syscall.EAGAIN {
+						return
+					}
+				}
+			}()
+
+			b.SetBytes(int64(streamSize))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				n, err := rconn.Reader().Discard(streamSize)
+				if err != nil || n != streamSize {
+					b.Fatalf("discard %d: %v", n, err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(atomic.LoadInt64(&reads))/float64(b.N), "syscalls/op")
+		})
+	}
+}
+
+func BenchmarkConnectionFixedOutputBuffer(b *testing.B) {
+	for _, fixed := range []int{0, 64 * block1k} {
+		b.Run(fmt.Sprintf("fixed=%d", fixed), func(b *testing.B) {
+			r, w := GetSysFdPairs()
+			defer syscall.Close(r)
+			wconn := &connection{}
+			wconn.init(&netFD{fd: w}, &options{fixedOutput: fixed})
+			defer wconn.Close()
+			go func() {
+				buf := make([]byte, 64*block1k)
+				for {
+					if _, err := syscall.Read(r, buf); err != nil && err != syscall.EAGAIN {
+						return
+					}
+				}
+			}()
+
+			// steady small writes, the first ones warm up the pools
+			msg := make([]byte, 64)
+			for i := 0; i < 1000; i++ {
+				wconn.WriteBinary(msg)
+				wconn.Flush()
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := wconn.WriteBinary(msg); err != nil {
+					b.Fatal(err)
+				}
+				if err := wconn.Flush(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func TestConnectionWrite(t *testing.T) {
 	cycle, caps := 10000, 256
 	msg, buf := make([]byte, caps), make([]byte, caps)
@@ -88,20 +172,358 @@ func TestConnectionWrite(t *testing.T) {
 	rconn.Close()
 }
 
-func TestConnectionLargeWrite(t *testing.T) {
-	// ci machine don't have 4GB memory, so skip test
-	t.Skipf("skip large write test for ci job")
-	totalSize := 1024 * 1024 * 1024 * 4
+func TestConnectionWriteCoalesce(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, &options{})
+	wconn.init(&netFD{fd: w}, &options{})
+	defer rconn.Close()
+	defer wconn.Close()
+	MustNil(t, wconn.SetWriteCoalesce(time.Millisecond))
+
+	writers, cycle := 8, 200
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < cycle; i++ {
+				n, err := wconn.Write([]byte(fmt.Sprintf("%02d%06d", g, i)))
+				MustNil(t, err)
+				Equal(t, n, 8)
+			}
+		}(g)
+	}
+	// the order of each goroutine is preserved
+	next := make([]int, writers)
+	for k := 0; k < writers*cycle; k++ {
+		p, err := rconn.Reader().Next(8)
+		MustNil(t, err)
+		var g, i int
+		_, err = fmt.Sscanf(string(p), "%02d%06d", &g, &i)
+		MustNil(t, err)
+		Equal(t, i, next[g])
+		next[g]++
+	}
+	wg.Wait()
+	MustTrue(t, wconn.coalescer.rounds < uint64(writers*cycle))
+
+	// Flush returns after the data is written
+	_, err := wconn.Writer().WriteString("flush")
+	MustNil(t, err)
+	MustNil(t, wconn.Flush())
+	Equal(t, wconn.outputBuffer.Len(), 0)
+	p, err := rconn.Reader().Next(5)
+	MustNil(t, err)
+	Equal(t, string(p), "flush")
+
+	// disabled
+	MustNil(t, wconn.SetWriteCoalesce(0))
+	rounds := wconn.coalescer.rounds
+	_, err = wconn.Write([]byte("direct"))
+	MustNil(t, err)
+	Equal(t, wconn.coalescer.rounds, rounds)
+	p, err = rconn.Reader().Next(6)
+	MustNil(t, err)
+	Equal(t, string(p), "direct")
+
+	MustNil(t, wconn.SetWriteCoalesce(time.Millisecond))
+	wconn.Close()
+	_, err = wconn.Write([]byte("closed"))
+	MustTrue(t, errors.Is(err, ErrConnClosed))
+}
+
+func TestConnectionWriteCoalesceOrder(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, &options{})
+	wconn.init(&netFD{fd: w}, &options{})
+	defer rconn.Close()
+	defer wconn.Close()
+	MustNil(t, wconn.SetWriteCoalesce(20*time.Millisecond))
+
+	// the Write pushed before the Flush is sent before the data of Writer
+	written := make(chan error, 1)
+	go func() {
+		_, err := wconn.Write([]byte("A"))
+		written <- err
+	}()
+	for atomic.LoadPointer(&wconn.coalescer.head) == nil {
+		runtime.Gosched()
+	}
+	_, err := wconn.Writer().WriteString("B")
+	MustNil(t, err)
+	MustNil(t, wconn.Writer().Flush())
+	MustNil(t, <-written)
+	p, err := rconn.Reader().Next(2)
+	MustNil(t, err)
+	Equal(t, string(p), "AB")
+
+	// the Writes are mixed with the Flushes of Writer, which is used by one goroutine
+	MustNil(t, wconn.SetWriteCoalesce(time.Millisecond))
+	writers, cycle := 4, 200
+	var wg sync.WaitGroup
+	for g := 0; g <= writers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < cycle; i++ {
+				msg := fmt.Sprintf("%02d%06d", g, i)
+				if g < writers {
+					_, err := wconn.Write([]byte(msg))
+					MustNil(t, err)
+					continue
+				}
+				// the message of Writer is split by Malloc to check that it's not interleaved
+				buf, err := wconn.Writer().Malloc(4)
+				MustNil(t, err)
+				copy(buf, msg[:4])
+				_, err = wconn.Writer().WriteString(msg[4:])
+				MustNil(t, err)
+				MustNil(t, wconn.Writer().Flush())
+			}
+		}(g)
+	}
+	next := make([]int, writers+1)
+	for k := 0; k < (writers+1)*cycle; k++ {
+		p, err := rconn.Reader().Next(8)
+		MustNil(t, err)
+		var g, i int
+		_, err = fmt.Sscanf(string(p), "%02d%06d", &g, &i)
+		MustNil(t, err)
+		Equal(t, i, next[g])
+		next[g]++
+	}
+	wg.Wait()
+	Equal(t, wconn.outputBuffer.Len(), 0)
+}
+
+func BenchmarkConnectionWriteCoalesce(b *testing.B) {
+	for _, window := range []time.Duration{0, 50 * time.Microsecond} {
+		b.Run(fmt.Sprintf("window=%v", window), func(b *testing.B) {
+			r, w := GetSysFdPairs()
+			rconn, wconn := &connection{}, &connection{}
+			rconn.init(&netFD{fd: r}, &options{})
+			wconn.init(&netFD{fd: w}, &options{})
+			defer rconn.Close()
+			defer wconn.Close()
+			wconn.SetWriteCoalesce(window)
+			go func() {
+				for {
+					if _, err := rconn.Reader().Next(rconn.Reader().Len()); err != nil {
+						return
+					}
+					rconn.Reader().Release()
+					if _, err := rconn.Reader().Peek(1); err != nil {
+						return
+					}
+				}
+			}()
+
+			// without coalescing, the writers must be serialized and each Write makes a syscall
+			var mu sync.Mutex
+			msg := make([]byte, 64)
+			b.SetParallelism(8)
+			calls := atomic.LoadUint64(&wconn.writeCalls)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if window == 0 {
+						mu.Lock()
+						wconn.Write(msg)
+						mu.Unlock()
+					} else {
+						wconn.Write(msg)
+					}
+				}
+			})
+			b.StopTimer()
+			b.ReportMetric(float64(atomic.LoadUint64(&wconn.writeCalls)-calls)/float64(b.N), "syscalls/op")
+		})
+	}
+}
+
+func BenchmarkConnectionWriteCoalesceWriters(b *testing.B) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, &options{})
+	wconn.init(&netFD{fd: w}, &options{})
+	defer rconn.Close()
+	defer wconn.Close()
+	wconn.SetWriteCoalesce(20 * time.Microsecond)
+	go func() {
+		for {
+			if _, err := rconn.Reader().Next(rconn.Reader().Len()); err != nil {
+				return
+			}
+			rconn.Reader().Release()
+			if _, err := rconn.Reader().Peek(1); err != nil {
+				return
+			}
+		}
+	}()
+
+	// the writers contend for the write path of the same connection
+	const writers = 16
+	msg := make([]byte, 64)
+	var left int64 = int64(b.N)
+	var wg sync.WaitGroup
+	runtime.SetMutexProfileFraction(1)
+	defer runtime.SetMutexProfileFraction(0)
+	contention := mutexContentionCycles()
+	b.ResetTimer()
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.AddInt64(&left, -1) >= 0 {
+				wconn.Write(msg)
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/float64(atomic.LoadUint64(&wconn.coalescer.rounds)), "writes/round")
+	b.ReportMetric(float64(mutexContentionCycles()-contention)/float64(b.N), "contention-cycles/op")
+}
+
+// mutexContentionCycles returns the cycles blocked on the contended mutexes recorded by the mutex profile.
+func mutexContentionCycles() (cycles int64) {
+	n, _ := runtime.MutexProfile(nil)
+	records := make([]runtime.BlockProfileRecord, n+64)
+	n, _ = runtime.MutexProfile(records)
+	for _, r := range records[:n] {
+		cycles += r.Cycles
+	}
+	return cycles
+}
+
+func TestConnectionReadBufferThreshold(t *testing.T) {
+	threshold := 64 * 1024
+	r, w := GetSysFdPairs()
+	rconn := &connection{}
+	rconn.init(&netFD{fd: r}, &options{})
+	defer rconn.Close()
+	defer syscall.Close(w)
+	err := rconn.SetReadBufferThreshold(threshold)
+	MustNil(t, err)
+
+	// write until the kernel buffers are full
+	err = syscall.SetNonblock(w, true)
+	MustNil(t, err)
+	msg := make([]byte, block4k)
+	written, stalled := 0, 0
+	for stalled < 10 {
+		n, err := syscall.Write(w, msg)
+		if err == syscall.EAGAIN {
+			stalled++
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		MustNil(t, err)
+		written += n
+	}
+	// the unread data is limited in the kernel rather than process memory
+	length := rconn.Reader().Len()
+	t.Logf("written=%d, buffered=%d", written, length)
+	MustTrue(t, length >= threshold)
+	MustTrue(t, length < 4*threshold)
+	MustTrue(t, written > length)
+
+	// reading is resumed once the buffer is drained
+	for read := 0; read < written; {
+		n := written - read
+		if n > block1k {
+			n = block1k
+		}
+		_, err = rconn.Reader().Next(n)
+		MustNil(t, err)
+		read += n
+		MustTrue(t, rconn.Reader().Len() < 4*threshold)
+	}
+	Equal(t, rconn.Reader().Len(), 0)
+
+	// waiting for more data than the threshold also resumes reading
+	go func() {
+		for sent := 0; sent < 2*threshold; {
+			n, err := syscall.Write(w, msg)
+			if err == syscall.EAGAIN {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			MustNil(t, err)
+			sent += n
+		}
+	}()
+	_, err = rconn.Reader().Next(2 * threshold)
+	MustNil(t, err)
+}
+
+func TestConnectionSetReadLimit(t *testing.T) {
+	limit := 512 * 1024
+	r, w := GetSysFdPairs()
+	rconn := &connection{}
+	rconn.init(&netFD{fd: r}, &options{})
+	defer rconn.Close()
+	defer syscall.Close(w)
+	MustNil(t, rconn.SetReadLimit(limit))
+
+	// the sender is never blocked by itself
+	stop := make(chan struct{})
+	defer close(stop)
+	MustNil(t, syscall.SetNonblock(w, true))
+	go func() {
+		msg := make([]byte, block32k)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := syscall.Write(w, msg); err == syscall.EAGAIN {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	// the sustained rate stays near the limit after the burst
+	start := time.Now()
+	for read := 0; read < limit; read += block4k {
+		_, err := rconn.Reader().Next(block4k)
+		MustNil(t, err)
+		MustNil(t, rconn.Reader().Release())
+	}
+	elapsed := time.Since(start)
+	t.Logf("read %d bytes in %v", limit, elapsed)
+	MustTrue(t, elapsed > 750*time.Millisecond)
+	MustTrue(t, elapsed < 1500*time.Millisecond)
+	MustTrue(t, rconn.InputBytes() < uint64(limit+limit/2))
+
+	// no limit after cleared
+	MustNil(t, rconn.SetReadLimit(0))
+	start = time.Now()
+	for read := 0; read < 4*limit; read += block4k {
+		_, err := rconn.Reader().Next(block4k)
+		MustNil(t, err)
+		MustNil(t, rconn.Reader().Release())
+	}
+	MustTrue(t, time.Since(start) < 500*time.Millisecond)
+}
+
+func TestConnectionBytesCounter(t *testing.T) {
+	size := 1024
 	var wg sync.WaitGroup
 	wg.Add(1)
 	opts := &options{}
 	opts.onRequest = func(ctx context.Context, connection Connection) error {
-		if connection.Reader().Len() < totalSize {
+		if connection.Reader().Len() < size {
 			return nil
 		}
-		_, err := connection.Reader().Next(totalSize)
+		_, err := connection.Reader().Next(size)
 		MustNil(t, err)
-		err = connection.Reader().Release()
+		_, err = connection.Writer().WriteString("pong")
+		MustNil(t, err)
+		err = connection.Writer().Flush()
 		MustNil(t, err)
 		wg.Done()
 		return nil
@@ -110,47 +532,1035 @@ func TestConnectionLargeWrite(t *testing.T) {
 	r, w := GetSysFdPairs()
 	rconn, wconn := &connection{}, &connection{}
 	rconn.init(&netFD{fd: r}, opts)
-	wconn.init(&netFD{fd: w}, opts)
+	wconn.init(&netFD{fd: w}, &options{})
+	defer rconn.Close()
+	defer wconn.Close()
+	Equal(t, wconn.OutputBytes(), uint64(0))
+
+	for i := 0; i < 4; i++ {
+		_, err := wconn.Write(make([]byte, size/4))
+		MustNil(t, err)
+	}
+	wg.Wait()
+	Equal(t, rconn.InputBytes(), uint64(size))
+	Equal(t, rconn.OutputBytes(), uint64(4))
+	Equal(t, wconn.OutputBytes(), uint64(size))
+	_, err := wconn.Reader().Next(4)
+	MustNil(t, err)
+	Equal(t, wconn.InputBytes(), uint64(4))
+}
+
+func TestConnectionSendfile(t *testing.T) {
+	// larger than the socket buffer
+	size := 8 * 1024 * 1024
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	f, err := ioutil.TempFile("", "netpoll_sendfile")
+	MustNil(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.Write(data)
+	MustNil(t, err)
+
+	header, offset := "header", 1
+	expect := header + string(data[offset:])
+	for _, send := range []func(c *connection) (int64, error){
+		func(c *connection) (int64, error) {
+			return c.Sendfile(f, int64(offset), int64(size))
+		},
+		func(c *connection) (int64, error) {
+			// fallback without sendfile
+			if err := c.Flush(); err != nil {
+				return 0, err
+			}
+			return c.copyFile(f, int64(offset), int64(size))
+		},
+	} {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		received := make([]byte, 0, len(expect))
+		opts := &options{}
+		opts.onRequest = func(ctx context.Context, connection Connection) error {
+			buf, err := connection.Reader().Next(connection.Reader().Len())
+			MustNil(t, err)
+			received = append(received, buf...)
+			if len(received) >= len(expect) {
+				wg.Done()
+			}
+			return nil
+		}
+		r, w := GetSysFdPairs()
+		rconn, wconn := &connection{}, &connection{}
+		rconn.init(&netFD{fd: r}, opts)
+		wconn.init(&netFD{fd: w}, &options{})
+
+		// the pending data is sent before the file
+		_, err = wconn.Writer().WriteString(header)
+		MustNil(t, err)
+		n, err := send(wconn)
+		MustNil(t, err)
+		Equal(t, n, int64(size-offset)) // stop at EOF
+		wg.Wait()
+		MustTrue(t, string(received) == expect)
+		wconn.Close()
+		rconn.Close()
+	}
+}
+
+func TestConnectionSplice(t *testing.T) {
+	// larger than the socket buffer
+	size := 8 * 1024 * 1024
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	for _, move := range []func(src, dst *connection, n int) (int64, error){
+		func(src, dst *connection, n int) (int64, error) {
+			return src.Splice(dst, n)
+		},
+		func(src, dst *connection, n int) (int64, error) {
+			// fallback without splice
+			return src.copyN(dst, n)
+		},
+	} {
+		// client => src, dst => server
+		client, src, dst, server := newSplicePipeline()
+
+		// the data in Reader is moved before the socket
+		_, err := client.Writer().WriteBinary(data[:1024])
+		MustNil(t, err)
+		MustNil(t, client.Writer().Flush())
+		_, err = src.Peek(1024)
+		MustNil(t, err)
+		go func() {
+			_, err := client.Writer().WriteBinary(data[1024:])
+			MustNil(t, err)
+			MustNil(t, client.Writer().Flush())
+			client.Close()
+		}()
+		// the pending data of dst is sent first
+		_, err = dst.Writer().WriteString("header")
+		MustNil(t, err)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf, err := server.Reader().Next(len("header") + size)
+			MustNil(t, err)
+			Equal(t, string(buf[:len("header")]), "header")
+			MustTrue(t, string(buf[len("header"):]) == string(data))
+		}()
+		n, err := move(src, dst, size-1)
+		MustNil(t, err)
+		Equal(t, n, int64(size-1))
+		// stop at EOF
+		n, err = move(src, dst, size)
+		MustTrue(t, errors.Is(err, ErrEOF))
+		Equal(t, n, int64(1))
+		wg.Wait()
+		Equal(t, dst.OutputBytes(), uint64(len("header")+size))
+		src.Close()
+		dst.Close()
+		server.Close()
+	}
+}
+
+func BenchmarkConnectionSplice(b *testing.B) {
+	chunk := 64 * 1024
+	data := make([]byte, chunk)
+	for _, bc := range []struct {
+		name string
+		move func(src, dst *connection, n int) (int64, error)
+	}{
+		{"splice", func(src, dst *connection, n int) (int64, error) { return src.Splice(dst, n) }},
+		{"copy", func(src, dst *connection, n int) (int64, error) { return src.copyN(dst, n) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			client, src, dst, server := newSplicePipeline()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					client.Writer().WriteBinary(data)
+					if client.Writer().Flush() != nil {
+						return
+					}
+				}
+			}()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for left := b.N * chunk; left > 0; {
+					if server.Reader().Len() == 0 {
+						if _, err := server.Reader().Peek(1); err != nil {
+							return
+						}
+					}
+					size := server.Reader().Len()
+					server.Reader().Skip(size)
+					server.Reader().Release()
+					left -= size
+				}
+			}()
+
+			b.SetBytes(int64(chunk))
+			b.ResetTimer()
+			_, err := bc.move(src, dst, b.N*chunk)
+			<-done
+			b.StopTimer()
+			if err != nil {
+				b.Fatal(err)
+			}
+			client.Close()
+			src.Close()
+			dst.Close()
+			server.Close()
+		})
+	}
+}
+
+// newSplicePipeline returns two pairs of connected connections: client => src and dst => server.
+func newSplicePipeline() (client, src, dst, server *connection) {
+	client, src, dst, server = &connection{}, &connection{}, &connection{}, &connection{}
+	cfd, sfd := GetSysFdPairs()
+	client.init(&netFD{fd: cfd}, &options{})
+	src.init(&netFD{fd: sfd}, &options{})
+	dfd, rfd := GetSysFdPairs()
+	dst.init(&netFD{fd: dfd}, &options{})
+	server.init(&netFD{fd: rfd}, &options{})
+	return client, src, dst, server
+}
+
+func TestConnectionCloseWrite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	MustNil(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		MustNil(t, err)
+		defer conn.Close()
+		// read until EOF
+		req, err := ioutil.ReadAll(conn)
+		MustNil(t, err)
+		Equal(t, string(req), "request")
+		_, err = conn.Write([]byte("response"))
+		MustNil(t, err)
+	}()
+
+	conn, err := DialConnection("tcp", ln.Addr().String(), time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	_, err = conn.Writer().WriteString("request")
+	MustNil(t, err)
+	// pending data is flushed before shutdown
+	err = conn.CloseWrite()
+	MustNil(t, err)
+	MustTrue(t, conn.IsActive())
+
+	// read side is still open
+	s, err := conn.Reader().ReadString(len("response"))
+	MustNil(t, err)
+	Equal(t, s, "response")
+	_, err = conn.Reader().Next(1)
+	MustTrue(t, errors.Is(err, ErrEOF))
+}
+
+func TestConnectionCloseWithReset(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	MustNil(t, err)
+	defer ln.Close()
+	result := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		MustNil(t, err)
+		defer conn.Close()
+		_, err = ioutil.ReadAll(conn)
+		result <- err
+	}()
+
+	conn, err := DialConnection("tcp", ln.Addr().String(), time.Second)
+	MustNil(t, err)
+	MustNil(t, conn.CloseWithReset())
+	MustTrue(t, !conn.IsActive())
+	err = <-result
+	Assert(t, errors.Is(err, syscall.ECONNRESET), err)
+	err = conn.CloseWithReset()
+	MustTrue(t, errors.Is(err, ErrConnClosed))
+}
+
+func TestConnectionCloseReason(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	MustNil(t, err)
+	defer ln.Close()
+	dial := func() (Connection, net.Conn, chan error) {
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			peer, err := ln.Accept()
+			MustNil(t, err)
+			accepted <- peer
+		}()
+		conn, err := DialConnection("tcp", ln.Addr().String(), time.Second)
+		MustNil(t, err)
+		reasons := make(chan error, 1)
+		MustNil(t, conn.AddCloseReasonCallback(func(connection Connection, reason error) error {
+			reasons <- reason
+			return nil
+		}))
+		return conn, <-accepted, reasons
+	}
+	closeByPeer := func(conn Connection) {
+		for conn.IsActive() {
+			time.Sleep(time.Millisecond)
+		}
+		MustNil(t, conn.Close())
+	}
+
+	// graceful close by the user
+	conn, peer, reasons := dial()
+	MustNil(t, conn.Close())
+	err = <-reasons
+	Assert(t, err == nil, err)
+	peer.Close()
+
+	// graceful close by the peer
+	conn, peer, reasons = dial()
+	MustNil(t, peer.Close())
+	closeByPeer(conn)
+	err = <-reasons
+	Assert(t, errors.Is(err, ErrEOF), err)
+
+	// reset by the peer
+	conn, peer, reasons = dial()
+	MustNil(t, peer.(*net.TCPConn).SetLinger(0))
+	MustNil(t, peer.Close())
+	closeByPeer(conn)
+	err = <-reasons
+	Assert(t, errors.Is(err, syscall.ECONNRESET) && errors.Is(err, ErrConnReset), err)
+
+	// the keepalive of SetIdleTimeout cannot time out on loopback since the peer always acks,
+	// so the poller hangs up with ETIMEDOUT as the socket reading does after the keepalive probes fail
+	conn, peer, reasons = dial()
+	c := conn.(*TCPConnection)
+	MustNil(t, c.operator.Control(PollDetach))
+	c.operator.setHupErr(syscall.ETIMEDOUT)
+	MustNil(t, c.onHup(nil))
+	closeByPeer(conn)
+	err = <-reasons
+	var nerr net.Error
+	Assert(t, errors.Is(err, syscall.ETIMEDOUT) && errors.As(err, &nerr) && nerr.Timeout(), err)
+	peer.Close()
+
+	// write timeout, and the later close by the user doesn't change the reason
+	conn, peer, reasons = dial()
+	MustNil(t, conn.SetWriteTimeout(10*time.Millisecond))
+	_, err = conn.Writer().Malloc(64 * 1024 * 1024)
+	MustNil(t, err)
+	err = conn.Writer().Flush()
+	MustTrue(t, errors.Is(err, ErrWriteTimeout))
+	conn.Close()
+	err = <-reasons
+	Assert(t, errors.Is(err, ErrWriteTimeout), err)
+	peer.Close()
+}
+
+func TestConnectionInterruptRead(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	MustNil(t, err)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		MustNil(t, err)
+		accepted <- conn
+	}()
+	conn, err := DialConnection("tcp", ln.Addr().String(), time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	peer := <-accepted
+	defer peer.Close()
+
+	// the received bytes are kept by the interrupted read
+	_, err = peer.Write([]byte("he"))
+	MustNil(t, err)
+	waiting := func() bool {
+		return atomic.LoadInt32(&conn.(*TCPConnection).readWaiter) == 1
+	}
+	for _, timeout := range []time.Duration{0, time.Second} {
+		MustNil(t, conn.SetReadTimeout(timeout))
+		go func() {
+			for !waiting() {
+				runtime.Gosched()
+			}
+			MustNil(t, conn.InterruptRead())
+		}()
+		_, err = conn.Reader().Next(5)
+		Assert(t, errors.Is(err, ErrInterrupted), err)
+		MustTrue(t, conn.IsActive())
+	}
+
+	_, err = peer.Write([]byte("llo"))
+	MustNil(t, err)
+	buf, err := conn.Reader().Next(5)
+	MustNil(t, err)
+	Equal(t, string(buf), "hello")
+
+	// it does nothing if no read is waiting
+	MustNil(t, conn.InterruptRead())
+	MustTrue(t, !waiting())
+	_, err = peer.Write([]byte("!"))
+	MustNil(t, err)
+	buf, err = conn.Reader().Next(1)
+	MustNil(t, err)
+	Equal(t, string(buf), "!")
+
+	MustNil(t, conn.Close())
+	err = conn.InterruptRead()
+	MustTrue(t, errors.Is(err, ErrConnClosed))
+}
+
+func TestConnectionAsReader(t *testing.T) {
+	type message struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	MustNil(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		MustNil(t, err)
+		defer conn.Close()
+		// the objects are split across the writes
+		stream := `{"id":1,"name":"a"}{"id":2,` + "\n" + `"name":"b"} {"id":3,"name":"c"}`
+		for i := 0; i < len(stream); i += 7 {
+			end := i + 7
+			if end > len(stream) {
+				end = len(stream)
+			}
+			_, err = conn.Write([]byte(stream[i:end]))
+			MustNil(t, err)
+			time.Sleep(time.Millisecond)
+		}
+		var reply message
+		MustNil(t, json.NewDecoder(conn).Decode(&reply))
+		Equal(t, reply.ID, 4)
+	}()
+
+	conn, err := DialConnection("tcp", ln.Addr().String(), time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	dec := json.NewDecoder(conn.AsReader())
+	var msgs []message
+	for {
+		var msg message
+		if err = dec.Decode(&msg); err == io.EOF {
+			break
+		}
+		MustNil(t, err)
+		msgs = append(msgs, msg)
+		if len(msgs) == 3 {
+			MustNil(t, json.NewEncoder(conn.AsWriter()).Encode(message{ID: 4}))
+		}
+	}
+	Equal(t, fmt.Sprint(msgs), "[{1 a} {2 b} {3 c}]")
+}
+
+func TestConnectionWriteAndClose(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	resp := bytes.Repeat([]byte("0123456789abcdef"), 16*1024)
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			if _, err := connection.Reader().Next(len("request")); err != nil {
+				return err
+			}
+			// the pending data in Writer is sent before data
+			connection.Writer().WriteBinary(resp[:100])
+			return connection.WriteAndClose(resp[100:])
+		})
+	defer loop.Shutdown(context.Background())
+
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial(network, address)
+		MustNil(t, err)
+		_, err = conn.Write([]byte("request"))
+		MustNil(t, err)
+		// EOF is read only after the whole response
+		buf, err := ioutil.ReadAll(conn)
+		MustNil(t, err)
+		Assert(t, bytes.Equal(buf, resp), i, len(buf))
+		conn.Close()
+	}
+
+	// the input that is never read doesn't reset the connection before the response is read
+	for i := 0; i < 10; i++ {
+		conn, err := net.Dial(network, address)
+		MustNil(t, err)
+		_, err = conn.Write([]byte("request"))
+		MustNil(t, err)
+		stop := make(chan struct{})
+		go func() {
+			junk := make([]byte, 1024)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := conn.Write(junk); err != nil {
+					return
+				}
+			}
+		}()
+		buf, err := ioutil.ReadAll(conn)
+		close(stop)
+		MustNil(t, err)
+		Assert(t, bytes.Equal(buf, resp), i, len(buf))
+		conn.Close()
+	}
+
+	conn, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	MustNil(t, conn.Close())
+	err = conn.WriteAndClose(resp)
+	MustTrue(t, errors.Is(err, ErrConnClosed))
+}
+
+func TestConnectionWritevDirect(t *testing.T) {
+	// each sendmsg is received as a single packet by SOCK_SEQPACKET socket
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	MustNil(t, err)
+	r, w := fds[0], fds[1]
+	defer syscall.Close(r)
+	wconn := &connection{}
+	wconn.init(&netFD{fd: w}, &options{})
+	defer wconn.Close()
+
+	header, _ := wconn.Writer().Malloc(2)
+	copy(header, "ab")
+	err = wconn.Writer().WritevDirect([][]byte{[]byte("cde"), []byte("fghi"), []byte("jklmn")})
+	MustNil(t, err)
+	err = wconn.Writer().Flush()
+	MustNil(t, err)
+
+	buf := make([]byte, 64)
+	n, err := syscall.Read(r, buf)
+	MustNil(t, err)
+	Equal(t, string(buf[:n]), "abcdefghijklmn")
+}
+
+func TestConnectionLargeWrite(t *testing.T) {
+	// ci machine don't have 4GB memory, so skip test
+	t.Skipf("skip large write test for ci job")
+	totalSize := 1024 * 1024 * 1024 * 4
+	var wg sync.WaitGroup
+	wg.Add(1)
+	opts := &options{}
+	opts.onRequest = func(ctx context.Context, connection Connection) error {
+		if connection.Reader().Len() < totalSize {
+			return nil
+		}
+		_, err := connection.Reader().Next(totalSize)
+		MustNil(t, err)
+		err = connection.Reader().Release()
+		MustNil(t, err)
+		wg.Done()
+		return nil
+	}
+
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, opts)
+	wconn.init(&netFD{fd: w}, opts)
+
+	msg := make([]byte, totalSize/4)
+	for i := 0; i < 4; i++ {
+		_, err := wconn.Writer().WriteBinary(msg)
+		MustNil(t, err)
+	}
+	wg.Wait()
+
+	rconn.Close()
+}
+
+func TestConnectionRead(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	err := rconn.init(&netFD{fd: r}, nil)
+	MustNil(t, err)
+	err = wconn.init(&netFD{fd: w}, nil)
+	MustNil(t, err)
+
+	size := 256
+	cycleTime := 1000
+	msg := make([]byte, size)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < cycleTime; i++ {
+			buf, err := rconn.Reader().Next(size)
+			MustNil(t, err)
+			Equal(t, len(buf), size)
+			rconn.Reader().Release()
+		}
+	}()
+	for i := 0; i < cycleTime; i++ {
+		n, err := wconn.Write(msg)
+		MustNil(t, err)
+		Equal(t, n, len(msg))
+	}
+	wg.Wait()
+	rconn.Close()
+}
+
+func TestConnectionPeek(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, &options{})
+	wconn.init(&netFD{fd: w}, &options{})
+	defer rconn.Close()
+	defer wconn.Close()
+
+	// the length prefix and the payload arrive separately, so they are in different nodes
+	header := []byte{0, 0, 0, 5}
+	go func() {
+		_, err := wconn.Write(header)
+		MustNil(t, err)
+		time.Sleep(10 * time.Millisecond)
+		_, err = wconn.Write([]byte("hello"))
+		MustNil(t, err)
+	}()
+
+	// Peek blocks until enough data and doesn't advance the reader
+	p, err := rconn.Reader().Peek(4)
+	MustNil(t, err)
+	Equal(t, string(p), string(header))
+	p, err = rconn.Reader().Peek(4 + 5)
+	MustNil(t, err)
+	Equal(t, string(p[4:]), "hello")
+	Equal(t, rconn.Reader().Len(), 4+5)
+
+	p, err = rconn.Reader().Next(4 + 5)
+	MustNil(t, err)
+	Equal(t, string(p), string(header)+"hello")
+	Equal(t, rconn.Reader().Len(), 0)
+}
+
+func TestConnectionTryNext(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, &options{})
+	wconn.init(&netFD{fd: w}, &options{})
+	defer rconn.Close()
+	defer wconn.Close()
+
+	// TryNext never blocks without data
+	start := time.Now()
+	_, err := rconn.Reader().TryNext(1)
+	MustTrue(t, errors.Is(err, ErrNotEnough))
+	MustTrue(t, time.Since(start) < 50*time.Millisecond)
+
+	// drain all the pipelined messages from one wakeup
+	_, err = wconn.Write([]byte("ping1ping2ping3p"))
+	MustNil(t, err)
+	_, err = rconn.Reader().Peek(1)
+	MustNil(t, err)
+	for rconn.Reader().Len() < 16 {
+		runtime.Gosched()
+	}
+	var msgs []string
+	for {
+		p, err := rconn.Reader().TryNext(5)
+		if err != nil {
+			MustTrue(t, errors.Is(err, ErrNotEnough))
+			break
+		}
+		msgs = append(msgs, string(p))
+	}
+	Equal(t, len(msgs), 3)
+	Equal(t, msgs[2], "ping3")
+	Equal(t, rconn.Reader().Len(), 1)
+}
+
+func TestConnectionWaitReadSize(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, &options{})
+	wconn.init(&netFD{fd: w}, &options{})
+	defer rconn.Close()
+
+	// the data accumulates across the nodes of multiple reads
+	chunk := 8 * 1024
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for i := 0; i < 3; i++ {
+			msg := make([]byte, chunk)
+			for j := range msg {
+				msg[j] = byte(i)
+			}
+			wconn.Write(msg)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	MustNil(t, rconn.Reader().WaitReadSize(3*chunk))
+	Equal(t, rconn.Reader().Len(), 3*chunk)
+	MustNil(t, rconn.Reader().WaitReadSize(chunk))
+	Equal(t, rconn.Reader().Len(), 3*chunk)
+	for i := 0; i < 3; i++ {
+		p, err := rconn.Reader().Next(chunk)
+		MustNil(t, err)
+		Equal(t, p[0], byte(i))
+		Equal(t, p[chunk-1], byte(i))
+	}
+	MustNil(t, rconn.Reader().Release())
+
+	// it fails if the peer closes before enough
+	<-written
+	wconn.Write([]byte("hello"))
+	MustNil(t, rconn.Reader().WaitReadSize(5))
+	Equal(t, rconn.Reader().Len(), 5)
+	wconn.Close()
+	err := rconn.Reader().WaitReadSize(6)
+	MustTrue(t, errors.Is(err, ErrEOF))
+}
+
+func TestConnectionDiscard(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, &options{})
+	wconn.init(&netFD{fd: w}, &options{})
+	defer rconn.Close()
+
+	// the skipped field is much larger than a node and arrives in multiple writes
+	chunk, count := 16*1024, 16
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		wconn.Write([]byte("hd"))
+		for i := 0; i < count; i++ {
+			wconn.Write(make([]byte, chunk))
+			time.Sleep(time.Millisecond)
+		}
+		wconn.Write([]byte("body"))
+	}()
+	p, err := rconn.Reader().Next(2)
+	MustNil(t, err)
+	Equal(t, string(p), "hd")
+	n, err := rconn.Reader().Discard(count * chunk)
+	MustNil(t, err)
+	Equal(t, n, count*chunk)
+	p, err = rconn.Reader().Next(4)
+	MustNil(t, err)
+	Equal(t, string(p), "body")
+
+	// it returns the skipped count if the peer closes before n bytes
+	<-written
+	wconn.Write([]byte("abc"))
+	wconn.Close()
+	n, err = rconn.Reader().Discard(5)
+	MustTrue(t, errors.Is(err, ErrEOF))
+	Equal(t, n, 3)
+}
+
+func TestConnectionDiscardAll(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn := &connection{}
+	rconn.init(&netFD{fd: r}, &options{})
+	defer rconn.Close()
+	defer syscall.Close(w)
+
+	// the buffered data is larger than a node
+	size := 4 * defaultLinkBufferSize
+	_, err := syscall.Write(w, make([]byte, size))
+	MustNil(t, err)
+	MustNil(t, rconn.Reader().WaitReadSize(size))
+	n, err := rconn.Reader().DiscardAll()
+	MustNil(t, err)
+	Equal(t, n, size)
+	Equal(t, rconn.Reader().Len(), 0)
+	MustTrue(t, rconn.inputBuffer.head == rconn.inputBuffer.read)
+
+	// it doesn't wait for more data
+	n, err = rconn.Reader().DiscardAll()
+	MustNil(t, err)
+	Equal(t, n, 0)
+	_, err = syscall.Write(w, []byte("resync"))
+	MustNil(t, err)
+	p, err := rconn.Reader().Next(6)
+	MustNil(t, err)
+	Equal(t, string(p), "resync")
+}
+
+func TestConnectionWriteTo(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, &options{})
+	wconn.init(&netFD{fd: w}, &options{})
+	defer rconn.Close()
+
+	// the payload is much larger than the input buffer and copied until the peer closed
+	payload := make([]byte, 8*1024*1024)
+	rand.Read(payload)
+	go func() {
+		for p := payload; len(p) > 0; {
+			size := 64 * 1024
+			if size > len(p) {
+				size = len(p)
+			}
+			wconn.Write(p[:size])
+			p = p[size:]
+		}
+		wconn.Close()
+	}()
+	var sink bytes.Buffer
+	n, err := io.Copy(&sink, rconn)
+	MustNil(t, err)
+	Equal(t, n, int64(len(payload)))
+	MustTrue(t, bytes.Equal(sink.Bytes(), payload))
+	Equal(t, rconn.Reader().Len(), 0)
+}
+
+func TestConnectionReadFrom(t *testing.T) {
+	payload := make([]byte, 4*1024*1024+123)
+	rand.Read(payload)
+	f, err := ioutil.TempFile("", "netpoll-readfrom")
+	MustNil(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.Write(payload)
+	MustNil(t, err)
+
+	for _, fixed := range []int{0, 64 * 1024} {
+		r, w := GetSysFdPairs()
+		rconn, wconn := &connection{}, &connection{}
+		rconn.init(&netFD{fd: r}, &options{})
+		wconn.init(&netFD{fd: w}, &options{fixedOutput: fixed})
+
+		received := make(chan []byte, 1)
+		go func() {
+			buf := make([]byte, 2+len(payload))
+			_, err := io.ReadFull(rconn, buf)
+			MustNil(t, err)
+			received <- buf
+		}()
+		// the data written before is flushed together
+		_, err = wconn.WriteString("hd")
+		MustNil(t, err)
+		_, err = f.Seek(0, io.SeekStart)
+		MustNil(t, err)
+		n, err := wconn.ReadFrom(f)
+		MustNil(t, err)
+		Equal(t, n, int64(len(payload)))
+		buf := <-received
+		Equal(t, string(buf[:2]), "hd")
+		MustTrue(t, bytes.Equal(buf[2:], payload))
+
+		// io.Copy uses it as well, if the src is not an io.WriterTo
+		go func() {
+			buf := make([]byte, len(payload))
+			_, err := io.ReadFull(rconn, buf)
+			MustNil(t, err)
+			received <- buf
+		}()
+		n, err = io.Copy(wconn, struct{ io.Reader }{bytes.NewReader(payload)})
+		MustNil(t, err)
+		Equal(t, n, int64(len(payload)))
+		MustTrue(t, bytes.Equal(<-received, payload))
+		rconn.Close()
+		wconn.Close()
+	}
+}
+
+func TestConnectionReadFrame(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, &options{})
+	wconn.init(&netFD{fd: w}, &options{})
+	defer rconn.Close()
+
+	// the frame is read across multiple writes
+	go func() {
+		wconn.Write([]byte{0, 0})
+		time.Sleep(10 * time.Millisecond)
+		wconn.Write([]byte{0, 5, 'h', 'e'})
+		time.Sleep(10 * time.Millisecond)
+		wconn.Write([]byte{'l', 'l', 'o', 3, 0, 'b'})
+	}()
+	p, err := rconn.Reader().ReadFrame(4, true, 1024)
+	MustNil(t, err)
+	Equal(t, string(p), "hello")
+
+	// truncated mid-frame
+	wconn.Close()
+	_, err = rconn.Reader().ReadFrame(2, false, 1024)
+	MustTrue(t, errors.Is(err, ErrEOF))
+}
+
+func TestConnectionPeekInitial(t *testing.T) {
+	r, w := GetSysFdPairs()
+	_, err := syscall.Write(w, []byte("hello"))
+	MustNil(t, err)
+
+	// peek the socket in OnPrepare before registered into poller
+	rconn := &connection{}
+	var prepared []byte
+	rconn.init(&netFD{fd: r}, &options{onPrepare: func(connection Connection) context.Context {
+		p, err := connection.PeekInitial(8)
+		MustTrue(t, errors.Is(err, ErrNotEnough))
+		Equal(t, string(p), "hello")
+		prepared, err = connection.PeekInitial(3)
+		MustNil(t, err)
+		return context.Background()
+	}})
+	defer rconn.Close()
+	Equal(t, string(prepared), "hel")
+	p, err := rconn.Reader().Next(5)
+	MustNil(t, err)
+	Equal(t, string(p), "hello")
+	MustNil(t, rconn.Reader().Release())
+
+	// the buffered data is ahead of the socket
+	_, err = syscall.Write(w, []byte("abc"))
+	MustNil(t, err)
+	_, err = rconn.Reader().Peek(3)
+	MustNil(t, err)
+	_, err = syscall.Write(w, []byte("def"))
+	MustNil(t, err)
+	p, err = rconn.PeekInitial(6)
+	MustNil(t, err)
+	Equal(t, string(p), "abcdef")
+	p, err = rconn.Reader().Next(6)
+	MustNil(t, err)
+	Equal(t, string(p), "abcdef")
+
+	syscall.Close(w)
+	for rconn.IsActive() {
+		runtime.Gosched()
+	}
+	_, err = rconn.PeekInitial(1)
+	MustTrue(t, errors.Is(err, ErrConnClosed))
+}
+
+func TestConnectionReadv(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, &options{})
+	wconn.init(&netFD{fd: w}, &options{})
+	defer rconn.Close()
+	defer wconn.Close()
 
-	msg := make([]byte, totalSize/4)
-	for i := 0; i < 4; i++ {
-		_, err := wconn.Writer().WriteBinary(msg)
+	// the buffered data is read before the socket
+	_, err := wconn.Write([]byte("hello"))
+	MustNil(t, err)
+	_, err = rconn.Reader().Peek(5)
+	MustNil(t, err)
+	_, err = wconn.Write([]byte("world"))
+	MustNil(t, err)
+	var received []byte
+	for len(received) < 10 {
+		a, b := make([]byte, 3), make([]byte, 7)
+		n, err := rconn.Readv([][]byte{a, {}, b})
 		MustNil(t, err)
+		received = append(received, append(a, b...)[:n]...)
 	}
-	wg.Wait()
+	Equal(t, string(received), "helloworld")
+	Equal(t, rconn.Reader().Len(), 0)
 
-	rconn.Close()
+	// wait for the data if nothing can be read
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		wconn.Write([]byte("again"))
+	}()
+	buf := make([]byte, 16)
+	n, err := rconn.Readv([][]byte{buf})
+	MustNil(t, err)
+	Equal(t, string(buf[:n]), "again")
+
+	// the poller resumes reading into Reader
+	_, err = wconn.Write([]byte("next"))
+	MustNil(t, err)
+	p, err := rconn.Reader().Next(4)
+	MustNil(t, err)
+	Equal(t, string(p), "next")
+	Equal(t, rconn.InputBytes(), uint64(len("helloworldagainnext")))
+
+	wconn.Close()
+	_, err = rconn.Readv([][]byte{buf})
+	MustTrue(t, errors.Is(err, ErrEOF))
 }
 
-func TestConnectionRead(t *testing.T) {
+func TestConnectionSyscallConn(t *testing.T) {
 	r, w := GetSysFdPairs()
 	rconn, wconn := &connection{}, &connection{}
-	err := rconn.init(&netFD{fd: r}, nil)
+	rconn.init(&netFD{fd: r}, &options{})
+	wconn.init(&netFD{fd: w}, &options{})
+	defer wconn.Close()
+
+	raw, err := rconn.SyscallConn()
 	MustNil(t, err)
-	err = wconn.init(&netFD{fd: w}, nil)
+	var sotype int
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		Equal(t, int(fd), r)
+		sotype, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TYPE)
+		// the writes are not blocked by Control
+		_, werr := rconn.Write([]byte("world"))
+		MustNil(t, werr)
+	})
 	MustNil(t, err)
+	MustNil(t, serr)
+	Equal(t, sotype, syscall.SOCK_STREAM)
+	p, err := wconn.Reader().Next(5)
+	MustNil(t, err)
+	Equal(t, string(p), "world")
+	err = raw.Read(func(fd uintptr) bool { return true })
+	MustTrue(t, errors.Is(err, ErrUnsupported))
 
-	size := 256
-	cycleTime := 1000
-	msg := make([]byte, size)
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for i := 0; i < cycleTime; i++ {
-			buf, err := rconn.Reader().Next(size)
+	// the connection still works after Control
+	_, err = wconn.Write([]byte("hello"))
+	MustNil(t, err)
+	p, err = rconn.Reader().Next(5)
+	MustNil(t, err)
+	Equal(t, string(p), "hello")
+
+	MustNil(t, rconn.Close())
+	err = raw.Control(func(fd uintptr) { t.Fatal("called after closed") })
+	MustTrue(t, errors.Is(err, ErrConnClosed))
+	_, err = rconn.SyscallConn()
+	MustTrue(t, errors.Is(err, ErrConnClosed))
+}
+
+func TestConnectionReadBinaryOwned(t *testing.T) {
+	for _, nocopy := range []bool{false, true} {
+		MustNil(t, Configure(Config{Feature: Feature{AlwaysNoCopyRead: nocopy}}))
+		r, w := GetSysFdPairs()
+		rconn, wconn := &connection{}, &connection{}
+		rconn.init(&netFD{fd: r}, &options{})
+		wconn.init(&netFD{fd: w}, &options{})
+
+		size := 128
+		_, err := wconn.Write(bytes.Repeat([]byte{'a'}, size))
+		MustNil(t, err)
+		stored, err := rconn.Reader().ReadBinary(size)
+		MustNil(t, err)
+		MustNil(t, rconn.Reader().Release())
+
+		// the stored slice survives the following reads and Release
+		for i := 0; i < 16; i++ {
+			_, err = wconn.Write(bytes.Repeat([]byte{'b' + byte(i)}, size))
 			MustNil(t, err)
-			Equal(t, len(buf), size)
-			rconn.Reader().Release()
+			p, err := rconn.Reader().Next(size)
+			MustNil(t, err)
+			Equal(t, p[0], 'b'+byte(i))
+			MustNil(t, rconn.Reader().Release())
 		}
-	}()
-	for i := 0; i < cycleTime; i++ {
-		n, err := wconn.Write(msg)
-		MustNil(t, err)
-		Equal(t, n, len(msg))
+		Equal(t, string(stored), strings.Repeat("a", size))
+		rconn.Close()
+		wconn.Close()
 	}
-	wg.Wait()
-	rconn.Close()
+	MustNil(t, Configure(Config{Feature: Feature{AlwaysNoCopyRead: false}}))
 }
 
 func TestConnectionNoCopyReadString(t *testing.T) {
@@ -355,133 +1765,840 @@ func TestWriteTimeout(t *testing.T) {
 	ln, err := createTestListener("tcp", address)
 	MustNil(t, err)
 
-	interval := time.Millisecond * 100
+	interval := time.Millisecond * 100
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if conn == nil && err == nil {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 1024)
+				// slow read
+				for {
+					_, err := conn.Read(buf)
+					if err != nil {
+						err = conn.Close()
+						MustNil(t, err)
+						return
+					}
+					time.Sleep(interval)
+				}
+			}()
+		}
+	}()
+
+	conn, err := DialConnection("tcp", address, time.Second)
+	MustNil(t, err)
+
+	_, err = conn.Writer().Malloc(1024)
+	MustNil(t, err)
+	err = conn.Writer().Flush()
+	MustNil(t, err)
+
+	_ = conn.SetWriteTimeout(time.Millisecond * 10)
+	_, err = conn.Writer().Malloc(1024 * 1024 * 512)
+	MustNil(t, err)
+	err = conn.Writer().Flush()
+	MustTrue(t, errors.Is(err, ErrWriteTimeout))
+	// write timeout closes the connection
+	MustTrue(t, !conn.IsActive())
+	err = conn.Writer().Flush()
+	MustTrue(t, errors.Is(err, ErrConnClosed))
+
+	// close success
+	err = conn.Close()
+	MustNil(t, err)
+
+	err = ln.Close()
+	MustNil(t, err)
+}
+
+// TestConnectionLargeMemory is used to verify the memory usage in the large package scenario.
+func TestConnectionLargeMemory(t *testing.T) {
+	var start, end runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&start)
+
+	r, w := GetSysFdPairs()
+	rconn := &connection{}
+	rconn.init(&netFD{fd: r}, nil)
+
+	var wg sync.WaitGroup
+	rn, wn := 1024, 1*1024*1024
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := rconn.Reader().Next(wn)
+		MustNil(t, err)
+	}()
+
+	msg := make([]byte, rn)
+	for i := 0; i < wn/rn; i++ {
+		n, err := syscall.Write(w, msg)
+		if err != nil {
+			MustNil(t, err)
+		}
+		Equal(t, n, rn)
+	}
+
+	runtime.ReadMemStats(&end)
+	alloc := end.TotalAlloc - start.TotalAlloc
+	limit := uint64(4 * 1024 * 1024)
+	Assert(t, alloc <= limit, fmt.Sprintf("alloc[%d] out of memory %d", alloc, limit))
+}
+
+// TestSetTCPNoDelay is used to verify the connection initialization set the TCP_NODELAY correctly
+func TestSetTCPNoDelay(t *testing.T) {
+	fd, err := sysSocket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	MustNil(t, err)
+	conn := &connection{}
+	conn.init(&netFD{network: "tcp", fd: fd}, nil)
+
+	n, _ := syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	MustTrue(t, n > 0)
+	err = setTCPNoDelay(fd, false)
+	MustNil(t, err)
+	n, _ = syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	MustTrue(t, n == 0)
+}
+
+func TestConnectionUntil(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, nil)
+	wconn.init(&netFD{fd: w}, nil)
+	loopSize := 10000
+
+	msg := make([]byte, 1002)
+	msg[500], msg[1001] = '\n', '\n'
+	go func() {
+		for i := 0; i < loopSize; i++ {
+			n, err := wconn.Write(msg)
+			MustNil(t, err)
+			MustTrue(t, n == len(msg))
+		}
+		wconn.Write(msg[:100])
+		wconn.Close()
+	}()
+
+	for i := 0; i < loopSize*2; i++ {
+		buf, err := rconn.Reader().Until('\n')
+		MustNil(t, err)
+		Equal(t, len(buf), 501)
+		rconn.Reader().Release()
+	}
+
+	buf, err := rconn.Reader().Until('\n')
+	Equal(t, len(buf), 100)
+	Assert(t, errors.Is(err, ErrEOF), err)
+}
+
+func TestConnectionUntilLimit(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, nil)
+	wconn.init(&netFD{fd: w}, nil)
+	MustNil(t, rconn.SetUntilLimit(16))
+
+	// the delimiter arrives in another write
+	_, err := wconn.Write([]byte("hello "))
+	MustNil(t, err)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		wconn.Write([]byte("world\n"))
+	}()
+	buf, err := rconn.Reader().Until('\n')
+	MustNil(t, err)
+	Equal(t, string(buf), "hello world\n")
+
+	// no delimiter within the limit, and the data is not consumed
+	_, err = wconn.Write([]byte("0123456789abcdefg\n"))
+	MustNil(t, err)
+	_, err = rconn.Reader().Until('\n')
+	Assert(t, errors.Is(err, ErrLineTooLong), err)
+	Equal(t, rconn.Reader().Len(), 18)
+	MustNil(t, rconn.Reader().Skip(18))
+
+	// closed before the delimiter
+	_, err = wconn.Write([]byte("bye"))
+	MustNil(t, err)
+	wconn.Close()
+	buf, err = rconn.Reader().Until('\n')
+	Equal(t, string(buf), "bye")
+	Assert(t, errors.Is(err, ErrEOF), err)
+}
+
+func TestConnectionSetReadChunkSize(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, &options{})
+	wconn.init(&netFD{fd: w}, &options{})
+	defer rconn.Close()
+	defer wconn.Close()
+
+	// the size booked for the next read
+	bookSize := func() int {
+		vs := rconn.inputs(make([][]byte, 1))
+		rconn.inputBuffer.bookAck(0)
+		return len(vs[0])
+	}
+	Equal(t, bookSize(), rconn.bookSize)
+	MustNil(t, rconn.SetReadChunkSize(block2k))
+	Equal(t, bookSize(), block2k)
+	MustNil(t, rconn.SetReadChunkSize(1))
+	Equal(t, bookSize(), minReadChunkSize)
+	MustNil(t, rconn.SetReadChunkSize(2*mallocMax))
+	Equal(t, atomic.LoadInt64(&rconn.readChunkSize), int64(maxReadChunkSize))
+
+	// the data is read correctly in small chunks
+	MustNil(t, rconn.SetReadChunkSize(minReadChunkSize))
+	size := 256 * block1k
+	msg := make([]byte, size)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go func() {
+		wconn.Write(msg)
+	}()
+	p, err := rconn.Reader().Next(size)
+	MustNil(t, err)
+	MustTrue(t, bytes.Equal(p, msg))
+	MustNil(t, rconn.Reader().Release())
+
+	// zero restores the auto sizing
+	MustNil(t, rconn.SetReadChunkSize(0))
+	Equal(t, bookSize(), rconn.bookSize)
+}
+
+func TestConnectionFixedOutputBuffer(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, &options{})
+	wconn.init(&netFD{fd: w}, &options{fixedOutput: block1k})
+	defer rconn.Close()
+	defer wconn.Close()
+
+	// the writes overflowing the ring fail without allocating
+	msg := make([]byte, block1k)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	_, err := wconn.Writer().WriteBinary(make([]byte, block1k+1))
+	MustTrue(t, errors.Is(err, ErrBufferFull))
+	_, err = wconn.Writer().Malloc(block1k + 1)
+	MustTrue(t, errors.Is(err, ErrBufferFull))
+	Equal(t, wconn.outputBuffer.memorySize(), block1k/4)
+
+	// the ring is reused by the steady writes
+	for i := 0; i < 16; i++ {
+		_, err = wconn.Writer().WriteBinary(msg)
+		MustNil(t, err)
+		MustNil(t, wconn.Writer().Flush())
+		p, err := rconn.Reader().Next(block1k)
+		MustNil(t, err)
+		MustTrue(t, bytes.Equal(p, msg))
+		MustNil(t, rconn.Reader().Release())
+	}
+	MustTrue(t, wconn.outputBuffer.memorySize() <= block1k)
+}
+
+func TestConnectionPendingOutputBytes(t *testing.T) {
+	r, w := GetSysFdPairs()
+	defer syscall.Close(r)
+	wconn := &connection{}
+	wconn.init(&netFD{fd: w}, nil)
+	defer wconn.Close()
+	Equal(t, wconn.PendingOutputBytes(), 0)
+
+	// the peer doesn't read, so the flushed data is pending
+	size := 8 * 1024 * 1024
+	done := make(chan error, 1)
+	go func() {
+		_, err := wconn.Writer().WriteBinary(make([]byte, size))
+		MustNil(t, err)
+		done <- wconn.Writer().Flush()
+	}()
+	pending := 0
+	for i := 0; i < 100 && pending == 0; i++ {
+		time.Sleep(time.Millisecond)
+		pending = wconn.PendingOutputBytes()
+	}
+	MustTrue(t, pending > 0 && pending <= size)
+	time.Sleep(10 * time.Millisecond)
+	Equal(t, wconn.PendingOutputBytes(), pending)
+
+	// drained as the peer reads
+	buf := make([]byte, 64*1024)
+	for read := 0; read < size; {
+		n, err := syscall.Read(r, buf)
+		MustNil(t, err)
+		read += n
+		MustTrue(t, wconn.PendingOutputBytes() <= size-read)
+	}
+	MustNil(t, <-done)
+	Equal(t, wconn.PendingOutputBytes(), 0)
+}
+
+func TestConnectionSetOnWriteReady(t *testing.T) {
+	r, w := GetSysFdPairs()
+	defer syscall.Close(r)
+	wconn := &connection{}
+	wconn.init(&netFD{fd: w}, nil)
+
+	// called immediately if not pending
+	var fired int32
+	ready := make(chan struct{}, 2)
+	onReady := func() {
+		atomic.AddInt32(&fired, 1)
+		ready <- struct{}{}
+	}
+	wconn.SetOnWriteReady(1, onReady)
+	<-ready
+
+	// fill the output buffer since the peer doesn't read
+	size := 8 * 1024 * 1024
+	done := make(chan error, 1)
+	go func() {
+		_, err := wconn.Writer().WriteBinary(make([]byte, size))
+		MustNil(t, err)
+		done <- wconn.Writer().Flush()
+	}()
+	pending := 0
+	for i := 0; i < 100 && pending == 0; i++ {
+		time.Sleep(time.Millisecond)
+		pending = wconn.PendingOutputBytes()
+	}
+	MustTrue(t, pending > 0)
+	threshold := pending / 2
+	wconn.SetOnWriteReady(threshold, onReady)
+	time.Sleep(10 * time.Millisecond)
+	Equal(t, atomic.LoadInt32(&fired), int32(1))
+
+	// fired once as the peer drains
+	buf := make([]byte, 64*1024)
+	for read := 0; read < size; {
+		n, err := syscall.Read(r, buf)
+		MustNil(t, err)
+		read += n
+		if wconn.PendingOutputBytes() >= threshold {
+			Equal(t, atomic.LoadInt32(&fired), int32(1))
+		}
+	}
+	MustNil(t, <-done)
+	<-ready
+	time.Sleep(10 * time.Millisecond)
+	Equal(t, atomic.LoadInt32(&fired), int32(2))
+
+	// cleared on close
+	go func() {
+		wconn.Writer().WriteBinary(make([]byte, size))
+		wconn.Writer().Flush()
+	}()
+	for i := 0; i < 100 && wconn.PendingOutputBytes() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	wconn.SetOnWriteReady(1, onReady)
+	MustNil(t, wconn.Close())
+	time.Sleep(10 * time.Millisecond)
+	Equal(t, atomic.LoadInt32(&fired), int32(2))
+}
+
+func TestConnectionDeadline(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			connection.Reader().Skip(connection.Reader().Len())
+			return connection.Reader().Release()
+		})
+	defer loop.Shutdown(context.Background())
+	conn, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+
+	isTimeout := func(err error) bool {
+		var nerr net.Error
+		return errors.As(err, &nerr) && nerr.Timeout() && errors.Is(err, ErrReadTimeout)
+	}
+	start := time.Now()
+	MustNil(t, conn.SetReadDeadline(start.Add(50*time.Millisecond)))
+	_, err = conn.Reader().Next(1)
+	Assert(t, isTimeout(err), err)
+	MustTrue(t, time.Since(start) >= 50*time.Millisecond)
+	// past deadline returns immediately
+	start = time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	Assert(t, isTimeout(err), err)
+	MustTrue(t, time.Since(start) < 50*time.Millisecond)
+
+	// the earlier one of read timeout and deadline works
+	MustNil(t, conn.SetReadTimeout(20*time.Millisecond))
+	MustNil(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	start = time.Now()
+	_, err = conn.Reader().Next(1)
+	Assert(t, isTimeout(err), err)
+	MustTrue(t, time.Since(start) < time.Second)
+
+	// zero value clears the deadline
+	MustNil(t, conn.SetReadTimeout(0))
+	MustNil(t, conn.SetDeadline(time.Time{}))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		loop.Range(func(connection Connection) bool {
+			connection.Writer().WriteString("ok")
+			connection.Writer().Flush()
+			return true
+		})
+	}()
+	buf, err := conn.Reader().Next(2)
+	MustNil(t, err)
+	Equal(t, string(buf), "ok")
+
+	// write past deadline
+	MustNil(t, conn.SetWriteDeadline(time.Now().Add(-time.Second)))
+	_, err = conn.Write(make([]byte, 16*1024*1024))
+	var nerr net.Error
+	Assert(t, errors.As(err, &nerr) && nerr.Timeout() && errors.Is(err, ErrWriteTimeout), err)
+	MustTrue(t, !conn.IsActive())
+}
+
+func TestConnectionAppendBuffer(t *testing.T) {
+	r1, w1 := GetSysFdPairs()
+	r2, w2 := GetSysFdPairs()
+	src, dst := &connection{}, &connection{}
+	src.init(&netFD{fd: r1}, nil)
+	dst.init(&netFD{fd: w2}, nil)
+	defer src.Close()
+	defer dst.Close()
+	defer syscall.Close(w1)
+
+	// forward the frames from src to dst
+	frame := make([]byte, 256*1024)
+	for i := range frame {
+		frame[i] = byte(i)
+	}
 	go func() {
-		for {
-			conn, err := ln.Accept()
-			if conn == nil && err == nil {
-				continue
-			}
-			if err != nil {
-				return
-			}
-			go func() {
-				buf := make([]byte, 1024)
-				// slow read
-				for {
-					_, err := conn.Read(buf)
-					if err != nil {
-						err = conn.Close()
-						MustNil(t, err)
-						return
-					}
-					time.Sleep(interval)
-				}
-			}()
+		for i := 0; i < 4; i++ {
+			syscall.Write(w1, frame)
 		}
 	}()
+	go func() {
+		for i := 0; i < 4; i++ {
+			MustNil(t, dst.Writer().AppendBuffer(src.Reader(), len(frame)))
+			MustNil(t, dst.Writer().Flush())
+		}
+	}()
+	rconn := &connection{}
+	rconn.init(&netFD{fd: r2}, nil)
+	defer rconn.Close()
+	for i := 0; i < 4; i++ {
+		p, err := rconn.Reader().Next(len(frame))
+		MustNil(t, err)
+		MustTrue(t, bytes.Equal(p, frame))
+		MustNil(t, rconn.Reader().Release())
+	}
+}
 
-	conn, err := DialConnection("tcp", address, time.Second)
+func TestConnectionTransferBuffer(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, nil)
+	wconn.init(&netFD{fd: w}, nil)
+	defer rconn.Close()
+	defer wconn.Close()
+
+	// build each batch aside, the buffer is reused after the transfer
+	buf := NewLinkBuffer()
+	var expect []byte
+	for i := 0; i < 8; i++ {
+		batch := bytes.Repeat([]byte{byte('a' + i)}, 16*1024)
+		_, err := buf.WriteBinary(batch[:8*1024])
+		MustNil(t, err)
+		MustNil(t, buf.Flush())
+		// the malloc data is moved too
+		_, err = buf.WriteBinary(batch[8*1024:])
+		MustNil(t, err)
+		MustNil(t, buf.Transfer(wconn.Writer()))
+		Equal(t, buf.Len(), 0)
+		Equal(t, buf.MallocLen(), 0)
+		MustNil(t, wconn.Writer().Flush())
+		expect = append(expect, batch...)
+	}
+	MustNil(t, buf.Transfer(wconn.Writer()))
+	Equal(t, wconn.outputBuffer.Len(), 0)
+
+	p, err := rconn.Reader().Next(len(expect))
 	MustNil(t, err)
+	MustTrue(t, bytes.Equal(p, expect))
+	MustNil(t, buf.Release())
+}
 
-	_, err = conn.Writer().Malloc(1024)
+func TestConnectionSetAutoFlush(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, nil)
+	wconn.init(&netFD{fd: w}, nil)
+	defer rconn.Close()
+	defer wconn.Close()
+
+	threshold, chunk := 64*1024, 1024
+	MustNil(t, wconn.Writer().SetAutoFlush(threshold))
+	data := make([]byte, 100*chunk)
+	rand.Read(data)
+	for i := 0; i < len(data); i += chunk {
+		_, err := wconn.Writer().WriteBinary(data[i : i+chunk])
+		MustNil(t, err)
+	}
+	// the bytes up to the threshold are delivered without Flush
+	Equal(t, wconn.Writer().MallocLen(), len(data)-threshold)
+	p, err := rconn.Reader().Next(threshold)
 	MustNil(t, err)
-	err = conn.Writer().Flush()
+	MustTrue(t, bytes.Equal(p, data[:threshold]))
+	MustNil(t, wconn.Writer().Flush())
+	p, err = rconn.Reader().Next(len(data) - threshold)
 	MustNil(t, err)
+	MustTrue(t, bytes.Equal(p, data[threshold:]))
 
-	_ = conn.SetWriteTimeout(time.Millisecond * 10)
-	_, err = conn.Writer().Malloc(1024 * 1024 * 512)
+	// suspended until the malloc header is filled and flushed
+	header, err := wconn.Writer().Malloc(4)
 	MustNil(t, err)
-	err = conn.Writer().Flush()
-	MustTrue(t, errors.Is(err, ErrWriteTimeout))
-
-	// close success
-	err = conn.Close()
+	_, err = wconn.Writer().WriteBinary(data)
+	MustNil(t, err)
+	Equal(t, wconn.Writer().MallocLen(), len(data)+4)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	MustNil(t, wconn.Writer().Flush())
+	p, err = rconn.Reader().Next(len(data) + 4)
 	MustNil(t, err)
+	Equal(t, int(binary.BigEndian.Uint32(p)), len(data))
+	MustTrue(t, bytes.Equal(p[4:], data))
 
-	err = ln.Close()
+	// disabled
+	MustNil(t, wconn.Writer().SetAutoFlush(0))
+	_, err = wconn.Writer().WriteBinary(data)
 	MustNil(t, err)
+	Equal(t, wconn.Writer().MallocLen(), len(data))
 }
 
-// TestConnectionLargeMemory is used to verify the memory usage in the large package scenario.
-func TestConnectionLargeMemory(t *testing.T) {
-	var start, end runtime.MemStats
-	runtime.GC()
-	runtime.ReadMemStats(&start)
+func TestConnectionClone(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn := &connection{}
+	rconn.init(&netFD{fd: r}, nil)
+	defer rconn.Close()
+	defer syscall.Close(w)
+
+	syscall.Write(w, []byte("\x00\x05hello"))
+	MustNil(t, rconn.Reader().WaitReadSize(7))
+	// try a frame with a 4-byte length, which fails
+	clone := rconn.Reader().Clone()
+	n := clone.Len()
+	p, err := clone.Next(4)
+	MustNil(t, err)
+	MustTrue(t, int(binary.BigEndian.Uint32(p)) > clone.Len())
+	MustNil(t, clone.Release())
+	Equal(t, rconn.Reader().Len(), n)
+
+	// then a 2-byte length is parsed by the clone and committed
+	clone = rconn.Reader().Clone()
+	p, err = clone.Next(2)
+	MustNil(t, err)
+	Equal(t, int(binary.BigEndian.Uint16(p)), 5)
+	MustNil(t, clone.Release())
+	MustNil(t, rconn.Reader().Skip(2))
+	// re-read from the original
+	body, err := rconn.Reader().ReadString(5)
+	MustNil(t, err)
+	Equal(t, body, "hello")
+	Equal(t, rconn.Reader().Len(), 0)
+}
 
+func TestConnectionMaxReadSize(t *testing.T) {
 	r, w := GetSysFdPairs()
 	rconn := &connection{}
 	rconn.init(&netFD{fd: r}, nil)
+	defer rconn.Close()
+	defer syscall.Close(w)
+	MustNil(t, rconn.SetMaxReadSize(16))
 
-	var wg sync.WaitGroup
-	rn, wn := 1024, 1*1024*1024
+	// a malicious length prefix of 1GB
+	_, err := syscall.Write(w, []byte{0x40, 0, 0, 0})
+	MustNil(t, err)
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	allocated := ms.TotalAlloc
+	_, err = rconn.ReadFrame(4, true, 0)
+	Assert(t, errors.Is(err, ErrMessageTooLarge), err)
+	_, err = rconn.Next(1 << 30)
+	Assert(t, errors.Is(err, ErrMessageTooLarge), err)
+	_, err = rconn.Peek(17)
+	Assert(t, errors.Is(err, ErrMessageTooLarge), err)
+	runtime.ReadMemStats(&ms)
+	Assert(t, ms.TotalAlloc-allocated < 1<<20, ms.TotalAlloc-allocated)
+	// nothing is consumed
+	p, err := rconn.Peek(4)
+	MustNil(t, err)
+	Equal(t, p[0], byte(0x40))
+	_, err = rconn.Discard(4)
+	MustNil(t, err)
 
-	wg.Add(1)
+	// the line without the delimiter exceeds the limit
+	_, err = syscall.Write(w, []byte("0123456789abcdef0123"))
+	MustNil(t, err)
+	_, err = rconn.Until('\n')
+	Assert(t, errors.Is(err, ErrMessageTooLarge), err)
+	Equal(t, rconn.Len(), 20)
+	p, err = rconn.Next(16)
+	MustNil(t, err)
+	Equal(t, string(p), "0123456789abcdef")
+
+	MustNil(t, rconn.SetMaxReadSize(0))
+	_, err = syscall.Write(w, make([]byte, 28))
+	MustNil(t, err)
+	p, err = rconn.Next(32)
+	MustNil(t, err)
+	Equal(t, len(p), 32)
+}
+
+func TestConnectionReadFull(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn := &connection{}
+	rconn.init(&netFD{fd: r}, nil)
+	defer rconn.Close()
+
+	// larger than a node, and arrives in several writes
+	data := make([]byte, 64*pagesize+100)
+	rand.Read(data)
 	go func() {
-		defer wg.Done()
-		_, err := rconn.Reader().Next(wn)
-		MustNil(t, err)
+		for i := 0; i < len(data); i += 8 * pagesize {
+			end := i + 8*pagesize
+			if end > len(data) {
+				end = len(data)
+			}
+			syscall.Write(w, data[i:end])
+			time.Sleep(time.Millisecond)
+		}
 	}()
+	p := make([]byte, len(data))
+	n, err := rconn.Reader().ReadFull(p)
+	MustNil(t, err)
+	Equal(t, n, len(data))
+	MustTrue(t, bytes.Equal(p, data))
+	Equal(t, rconn.Reader().Len(), 0)
 
-	msg := make([]byte, rn)
-	for i := 0; i < wn/rn; i++ {
-		n, err := syscall.Write(w, msg)
+	// closed before p is filled
+	syscall.Write(w, []byte("hello"))
+	syscall.Close(w)
+	n, err = rconn.Reader().ReadFull(p)
+	MustTrue(t, errors.Is(err, ErrEOF))
+	Equal(t, n, 5)
+	Equal(t, string(p[:n]), "hello")
+}
+
+func TestConnectionWriteMmap(t *testing.T) {
+	size := 4*1024*1024 + 100
+	data := make([]byte, size)
+	rand.Read(data)
+	f, err := ioutil.TempFile("", "netpoll-mmap")
+	MustNil(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.Write(data)
+	MustNil(t, err)
+	mem, err := syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	MustNil(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	MustNil(t, err)
+	defer ln.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
 		if err != nil {
-			MustNil(t, err)
+			return
 		}
-		Equal(t, n, rn)
-	}
+		defer conn.Close()
+		buf, _ := ioutil.ReadAll(conn)
+		received <- buf
+	}()
 
-	runtime.ReadMemStats(&end)
-	alloc := end.TotalAlloc - start.TotalAlloc
-	limit := uint64(4 * 1024 * 1024)
-	Assert(t, alloc <= limit, fmt.Sprintf("alloc[%d] out of memory %d", alloc, limit))
+	conn, err := DialConnection("tcp", ln.Addr().String(), time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	unmapped := make(chan struct{})
+	_, err = conn.Writer().WriteString("header")
+	MustNil(t, err)
+	MustNil(t, conn.WriteMmap(mem, func() {
+		syscall.Munmap(mem)
+		close(unmapped)
+	}))
+	_, err = conn.Writer().WriteString("trailer")
+	MustNil(t, err)
+	// still referenced before flush
+	select {
+	case <-unmapped:
+		t.Fatal("unmapped before flush")
+	default:
+	}
+	MustNil(t, conn.Writer().Flush())
+	select {
+	case <-unmapped:
+	case <-time.After(time.Second):
+		t.Fatal("not unmapped after flush")
+	}
+	// empty data is released at once
+	released := false
+	MustNil(t, conn.WriteMmap(nil, func() { released = true }))
+	MustTrue(t, released)
+
+	MustNil(t, conn.Close())
+	buf := <-received
+	Equal(t, len(buf), len("header")+size+len("trailer"))
+	Equal(t, string(buf[:6]), "header")
+	MustTrue(t, bytes.Equal(buf[6:6+size], data))
+	Equal(t, string(buf[6+size:]), "trailer")
+
+	// released at once after closed
+	released = false
+	err = conn.WriteMmap(data, func() { released = true })
+	MustTrue(t, errors.Is(err, ErrConnClosed))
+	MustTrue(t, released)
+
+	// released by close without flush, even if the output buffer is not recycled
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err = DialConnection("tcp", ln.Addr().String(), time.Second)
+	MustNil(t, err)
+	defer func() { (<-accepted).Close() }()
+	var releases int32
+	MustNil(t, conn.WriteMmap(data, func() { atomic.AddInt32(&releases, 1) }))
+	MustNil(t, conn.Close())
+	for i := 0; i < 100 && atomic.LoadInt32(&releases) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	Equal(t, atomic.LoadInt32(&releases), int32(1))
 }
 
-// TestSetTCPNoDelay is used to verify the connection initialization set the TCP_NODELAY correctly
-func TestSetTCPNoDelay(t *testing.T) {
-	fd, err := sysSocket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+func TestConnectionTCPInfo(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	MustNil(t, err)
-	conn := &connection{}
-	conn.init(&netFD{network: "tcp", fd: fd}, nil)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
 
-	n, _ := syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
-	MustTrue(t, n > 0)
-	err = setTCPNoDelay(fd, false)
+	conn, err := DialConnection("tcp", ln.Addr().String(), time.Second)
 	MustNil(t, err)
-	n, _ = syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
-	MustTrue(t, n == 0)
-}
+	defer conn.Close()
+	for i := 0; i < 8; i++ {
+		_, err = conn.Writer().WriteString("ping")
+		MustNil(t, err)
+		MustNil(t, conn.Writer().Flush())
+		_, err = conn.Reader().Next(len("ping"))
+		MustNil(t, err)
+		MustNil(t, conn.Reader().Release())
+	}
+	info, err := conn.TCPInfo()
+	if runtime.GOOS != "linux" {
+		MustTrue(t, errors.Is(err, ErrUnsupported))
+		return
+	}
+	MustNil(t, err)
+	Equal(t, info.State, uint8(1)) // ESTABLISHED
+	MustTrue(t, info.RTT > 0)
+	MustTrue(t, info.SndMSS > 0)
+	MustTrue(t, info.SndCwnd > 0)
 
-func TestConnectionUntil(t *testing.T) {
+	// not a TCP socket
 	r, w := GetSysFdPairs()
-	rconn, wconn := &connection{}, &connection{}
-	rconn.init(&netFD{fd: r}, nil)
-	wconn.init(&netFD{fd: w}, nil)
-	loopSize := 10000
+	defer syscall.Close(w)
+	uconn := &connection{}
+	uconn.init(&netFD{fd: r}, nil)
+	defer uconn.Close()
+	_, err = uconn.TCPInfo()
+	MustTrue(t, err != nil)
+}
 
-	msg := make([]byte, 1002)
-	msg[500], msg[1001] = '\n', '\n'
+func TestConnectionOriginalDst(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	MustNil(t, err)
+	defer ln.Close()
 	go func() {
-		for i := 0; i < loopSize; i++ {
-			n, err := wconn.Write(msg)
-			MustNil(t, err)
-			MustTrue(t, n == len(msg))
+		conn, err := ln.Accept()
+		if err != nil {
+			return
 		}
-		wconn.Write(msg[:100])
-		wconn.Close()
+		defer conn.Close()
+		io.Copy(conn, conn)
 	}()
 
-	for i := 0; i < loopSize*2; i++ {
-		buf, err := rconn.Reader().Until('\n')
-		MustNil(t, err)
-		Equal(t, len(buf), 501)
-		rconn.Reader().Release()
+	// the loopback connection is not redirected, whether netfilter tracks it or not
+	conn, err := DialConnection("tcp", ln.Addr().String(), time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	_, err = conn.OriginalDst()
+	if runtime.GOOS != "linux" {
+		MustTrue(t, errors.Is(err, ErrUnsupported))
+		return
 	}
+	MustTrue(t, errors.Is(err, ErrNotRedirected))
 
-	buf, err := rconn.Reader().Until('\n')
-	Equal(t, len(buf), 100)
-	Assert(t, errors.Is(err, ErrEOF), err)
+	// not a TCP socket
+	r, w := GetSysFdPairs()
+	defer syscall.Close(w)
+	uconn := &connection{}
+	uconn.init(&netFD{fd: r}, nil)
+	defer uconn.Close()
+	_, err = uconn.OriginalDst()
+	MustTrue(t, err != nil)
+}
+
+func TestConnectionFlushResult(t *testing.T) {
+	ln, err := net.Listen("tcp", getTestAddress())
+	MustNil(t, err)
+	defer ln.Close()
+	received := make(chan int, 1)
+	go func() {
+		conn, err := ln.Accept()
+		MustNil(t, err)
+		// read some bytes then reset the connection
+		n, _ := io.ReadFull(conn, make([]byte, 1024*1024))
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+		received <- n
+	}()
+
+	conn, err := DialConnection("tcp", ln.Addr().String(), time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	_, err = conn.Writer().WriteString("hello")
+	MustNil(t, err)
+	MustNil(t, conn.Writer().Flush())
+	written, err := conn.FlushResult()
+	Equal(t, written, 5)
+	MustNil(t, err)
+
+	size := 64 * 1024 * 1024
+	MustNil(t, conn.Writer().WriteDirect(make([]byte, size), 0))
+	err = conn.Writer().Flush()
+	MustTrue(t, err != nil)
+	written, ferr := conn.FlushResult()
+	Equal(t, ferr, err)
+	Assert(t, errors.Is(err, ErrConnReset) || errors.Is(err, ErrConnClosed), err)
+	peer := <-received - 5
+	Assert(t, written >= peer && written < size, written, peer)
 }
 
 func TestBookSizeLargerThanMaxSize(t *testing.T) {
@@ -774,3 +2891,197 @@ func TestConnectionDailTimeoutAndClose(t *testing.T) {
 		wg.Wait()
 	}
 }
+
+func TestConnectionMigrateToPoller(t *testing.T) {
+	numLoops := pollmanager.numLoops
+	MustNil(t, pollmanager.SetNumLoops(4))
+	defer func() {
+		MustNil(t, pollmanager.SetNumLoops(int(numLoops)))
+	}()
+
+	var mu sync.Mutex
+	var conns []Connection
+	network, address := "tcp", getTestAddress()
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			buf, err := connection.Reader().Next(connection.Reader().Len())
+			if err != nil {
+				return err
+			}
+			// buf is referred by the output until flushed
+			connection.Writer().WriteBinary(buf)
+			err = connection.Writer().Flush()
+			connection.Reader().Release()
+			return err
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			mu.Lock()
+			conns = append(conns, connection)
+			mu.Unlock()
+			return ctx
+		}))
+	defer loop.Shutdown(context.Background())
+
+	conn, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	pollers := len(pollmanager.polls)
+	Equal(t, pollers, 4)
+	MustTrue(t, conn.MigrateToPoller(-1) != nil)
+	MustTrue(t, conn.MigrateToPoller(pollers) != nil)
+	for i := 0; i < pollers; i++ {
+		MustNil(t, conn.MigrateToPoller(i))
+		Equal(t, pollmanager.Index(conn.(*TCPConnection).operator.getPoll()), i)
+	}
+	MustNil(t, conn.Close())
+	Assert(t, errors.Is(conn.MigrateToPoller(0), ErrConnClosed))
+
+	// migrate both sides of the connections while they are blocked in Flush or Next,
+	// which must not fail the transfers
+	var wg sync.WaitGroup
+	var migrated int32
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		conn, err := DialConnection(network, address, time.Second)
+		MustNil(t, err)
+		mu.Lock()
+		conns = append(conns, conn)
+		mu.Unlock()
+		wg.Add(1)
+		go func(conn Connection) {
+			defer wg.Done()
+			defer conn.Close()
+			msg := make([]byte, 16*1024)
+			for j := 0; j < 200; j++ {
+				for k := range msg {
+					msg[k] = byte(j + k)
+				}
+				_, err := conn.Writer().WriteBinary(msg)
+				MustNil(t, err)
+				MustNil(t, conn.Writer().Flush())
+				buf, err := conn.Reader().Next(len(msg))
+				MustNil(t, err)
+				MustTrue(t, bytes.Equal(buf, msg))
+				MustNil(t, conn.Reader().Release())
+			}
+		}(conn)
+	}
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			mu.Lock()
+			conn := conns[i%len(conns)]
+			mu.Unlock()
+			err := conn.MigrateToPoller(i % pollers)
+			if err == nil {
+				atomic.AddInt32(&migrated, 1)
+			} else {
+				Assert(t, errors.Is(err, ErrConnClosed), err)
+			}
+			runtime.Gosched()
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	MustTrue(t, atomic.LoadInt32(&migrated) > 0)
+}
+
+func TestConnectionFlushSync(t *testing.T) {
+	ln, err := net.Listen("tcp", getTestAddress())
+	MustNil(t, err)
+	defer ln.Close()
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := ln.Accept()
+		MustNil(t, err)
+		defer conn.Close()
+		// read slowly, so that the data is queued in the socket
+		time.Sleep(50 * time.Millisecond)
+		n, _ := io.Copy(ioutil.Discard, conn)
+		received <- n
+	}()
+
+	conn, err := DialConnection("tcp", ln.Addr().String(), time.Second)
+	MustNil(t, err)
+	size := 8 * 1024 * 1024
+	_, err = conn.Writer().WriteBinary(make([]byte, size))
+	MustNil(t, err)
+	MustNil(t, conn.Writer().FlushSync())
+	Equal(t, conn.PendingOutputBytes(), 0)
+	queued, err := sendQueueLen(conn.(*TCPConnection).fd)
+	MustNil(t, err)
+	Equal(t, queued, 0)
+	// all the bytes are received by the peer even if reset immediately
+	MustNil(t, syscall.SetsockoptLinger(conn.(*TCPConnection).fd, syscall.SOL_SOCKET, syscall.SO_LINGER, &syscall.Linger{Onoff: 1, Linger: 0}))
+	MustNil(t, conn.Close())
+	Equal(t, <-received, int64(size))
+
+	// the wait is limited by the write timeout if the peer never reads, and the connection is kept
+	r, w := GetSysFdPairs()
+	defer syscall.Close(r)
+	wconn := &connection{}
+	MustNil(t, wconn.init(&netFD{fd: w, remoteAddr: &UnixAddr{net.UnixAddr{Net: "unix"}}}, nil))
+	defer wconn.Close()
+	MustNil(t, wconn.SetWriteTimeout(50*time.Millisecond))
+	_, err = wconn.Writer().WriteString("never read")
+	MustNil(t, err)
+	err = wconn.Writer().FlushSync()
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		MustTrue(t, errors.Is(err, ErrWriteTimeout))
+	} else {
+		MustNil(t, err)
+	}
+	MustTrue(t, wconn.IsActive())
+
+	// LinkBuffer has no socket to wait for
+	buf := NewLinkBuffer()
+	buf.WriteString("hello")
+	MustNil(t, buf.FlushSync())
+	Equal(t, buf.Len(), 5)
+}
+
+func TestConnectionSetTOS(t *testing.T) {
+	getTOS := func(fd int) int {
+		tos, err := syscall.GetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS)
+		MustNil(t, err)
+		return tos
+	}
+	network, address := "tcp", getTestAddress()
+	accepted := make(chan int, 1)
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			return nil
+		},
+		WithOnConnect(func(ctx context.Context, conn Connection) context.Context {
+			accepted <- getTOS(conn.(Conn).Fd())
+			return ctx
+		}),
+		WithTOS(0x28))
+	defer loop.Shutdown(context.Background())
+
+	conn, err := NewDialer(WithTOS(0x20)).DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	Equal(t, <-accepted, 0x28)
+	fd := conn.(Conn).Fd()
+	Equal(t, getTOS(fd), 0x20)
+	// DSCP EF
+	MustNil(t, conn.SetTOS(46<<2))
+	Equal(t, getTOS(fd), 46<<2)
+	err = conn.SetTOS(256)
+	MustTrue(t, errors.Is(err, syscall.EINVAL))
+	Equal(t, getTOS(fd), 46<<2)
+
+	// not an IP socket
+	r, w := GetSysFdPairs()
+	defer syscall.Close(w)
+	uconn := &connection{}
+	uconn.init(&netFD{fd: r}, nil)
+	defer uconn.Close()
+	MustTrue(t, errors.Is(uconn.SetTOS(0x20), ErrUnsupported))
+	_, err = CreateListener("unix", filepath.Join(t.TempDir(), "tos.sock"), WithTOS(0x20))
+	MustTrue(t, errors.Is(err, ErrUnsupported))
+}
@@ -0,0 +1,636 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netpoll
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+const (
+	// tlsRecordHeaderLen is the length of the header of TLS records.
+	tlsRecordHeaderLen = 5
+	// tlsMaxPlaintext is the max length of the plaintext in a TLS record.
+	tlsMaxPlaintext = 16 * 1024
+)
+
+// NewTLSConnection performs the server side TLS handshake over conn, and returns a Connection
+// whose Reader and Writer transfer the plaintext, while the ciphertext is carried by conn.
+// It blocks until the handshake finished, so it can be called in OnConnect, and the OnRequest
+// set by SetOnRequest of the returned Connection will be called with it, e.g.:
+//
+//	func onConnect(ctx context.Context, conn netpoll.Connection) context.Context {
+//		tconn, err := netpoll.NewTLSConnection(conn, config)
+//		if err != nil {
+//			conn.Close()
+//			return ctx
+//		}
+//		tconn.SetOnRequest(onRequest)
+//		return ctx
+//	}
+//
+// The TLS records are read one by one from conn, so that the unhandled records are always left in conn
+// and trigger OnRequest. If the OnRequest of EventLoop is used with the TLS connection instead,
+// it must read all the plaintext before returning, otherwise the rest will not trigger OnRequest.
+// Closing the returned Connection sends close_notify to the peer before closing conn,
+// and the close callbacks added to it will be called with itself.
+//
+// The returned Connection has the method ConnectionState() tls.ConnectionState like *tls.Conn,
+// e.g. to check DidResume. The sessions are resumed by the session tickets of config, which are encrypted
+// by the keys of config, so the same config should be used for all connections, or set by SetSessionTicketKeys.
+func NewTLSConnection(conn Connection, config *tls.Config) (Connection, error) {
+	return newTLSConnection(conn, config, false)
+}
+
+// NewTLSClientConnection is the same as NewTLSConnection, but performs the client side TLS handshake.
+// The sessions are resumed across the dials if ClientSessionCache of config is set, e.g. once by
+// config.ClientSessionCache = tls.NewLRUClientSessionCache(1024), which is safe for concurrent use and bounded,
+// and the same config is used for the later dials. netpoll keeps no session state of its own.
+func NewTLSClientConnection(conn Connection, config *tls.Config) (Connection, error) {
+	return newTLSConnection(conn, config, true)
+}
+
+func newTLSConnection(conn Connection, config *tls.Config, isClient bool) (*tlsConnection, error) {
+	c := &tlsConnection{
+		Connection:   conn,
+		inputBuffer:  NewLinkBuffer(),
+		outputBuffer: NewLinkBuffer(),
+	}
+	rconn := &tlsRecordConn{Connection: conn}
+	if isClient {
+		c.conn = tls.Client(rconn, config)
+	} else {
+		c.conn = tls.Server(rconn, config)
+	}
+	if err := c.conn.Handshake(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+var _ Connection = &tlsConnection{}
+
+// tlsConnection implements Connection over crypto/tls,
+// the buffers hold the plaintext and the embedded Connection carries the ciphertext.
+type tlsConnection struct {
+	Connection
+	conn         *tls.Conn
+	inputBuffer  *LinkBuffer
+	outputBuffer *LinkBuffer
+	autoFlush    autoFlusher // the state of SetAutoFlush, for the plaintext
+	untilLimit   int64       // the maximum length of the line returned by Until
+	maxReadSize  int64       // the maximum size of a single read by SetMaxReadSize
+}
+
+// ConnectionState returns the state of the TLS connection, the same as *tls.Conn.
+func (c *tlsConnection) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState()
+}
+
+// Reader implements Connection.
+func (c *tlsConnection) Reader() Reader {
+	return c
+}
+
+// Writer implements Connection.
+func (c *tlsConnection) Writer() Writer {
+	return c
+}
+
+// ------------------------------------------ implement zero-copy reader ------------------------------------------
+
+// Next implements Connection.
+func (c *tlsConnection) Next(n int) (p []byte, err error) {
+	if err = c.waitRead(n); err != nil {
+		return p, err
+	}
+	return c.inputBuffer.Next(n)
+}
+
+// TryNext implements Connection.
+// Only the decrypted data is checked, even if there are complete records in the underlying connection.
+func (c *tlsConnection) TryNext(n int) (p []byte, err error) {
+	return c.inputBuffer.TryNext(n)
+}
+
+// ReadFrame implements Connection.
+func (c *tlsConnection) ReadFrame(header int, bigEndian bool, maxSize int) (p []byte, err error) {
+	return readFrame(c, header, bigEndian, maxSize)
+}
+
+// Peek implements Connection.
+func (c *tlsConnection) Peek(n int) (buf []byte, err error) {
+	if err = c.waitRead(n); err != nil {
+		return buf, err
+	}
+	return c.inputBuffer.Peek(n)
+}
+
+// Skip implements Connection.
+func (c *tlsConnection) Skip(n int) (err error) {
+	if err = c.waitRead(n); err != nil {
+		return err
+	}
+	return c.inputBuffer.Skip(n)
+}
+
+// Discard implements Connection.
+func (c *tlsConnection) Discard(n int) (skipped int, err error) {
+	for skipped < n {
+		if err = c.waitRead(1); err != nil {
+			return skipped, err
+		}
+		l := c.inputBuffer.Len()
+		if l > n-skipped {
+			l = n - skipped
+		}
+		c.inputBuffer.Skip(l)
+		c.inputBuffer.Release()
+		skipped += l
+	}
+	return skipped, nil
+}
+
+// DiscardAll implements Connection, which discards the buffered plaintext.
+func (c *tlsConnection) DiscardAll() (skipped int, err error) {
+	return c.inputBuffer.DiscardAll()
+}
+
+// WriteTo implements Connection.
+func (c *tlsConnection) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		if err = c.waitRead(1); err != nil {
+			if errors.Is(err, ErrEOF) {
+				err = nil
+			}
+			return n, err
+		}
+		m, err := c.inputBuffer.WriteTo(w)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// SetUntilLimit implements Connection.
+func (c *tlsConnection) SetUntilLimit(bytes int) error {
+	if bytes >= 0 {
+		atomic.StoreInt64(&c.untilLimit, int64(bytes))
+	}
+	return nil
+}
+
+// SetMaxReadSize implements Connection, which limits the reads of the plaintext data.
+func (c *tlsConnection) SetMaxReadSize(bytes int) error {
+	if bytes >= 0 {
+		atomic.StoreInt64(&c.maxReadSize, int64(bytes))
+	}
+	return nil
+}
+
+// Until implements Connection.
+func (c *tlsConnection) Until(delim byte) (line []byte, err error) {
+	var n int
+	limit := int(atomic.LoadInt64(&c.untilLimit))
+	for {
+		if err = c.waitRead(n + 1); err != nil {
+			if errors.Is(err, ErrMessageTooLarge) {
+				return nil, err
+			}
+			// return all the data in the buffer
+			line, _ = c.inputBuffer.Next(c.inputBuffer.Len())
+			return
+		}
+		i := c.inputBuffer.indexByte(delim, n)
+		if limit > 0 && (i >= limit || i < 0 && c.inputBuffer.Len() >= limit) {
+			return nil, Exception(ErrLineTooLong, fmt.Sprintf("when tls until, limit[%d]", limit))
+		}
+		if i < 0 {
+			n = c.inputBuffer.Len() // skip all exists bytes
+			continue
+		}
+		return c.inputBuffer.Next(i + 1)
+	}
+}
+
+// ReadString implements Connection.
+func (c *tlsConnection) ReadString(n int) (s string, err error) {
+	if err = c.waitRead(n); err != nil {
+		return s, err
+	}
+	return c.inputBuffer.ReadString(n)
+}
+
+// ReadBinary implements Connection.
+func (c *tlsConnection) ReadBinary(n int) (p []byte, err error) {
+	if err = c.waitRead(n); err != nil {
+		return p, err
+	}
+	return c.inputBuffer.ReadBinary(n)
+}
+
+// ReadFull implements Connection.
+func (c *tlsConnection) ReadFull(p []byte) (n int, err error) {
+	if err = c.waitRead(len(p)); err != nil {
+		return 0, err
+	}
+	return c.inputBuffer.ReadFull(p)
+}
+
+// ReadByte implements Connection.
+func (c *tlsConnection) ReadByte() (b byte, err error) {
+	if err = c.waitRead(1); err != nil {
+		return b, err
+	}
+	return c.inputBuffer.ReadByte()
+}
+
+// Slice implements Connection.
+func (c *tlsConnection) Slice(n int) (r Reader, err error) {
+	if err = c.waitRead(n); err != nil {
+		return nil, err
+	}
+	return c.inputBuffer.Slice(n)
+}
+
+// Clone implements Connection, the data not read into the buffer yet is not cloned.
+func (c *tlsConnection) Clone() (r Reader) {
+	return c.inputBuffer.Clone()
+}
+
+// Release implements Connection.
+func (c *tlsConnection) Release() (err error) {
+	return c.inputBuffer.Release()
+}
+
+// Len implements Connection.
+func (c *tlsConnection) Len() (length int) {
+	return c.inputBuffer.Len()
+}
+
+// WaitReadSize implements Connection.
+func (c *tlsConnection) WaitReadSize(n int) (err error) {
+	return c.waitRead(n)
+}
+
+// ------------------------------------------ implement zero-copy writer ------------------------------------------
+
+// Malloc implements Connection.
+func (c *tlsConnection) Malloc(n int) (buf []byte, err error) {
+	c.autoFlush.malloc()
+	return c.outputBuffer.Malloc(n)
+}
+
+// TryMalloc implements Connection.
+func (c *tlsConnection) TryMalloc(n int) (buf []byte) {
+	c.autoFlush.malloc()
+	return c.outputBuffer.TryMalloc(n)
+}
+
+// MallocLen implements Connection.
+func (c *tlsConnection) MallocLen() (length int) {
+	return c.outputBuffer.MallocLen()
+}
+
+// MallocAck implements Connection.
+func (c *tlsConnection) MallocAck(n int) (err error) {
+	return c.outputBuffer.MallocAck(n)
+}
+
+// Append implements Connection.
+func (c *tlsConnection) Append(w Writer) (err error) {
+	return c.autoFlush.flushIfFull(c, c.outputBuffer.Append(w))
+}
+
+// AppendBuffer implements Connection.
+func (c *tlsConnection) AppendBuffer(r Reader, n int) (err error) {
+	return c.autoFlush.flushIfFull(c, c.outputBuffer.AppendBuffer(r, n))
+}
+
+// WriteString implements Connection.
+func (c *tlsConnection) WriteString(s string) (n int, err error) {
+	n, err = c.outputBuffer.WriteString(s)
+	return n, c.autoFlush.flushIfFull(c, err)
+}
+
+// WriteBinary implements Connection.
+func (c *tlsConnection) WriteBinary(b []byte) (n int, err error) {
+	n, err = c.outputBuffer.WriteBinary(b)
+	return n, c.autoFlush.flushIfFull(c, err)
+}
+
+// WriteDirect implements Connection.
+func (c *tlsConnection) WriteDirect(p []byte, remainCap int) (err error) {
+	return c.outputBuffer.WriteDirect(p, remainCap)
+}
+
+// WritevDirect implements Connection.
+func (c *tlsConnection) WritevDirect(bufs [][]byte) (err error) {
+	return c.outputBuffer.WritevDirect(bufs)
+}
+
+// WriteMmap implements Connection, data is copied and released at once,
+// since it's encrypted by Flush anyway, and the plaintext buffer is not recycled by Close.
+func (c *tlsConnection) WriteMmap(data []byte, release func()) (err error) {
+	defer release()
+	if !c.IsActive() {
+		return Exception(ErrConnClosed, "when write mmap")
+	}
+	_, err = c.outputBuffer.WriteBinary(data)
+	return err
+}
+
+// WriteByte implements Connection.
+func (c *tlsConnection) WriteByte(b byte) (err error) {
+	return c.autoFlush.flushIfFull(c, c.outputBuffer.WriteByte(b))
+}
+
+// Flush encrypts all the malloc data and writes it to the underlying connection.
+func (c *tlsConnection) Flush() (err error) {
+	c.autoFlush.flush()
+	c.outputBuffer.Flush()
+	n := c.outputBuffer.Len()
+	if n == 0 {
+		return nil
+	}
+	p, _ := c.outputBuffer.Next(n)
+	_, err = c.conn.Write(p)
+	c.outputBuffer.Release()
+	return err
+}
+
+// SetAutoFlush implements Writer.
+func (c *tlsConnection) SetAutoFlush(threshold int) error {
+	c.autoFlush.set(threshold)
+	return nil
+}
+
+// ReadFrom implements Connection.
+func (c *tlsConnection) ReadFrom(r io.Reader) (n int64, err error) {
+	return readFrom(c, r)
+}
+
+// FlushSync implements Connection.
+func (c *tlsConnection) FlushSync() (err error) {
+	if err = c.Flush(); err != nil {
+		return err
+	}
+	return c.Connection.Writer().FlushSync()
+}
+
+// ------------------------------------------ implement net.Conn ------------------------------------------
+
+// Read behavior is the same as Connection.Read.
+func (c *tlsConnection) Read(p []byte) (n int, err error) {
+	l := len(p)
+	if l == 0 {
+		return 0, nil
+	}
+	if err = c.waitRead(1); err != nil {
+		return 0, err
+	}
+	if has := c.inputBuffer.Len(); has < l {
+		l = has
+	}
+	src, err := c.inputBuffer.Next(l)
+	n = copy(p, src)
+	if err == nil {
+		err = c.inputBuffer.Release()
+	}
+	return n, err
+}
+
+// Readv implements Connection, which reads the plaintext into bufs.
+func (c *tlsConnection) Readv(bufs [][]byte) (n int, err error) {
+	if err = c.waitRead(1); err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(bufs) && c.inputBuffer.Len() > 0; i++ {
+		size := c.inputBuffer.Len()
+		if l := len(bufs[i]); size > l {
+			size = l
+		}
+		p, _ := c.inputBuffer.Next(size)
+		n += copy(bufs[i], p)
+	}
+	return n, c.inputBuffer.Release()
+}
+
+// Write behavior is the same as Connection.Write.
+func (c *tlsConnection) Write(p []byte) (n int, err error) {
+	dst, _ := c.outputBuffer.Malloc(len(p))
+	n = copy(dst, p)
+	return n, c.Flush()
+}
+
+// Close sends close_notify to the peer and closes the underlying connection.
+func (c *tlsConnection) Close() error {
+	return c.conn.Close()
+}
+
+// CloseWrite sends close_notify to the peer and shuts down the write side of the underlying connection.
+func (c *tlsConnection) CloseWrite() error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	if err := c.conn.CloseWrite(); err != nil {
+		return err
+	}
+	return c.Connection.CloseWrite()
+}
+
+// AsReader implements Connection.
+func (c *tlsConnection) AsReader() io.Reader {
+	return &eofReader{r: c}
+}
+
+// AsWriter implements Connection.
+func (c *tlsConnection) AsWriter() io.Writer {
+	return c
+}
+
+// InterruptRead implements Connection, it's unsupported since the tls stream can't be resumed after an error.
+func (c *tlsConnection) InterruptRead() error {
+	return Exception(ErrUnsupported, "when interrupt tls read")
+}
+
+// WriteAndClose implements Connection.
+func (c *tlsConnection) WriteAndClose(data []byte) error {
+	return writeAndClose(c, data)
+}
+
+// SetOnRequest implements Connection, and OnRequest will be called with the TLS connection.
+// Since OnRequest is triggered by the ciphertext, it's called again here until all the plaintext is read.
+func (c *tlsConnection) SetOnRequest(on OnRequest) error {
+	if on == nil {
+		return nil
+	}
+	return c.Connection.SetOnRequest(func(ctx context.Context, _ Connection) (err error) {
+		for {
+			err = on(ctx, c)
+			if c.inputBuffer.Len() == 0 || !c.IsActive() {
+				return err
+			}
+		}
+	})
+}
+
+// AddCloseCallback implements Connection, and the callback will be called with the TLS connection.
+func (c *tlsConnection) AddCloseCallback(callback CloseCallback) error {
+	if callback == nil {
+		return nil
+	}
+	return c.Connection.AddCloseCallback(func(Connection) error {
+		return callback(c)
+	})
+}
+
+// AddCloseReasonCallback implements Connection, and the callback will be called with the TLS connection.
+func (c *tlsConnection) AddCloseReasonCallback(callback CloseReasonCallback) error {
+	if callback == nil {
+		return nil
+	}
+	return c.Connection.AddCloseReasonCallback(func(_ Connection, reason error) error {
+		return callback(c, reason)
+	})
+}
+
+// Sendfile implements Connection, the file is encrypted by a buffered copy.
+func (c *tlsConnection) Sendfile(f *os.File, offset, count int64) (written int64, err error) {
+	if err = c.Flush(); err != nil {
+		return 0, err
+	}
+	for written < count {
+		size := count - written
+		if size > tlsMaxPlaintext {
+			size = tlsMaxPlaintext
+		}
+		buf, _ := c.outputBuffer.Malloc(int(size))
+		n, rerr := f.ReadAt(buf, offset+written)
+		c.outputBuffer.MallocAck(n)
+		if err = c.Flush(); err != nil {
+			return written, err
+		}
+		written += int64(n)
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+	return written, nil
+}
+
+// Splice implements Connection, the plaintext is moved by a buffered copy.
+func (c *tlsConnection) Splice(dst Connection, n int) (written int64, err error) {
+	w := dst.Writer()
+	for written < int64(n) {
+		if err = c.waitRead(1); err != nil {
+			return written, err
+		}
+		size := c.inputBuffer.Len()
+		if left := n - int(written); size > left {
+			size = left
+		}
+		p, _ := c.inputBuffer.Next(size)
+		buf, err := w.Malloc(size)
+		if err != nil {
+			return written, err
+		}
+		copy(buf, p)
+		c.inputBuffer.Release()
+		if err = w.Flush(); err != nil {
+			return written, err
+		}
+		written += int64(size)
+	}
+	return written, nil
+}
+
+// waitRead decrypts the records until n bytes of plaintext are available.
+func (c *tlsConnection) waitRead(n int) (err error) {
+	if err = checkReadSize(n, &c.maxReadSize); err != nil {
+		return err
+	}
+	for c.inputBuffer.Len() < n {
+		buf, _ := c.inputBuffer.Malloc(tlsMaxPlaintext)
+		m, err := c.conn.Read(buf)
+		c.inputBuffer.MallocAck(m)
+		c.inputBuffer.Flush()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return Exception(ErrEOF, "tls read")
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// tlsRecordConn is the net.Conn under tls.Conn, and each Read returns the data of up to one record,
+// so that the next records are still left in the Connection.
+type tlsRecordConn struct {
+	Connection
+	left int // the left length of the current record
+}
+
+// Read implements net.Conn.
+func (c *tlsRecordConn) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	reader := c.Connection.Reader()
+	if c.left == 0 {
+		header, err := reader.Peek(tlsRecordHeaderLen)
+		if err != nil {
+			return 0, c.convertErr(err)
+		}
+		c.left = tlsRecordHeaderLen + int(binary.BigEndian.Uint16(header[3:5]))
+	} else if reader.Len() == 0 {
+		if _, err = reader.Peek(1); err != nil {
+			return 0, c.convertErr(err)
+		}
+	}
+	n = reader.Len()
+	if n > c.left {
+		n = c.left
+	}
+	if n > len(p) {
+		n = len(p)
+	}
+	buf, err := reader.Next(n)
+	if err != nil {
+		return 0, err
+	}
+	copy(p, buf)
+	c.left -= n
+	return n, reader.Release()
+}
+
+// convertErr converts ErrEOF to io.EOF, which is expected by tls.Conn when the peer closed.
+func (c *tlsRecordConn) convertErr(err error) error {
+	if errors.Is(err, ErrEOF) {
+		return io.EOF
+	}
+	return err
+}
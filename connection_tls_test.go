@@ -0,0 +1,252 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package netpoll
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTLSConnectionServer(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	onRequest := func(ctx context.Context, connection Connection) error {
+		// called with the TLS connection
+		line, err := connection.Reader().Until('\n')
+		if err != nil {
+			return err
+		}
+		if string(line) == "bye\n" {
+			return connection.Close()
+		}
+		_, err = connection.Writer().WriteBinary(line)
+		MustNil(t, err)
+		return connection.Writer().Flush()
+	}
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			t.Fatal("replaced in OnConnect")
+			return nil
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			// handshake in OnConnect
+			conn, err := NewTLSConnection(connection, &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}})
+			MustNil(t, err)
+			MustNil(t, conn.SetOnRequest(onRequest))
+			return ctx
+		}))
+	defer loop.Shutdown(context.Background())
+
+	raw, err := net.Dial(network, address)
+	MustNil(t, err)
+	recorder := &tlsRecordRecorder{Conn: raw}
+	// TLS 1.2 sends the alerts in plaintext record type
+	client := tls.Client(recorder, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	defer client.Close()
+	// several pipelined requests in one write
+	_, err = client.Write([]byte("hello\nworld\n"))
+	MustNil(t, err)
+	buf := make([]byte, len("hello\nworld\n"))
+	_, err = io.ReadFull(client, buf)
+	MustNil(t, err)
+	Equal(t, string(buf), "hello\nworld\n")
+
+	// the server sends close_notify when closing
+	_, err = client.Write([]byte("bye\n"))
+	MustNil(t, err)
+	_, err = client.Read(buf)
+	Equal(t, err, io.EOF)
+	MustTrue(t, recorder.hasAlert())
+}
+
+func TestTLSConnectionClient(t *testing.T) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}})
+	MustNil(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	raw, err := DialConnection("tcp", ln.Addr().String(), time.Second)
+	MustNil(t, err)
+	conn, err := NewTLSClientConnection(raw, &tls.Config{InsecureSkipVerify: true})
+	MustNil(t, err)
+	var closed sync.WaitGroup
+	closed.Add(1)
+	conn.AddCloseCallback(func(connection Connection) error {
+		Assert(t, connection == conn)
+		closed.Done()
+		return nil
+	})
+
+	// larger than a record
+	size := 3*tlsMaxPlaintext + 1
+	_, err = conn.Writer().WriteBinary(make([]byte, size))
+	MustNil(t, err)
+	MustNil(t, conn.Writer().Flush())
+	_, err = conn.Reader().Next(size)
+	MustNil(t, err)
+	Equal(t, conn.Reader().Len(), 0)
+	MustNil(t, conn.Reader().Release())
+
+	MustNil(t, conn.Close())
+	closed.Wait()
+	_, err = conn.Reader().Next(1)
+	MustTrue(t, err != nil)
+}
+
+func TestTLSConnectionResumption(t *testing.T) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}})
+	MustNil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	// the session ticket is received after the handshake, so read a response before closing
+	dial := func(config *tls.Config) bool {
+		raw, err := DialConnection("tcp", ln.Addr().String(), time.Second)
+		MustNil(t, err)
+		conn, err := NewTLSClientConnection(raw, config)
+		MustNil(t, err)
+		defer conn.Close()
+		_, err = conn.Writer().WriteString("ping")
+		MustNil(t, err)
+		MustNil(t, conn.Writer().Flush())
+		s, err := conn.Reader().ReadString(len("ping"))
+		MustNil(t, err)
+		Equal(t, s, "ping")
+		return conn.(interface{ ConnectionState() tls.ConnectionState }).ConnectionState().DidResume
+	}
+	config := &tls.Config{InsecureSkipVerify: true, ClientSessionCache: tls.NewLRUClientSessionCache(16)}
+	MustTrue(t, !dial(config))
+	// the session is cached across the dials with the same config
+	MustTrue(t, dial(config))
+	// but never without a cache
+	noCache := &tls.Config{InsecureSkipVerify: true}
+	MustTrue(t, !dial(noCache))
+	MustTrue(t, !dial(noCache))
+}
+
+func TestTLSConnectionHandshakeFailed(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, wconn := &connection{}, &connection{}
+	rconn.init(&netFD{fd: r}, &options{})
+	wconn.init(&netFD{fd: w}, &options{})
+	defer rconn.Close()
+	defer wconn.Close()
+
+	_, err := wconn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	MustNil(t, err)
+	_, err = NewTLSConnection(rconn, &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}})
+	MustTrue(t, err != nil)
+}
+
+// tlsRecordRecorder records the types of the received TLS records.
+type tlsRecordRecorder struct {
+	net.Conn
+	mu    sync.Mutex
+	data  []byte
+	types []byte
+}
+
+func (r *tlsRecordRecorder) Read(p []byte) (n int, err error) {
+	n, err = r.Conn.Read(p)
+	r.mu.Lock()
+	r.data = append(r.data, p[:n]...)
+	for len(r.data) >= tlsRecordHeaderLen {
+		l := tlsRecordHeaderLen + int(r.data[3])<<8 + int(r.data[4])
+		if len(r.data) < l {
+			break
+		}
+		r.types = append(r.types, r.data[0])
+		r.data = r.data[l:]
+	}
+	r.mu.Unlock()
+	return n, err
+}
+
+func (r *tlsRecordRecorder) hasAlert() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, typ := range r.types {
+		if typ == 21 { // alert
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	testCertOnce sync.Once
+	testCert     tls.Certificate
+	testCertErr  error
+)
+
+func newTestCertificate(t *testing.T) tls.Certificate {
+	testCertOnce.Do(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			testCertErr = err
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "netpoll"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			testCertErr = err
+			return
+		}
+		testCert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	})
+	MustNil(t, testCertErr)
+	return testCert
+}
+
+var _ = errors.Is
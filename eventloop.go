@@ -26,12 +26,91 @@ type EventLoop interface {
 	// Serve will return an error which describes the specific reason.
 	Serve(ln net.Listener) error
 
+	// ServeMulti is the same as Serve, but registers all the listeners at once,
+	// e.g. a TCP listener with a Unix socket listener, and all of them share the same options and OnRequest.
+	// Options such as WithMaxConnections take effect on each listener separately.
+	// ServeMulti returns once any of the listeners exits, and Shutdown closes all of them.
+	ServeMulti(lns ...net.Listener) error
+
 	// Shutdown is used to graceful exit.
 	// It will close all idle connections on the server, but will not change the underlying pollers.
 	//
 	// Argument: ctx set the waiting deadline, after which an error will be returned,
 	// but will not force the closing of connections in progress.
+	// If WithGracefulShutdown is set, the connections in progress will be closed forcibly after the deadline,
+	// and a *ShutdownError will be returned.
 	Shutdown(ctx context.Context) error
+
+	// Stats returns the statistics of the pollers, which are cheap atomic reads.
+	// The pollers are shared by all EventLoops and dialers in the process, so are the statistics.
+	Stats() Stats
+
+	// PollerLoads returns the number of the active connections of the EventLoop on each poller,
+	// which is in the same order as Stats().Pollers and has the length of NumPollers,
+	// e.g. to find the imbalance of the connections before MigrateToPoller.
+	// Unlike the FDs of Stats, only the connections accepted by this EventLoop are counted.
+	PollerLoads() []int
+
+	// Range calls fn for each active connection served by the EventLoop, until fn returns false.
+	// It's safe against the connections opened and closed concurrently, which may or may not be visited,
+	// and fn can inspect the connection and Close it directly, e.g. to kick the connections from a banned IP.
+	Range(fn func(connection Connection) bool)
+
+	// RangeByTag is the same as Range, but only calls fn for the connections whose tag of key is value,
+	// see Connection.SetTag, e.g. to count or close the connections of a tenant.
+	RangeByTag(key, value string, fn func(connection Connection) bool)
+
+	// SetOnRequest replaces the OnRequest of the EventLoop atomically, e.g. to reload the handler on a config update,
+	// the new and existing connections call fn from their next OnRequest, while the running ones finish with the old.
+	// The middlewares of WithMiddleware are chained around fn again, and the connections replacing OnRequest
+	// by Connection.SetOnRequest are not affected. A nil fn is ignored, and ErrUnsupported is returned
+	// if the EventLoop is created without OnRequest, since its connections never call OnRequest.
+	SetOnRequest(fn OnRequest) error
+
+	// StateEvents returns the channel of the state transitions of the connections served by the EventLoop,
+	// from StateConnecting to StateActive, StateClosing and StateClosed, e.g. for the lifecycle observability.
+	// The events are delivered only after the first call, and the channel is shared by all the callers.
+	// The poller never blocks on it, the events are dropped once the buffer of stateEventsSize is full,
+	// and counted by DroppedStateEvents.
+	StateEvents() <-chan ConnEvent
+
+	// DroppedStateEvents returns the number of the events dropped since the channel of StateEvents was full.
+	DroppedStateEvents() uint64
+}
+
+// ConnState is the state of a connection reported by EventLoop.StateEvents.
+type ConnState int
+
+const (
+	// StateConnecting means the connection is accepted and being initialized, before OnPrepare.
+	StateConnecting ConnState = iota
+	// StateActive means the connection is registered into poller, before OnConnect.
+	StateActive
+	// StateClosing means the connection is being closed by the user or the peer.
+	StateClosing
+	// StateClosed means the connection is closed and its resources are released.
+	StateClosed
+)
+
+// String implements fmt.Stringer.
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateActive:
+		return "active"
+	case StateClosing:
+		return "closing"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// ConnEvent is a state transition of a connection.
+type ConnEvent struct {
+	RemoteAddr net.Addr
+	State      ConnState
 }
 
 /* The Connection Callback Sequence Diagram
@@ -39,7 +118,7 @@ type EventLoop interface {
 |   Connected but not initialized      |    OnPrepare      | Conn is not registered into poller
 |   Connected and initialized          |    OnConnect      | Conn is ready for read or write
 |   Read first byte                    |    OnRequest      | Conn is ready for read or write
-|   Peer closed but conn is active     |    OnDisconnect   | Conn access will race with OnRequest function
+|   Peer closed but conn is active     |    OnDisconnect   | Conn access will race with OnRequest function, not for self closed
 |   Self closed and conn is closed     |    CloseCallback  | Conn is destroyed
 
 Execution Order:
@@ -66,6 +145,11 @@ type OnPrepare func(connection Connection) context.Context
 // OnConnect will not block the poller since it's executed asynchronously.
 // Only after OnConnect finished the OnRequest could be executed.
 //
+// OnConnect can reject the connection, e.g. after authenticating the first few bytes,
+// by closing the connection or returning a ctx which has been canceled.
+// The rejected connection will be closed, and OnRequest will never be called.
+// If rejected by the ctx, the close reason seen by the CloseReasonCallback is ctx.Err(), e.g. context.Canceled.
+//
 // An example usage in TCP Proxy scenario:
 //
 //	func onConnect(ctx context.Context, upstream netpoll.Connection) context.Context {
@@ -81,6 +165,12 @@ type OnConnect func(ctx context.Context, connection Connection) context.Context
 // OnDisconnect is called once connection is going to be closed.
 // OnDisconnect must return as quick as possible because it will block poller.
 // OnDisconnect is different from CloseCallback, you could check with "The Connection Callback Sequence Diagram" section.
+//
+// It's called exactly once when the connection is closed by the peer or an error detected by poller,
+// but not when it's closed by the user, including being rejected in OnConnect.
+// If OnConnect is set, it's called only after OnConnect returned, and never for the connections that OnConnect is not finished.
+// It's called by poller while OnRequest may still be running, and before CloseCallback, which waits for OnRequest to return.
+// The data received before the close is still in Reader, but reading it would race with the running OnRequest.
 type OnDisconnect func(ctx context.Context, connection Connection)
 
 // OnRequest defines the function for handling connection. When data is sent from the connection peer,
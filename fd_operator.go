@@ -16,7 +16,9 @@ package netpoll
 
 import (
 	"runtime"
+	"sync"
 	"sync/atomic"
+	"unsafe"
 )
 
 // FDOperator is a collection of operations on file descriptors.
@@ -39,23 +41,78 @@ type FDOperator struct {
 	Outputs   func(vs [][]byte) (rs [][]byte, supportZeroCopy bool)
 	OutputAck func(n int) (err error)
 
+	// Read reads the socket into the buffers returned by Inputs instead of readv(2) if set,
+	// e.g. to receive the ancillary data, and it returns the same as readv(2).
+	Read func(bs [][]byte) (n int, err error)
+
 	// poll is the registered location of the file descriptor.
-	poll Poll
+	// migrated points to the Poll which the operator is moved to by MigrateToPoller, and overrides poll if set.
+	poll     Poll
+	migrated unsafe.Pointer // *Poll
 
 	// protect only detach once
 	detached int32
 
+	// paused and writing record the monitored events changed by PollR2Hup/PollHup2R and PollR2RW/PollRW2R,
+	// mux makes sure that they are modified together with the events.
+	mux     sync.Mutex
+	paused  int32
+	writing int32
+
+	// edge registers the readable events as edge-triggered by WithTriggerMode, so the socket must be drained on each event.
+	edge bool
+
+	// hupErr is the error that the poller hangs up the fd with, e.g. ECONNRESET, which is set before OnHup is called.
+	// It's accessed atomically, since OnHup runs asynchronously and may race with the reset by a concurrent close.
+	hupErr unsafe.Pointer // *error
+
 	// private, used by operatorCache
 	next  *FDOperator
-	state int32 // CAS: 0(unused) 1(inuse) 2(do-done)
-	index int32 // index in operatorCache
+	state int32          // CAS: 0(unused) 1(inuse) 2(do-done)
+	index int32          // index in operatorCache
+	cache *operatorCache // the operatorCache allocated from, which may not belong to poll after migration
 }
 
 func (op *FDOperator) Control(event PollEvent) error {
 	if event == PollDetach && atomic.AddInt32(&op.detached, 1) > 1 {
 		return nil
 	}
-	return op.poll.Control(op, event)
+	return op.getPoll().Control(op, event)
+}
+
+// getPoll returns the Poll where the file descriptor is registered currently.
+func (op *FDOperator) getPoll() Poll {
+	if p := atomic.LoadPointer(&op.migrated); p != nil {
+		return *(*Poll)(p)
+	}
+	return op.poll
+}
+
+// setPoll is called by the migration with mux held, the concurrent controls are redirected to poll.
+func (op *FDOperator) setPoll(poll Poll) {
+	atomic.StorePointer(&op.migrated, unsafe.Pointer(&poll))
+}
+
+// isPaused reports whether the readable monitor has been removed by PollR2Hup.
+func (op *FDOperator) isPaused() bool {
+	return atomic.LoadInt32(&op.paused) == 1
+}
+
+// setHupErr records the reason of hanging up, nil if unknown.
+func (op *FDOperator) setHupErr(err error) {
+	if err == nil {
+		atomic.StorePointer(&op.hupErr, nil)
+		return
+	}
+	atomic.StorePointer(&op.hupErr, unsafe.Pointer(&err))
+}
+
+// getHupErr returns the reason recorded by setHupErr.
+func (op *FDOperator) getHupErr() error {
+	if p := atomic.LoadPointer(&op.hupErr); p != nil {
+		return *(*error)(p)
+	}
+	return nil
 }
 
 func (op *FDOperator) Free() {
@@ -97,6 +154,11 @@ func (op *FDOperator) reset() {
 	op.OnRead, op.OnWrite, op.OnHup = nil, nil, nil
 	op.Inputs, op.InputAck = nil, nil
 	op.Outputs, op.OutputAck = nil, nil
+	op.Read = nil
 	op.poll = nil
+	atomic.StorePointer(&op.migrated, nil)
 	op.detached = 0
+	op.paused, op.writing = 0, 0
+	op.edge = false
+	atomic.StorePointer(&op.hupErr, nil)
 }
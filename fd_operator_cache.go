@@ -47,7 +47,7 @@ func (c *operatorCache) alloc() *FDOperator {
 		}
 		index := int32(len(c.cache))
 		for i := uintptr(0); i < n; i++ {
-			pd := &FDOperator{index: index}
+			pd := &FDOperator{index: index, cache: c}
 			c.cache = append(c.cache, pd)
 			pd.next = c.first
 			c.first = pd
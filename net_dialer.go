@@ -20,9 +20,17 @@ package netpoll
 import (
 	"context"
 	"net"
+	"strings"
+	"sync"
 	"time"
 )
 
+// lookupIPAddr and dialTCPAddr are replaced by tests to mock the resolver and the connect
+var (
+	lookupIPAddr = net.DefaultResolver.LookupIPAddr
+	dialTCPAddr  = dialTCP
+)
+
 // DialConnection is a default implementation of Dialer.
 func DialConnection(network, address string, timeout time.Duration) (connection Connection, err error) {
 	return defaultDialer.DialConnection(network, address, timeout)
@@ -44,14 +52,23 @@ func NewFDConnection(fd int) (Connection, error) {
 	return conn, nil
 }
 
-// NewDialer only support TCP and unix socket now.
-func NewDialer() Dialer {
-	return &dialer{}
+// NewDialer supports TCP, UDP and unix socket now.
+// The options, like WithTCPNoDelay, are applied to the dialed TCP connections.
+func NewDialer(ops ...Option) Dialer {
+	opts := &options{
+		tcpNoDelay: true,
+	}
+	for _, do := range ops {
+		do.f(opts)
+	}
+	return &dialer{opts: opts}
 }
 
 var defaultDialer = NewDialer()
 
-type dialer struct{}
+type dialer struct {
+	opts *options
+}
 
 // DialTimeout implements Dialer.
 func (d *dialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
@@ -66,54 +83,147 @@ func (d *dialer) DialConnection(network, address string, timeout time.Duration)
 		defer cancel()
 		ctx = subCtx
 	}
+	return d.DialContext(ctx, network, address)
+}
+
+// DialWithData implements Dialer.
+func (d *dialer) DialWithData(network, address string, data []byte, timeout time.Duration) (connection Connection, err error) {
+	return dialWithData(d, network, address, data, timeout)
+}
+
+// DialMany implements Dialer.
+func (d *dialer) DialMany(network, address string, count int, timeout time.Duration) (connections []Connection, err error) {
+	return dialMany(d, network, address, count, timeout)
+}
+
+// dialMany dials count connections by d concurrently, which share the deadline of timeout.
+func dialMany(d Dialer, network, address string, count int, timeout time.Duration) (connections []Connection, err error) {
+	if count <= 0 {
+		return nil, nil
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		subCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		ctx = subCtx
+	}
+	conns := make([]Connection, count)
+	errs := make([]error, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conns[i], errs[i] = d.DialContext(ctx, network, address)
+		}(i)
+	}
+	wg.Wait()
+
+	var derr *DialManyError
+	connections = conns[:0]
+	for i := range conns {
+		if errs[i] == nil {
+			connections = append(connections, conns[i])
+			continue
+		}
+		if derr == nil {
+			derr = &DialManyError{Err: errs[i]}
+		}
+		derr.Failed++
+	}
+	if derr != nil {
+		return connections, derr
+	}
+	return connections, nil
+}
+
+// dialWithData dials by d and writes data, with TCP Fast Open the first write is sent with the SYN,
+// since the connect is deferred to it.
+func dialWithData(d Dialer, network, address string, data []byte, timeout time.Duration) (connection Connection, err error) {
+	connection, err = d.DialConnection(network, address, timeout)
+	if err != nil || len(data) == 0 {
+		return connection, err
+	}
+	if _, err = connection.Writer().WriteBinary(data); err == nil {
+		err = connection.Writer().Flush()
+	}
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return connection, nil
+}
 
+// DialContext implements Dialer.
+func (d *dialer) DialContext(ctx context.Context, network, address string) (connection Connection, err error) {
 	switch network {
 	case "tcp", "tcp4", "tcp6":
 		return d.dialTCP(ctx, network, address)
-	// case "udp", "udp4", "udp6":  // TODO: unsupported now
+	case "udp", "udp4", "udp6":
+		return d.dialUDP(ctx, network, address)
 	case "unix", "unixgram", "unixpacket":
 		raddr := &UnixAddr{
 			UnixAddr: net.UnixAddr{Name: address, Net: network},
 		}
-		return DialUnix(network, nil, raddr)
+		var laddr *UnixAddr
+		switch addr := d.opts.localAddr.(type) {
+		case nil:
+		case *net.UnixAddr:
+			laddr = &UnixAddr{UnixAddr: *addr}
+		case *UnixAddr:
+			laddr = addr
+		default:
+			return nil, &net.OpError{Op: "dial", Net: network, Source: addr, Addr: raddr, Err: errLocalAddrType}
+		}
+		return dialUnix(ctx, network, laddr, raddr, d.opts)
 	default:
 		return nil, net.UnknownNetworkError(network)
 	}
 }
 
 func (d *dialer) dialTCP(ctx context.Context, network, address string) (connection *TCPConnection, err error) {
-	host, port, err := net.SplitHostPort(address)
+	ipaddrs, portnum, err := resolveIPAddrs(ctx, d.opts.resolver, network, address)
 	if err != nil {
 		return nil, err
 	}
-	var portnum int
-	if portnum, err = net.DefaultResolver.LookupPort(ctx, network, port); err != nil {
-		return nil, err
+	var laddr *TCPAddr
+	switch addr := d.opts.localAddr.(type) {
+	case nil:
+	case *net.TCPAddr:
+		laddr = &TCPAddr{TCPAddr: *addr}
+	case *TCPAddr:
+		laddr = addr
+	case *net.IPAddr:
+		laddr = &TCPAddr{TCPAddr: net.TCPAddr{IP: addr.IP, Zone: addr.Zone}}
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Source: addr, Addr: nil, Err: errLocalAddrType}
 	}
-	var ipaddrs []net.IPAddr
-	// host maybe empty if address is :12345
-	if host == "" {
-		ipaddrs = []net.IPAddr{{}}
-	} else {
-		ipaddrs, err = net.DefaultResolver.LookupIPAddr(ctx, host)
-		if err != nil {
-			return nil, err
-		}
-		if len(ipaddrs) == 0 {
-			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	if d.opts.fallbackDelay > 0 && network == "tcp" {
+		if primaries, fallbacks := partitionIPv6(ipaddrs); len(primaries) > 0 && len(fallbacks) > 0 {
+			return d.dialParallel(ctx, network, laddr, primaries, fallbacks, portnum)
 		}
 	}
+	return d.dialSerial(ctx, network, laddr, ipaddrs, portnum)
+}
 
+// dialSerial dials the addresses in order until one succeeds.
+func (d *dialer) dialSerial(ctx context.Context, network string, laddr *TCPAddr, ipaddrs []net.IPAddr, portnum int) (connection *TCPConnection, err error) {
 	var firstErr error // The error from the first address is most relevant.
 	tcpAddr := &TCPAddr{}
 	for _, ipaddr := range ipaddrs {
+		if laddr != nil && !sameFamily(laddr.IP, ipaddr.IP) {
+			if firstErr == nil {
+				firstErr = &net.OpError{Op: "dial", Net: network, Source: laddr, Addr: &TCPAddr{net.TCPAddr{IP: ipaddr.IP, Port: portnum, Zone: ipaddr.Zone}}, Err: errLocalFamily}
+			}
+			continue
+		}
 		tcpAddr.IP = ipaddr.IP
 		tcpAddr.Port = portnum
 		tcpAddr.Zone = ipaddr.Zone
 		if ipaddr.IP != nil && ipaddr.IP.To4() == nil {
-			connection, err = DialTCP(ctx, "tcp6", nil, tcpAddr)
+			connection, err = dialTCPAddr(ctx, "tcp6", laddr, tcpAddr, d.opts)
 		} else {
-			connection, err = DialTCP(ctx, "tcp", nil, tcpAddr)
+			connection, err = dialTCPAddr(ctx, "tcp", laddr, tcpAddr, d.opts)
 		}
 		if err == nil {
 			return connection, nil
@@ -134,8 +244,176 @@ func (d *dialer) dialTCP(ctx context.Context, network, address string) (connecti
 	return nil, firstErr
 }
 
+// dialParallel races the IPv6 primaries and the IPv4 fallbacks by RFC 8305,
+// the fallbacks start after the head-start of primaries or once the primaries failed.
+// It returns the first established connection, and closes the one of the other attempt if it also succeeds.
+func (d *dialer) dialParallel(ctx context.Context, network string, laddr *TCPAddr, primaries, fallbacks []net.IPAddr, portnum int) (*TCPConnection, error) {
+	type dialResult struct {
+		connection *TCPConnection
+		err        error
+		primary    bool
+		done       bool
+	}
+	results := make(chan dialResult) // unbuffered
+	returned := make(chan struct{})
+	defer close(returned)
+
+	startRacer := func(ctx context.Context, primary bool) {
+		ipaddrs := primaries
+		if !primary {
+			ipaddrs = fallbacks
+		}
+		connection, err := d.dialSerial(ctx, network, laddr, ipaddrs, portnum)
+		select {
+		case results <- dialResult{connection: connection, err: err, primary: primary, done: true}:
+		case <-returned:
+			if connection != nil {
+				connection.Close()
+			}
+		}
+	}
+
+	var primary, fallback dialResult
+	primaryCtx, primaryCancel := context.WithCancel(ctx)
+	defer primaryCancel()
+	go startRacer(primaryCtx, true)
+
+	fallbackTimer := time.NewTimer(d.opts.fallbackDelay)
+	defer fallbackTimer.Stop()
+	for {
+		select {
+		case <-fallbackTimer.C:
+			fallbackCtx, fallbackCancel := context.WithCancel(ctx)
+			defer fallbackCancel()
+			go startRacer(fallbackCtx, false)
+		case res := <-results:
+			if res.err == nil {
+				return res.connection, nil
+			}
+			if res.primary {
+				primary = res
+			} else {
+				fallback = res
+			}
+			if primary.done && fallback.done {
+				return nil, primary.err
+			}
+			// start the fallbacks immediately if the primaries failed
+			if res.primary && fallbackTimer.Stop() {
+				fallbackTimer.Reset(0)
+			}
+		}
+	}
+}
+
+// partitionIPv6 divides the addresses into the IPv6 ones and the IPv4 ones.
+func partitionIPv6(ipaddrs []net.IPAddr) (ipv6s, ipv4s []net.IPAddr) {
+	for _, ipaddr := range ipaddrs {
+		if ipaddr.IP != nil && ipaddr.IP.To4() == nil {
+			ipv6s = append(ipv6s, ipaddr)
+		} else {
+			ipv4s = append(ipv4s, ipaddr)
+		}
+	}
+	return ipv6s, ipv4s
+}
+
+func (d *dialer) dialUDP(ctx context.Context, network, address string) (connection *UDPConnection, err error) {
+	ipaddrs, portnum, err := resolveIPAddrs(ctx, d.opts.resolver, network, address)
+	if err != nil {
+		return nil, err
+	}
+	var laddr *UDPAddr
+	switch addr := d.opts.localAddr.(type) {
+	case nil:
+	case *net.UDPAddr:
+		laddr = &UDPAddr{UDPAddr: *addr}
+	case *UDPAddr:
+		laddr = addr
+	case *net.IPAddr:
+		laddr = &UDPAddr{UDPAddr: net.UDPAddr{IP: addr.IP, Zone: addr.Zone}}
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Source: addr, Addr: nil, Err: errLocalAddrType}
+	}
+
+	var firstErr error // The error from the first address is most relevant.
+	udpAddr := &UDPAddr{}
+	for _, ipaddr := range ipaddrs {
+		if laddr != nil && !sameFamily(laddr.IP, ipaddr.IP) {
+			if firstErr == nil {
+				firstErr = &net.OpError{Op: "dial", Net: network, Source: laddr, Addr: &UDPAddr{net.UDPAddr{IP: ipaddr.IP, Port: portnum, Zone: ipaddr.Zone}}, Err: errLocalFamily}
+			}
+			continue
+		}
+		udpAddr.IP = ipaddr.IP
+		udpAddr.Port = portnum
+		udpAddr.Zone = ipaddr.Zone
+		if ipaddr.IP != nil && ipaddr.IP.To4() == nil {
+			connection, err = DialUDP(ctx, "udp6", laddr, udpAddr)
+		} else {
+			connection, err = DialUDP(ctx, "udp", laddr, udpAddr)
+		}
+		if err == nil {
+			return connection, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr == nil {
+		firstErr = &net.OpError{Op: "dial", Net: network, Source: nil, Addr: nil, Err: errMissingAddress}
+	}
+	return nil, firstErr
+}
+
+// sameFamily reports whether the local and remote IPs are in the same family, a nil IP matches any family.
+func sameFamily(local, remote net.IP) bool {
+	if local == nil || remote == nil {
+		return true
+	}
+	return (local.To4() != nil) == (remote.To4() != nil)
+}
+
+// resolveIPAddrs resolves the host and port of address, the returned ipaddrs is never empty if err is nil.
+// The host name is resolved by resolver if not nil, while the literal IP is always parsed by the net package.
+func resolveIPAddrs(ctx context.Context, resolver Resolver, network, address string) (ipaddrs []net.IPAddr, portnum int, err error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	if portnum, err = net.DefaultResolver.LookupPort(ctx, network, port); err != nil {
+		return nil, 0, err
+	}
+	// host maybe empty if address is :12345
+	if host == "" {
+		return []net.IPAddr{{}}, portnum, nil
+	}
+	if resolver != nil && !isLiteralIP(host) {
+		ipaddrs, err = resolver.LookupIPAddr(ctx, host)
+	} else {
+		ipaddrs, err = lookupIPAddr(ctx, host)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(ipaddrs) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ipaddrs, portnum, nil
+}
+
+// isLiteralIP reports whether host is an IP address, which may have an IPv6 zone.
+func isLiteralIP(host string) bool {
+	if i := strings.LastIndexByte(host, '%'); i > 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host) != nil
+}
+
 // sysDialer contains a Dial's parameters and configuration.
 type sysDialer struct {
 	net.Dialer
 	network, address string
+	opts             *options // applied to the connection before registered into poller
 }
@@ -0,0 +1,86 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package netpoll
+
+import (
+	"context"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpiOptSynData is TCPI_OPT_SYN_DATA of tcpi_options, set if the data in the SYN is acked by the server.
+const tcpiOptSynData = 0x20
+
+func TestDialerFastOpen(t *testing.T) {
+	p, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	MustNil(t, err)
+	if mode, _ := strconv.Atoi(strings.TrimSpace(string(p))); mode&3 != 3 {
+		t.Skip("TCP Fast Open is not enabled for both sides by net.ipv4.tcp_fastopen")
+	}
+	network, address := "tcp", getTestAddress()
+	ln, err := CreateListener(network, address, WithFastOpen(true))
+	MustNil(t, err)
+	defer ln.Close()
+	qlen, err := unix.GetsockoptInt(ln.Fd(), unix.IPPROTO_TCP, unix.TCP_FASTOPEN)
+	MustNil(t, err)
+	Equal(t, qlen, fastOpenQueueLen)
+
+	loop, err := NewEventLoop(func(ctx context.Context, connection Connection) error {
+		buf, err := connection.Reader().Next(connection.Reader().Len())
+		if err != nil {
+			return err
+		}
+		connection.Writer().WriteBinary(buf)
+		return connection.Writer().Flush()
+	}, WithFastOpen(true))
+	MustNil(t, err)
+	go loop.Serve(ln)
+	defer loop.Shutdown(context.Background())
+
+	dialer := NewDialer(WithFastOpen(true))
+	// the first connection gets the cookie if not cached, then the data is sent with the SYN
+	for i := 0; i < 2; i++ {
+		conn, err := dialer.DialWithData(network, address, []byte("ping"), time.Second)
+		MustNil(t, err)
+		s, err := conn.Reader().ReadString(len("ping"))
+		MustNil(t, err)
+		Equal(t, s, "ping")
+		info, err := unix.GetsockoptTCPInfo(conn.(*TCPConnection).fd, unix.IPPROTO_TCP, unix.TCP_INFO)
+		MustNil(t, err)
+		if i > 0 {
+			Assert(t, info.Options&tcpiOptSynData != 0, info.Options)
+		}
+		MustNil(t, conn.Close())
+	}
+
+	// the data is written after the handshake without TCP Fast Open
+	conn, err := NewDialer().DialWithData(network, address, []byte("ping"), time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	s, err := conn.Reader().ReadString(len("ping"))
+	MustNil(t, err)
+	Equal(t, s, "ping")
+	info, err := unix.GetsockoptTCPInfo(conn.(*TCPConnection).fd, unix.IPPROTO_TCP, unix.TCP_INFO)
+	MustNil(t, err)
+	Equal(t, info.Options&tcpiOptSynData, uint8(0))
+}
@@ -0,0 +1,277 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package netpoll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Version   = 0x05
+	socks5NoAuth    = 0x00
+	socks5UserPass  = 0x02
+	socks5NoMethods = 0xff
+	socks5Connect   = 0x01
+	socks5IPv4      = 0x01
+	socks5Domain    = 0x03
+	socks5IPv6      = 0x04
+)
+
+var socks5Replies = [...]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// ProxyAuth is the username/password authentication of SOCKS5 (RFC 1929).
+type ProxyAuth struct {
+	Username string
+	Password string
+}
+
+// NewProxyDialer returns a Dialer which dials TCP connections through the SOCKS5 proxy at proxyAddr.
+// If auth is not nil, the username/password authentication is offered besides no authentication.
+// The handshake is done by the Connection registered into the poller, which is returned as
+// the connection to the address if succeeded, and the dial timeout includes the handshake.
+// Note that RemoteAddr of the returned connection is the address of the proxy.
+// The errors from the proxy are prefixed with "socks5", e.g. "socks5 connect: connection refused".
+func NewProxyDialer(proxyAddr string, auth *ProxyAuth) Dialer {
+	return &proxyDialer{
+		dialer:    NewDialer(),
+		proxyAddr: proxyAddr,
+		auth:      auth,
+	}
+}
+
+type proxyDialer struct {
+	dialer    Dialer
+	proxyAddr string
+	auth      *ProxyAuth
+}
+
+// DialTimeout implements Dialer.
+func (d *proxyDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	return d.DialConnection(network, address, timeout)
+}
+
+// DialConnection implements Dialer.
+func (d *proxyDialer) DialConnection(network, address string, timeout time.Duration) (connection Connection, err error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		subCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		ctx = subCtx
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+// DialWithData implements Dialer, and data is written after the handshake with the proxy.
+func (d *proxyDialer) DialWithData(network, address string, data []byte, timeout time.Duration) (connection Connection, err error) {
+	return dialWithData(d, network, address, data, timeout)
+}
+
+// DialMany implements Dialer, and each connection makes its own handshake with the proxy.
+func (d *proxyDialer) DialMany(network, address string, count int, timeout time.Duration) (connections []Connection, err error) {
+	return dialMany(d, network, address, count, timeout)
+}
+
+// DialContext implements Dialer.
+func (d *proxyDialer) DialContext(ctx context.Context, network, address string) (connection Connection, err error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	// the blocking reads of the handshake are interrupted by closing the connection
+	stop, canceled := make(chan struct{}), make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			canceled <- true
+		case <-stop:
+			canceled <- false
+		}
+	}()
+	deadline, _ := ctx.Deadline()
+	err = d.handshake(conn, address, deadline)
+	close(stop)
+	if <-canceled {
+		err = mapErr(ctx.Err())
+	}
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: conn.RemoteAddr(), Err: err}
+	}
+	conn.SetReadTimeout(0)
+	return conn, nil
+}
+
+// handshake negotiates the authentication method and sends CONNECT to the proxy.
+func (d *proxyDialer) handshake(conn Connection, address string, deadline time.Time) (err error) {
+	req, err := socks5ConnectRequest(address)
+	if err != nil {
+		return err
+	}
+	methods := []byte{socks5Version, 1, socks5NoAuth}
+	if d.auth != nil {
+		methods = []byte{socks5Version, 2, socks5NoAuth, socks5UserPass}
+	}
+	reply, err := socks5RoundTrip(conn, methods, 2, deadline)
+	if err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("socks5 handshake: unexpected version[%d]", reply[0])
+	}
+	switch reply[1] {
+	case socks5NoAuth:
+	case socks5UserPass:
+		if d.auth == nil {
+			return errors.New("socks5 handshake: unexpected username/password authentication")
+		}
+		if err = d.authenticate(conn, deadline); err != nil {
+			return err
+		}
+	case socks5NoMethods:
+		return errors.New("socks5 handshake: no acceptable authentication methods")
+	default:
+		return fmt.Errorf("socks5 handshake: unsupported authentication method[%d]", reply[1])
+	}
+
+	// VER REP RSV ATYP BND.ADDR BND.PORT
+	reply, err = socks5RoundTrip(conn, req, 4, deadline)
+	if err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("socks5 connect: unexpected version[%d]", reply[0])
+	}
+	if code := int(reply[1]); code != 0 {
+		if code < len(socks5Replies) && socks5Replies[code] != "" {
+			return fmt.Errorf("socks5 connect: %s", socks5Replies[code])
+		}
+		return fmt.Errorf("socks5 connect: unknown reply[%d]", code)
+	}
+	var size int
+	switch reply[3] {
+	case socks5IPv4:
+		size = net.IPv4len
+	case socks5IPv6:
+		size = net.IPv6len
+	case socks5Domain:
+		l, err := conn.Reader().ReadByte()
+		if err != nil {
+			return err
+		}
+		size = int(l)
+	default:
+		return fmt.Errorf("socks5 connect: unknown address type[%d]", reply[3])
+	}
+	if err = conn.Reader().Skip(size + 2); err != nil {
+		return err
+	}
+	return conn.Reader().Release()
+}
+
+// authenticate sends the username/password to the proxy.
+func (d *proxyDialer) authenticate(conn Connection, deadline time.Time) error {
+	user, pass := d.auth.Username, d.auth.Password
+	if len(user) == 0 || len(user) > 255 || len(pass) > 255 {
+		return errors.New("socks5 auth: invalid username or password length")
+	}
+	req := make([]byte, 0, 3+len(user)+len(pass))
+	req = append(req, 0x01, byte(len(user)))
+	req = append(req, user...)
+	req = append(req, byte(len(pass)))
+	req = append(req, pass...)
+	reply, err := socks5RoundTrip(conn, req, 2, deadline)
+	if err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("socks5 auth: username/password rejected")
+	}
+	return nil
+}
+
+// socks5RoundTrip sends the request and reads n bytes of the reply before the deadline.
+func socks5RoundTrip(conn Connection, req []byte, n int, deadline time.Time) (reply []byte, err error) {
+	if _, err = conn.Writer().WriteBinary(req); err != nil {
+		return nil, err
+	}
+	if err = conn.Writer().Flush(); err != nil {
+		return nil, err
+	}
+	if !deadline.IsZero() {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return nil, Exception(ErrDialTimeout, "socks5 handshake")
+		}
+		conn.SetReadTimeout(timeout)
+	}
+	return conn.Reader().ReadBinary(n)
+}
+
+// socks5ConnectRequest builds the CONNECT request to address.
+func socks5ConnectRequest(address string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portnum, err := strconv.Atoi(port)
+	if err != nil {
+		if portnum, err = net.DefaultResolver.LookupPort(context.Background(), "tcp", port); err != nil {
+			return nil, err
+		}
+	}
+	if portnum < 0 || portnum > 0xffff {
+		return nil, fmt.Errorf("socks5 connect: invalid port[%d]", portnum)
+	}
+
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("socks5 connect: invalid host[%s]", host)
+		}
+		req = append(req, socks5Domain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5IPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5IPv6)
+		req = append(req, ip...)
+	}
+	return append(req, byte(portnum>>8), byte(portnum)), nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package netpoll
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveSocks5 serves a minimal SOCKS5 proxy which supports CONNECT and the username/password authentication.
+func serveSocks5(ln net.Listener, auth *ProxyAuth) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			buf := make([]byte, 512)
+			// methods
+			if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+				return
+			}
+			methods := buf[:buf[1]]
+			io.ReadFull(conn, methods)
+			want := byte(socks5NoAuth)
+			if auth != nil {
+				want = socks5UserPass
+			}
+			if !strings.Contains(string(methods), string([]byte{want})) {
+				conn.Write([]byte{socks5Version, socks5NoMethods})
+				return
+			}
+			conn.Write([]byte{socks5Version, want})
+			if auth != nil {
+				io.ReadFull(conn, buf[:2])
+				user := make([]byte, buf[1])
+				io.ReadFull(conn, user)
+				io.ReadFull(conn, buf[:1])
+				pass := make([]byte, buf[0])
+				io.ReadFull(conn, pass)
+				if string(user) != auth.Username || string(pass) != auth.Password {
+					conn.Write([]byte{0x01, 0x01})
+					return
+				}
+				conn.Write([]byte{0x01, 0x00})
+			}
+			// connect
+			io.ReadFull(conn, buf[:4])
+			var host string
+			switch buf[3] {
+			case socks5IPv4:
+				io.ReadFull(conn, buf[:net.IPv4len])
+				host = net.IP(buf[:net.IPv4len]).String()
+			case socks5Domain:
+				io.ReadFull(conn, buf[:1])
+				name := make([]byte, buf[0])
+				io.ReadFull(conn, name)
+				host = string(name)
+			}
+			io.ReadFull(conn, buf[:2])
+			port := int(buf[0])<<8 | int(buf[1])
+			target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+			if err != nil {
+				conn.Write([]byte{socks5Version, 0x05, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+				return
+			}
+			defer target.Close()
+			conn.Write([]byte{socks5Version, 0, 0, socks5Domain, 4, 'b', 'i', 'n', 'd', 0, 0})
+			go io.Copy(target, conn)
+			io.Copy(conn, target)
+		}()
+	}
+}
+
+func TestProxyDialer(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			buf, err := connection.Reader().Next(connection.Reader().Len())
+			if err != nil {
+				return err
+			}
+			connection.Writer().WriteBinary(buf)
+			return connection.Writer().Flush()
+		})
+	defer loop.Shutdown(context.Background())
+
+	auth := &ProxyAuth{Username: "user", Password: "pass"}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	MustNil(t, err)
+	defer ln.Close()
+	go serveSocks5(ln, auth)
+
+	// connect through the proxy with the domain address
+	_, port, _ := net.SplitHostPort(address)
+	dialer := NewProxyDialer(ln.Addr().String(), auth)
+	conn, err := dialer.DialConnection(network, "localhost:"+port, time.Second)
+	MustNil(t, err)
+	_, err = conn.Writer().WriteString("hello")
+	MustNil(t, err)
+	MustNil(t, conn.Writer().Flush())
+	p, err := conn.Reader().Next(5)
+	MustNil(t, err)
+	Equal(t, string(p), "hello")
+	MustNil(t, conn.Close())
+
+	// authentication failed
+	dialer = NewProxyDialer(ln.Addr().String(), &ProxyAuth{Username: "user", Password: "wrong"})
+	_, err = dialer.DialConnection(network, address, time.Second)
+	MustTrue(t, err != nil && strings.Contains(err.Error(), "socks5 auth"))
+	dialer = NewProxyDialer(ln.Addr().String(), nil)
+	_, err = dialer.DialConnection(network, address, time.Second)
+	MustTrue(t, err != nil && strings.Contains(err.Error(), "no acceptable authentication methods"))
+
+	// the target refused
+	dialer = NewProxyDialer(ln.Addr().String(), auth)
+	_, err = dialer.DialConnection(network, getTestAddress(), time.Second)
+	MustTrue(t, err != nil && strings.Contains(err.Error(), "socks5 connect: connection refused"))
+	_, err = dialer.DialConnection("udp", address, time.Second)
+	MustTrue(t, err != nil)
+}
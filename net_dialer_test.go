@@ -19,7 +19,9 @@ package netpoll
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"runtime"
 	"strconv"
 	"strings"
@@ -64,6 +66,247 @@ func TestDialerTCP(t *testing.T) {
 	Equal(t, conn.RemoteAddr().String(), address)
 }
 
+func TestDialerTCPNoDelay(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	accepted := make(chan int, 1)
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			return nil
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			n, _ := syscall.GetsockoptInt(connection.(Conn).Fd(), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+			accepted <- n
+			return ctx
+		}),
+		WithTCPNoDelay(false),
+	)
+	defer loop.Shutdown(context.Background())
+
+	// enabled by default
+	conn, err := NewDialer().DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	n, _ := syscall.GetsockoptInt(conn.(Conn).Fd(), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	MustTrue(t, n > 0)
+	// accepted connections inherit the option of EventLoop
+	Equal(t, <-accepted, 0)
+	conn.Close()
+
+	conn, err = NewDialer(WithTCPNoDelay(false)).DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	n, _ = syscall.GetsockoptInt(conn.(Conn).Fd(), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	Equal(t, n, 0)
+	Equal(t, <-accepted, 0)
+	conn.Close()
+}
+
+func TestDialerSocketBuffers(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	recvBuf, sendBuf := 64*1024, 96*1024
+	accepted := make(chan [2]int, 1)
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			return nil
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			rcv, err := connection.RecvBufSize()
+			MustNil(t, err)
+			snd, err := connection.SendBufSize()
+			MustNil(t, err)
+			accepted <- [2]int{rcv, snd}
+			return ctx
+		}),
+		WithRecvBuf(recvBuf), WithSendBuf(sendBuf),
+	)
+	defer loop.Shutdown(context.Background())
+
+	// Linux doubles the values
+	expected := func(bytes int) int {
+		if runtime.GOOS == "linux" {
+			return 2 * bytes
+		}
+		return bytes
+	}
+	conn, err := NewDialer(WithRecvBuf(recvBuf), WithSendBuf(sendBuf)).DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	rcv, err := conn.RecvBufSize()
+	MustNil(t, err)
+	Equal(t, rcv, expected(recvBuf))
+	snd, err := conn.SendBufSize()
+	MustNil(t, err)
+	Equal(t, snd, expected(sendBuf))
+	// accepted connections use the options of EventLoop
+	bufs := <-accepted
+	Equal(t, bufs[0], expected(recvBuf))
+	Equal(t, bufs[1], expected(sendBuf))
+}
+
+// stubResolver maps the host names to the addresses, and records the looked up hosts.
+type stubResolver struct {
+	hosts  map[string][]net.IPAddr
+	lookup []string
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lookup = append(r.lookup, host)
+	if ipaddrs, ok := r.hosts[host]; ok {
+		return ipaddrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestDialerResolver(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			return nil
+		},
+	)
+	defer loop.Shutdown(context.Background())
+	_, port, _ := net.SplitHostPort(address)
+
+	resolver := &stubResolver{hosts: map[string][]net.IPAddr{
+		"backend.registry": {{IP: net.ParseIP("127.0.0.1")}},
+	}}
+	dialer := NewDialer(WithResolver(resolver))
+	conn, err := dialer.DialConnection(network, "backend.registry:"+port, time.Second)
+	MustNil(t, err)
+	Equal(t, conn.RemoteAddr().String(), "127.0.0.1:"+port)
+	MustNil(t, conn.Close())
+
+	// the unknown host fails by the resolver
+	_, err = dialer.DialConnection(network, "unknown.registry:"+port, time.Second)
+	var dnsErr *net.DNSError
+	MustTrue(t, errors.As(err, &dnsErr))
+
+	// the literal IP is not resolved
+	conn, err = dialer.DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	MustNil(t, conn.Close())
+	Equal(t, len(resolver.lookup), 2)
+	Equal(t, resolver.lookup[0], "backend.registry")
+	Equal(t, resolver.lookup[1], "unknown.registry")
+}
+
+func TestDialerLocalAddr(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			return nil
+		},
+	)
+	defer loop.Shutdown(context.Background())
+
+	// the secondary loopback address is only routable by default on Linux
+	probe, err := net.ListenPacket("udp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("127.0.0.2 is not available: %v", err)
+	}
+	probe.Close()
+
+	laddr := &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}
+	conn, err := NewDialer(WithLocalAddr(laddr)).DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	MustTrue(t, strings.HasPrefix(conn.LocalAddr().String(), "127.0.0.2:"))
+	Equal(t, conn.RemoteAddr().String(), address)
+	conn.Close()
+
+	conn, err = NewDialer(WithLocalAddr(&net.IPAddr{IP: laddr.IP})).DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	MustTrue(t, strings.HasPrefix(conn.LocalAddr().String(), "127.0.0.2:"))
+	conn.Close()
+
+	// mismatched family and type
+	_, err = NewDialer(WithLocalAddr(&net.TCPAddr{IP: net.IPv6loopback})).DialConnection(network, address, time.Second)
+	MustTrue(t, err != nil && strings.Contains(err.Error(), errLocalFamily.Error()))
+	_, err = NewDialer(WithLocalAddr(&net.UnixAddr{Name: "local", Net: "unix"})).DialConnection(network, address, time.Second)
+	MustTrue(t, err != nil && strings.Contains(err.Error(), errLocalAddrType.Error()))
+}
+
+func TestDialerHappyEyeballs(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			return nil
+		},
+	)
+	defer loop.Shutdown(context.Background())
+	_, port, _ := net.SplitHostPort(address)
+
+	// the host resolves to both families, while the IPv6 connect hangs until canceled
+	lookup, dial := lookupIPAddr, dialTCPAddr
+	defer func() {
+		lookupIPAddr, dialTCPAddr = lookup, dial
+	}()
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}, {IP: net.IPv4(127, 0, 0, 1)}}, nil
+	}
+	canceled := make(chan struct{}, 1)
+	dialTCPAddr = func(ctx context.Context, network string, laddr, raddr *TCPAddr, opts *options) (*TCPConnection, error) {
+		if network == "tcp6" {
+			<-ctx.Done()
+			canceled <- struct{}{}
+			return nil, ctx.Err()
+		}
+		return dial(ctx, network, laddr, raddr, opts)
+	}
+
+	delay := 50 * time.Millisecond
+	start := time.Now()
+	conn, err := NewDialer(WithHappyEyeballs(delay)).DialConnection(network, "localhost:"+port, time.Second)
+	MustNil(t, err)
+	MustTrue(t, time.Since(start) >= delay)
+	Equal(t, conn.RemoteAddr().String(), address)
+	conn.Close()
+	<-canceled
+
+	// the addresses are dialed in order without it
+	_, err = NewDialer().DialConnection(network, "localhost:"+port, 100*time.Millisecond)
+	MustTrue(t, err != nil)
+}
+
+func TestDialerDialMany(t *testing.T) {
+	numLoops := pollmanager.numLoops
+	MustNil(t, pollmanager.SetNumLoops(4))
+	defer func() {
+		MustNil(t, pollmanager.SetNumLoops(int(numLoops)))
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	MustNil(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	const count = 50
+	conns, err := NewDialer().DialMany("tcp", ln.Addr().String(), count, time.Second)
+	MustNil(t, err)
+	Equal(t, len(conns), count)
+	loads := make(map[int]int)
+	for _, conn := range conns {
+		MustTrue(t, conn.IsActive())
+		loads[pollmanager.Index(conn.(*TCPConnection).operator.poll)]++
+		conn.Close()
+	}
+	// the connections are registered into all the pollers
+	Assert(t, len(loads) == 4, loads)
+
+	// the failures are aggregated
+	addr := ln.Addr().String()
+	ln.Close()
+	conns, err = NewDialer().DialMany("tcp", addr, 3, time.Second)
+	Equal(t, len(conns), 0)
+	var derr *DialManyError
+	MustTrue(t, errors.As(err, &derr))
+	Equal(t, derr.Failed, 3)
+}
+
 func TestDialerUnix(t *testing.T) {
 	dialer := NewDialer()
 	conn, err := dialer.DialTimeout("unix", "tmp.sock", time.Second)
@@ -106,6 +349,163 @@ func TestDialerUnix(t *testing.T) {
 	Equal(t, conn.RemoteAddr().String(), "tmp.sock")
 }
 
+func TestDialerUnixAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract namespace is only supported on linux")
+	}
+	ln, err := CreateListener("unix", "@netpoll.abstract")
+	MustNil(t, err)
+	defer ln.Close()
+	Equal(t, ln.Addr().String(), "@netpoll.abstract")
+	accepted := make(chan net.Conn, 3)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if conn != nil {
+				accepted <- conn
+			}
+		}
+	}()
+
+	// unbound
+	conn, err := DialConnection("unix", "@netpoll.abstract", time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	Equal(t, conn.LocalAddr().String(), "@")
+	Equal(t, conn.RemoteAddr().String(), "@netpoll.abstract")
+	peer := <-accepted
+	Equal(t, peer.LocalAddr().String(), "@netpoll.abstract")
+	Equal(t, peer.RemoteAddr().String(), "@")
+	peer.Close()
+
+	raddr, err := ResolveUnixAddr("unix", "@netpoll.abstract")
+	MustNil(t, err)
+	// explicit abstract name
+	laddr, err := ResolveUnixAddr("unix", "@netpoll.client")
+	MustNil(t, err)
+	uconn, err := DialUnix("unix", laddr, raddr)
+	MustNil(t, err)
+	defer uconn.Close()
+	Equal(t, uconn.LocalAddr().String(), "@netpoll.client")
+	peer = <-accepted
+	Equal(t, peer.RemoteAddr().String(), "@netpoll.client")
+	peer.Close()
+
+	// autobind
+	laddr, err = ResolveUnixAddr("unix", "@")
+	MustNil(t, err)
+	uconn, err = DialUnix("unix", laddr, raddr)
+	MustNil(t, err)
+	defer uconn.Close()
+	name := uconn.LocalAddr().String()
+	MustTrue(t, len(name) > 1 && name[0] == '@')
+	peer = <-accepted
+	Equal(t, peer.RemoteAddr().String(), name)
+	peer.Close()
+}
+
+func TestDialerDialContext(t *testing.T) {
+	address := getTestAddress()
+	ln, err := CreateListener("tcp", address)
+	MustNil(t, err)
+	defer ln.Close()
+
+	dialer := NewDialer()
+	conn, err := dialer.DialContext(context.Background(), "tcp", address)
+	MustNil(t, err)
+	MustNil(t, conn.Close())
+
+	// cancel mid-dial to a listener whose accept queue is full,
+	// the SYN is dropped like dialing a non-routable address
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	MustNil(t, err)
+	defer syscall.Close(fd)
+	MustNil(t, syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}))
+	MustNil(t, syscall.Listen(fd, 0))
+	sa, err := syscall.Getsockname(fd)
+	MustNil(t, err)
+	blocked := fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+	for i := 0; i < 8; i++ {
+		conn, err := dialer.DialConnection("tcp", blocked, 100*time.Millisecond)
+		if err != nil {
+			break
+		}
+		defer conn.Close()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = dialer.DialContext(ctx, "tcp", blocked)
+	if ctx.Err() == nil {
+		t.Skipf("dial returned before canceled: %v", err)
+	}
+	MustTrue(t, err != nil)
+	Assert(t, strings.Contains(err.Error(), "operation was canceled"), err)
+	MustTrue(t, time.Since(start) < time.Second)
+
+	// canceled before dial
+	_, err = dialer.DialContext(ctx, "tcp", address)
+	MustTrue(t, err != nil)
+}
+
+func TestDialerIPv6Zone(t *testing.T) {
+	var address, zone string
+	ifis, _ := net.Interfaces()
+	for _, ifi := range ifis {
+		addrs, _ := ifi.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+				address, zone = ipnet.IP.String()+"%"+ifi.Name, ifi.Name
+				break
+			}
+		}
+		if address != "" {
+			break
+		}
+	}
+	if address == "" {
+		t.Skip("no IPv6 link-local address")
+	}
+	ln, err := CreateListener("tcp6", net.JoinHostPort(address, "0"))
+	if err != nil {
+		t.Skipf("listen %s failed: %v", address, err)
+	}
+	defer ln.Close()
+	Equal(t, ln.Addr().(*net.TCPAddr).Zone, zone)
+
+	accepted := make(chan Connection, 1)
+	loop, err := NewEventLoop(func(ctx context.Context, connection Connection) error {
+		return nil
+	}, WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+		accepted <- connection
+		return ctx
+	}))
+	MustNil(t, err)
+	go loop.Serve(ln)
+	defer loop.Shutdown(context.Background())
+
+	conn, err := DialConnection("tcp6", ln.Addr().String(), time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	Equal(t, conn.RemoteAddr().String(), ln.Addr().String())
+	Equal(t, conn.LocalAddr().(*net.TCPAddr).Zone, zone)
+	connection := <-accepted
+	Equal(t, connection.RemoteAddr().String(), conn.LocalAddr().String())
+
+	// the zone by index
+	ifi, err := net.InterfaceByName(zone)
+	MustNil(t, err)
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	host = strings.Split(host, "%")[0] + "%" + strconv.Itoa(ifi.Index)
+	conn, err = DialConnection("tcp", net.JoinHostPort(host, port), time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	Equal(t, conn.RemoteAddr().String(), ln.Addr().String())
+}
+
 func TestDialerFdAlloc(t *testing.T) {
 	address := getTestAddress()
 	ln, err := CreateListener("tcp", address)
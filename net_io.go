@@ -33,6 +33,21 @@ func ioread(fd int, bs [][]byte, ivs []syscall.Iovec) (n int, err error) {
 	return n, err
 }
 
+// readInputs reads the socket of op into bs by op.Read if set, otherwise it's the same as ioread.
+func readInputs(op *FDOperator, bs [][]byte, ivs []syscall.Iovec) (n int, err error) {
+	if op.Read == nil {
+		return ioread(op.FD, bs, ivs)
+	}
+	n, err = op.Read(bs)
+	if n == 0 && err == nil { // means EOF
+		return 0, Exception(ErrEOF, "")
+	}
+	if err == syscall.EINTR || err == syscall.EAGAIN {
+		return 0, nil
+	}
+	return n, err
+}
+
 // return value:
 // - n: n == 0 but err == nil, retry syscall
 // - err: if not nil, connection should be closed.
@@ -18,6 +18,7 @@
 package netpoll
 
 import (
+	"context"
 	"errors"
 	"net"
 	"os"
@@ -25,13 +26,91 @@ import (
 )
 
 // CreateListener return a new Listener.
-func CreateListener(network, addr string) (l Listener, err error) {
-	if network == "udp" {
-		// TODO: udp listener.
-		return udpListener(network, addr)
+//
+// For UDP and "unixgram" networks, the returned Listener cannot Accept connections,
+// EventLoop.Serve will serve it as a single connection keeping the boundaries of datagrams like UDPConnection,
+// and call OnRequest per datagram. Like net.UnixConn, the socket file of "unixgram" is not removed by Close, and it must be removed before listening again.
+// The options other than WithBacklog and WithFastOpen are ignored.
+func CreateListener(network, addr string, opts ...Option) (l Listener, err error) {
+	op := &options{}
+	for _, opt := range opts {
+		opt.f(op)
+	}
+	l, err = createListener(network, addr, &net.ListenConfig{})
+	if err != nil {
+		return nil, err
+	}
+	if op.tos != 0 {
+		if err = setTOS(l.Fd(), op.tos); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if l.(*listener).isPacket() {
+		return l, nil
+	}
+	// listen again on the listening socket only changes the backlog
+	if op.backlog > 0 {
+		if err = syscall.Listen(l.Fd(), op.backlog); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if op.fastOpen {
+		enableFastOpen(l, op.backlog)
+	}
+	return l, nil
+}
+
+// fastOpenQueueLen is the default length of the queue of TCP Fast Open requests not yet accepted.
+const fastOpenQueueLen = 256
+
+// enableFastOpen enables TCP Fast Open of the TCP listener with the queue length of backlog, or fastOpenQueueLen
+// if not set, and the listener keeps working as usual if it fails.
+func enableFastOpen(ln Listener, backlog int) {
+	if _, ok := ln.Addr().(*net.TCPAddr); !ok {
+		return
+	}
+	if backlog <= 0 {
+		backlog = fastOpenQueueLen
+	}
+	if err := setFastOpen(ln.Fd(), backlog); err != nil {
+		logger.Printf("NETPOLL: set TCP_FASTOPEN failed: %v\n", err)
+	}
+}
+
+// CreateReusePortListener return a new Listener with SO_REUSEPORT set,
+// so that multiple listeners, e.g. served by different EventLoops, can bind the same address.
+//
+// On Linux (3.9+), the kernel distributes the incoming connections across the listeners.
+// On BSD and Darwin, it only allows binding the same address, and the connections are not balanced.
+// Only TCP and UDP networks are supported, otherwise ErrUnsupported will be returned.
+func CreateReusePortListener(network, addr string) (l Listener, err error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return nil, Exception(ErrUnsupported, "SO_REUSEPORT on network "+network)
+	}
+	lc := &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) (err error) {
+			if cerr := c.Control(func(fd uintptr) {
+				err = setReusePort(int(fd))
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	return createListener(network, addr, lc)
+}
+
+func createListener(network, addr string, lc *net.ListenConfig) (l Listener, err error) {
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram":
+		return listenPacket(network, addr, lc)
 	}
 	// tcp, tcp4, tcp6, unix
-	ln, err := net.Listen(network, addr)
+	ln, err := lc.Listen(context.Background(), network, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -53,17 +132,62 @@ func ConvertListener(l net.Listener) (nl Listener, err error) {
 	return ln, syscall.SetNonblock(ln.fd, true)
 }
 
-// TODO: udpListener does not work now.
-func udpListener(network, addr string) (l Listener, err error) {
-	ln := &listener{}
-	ln.pconn, err = net.ListenPacket(network, addr)
+// NewListenerFromFd returns a new Listener of the listening socket fd, e.g. inherited from the parent process
+// by ExtraFiles of os/exec during a hot upgrade, so that the new process keeps accepting without a bind gap.
+// The fd is duplicated, so the caller still owns it and should close it once the Listener is created,
+// and the Listener can be served by EventLoop.Serve like the one of CreateListener.
+// Both the stream sockets and the UDP sockets are supported.
+func NewListenerFromFd(fd int) (l Listener, err error) {
+	typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return nil, os.NewSyscallError("getsockopt", err)
+	}
+	// dup fd for the os.File, which closes it by Close, so that fd is kept for the caller
+	syscall.ForkLock.RLock()
+	nfd, err := syscall.Dup(fd)
+	if err == nil {
+		syscall.CloseOnExec(nfd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, os.NewSyscallError("dup", err)
+	}
+	file := os.NewFile(uintptr(nfd), "listener")
+	defer file.Close()
+	if typ == syscall.SOCK_DGRAM {
+		pconn, err := net.FilePacketConn(file)
+		if err != nil {
+			return nil, err
+		}
+		return packetListener(pconn)
+	}
+	ln, err := net.FileListener(file)
+	if err != nil {
+		return nil, err
+	}
+	if l, err = ConvertListener(ln); err != nil {
+		ln.Close()
+	}
+	return l, err
+}
+
+func listenPacket(network, addr string, lc *net.ListenConfig) (l Listener, err error) {
+	pconn, err := lc.ListenPacket(context.Background(), network, addr)
 	if err != nil {
 		return nil, err
 	}
+	return packetListener(pconn)
+}
+
+func packetListener(pconn net.PacketConn) (l Listener, err error) {
+	ln := &listener{}
+	ln.pconn = pconn
 	ln.addr = ln.pconn.LocalAddr()
 	switch pconn := ln.pconn.(type) {
 	case *net.UDPConn:
 		ln.file, err = pconn.File()
+	case *net.UnixConn:
+		ln.file, err = pconn.File()
 	}
 	if err != nil {
 		return nil, err
@@ -112,7 +236,7 @@ func (ln *listener) Accept() (net.Conn, error) {
 	return nfd, nil
 }
 
-// TODO: UDPAccept Not implemented.
+// UDPAccept is not supported, since packet sockets have no connections to accept.
 func (ln *listener) UDPAccept() (net.Conn, error) {
 	return nil, Exception(ErrUnsupported, "UDP")
 }
@@ -144,6 +268,11 @@ func (ln *listener) Fd() (fd int) {
 	return ln.fd
 }
 
+// isPacket reports whether the listener is based on a packet socket.
+func (ln *listener) isPacket() bool {
+	return ln.pconn != nil
+}
+
 func (ln *listener) parseFD() (err error) {
 	switch netln := ln.ln.(type) {
 	case *net.TCPListener:
@@ -19,8 +19,11 @@ package netpoll
 
 import (
 	"context"
+	"errors"
 	"net"
+	"runtime"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -109,3 +112,124 @@ func TestConvertListener(t *testing.T) {
 		panic(err)
 	}
 }
+
+func TestReusePortListener(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT doesn't balance connections on " + runtime.GOOS)
+	}
+	network, addr := "tcp", getTestAddress()
+	var accepted [2]int32
+	for i := 0; i < 2; i++ {
+		ln, err := CreateReusePortListener(network, addr)
+		MustNil(t, err)
+		idx := i
+		loop, err := NewEventLoop(
+			func(ctx context.Context, connection Connection) error {
+				return nil
+			},
+			WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+				atomic.AddInt32(&accepted[idx], 1)
+				return ctx
+			}),
+		)
+		MustNil(t, err)
+		go loop.Serve(ln)
+		defer loop.Shutdown(context.Background())
+	}
+
+	for i := 0; i < 64; i++ {
+		conn, err := DialConnection(network, addr, time.Second)
+		MustNil(t, err)
+		conn.Close()
+	}
+	for atomic.LoadInt32(&accepted[0])+atomic.LoadInt32(&accepted[1]) < 64 {
+		time.Sleep(time.Millisecond)
+	}
+	MustTrue(t, atomic.LoadInt32(&accepted[0]) > 0)
+	MustTrue(t, atomic.LoadInt32(&accepted[1]) > 0)
+
+	_, err := CreateReusePortListener("unix", "reuseport.sock")
+	MustTrue(t, errors.Is(err, ErrUnsupported))
+}
+
+func TestListenerBacklog(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the accept queue is counted differently on " + runtime.GOOS)
+	}
+	network, addr := "tcp", getTestAddress()
+	backlog := 4
+	ln, err := CreateListener(network, addr, WithBacklog(backlog))
+	MustNil(t, err)
+	defer ln.Close()
+
+	// Linux queues backlog+1 connections without accepting, then drops the SYNs
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < 16; i++ {
+		conn, err := net.DialTimeout(network, addr, 200*time.Millisecond)
+		if err != nil {
+			break
+		}
+		conns = append(conns, conn)
+	}
+	Equal(t, len(conns), backlog+1)
+
+	// the queued connections are accepted
+	for i := 0; i < len(conns); i++ {
+		var conn net.Conn
+		for conn == nil {
+			conn, err = ln.Accept()
+			MustNil(t, err)
+		}
+		conn.Close()
+	}
+
+	// UDP ignores the backlog
+	uln, err := CreateListener("udp", getTestAddress(), WithBacklog(backlog))
+	MustNil(t, err)
+	MustNil(t, uln.Close())
+}
+
+func TestNewListenerFromFd(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	ln, err := CreateListener(network, address)
+	MustNil(t, err)
+	// the duplicated fd works as the one inherited by the child process
+	fd, err := syscall.Dup(ln.Fd())
+	MustNil(t, err)
+	nln, err := NewListenerFromFd(fd)
+	MustNil(t, err)
+	MustNil(t, syscall.Close(fd))
+	Equal(t, nln.Addr().String(), ln.Addr().String())
+	// the old listener stops accepting, and the new one takes over without rebinding
+	MustNil(t, ln.Close())
+
+	loop, err := NewEventLoop(func(ctx context.Context, connection Connection) error {
+		buf, err := connection.Reader().Next(connection.Reader().Len())
+		if err != nil {
+			return err
+		}
+		connection.Writer().WriteBinary(buf)
+		return connection.Writer().Flush()
+	})
+	MustNil(t, err)
+	go loop.Serve(nln)
+	defer loop.Shutdown(context.Background())
+
+	conn, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	_, err = conn.Writer().WriteString("ping")
+	MustNil(t, err)
+	MustNil(t, conn.Writer().Flush())
+	s, err := conn.Reader().ReadString(4)
+	MustNil(t, err)
+	Equal(t, s, "ping")
+
+	_, err = NewListenerFromFd(-1)
+	MustTrue(t, err != nil)
+}
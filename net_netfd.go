@@ -92,18 +92,27 @@ func (c *netFD) dial(ctx context.Context, laddr, raddr sockaddr) (err error) {
 	// 1) the one returned by the connect method, if any; or
 	// 2) the one from Getpeername, if it succeeds; or
 	// 3) the one passed to us as the raddr parameter.
+	toAddr := c.addrFunc()
 	lsa, _ = syscall.Getsockname(c.fd)
-	c.localAddr = sockaddrToAddr(lsa)
+	c.localAddr = toAddr(lsa)
 	if crsa != nil {
-		c.remoteAddr = sockaddrToAddr(crsa)
+		c.remoteAddr = toAddr(crsa)
 	} else if crsa, _ = syscall.Getpeername(c.fd); crsa != nil {
-		c.remoteAddr = sockaddrToAddr(crsa)
+		c.remoteAddr = toAddr(crsa)
 	} else {
-		c.remoteAddr = sockaddrToAddr(rsa)
+		c.remoteAddr = toAddr(rsa)
 	}
 	return nil
 }
 
+// addrFunc returns the converter from syscall.Sockaddr to net.Addr, which depends on the socket type.
+func (c *netFD) addrFunc() func(syscall.Sockaddr) net.Addr {
+	if c.sotype == syscall.SOCK_DGRAM {
+		return sockaddrToUDPAddr
+	}
+	return sockaddrToAddr
+}
+
 func (c *netFD) connect(ctx context.Context, la, ra syscall.Sockaddr) (rsa syscall.Sockaddr, retErr error) {
 	// Do not need to call c.writing here,
 	// because c is not yet accessible to user,
@@ -175,6 +184,8 @@ var (
 	errMissingAddress = errors.New("missing address")
 	errCanceled       = errors.New("operation was canceled")
 	errIOTimeout      = errors.New("i/o timeout")
+	errLocalAddrType  = errors.New("mismatched local address type")
+	errLocalFamily    = errors.New("mismatched local address family")
 )
 
 // mapErr maps from the context errors to the historical internal net
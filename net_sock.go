@@ -14,6 +14,7 @@ import (
 	"context"
 	"net"
 	"runtime"
+	"strconv"
 	"syscall"
 )
 
@@ -39,12 +40,12 @@ type sockaddr interface {
 	toLocal(net string) sockaddr
 }
 
-func internetSocket(ctx context.Context, net string, laddr, raddr sockaddr, sotype, proto int, mode string) (conn *netFD, err error) {
+func internetSocket(ctx context.Context, net string, laddr, raddr sockaddr, sotype, proto int, mode string, ctrl func(fd int) error) (conn *netFD, err error) {
 	if (runtime.GOOS == "aix" || runtime.GOOS == "windows" || runtime.GOOS == "openbsd" || runtime.GOOS == "nacl") && raddr.isWildcard() {
 		raddr = raddr.toLocal(net)
 	}
 	family, ipv6only := favoriteAddrFamily(net, laddr, raddr)
-	return socket(ctx, net, family, sotype, proto, ipv6only, laddr, raddr)
+	return socket(ctx, net, family, sotype, proto, ipv6only, laddr, raddr, ctrl)
 }
 
 // favoriteAddrFamily returns the appropriate address family for the
@@ -102,7 +103,8 @@ func favoriteAddrFamily(network string, laddr, raddr sockaddr) (family int, ipv6
 
 // socket returns a network file descriptor that is ready for
 // asynchronous I/O using the network poller.
-func socket(ctx context.Context, net string, family, sotype, proto int, ipv6only bool, laddr, raddr sockaddr) (netfd *netFD, err error) {
+// If ctrl is not nil, it's called to set the socket options before connect.
+func socket(ctx context.Context, net string, family, sotype, proto int, ipv6only bool, laddr, raddr sockaddr, ctrl func(fd int) error) (netfd *netFD, err error) {
 	// syscall.Socket & set socket options
 	var fd int
 	fd, err = sysSocket(family, sotype, proto)
@@ -110,6 +112,9 @@ func socket(ctx context.Context, net string, family, sotype, proto int, ipv6only
 		return nil, err
 	}
 	err = setDefaultSockopts(fd, family, sotype, ipv6only)
+	if err == nil && ctrl != nil {
+		err = ctrl(fd)
+	}
 	if err != nil {
 		syscall.Close(fd)
 		return nil, err
@@ -134,21 +139,58 @@ func sockaddrToAddr(sa syscall.Sockaddr) net.Addr {
 			Port: sa.Port,
 		}
 	case *syscall.SockaddrInet6:
-		var zone string
-		if sa.ZoneId != 0 {
-			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
-				zone = ifi.Name
-			}
-		}
-		// if zone == "" && sa.ZoneId != 0 {
-		// }
 		a = &net.TCPAddr{
 			IP:   sa.Addr[0:],
 			Port: sa.Port,
-			Zone: zone,
+			Zone: zoneToString(int(sa.ZoneId)),
 		}
 	case *syscall.SockaddrUnix:
 		a = &net.UnixAddr{Net: "unix", Name: sa.Name}
 	}
 	return a
 }
+
+// sockaddrToUDPAddr returns a go/net friendly address of datagram sockets
+func sockaddrToUDPAddr(sa syscall.Sockaddr) net.Addr {
+	var a net.Addr
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		a = &net.UDPAddr{
+			IP:   sa.Addr[0:],
+			Port: sa.Port,
+		}
+	case *syscall.SockaddrInet6:
+		a = &net.UDPAddr{
+			IP:   sa.Addr[0:],
+			Port: sa.Port,
+			Zone: zoneToString(int(sa.ZoneId)),
+		}
+	case *syscall.SockaddrUnix:
+		a = &net.UnixAddr{Net: "unixgram", Name: sa.Name}
+	}
+	return a
+}
+
+// zoneToString returns the interface name of the IPv6 zone index, or the index in decimal
+// if the interface is not found, the same as the std library.
+func zoneToString(zone int) string {
+	if zone == 0 {
+		return ""
+	}
+	if ifi, err := net.InterfaceByIndex(zone); err == nil {
+		return ifi.Name
+	}
+	return strconv.Itoa(zone)
+}
+
+// zoneToInt returns the index of the IPv6 zone, which is an interface name or an index in decimal.
+func zoneToInt(zone string) int {
+	if zone == "" {
+		return 0
+	}
+	if ifi, err := net.InterfaceByName(zone); err == nil {
+		return ifi.Index
+	}
+	n, _ := strconv.Atoi(zone)
+	return n
+}
@@ -101,8 +101,7 @@ func ipToSockaddr(family int, ip net.IP, port int, zone string) (syscall.Sockadd
 		if ip6 == nil {
 			return nil, &net.AddrError{Err: "non-IPv6 address", Addr: ip.String()}
 		}
-		// TODO: sa := &syscall.SockaddrInet6{Port: port, ZoneId: uint32(zoneCache.index(zone))}
-		sa := &syscall.SockaddrInet6{Port: port}
+		sa := &syscall.SockaddrInet6{Port: port, ZoneId: uint32(zoneToInt(zone))}
 		copy(sa.Addr[:], ip6)
 		return sa, nil
 	}
@@ -138,9 +137,9 @@ type TCPConnection struct {
 }
 
 // newTCPConnection wraps *TCPConnection.
-func newTCPConnection(conn Conn) (connection *TCPConnection, err error) {
+func newTCPConnection(conn Conn, opts *options) (connection *TCPConnection, err error) {
 	connection = &TCPConnection{}
-	err = connection.init(conn, nil)
+	err = connection.init(conn, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -155,6 +154,10 @@ func newTCPConnection(conn Conn) (connection *TCPConnection, err error) {
 // If the IP field of raddr is nil or an unspecified IP address, the
 // local system is assumed.
 func DialTCP(ctx context.Context, network string, laddr, raddr *TCPAddr) (*TCPConnection, error) {
+	return dialTCP(ctx, network, laddr, raddr, nil)
+}
+
+func dialTCP(ctx context.Context, network string, laddr, raddr *TCPAddr, opts *options) (*TCPConnection, error) {
 	switch network {
 	case "tcp", "tcp4", "tcp6":
 	default:
@@ -166,7 +169,7 @@ func DialTCP(ctx context.Context, network string, laddr, raddr *TCPAddr) (*TCPCo
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	sd := &sysDialer{network: network, address: raddr.String()}
+	sd := &sysDialer{network: network, address: raddr.String(), opts: opts}
 	c, err := sd.dialTCP(ctx, laddr, raddr)
 	if err != nil {
 		return nil, &net.OpError{Op: "dial", Net: network, Source: laddr.opAddr(), Addr: raddr.opAddr(), Err: err}
@@ -175,7 +178,7 @@ func DialTCP(ctx context.Context, network string, laddr, raddr *TCPAddr) (*TCPCo
 }
 
 func (sd *sysDialer) dialTCP(ctx context.Context, laddr, raddr *TCPAddr) (*TCPConnection, error) {
-	conn, err := internetSocket(ctx, sd.network, laddr, raddr, syscall.SOCK_STREAM, 0, "dial")
+	conn, err := internetSocket(ctx, sd.network, laddr, raddr, syscall.SOCK_STREAM, 0, "dial", sd.control)
 
 	// TCP has a rarely used mechanism called a 'simultaneous connection' in
 	// which Dial("tcp", addr1, addr2) run on the machine at addr1 can
@@ -205,13 +208,21 @@ func (sd *sysDialer) dialTCP(ctx context.Context, laddr, raddr *TCPAddr) (*TCPCo
 		if err == nil {
 			conn.Close()
 		}
-		conn, err = internetSocket(ctx, sd.network, laddr, raddr, syscall.SOCK_STREAM, 0, "dial")
+		conn, err = internetSocket(ctx, sd.network, laddr, raddr, syscall.SOCK_STREAM, 0, "dial", sd.control)
 	}
 
 	if err != nil {
 		return nil, err
 	}
-	return newTCPConnection(conn)
+	return newTCPConnection(conn, sd.opts)
+}
+
+// control enables TCP Fast Open by WithFastOpen, and falls back to the regular connect if unsupported.
+func (sd *sysDialer) control(fd int) error {
+	if sd.opts != nil && sd.opts.fastOpen {
+		setFastOpenConnect(fd)
+	}
+	return nil
 }
 
 func selfConnect(conn *netFD, err error) bool {
@@ -0,0 +1,138 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package netpoll
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// UDPAddr represents the address of a UDP end point.
+type UDPAddr struct {
+	net.UDPAddr
+}
+
+func (a *UDPAddr) isWildcard() bool {
+	if a == nil || a.IP == nil {
+		return true
+	}
+	return a.IP.IsUnspecified()
+}
+
+func (a *UDPAddr) opAddr() net.Addr {
+	if a == nil {
+		return nil
+	}
+	return a
+}
+
+func (a *UDPAddr) family() int {
+	if a == nil || len(a.IP) <= net.IPv4len {
+		return syscall.AF_INET
+	}
+	if a.IP.To4() != nil {
+		return syscall.AF_INET
+	}
+	return syscall.AF_INET6
+}
+
+func (a *UDPAddr) sockaddr(family int) (syscall.Sockaddr, error) {
+	if a == nil {
+		return nil, nil
+	}
+	return ipToSockaddr(family, a.IP, a.Port, a.Zone)
+}
+
+func (a *UDPAddr) toLocal(network string) sockaddr {
+	addr := &UDPAddr{}
+	addr.IP = loopbackIP(network)
+	addr.Port = a.Port
+	addr.Zone = a.Zone
+	return addr
+}
+
+// ResolveUDPAddr returns an address of UDP end point.
+//
+// The network must be a UDP network name.
+func ResolveUDPAddr(network, address string) (*UDPAddr, error) {
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPAddr{*addr}, nil
+}
+
+// UDPConnection implements Connection.
+//
+// Since UDP is message oriented, UDPConnection keeps the boundaries of the datagrams:
+//   - Reader().Len() returns the unread size of the first datagram in the buffer,
+//     so Reader().Next(Reader().Len()) returns exactly one datagram.
+//   - Read(p) reads at most one datagram, and the rest of the datagram is discarded if p is too small.
+//   - Writer().Flush() sends all the written data as exactly one datagram.
+//   - RemoteAddr() returns the sender of the datagram most recently read by the caller.
+//
+// Datagrams larger than maxDatagramSize are truncated, and empty datagrams are dropped.
+type UDPConnection struct {
+	connection
+}
+
+// newUDPConnection wraps UDPConnection.
+func newUDPConnection(conn Conn) (connection *UDPConnection, err error) {
+	connection = &UDPConnection{}
+	err = connection.init(conn, nil)
+	if err != nil {
+		return nil, err
+	}
+	return connection, nil
+}
+
+// DialUDP acts like Dial for UDP networks.
+//
+// The network must be a UDP network name; see func Dial for details.
+//
+// If laddr is nil, a local address is automatically chosen.
+// If the IP field of raddr is nil or an unspecified IP address, the
+// local system is assumed.
+func DialUDP(ctx context.Context, network string, laddr, raddr *UDPAddr) (*UDPConnection, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Source: laddr.opAddr(), Addr: raddr.opAddr(), Err: net.UnknownNetworkError(network)}
+	}
+	if raddr == nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Source: laddr.opAddr(), Addr: nil, Err: errMissingAddress}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	sd := &sysDialer{network: network, address: raddr.String()}
+	c, err := sd.dialUDP(ctx, laddr, raddr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Source: laddr.opAddr(), Addr: raddr.opAddr(), Err: err}
+	}
+	return c, nil
+}
+
+func (sd *sysDialer) dialUDP(ctx context.Context, laddr, raddr *UDPAddr) (*UDPConnection, error) {
+	conn, err := internetSocket(ctx, sd.network, laddr, raddr, syscall.SOCK_DGRAM, 0, "dial", nil)
+	if err != nil {
+		return nil, err
+	}
+	return newUDPConnection(conn)
+}
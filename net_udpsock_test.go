@@ -0,0 +1,104 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package netpoll
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPConnection(t *testing.T) {
+	network, address := "udp", getTestAddress()
+	var clientAddr string
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			// one datagram per call
+			msg, err := connection.Reader().Next(connection.Reader().Len())
+			MustNil(t, err)
+			Equal(t, connection.RemoteAddr().String(), clientAddr)
+			_, err = connection.Writer().WriteBinary(msg)
+			MustNil(t, err)
+			return connection.Writer().Flush()
+		},
+	)
+	defer loop.Shutdown(context.Background())
+
+	conn, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	_, ok := conn.(*UDPConnection)
+	MustTrue(t, ok)
+	clientAddr = conn.LocalAddr().String()
+	Equal(t, conn.RemoteAddr().String(), address)
+
+	buf := make([]byte, 64)
+	for i := 0; i < 16; i++ {
+		msg := fmt.Sprintf("datagram-%d", i)
+		_, err = conn.Writer().WriteString(msg)
+		MustNil(t, err)
+		err = conn.Writer().Flush()
+		MustNil(t, err)
+
+		// Read returns exactly one datagram
+		n, err := conn.Read(buf)
+		MustNil(t, err)
+		Equal(t, string(buf[:n]), msg)
+	}
+}
+
+func TestUDPConnectionBoundary(t *testing.T) {
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	MustNil(t, err)
+	defer ln.Close()
+
+	conn, err := DialConnection("udp", ln.LocalAddr().String(), time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+
+	for _, msg := range []string{"a", "bb", "ccc"} {
+		_, err = ln.WriteTo([]byte(msg), conn.LocalAddr())
+		MustNil(t, err)
+	}
+	for conn.Reader().Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, msg := range []string{"a", "bb", "ccc"} {
+		_, err = conn.Reader().Peek(len(msg))
+		MustNil(t, err)
+		Equal(t, conn.Reader().Len(), len(msg))
+		s, err := conn.Reader().ReadString(len(msg))
+		MustNil(t, err)
+		Equal(t, s, msg)
+	}
+
+	// Read discards the rest of a truncated datagram
+	_, err = ln.WriteTo([]byte("hello"), conn.LocalAddr())
+	MustNil(t, err)
+	_, err = ln.WriteTo([]byte("world"), conn.LocalAddr())
+	MustNil(t, err)
+	buf := make([]byte, 2)
+	n, err := conn.Read(buf)
+	MustNil(t, err)
+	Equal(t, string(buf[:n]), "he")
+	s, err := conn.Reader().ReadString(5)
+	MustNil(t, err)
+	Equal(t, s, "world")
+}
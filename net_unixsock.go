@@ -14,6 +14,7 @@ import (
 	"context"
 	"errors"
 	"net"
+	"runtime"
 	"syscall"
 )
 
@@ -47,6 +48,11 @@ func (a *UnixAddr) sockaddr(family int) (syscall.Sockaddr, error) {
 	if a == nil {
 		return nil, nil
 	}
+	// a leading '@' is converted to a null byte for the abstract namespace on Linux by syscall,
+	// and a single '@' means autobind, which requires an empty address to bind.
+	if a.Name == "@" && runtime.GOOS == "linux" {
+		return &syscall.SockaddrUnix{}, nil
+	}
 	return &syscall.SockaddrUnix{Name: a.Name}, nil
 }
 
@@ -69,13 +75,32 @@ func ResolveUnixAddr(network, address string) (*UnixAddr, error) {
 }
 
 // UnixConnection implements Connection.
+// For the "unixgram" network, it keeps the boundaries of the datagrams the same as UDPConnection.
 type UnixConnection struct {
 	connection
 }
 
+// Ucred is the credentials of the peer process of a Unix socket, see UnixConnection.PeerCred.
+type Ucred struct {
+	Pid int32  // the process ID, which is zero on FreeBSD
+	Uid uint32 // the effective user ID
+	Gid uint32 // the effective group ID
+}
+
+// PeerCred returns the credentials of the peer process at the time it called connect(2) or socketpair(2),
+// e.g. to authorize the local IPC, by getsockopt(SO_PEERCRED) on Linux and LOCAL_PEERCRED on Darwin and FreeBSD
+// as getpeereid(3). It's not supported elsewhere, and ErrUnsupported is returned.
+func (c *UnixConnection) PeerCred() (*Ucred, error) {
+	return getPeerCred(c.fd)
+}
+
 // newUnixConnection wraps UnixConnection.
-func newUnixConnection(conn Conn) (connection *UnixConnection, err error) {
+func newUnixConnection(conn Conn, opts *options) (connection *UnixConnection, err error) {
 	connection = &UnixConnection{}
+	// the fds may be passed since the first read, so they are received by the poller from the beginning
+	if opts != nil && opts.fdPassing {
+		connection.rights = &unixRights{}
+	}
 	err = connection.init(conn, nil)
 	if err != nil {
 		return nil, err
@@ -83,32 +108,71 @@ func newUnixConnection(conn Conn) (connection *UnixConnection, err error) {
 	return connection, nil
 }
 
+// Pipe creates a pair of connected UnixConnections by socketpair(2), which are registered into the poller
+// like the dialed ones, e.g. for the tests or the transport between the components in the same process.
+// The data written to one end can be read from the other, and closing one end makes the other read ErrEOF.
+// Both ends are unnamed, so their addresses have an empty name. Only WithFDPassing is used by opts.
+func Pipe(opts ...Option) (c1, c2 Connection, err error) {
+	fds, err := sysSocketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	op := &options{}
+	for _, opt := range opts {
+		opt.f(op)
+	}
+	var conns [2]*UnixConnection
+	for i, fd := range fds {
+		nfd := newNetFD(fd, syscall.AF_UNIX, syscall.SOCK_STREAM, "unix")
+		nfd.isConnected = true
+		nfd.localAddr = &UnixAddr{net.UnixAddr{Net: "unix"}}
+		nfd.remoteAddr = &UnixAddr{net.UnixAddr{Net: "unix"}}
+		if conns[i], err = newUnixConnection(nfd, op); err != nil {
+			if i == 0 {
+				syscall.Close(fds[0])
+			} else {
+				conns[0].Close()
+			}
+			syscall.Close(fds[1])
+			return nil, nil, err
+		}
+	}
+	return conns[0], conns[1], nil
+}
+
 // DialUnix acts like Dial for Unix networks.
 //
 // The network must be a Unix network name; see func Dial for details.
 //
 // If laddr is non-nil, it is used as the local address for the
 // connection.
+//
+// On Linux, the address with a leading '@' is in the abstract namespace, e.g. "@myservice",
+// and a laddr of "@" binds the connection to a unique abstract address chosen by the kernel.
 func DialUnix(network string, laddr, raddr *UnixAddr) (*UnixConnection, error) {
+	return dialUnix(context.Background(), network, laddr, raddr, nil)
+}
+
+func dialUnix(ctx context.Context, network string, laddr, raddr *UnixAddr, opts *options) (*UnixConnection, error) {
 	switch network {
 	case "unix", "unixgram", "unixpacket":
 	default:
 		return nil, &net.OpError{Op: "dial", Net: network, Source: laddr.opAddr(), Addr: raddr.opAddr(), Err: net.UnknownNetworkError(network)}
 	}
 	sd := &sysDialer{network: network, address: raddr.String()}
-	c, err := sd.dialUnix(context.Background(), laddr, raddr)
+	c, err := sd.dialUnix(ctx, laddr, raddr, opts)
 	if err != nil {
 		return nil, &net.OpError{Op: "dial", Net: network, Source: laddr.opAddr(), Addr: raddr.opAddr(), Err: err}
 	}
 	return c, nil
 }
 
-func (sd *sysDialer) dialUnix(ctx context.Context, laddr, raddr *UnixAddr) (*UnixConnection, error) {
+func (sd *sysDialer) dialUnix(ctx context.Context, laddr, raddr *UnixAddr, opts *options) (*UnixConnection, error) {
 	conn, err := unixSocket(ctx, sd.network, laddr, raddr, "dial")
 	if err != nil {
 		return nil, err
 	}
-	return newUnixConnection(conn)
+	return newUnixConnection(conn, opts)
 }
 
 func unixSocket(ctx context.Context, network string, laddr, raddr sockaddr, mode string) (conn *netFD, err error) {
@@ -140,5 +204,5 @@ func unixSocket(ctx context.Context, network string, laddr, raddr sockaddr, mode
 		return nil, errors.New("unknown mode: " + mode)
 	}
 
-	return socket(ctx, network, syscall.AF_UNIX, sotype, 0, false, laddr, raddr)
+	return socket(ctx, network, syscall.AF_UNIX, sotype, 0, false, laddr, raddr, nil)
 }
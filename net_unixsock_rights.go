@@ -0,0 +1,210 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package netpoll
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxUnixRights is the maximum number of fds passed by one message, the same as SCM_MAX_FD on Linux.
+const maxUnixRights = 253
+
+var errRightsWithoutData = errors.New("at least one byte must be written with fds")
+
+// unixRights keeps the fds received by SCM_RIGHTS in the order of the stream.
+// The poller pushes the fds with the position of the data carrying them, and the reader pops them when the data is consumed.
+type unixRights struct {
+	mux   sync.Mutex
+	oob   []byte // only used by the poller
+	queue []unixRightsEntry
+}
+
+type unixRightsEntry struct {
+	end uint64 // the position in the stream after the data carrying fds
+	fds []int
+}
+
+func (r *unixRights) push(end uint64, fds []int) {
+	r.mux.Lock()
+	r.queue = append(r.queue, unixRightsEntry{end: end, fds: fds})
+	r.mux.Unlock()
+}
+
+// pop returns the fds carried by the data before the consumed position.
+func (r *unixRights) pop(consumed uint64) (fds []int) {
+	r.mux.Lock()
+	for len(r.queue) > 0 && r.queue[0].end <= consumed {
+		fds = append(fds, r.queue[0].fds...)
+		r.queue[0] = unixRightsEntry{}
+		r.queue = r.queue[1:]
+	}
+	r.mux.Unlock()
+	return fds
+}
+
+// closeAll closes the fds which have not been read.
+func (r *unixRights) closeAll() {
+	r.mux.Lock()
+	for _, entry := range r.queue {
+		for _, fd := range entry.fds {
+			syscall.Close(fd)
+		}
+	}
+	r.queue = nil
+	r.mux.Unlock()
+}
+
+// initRights makes the poller read the socket by recvmsg(2), so that the passed fds are received with the data.
+func (c *connection) initRights() {
+	c.rights.oob = make([]byte, syscall.CmsgSpace(maxUnixRights*4))
+	c.operator.Read = c.recvRights
+	c.AddCloseCallback(func(connection Connection) error {
+		c.rights.closeAll()
+		return nil
+	})
+}
+
+// recvRights implements FDOperator.Read, it's called by the poller when the unix socket is readable.
+func (c *connection) recvRights(bs [][]byte) (n int, err error) {
+	n, oobn, flags, _, err := unix.RecvmsgBuffers(c.fd, bs, c.rights.oob, 0)
+	if err != nil || oobn == 0 {
+		return n, err
+	}
+	if flags&unix.MSG_CTRUNC != 0 {
+		logger.Printf("NETPOLL: the passed fds are truncated, fd=%d", c.fd)
+	}
+	msgs, perr := unix.ParseSocketControlMessage(c.rights.oob[:oobn])
+	if perr != nil {
+		logger.Printf("NETPOLL: parse socket control message failed: %v", perr)
+		return n, nil
+	}
+	var fds []int
+	for i := range msgs {
+		rights, perr := unix.ParseUnixRights(&msgs[i])
+		if perr != nil {
+			continue
+		}
+		for _, fd := range rights {
+			syscall.CloseOnExec(fd)
+		}
+		fds = append(fds, rights...)
+	}
+	if len(fds) > 0 {
+		// the poller adds inputBytes after reading, so it's still the position before the data
+		c.rights.push(atomic.LoadUint64(&c.inputBytes)+uint64(n), fds)
+	}
+	return n, nil
+}
+
+// ReadWithFDs reads up to len(buf) bytes like Read, and returns the fds passed by SCM_RIGHTS
+// together with the data up to the end of what has been read, including the data consumed by other reads before.
+// The fds of a message are returned once all its data is read, so a partial read may return the fds by the next call.
+// The received fds are close-on-exec and not registered into any poller, and their blocking mode is left as set by the sender,
+// since it's shared with the fds of the sender. The caller owns them and must close them,
+// while the fds not read before the connection closed are closed automatically.
+// It returns ErrUnsupported unless the connection is created with WithFDPassing.
+func (c *UnixConnection) ReadWithFDs(buf []byte) (n int, fds []int, err error) {
+	if c.rights == nil || c.datagrams != nil {
+		return 0, nil, Exception(ErrUnsupported, "read with fds")
+	}
+	if len(buf) == 0 {
+		return 0, nil, nil
+	}
+	if !c.lockRead() {
+		return 0, nil, Exception(ErrConcurrentAccess, "when read with fds")
+	}
+	defer c.unlockRead()
+	if err = c.waitRead(1); err != nil {
+		return 0, nil, err
+	}
+	// the poller stops reading while the reading key is locked, so the position is stable after waitInputs
+	c.waitInputs()
+	_, n = c.readBuffered([][]byte{buf})
+	consumed := atomic.LoadUint64(&c.inputBytes) - uint64(c.inputBuffer.Len())
+	return n, c.rights.pop(consumed), nil
+}
+
+// WriteWithFDs writes buf with fds passed by SCM_RIGHTS, and returns the number of bytes written.
+// The pending data in Writer will be flushed first, then fds are sent with the first part of buf,
+// so buf must not be empty. The fds are duplicated to the peer and still owned by the caller,
+// and the peer must be created with WithFDPassing to receive them.
+func (c *UnixConnection) WriteWithFDs(buf []byte, fds []int) (n int, err error) {
+	if c.datagrams != nil {
+		return 0, Exception(ErrUnsupported, "write with fds")
+	}
+	if len(fds) == 0 {
+		return c.Write(buf)
+	}
+	if len(buf) == 0 {
+		return 0, errRightsWithoutData
+	}
+	if !c.IsActive() {
+		return 0, Exception(ErrConnClosed, "when write with fds")
+	}
+	if !c.lock(flushing) {
+		return 0, Exception(ErrConcurrentAccess, "when write with fds")
+	}
+	n, err = c.writeWithFDs(buf, fds)
+	c.unlock(flushing)
+	c.closeIfWriteTimeout(err)
+	return n, err
+}
+
+func (c *connection) writeWithFDs(buf []byte, fds []int) (n int, err error) {
+	// the pending output must be sent before
+	c.outputBuffer.Flush()
+	if err = c.flush(); err != nil {
+		return 0, err
+	}
+	oob := unix.UnixRights(fds...)
+	for {
+		n, err = unix.SendmsgN(c.fd, buf, oob, nil, 0)
+		switch err {
+		case nil:
+		case syscall.EINTR:
+			continue
+		case syscall.EAGAIN:
+			if err = c.operator.Control(PollR2RW); err != nil {
+				return 0, Exception(err, "when write with fds")
+			}
+			if err = c.waitFlush(); err != nil {
+				return 0, err
+			}
+			continue
+		default:
+			return 0, Exception(err, "when write with fds")
+		}
+		break
+	}
+	atomic.AddUint64(&c.outputBytes, uint64(n))
+	// the rest of buf is written without fds
+	if n < len(buf) {
+		dst, _ := c.outputBuffer.Malloc(len(buf) - n)
+		copy(dst, buf[n:])
+		c.outputBuffer.Flush()
+		if err = c.flush(); err != nil {
+			return n, err
+		}
+	}
+	return len(buf), nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package netpoll
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUnixConnectionFDs(t *testing.T) {
+	r, w := GetSysFdPairs()
+	rconn, err := newUnixConnection(&netFD{fd: r, network: "unix", sotype: syscall.SOCK_STREAM}, &options{fdPassing: true})
+	MustNil(t, err)
+	defer rconn.Close()
+	// the fds can be sent without WithFDPassing, which is only needed to receive them
+	wconn, err := newUnixConnection(&netFD{fd: w, network: "unix", sotype: syscall.SOCK_STREAM}, nil)
+	MustNil(t, err)
+	defer wconn.Close()
+	MustTrue(t, wconn.operator.Read == nil)
+	_, _, err = wconn.ReadWithFDs(make([]byte, 1))
+	MustTrue(t, errors.Is(err, ErrUnsupported))
+
+	var pipe [2]int
+	MustNil(t, syscall.Pipe(pipe[:]))
+	defer syscall.Close(pipe[0])
+	defer syscall.Close(pipe[1])
+
+	_, err = wconn.WriteWithFDs(nil, []int{pipe[0]})
+	MustTrue(t, err != nil)
+	_, err = wconn.WriteWithFDs([]byte("bad"), []int{-1})
+	MustTrue(t, err != nil)
+
+	// the fds are returned after all the data carrying them is read
+	_, err = wconn.Write([]byte("hello"))
+	MustNil(t, err)
+	n, err := wconn.WriteWithFDs([]byte("pipe"), []int{pipe[0]})
+	MustNil(t, err)
+	Equal(t, n, 4)
+	buf := make([]byte, 16)
+	n, fds, err := rconn.ReadWithFDs(buf[:5])
+	MustNil(t, err)
+	Equal(t, string(buf[:n]), "hello")
+	Equal(t, len(fds), 0)
+	n, fds, err = rconn.ReadWithFDs(buf[:2])
+	MustNil(t, err)
+	Equal(t, string(buf[:n]), "pi")
+	Equal(t, len(fds), 0)
+	n, fds, err = rconn.ReadWithFDs(buf)
+	MustNil(t, err)
+	Equal(t, string(buf[:n]), "pe")
+	Equal(t, len(fds), 1)
+	defer syscall.Close(fds[0])
+	MustTrue(t, fds[0] != pipe[0])
+
+	// read the pipe through the received fd
+	_, err = syscall.Write(pipe[1], []byte("through pipe"))
+	MustNil(t, err)
+	n, err = syscall.Read(fds[0], buf)
+	MustNil(t, err)
+	Equal(t, string(buf[:n]), "through pipe")
+
+	// the fds are also returned with the data read by others
+	_, err = wconn.WriteWithFDs([]byte("again"), []int{pipe[1]})
+	MustNil(t, err)
+	p, err := rconn.Reader().Next(5)
+	MustNil(t, err)
+	Equal(t, string(p), "again")
+	MustNil(t, rconn.Reader().Release())
+	_, err = wconn.Write([]byte("!"))
+	MustNil(t, err)
+	n, fds, err = rconn.ReadWithFDs(buf)
+	MustNil(t, err)
+	Equal(t, string(buf[:n]), "!")
+	Equal(t, len(fds), 1)
+	MustNil(t, syscall.Close(fds[0]))
+}
+
+func TestPipe(t *testing.T) {
+	c1, c2, err := Pipe()
+	MustNil(t, err)
+	Equal(t, c1.LocalAddr().Network(), "unix")
+
+	closed := make(chan struct{})
+	MustNil(t, c2.AddCloseCallback(func(connection Connection) error {
+		close(closed)
+		return nil
+	}))
+
+	// both directions work
+	_, err = c1.Writer().WriteString("ping")
+	MustNil(t, err)
+	MustNil(t, c1.Writer().Flush())
+	s, err := c2.Reader().ReadString(4)
+	MustNil(t, err)
+	Equal(t, s, "ping")
+	_, err = c2.Writer().WriteString("pong")
+	MustNil(t, err)
+	MustNil(t, c2.Writer().Flush())
+	s, err = c1.Reader().ReadString(4)
+	MustNil(t, err)
+	Equal(t, s, "pong")
+	MustNil(t, c2.Reader().Release())
+	MustNil(t, c1.Reader().Release())
+
+	// closing one end propagates EOF to the other
+	MustNil(t, c1.Close())
+	_, err = c2.Reader().Next(1)
+	MustTrue(t, errors.Is(err, ErrEOF))
+	MustTrue(t, !c2.IsActive())
+	MustNil(t, c2.Close())
+	<-closed
+
+	// the fds are only received with WithFDPassing
+	c1, c2, err = Pipe(WithFDPassing(true))
+	MustNil(t, err)
+	defer c1.Close()
+	defer c2.Close()
+	_, err = c1.(*UnixConnection).WriteWithFDs([]byte("fd"), []int{int(os.Stdin.Fd())})
+	MustNil(t, err)
+	buf := make([]byte, 2)
+	n, fds, err := c2.(*UnixConnection).ReadWithFDs(buf)
+	MustNil(t, err)
+	Equal(t, string(buf[:n]), "fd")
+	Equal(t, len(fds), 1)
+	MustNil(t, syscall.Close(fds[0]))
+}
+
+func TestUnixgramConnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netpoll-unixgram")
+	MustNil(t, err)
+	defer os.RemoveAll(dir)
+	address := filepath.Join(dir, "server.sock")
+
+	// echo each datagram to its sender
+	ln, err := CreateListener("unixgram", address)
+	MustNil(t, err)
+	received := make(chan string, 3)
+	loop, err := NewEventLoop(func(ctx context.Context, connection Connection) error {
+		msg, err := connection.Reader().ReadString(connection.Reader().Len())
+		if err != nil {
+			return err
+		}
+		received <- msg
+		connection.Writer().WriteString(msg)
+		return connection.Writer().Flush()
+	})
+	MustNil(t, err)
+	go loop.Serve(ln)
+	defer loop.Shutdown(context.Background())
+
+	// the client is bound to receive the echoes
+	laddr := &net.UnixAddr{Net: "unixgram", Name: filepath.Join(dir, "client.sock")}
+	conn, err := NewDialer(WithLocalAddr(laddr)).DialConnection("unixgram", address, time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	_, ok := conn.(*UnixConnection)
+	MustTrue(t, ok)
+	msgs := []string{"a", "bb", "ccc"}
+	for _, msg := range msgs {
+		_, err = conn.Writer().WriteString(msg)
+		MustNil(t, err)
+		MustNil(t, conn.Writer().Flush())
+	}
+	for _, msg := range msgs {
+		Equal(t, <-received, msg)
+	}
+	MustNil(t, conn.Reader().WaitReadSize(len("abbccc")))
+	for _, msg := range msgs {
+		Equal(t, conn.Reader().Len(), len(msg))
+		p, err := conn.Reader().Next(conn.Reader().Len())
+		MustNil(t, err)
+		Equal(t, string(p), msg)
+	}
+	Equal(t, conn.RemoteAddr().String(), address)
+}
+
+func TestUnixConnectionPeerCred(t *testing.T) {
+	r, w := GetSysFdPairs()
+	defer syscall.Close(w)
+	conn, err := newUnixConnection(&netFD{fd: r, network: "unix", sotype: syscall.SOCK_STREAM}, nil)
+	MustNil(t, err)
+	defer conn.Close()
+
+	cred, err := conn.PeerCred()
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd":
+	default:
+		MustTrue(t, errors.Is(err, ErrUnsupported))
+		return
+	}
+	MustNil(t, err)
+	// the peer of socketpair is the process itself
+	Equal(t, cred.Uid, uint32(os.Geteuid()))
+	Equal(t, cred.Gid, uint32(os.Getegid()))
+	if runtime.GOOS != "freebsd" {
+		Equal(t, cred.Pid, int32(os.Getpid()))
+	}
+
+	// not a Unix socket
+	var pipe [2]int
+	MustNil(t, syscall.Pipe(pipe[:]))
+	defer syscall.Close(pipe[1])
+	pconn, err := newUnixConnection(&netFD{fd: pipe[0], network: "unix", sotype: syscall.SOCK_STREAM}, nil)
+	MustNil(t, err)
+	defer pconn.Close()
+	_, err = pconn.PeerCred()
+	MustTrue(t, err != nil)
+}
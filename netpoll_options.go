@@ -14,7 +14,11 @@
 
 package netpoll
 
-import "time"
+import (
+	"context"
+	"net"
+	"time"
+)
 
 // Option .
 type Option struct {
@@ -22,13 +26,47 @@ type Option struct {
 }
 
 type options struct {
-	onPrepare    OnPrepare
-	onConnect    OnConnect
-	onDisconnect OnDisconnect
-	onRequest    OnRequest
-	readTimeout  time.Duration
-	writeTimeout time.Duration
-	idleTimeout  time.Duration
+	onPrepare     OnPrepare
+	onConnect     OnConnect
+	onDisconnect  OnDisconnect
+	onRequest     OnRequest
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	idleTimeout   time.Duration
+	graceful      bool
+	tcpNoDelay    bool
+	maxConns      int
+	acceptRate    *acceptRateConfig
+	scheduler     func(task func())
+	pollerCPUs    []int
+	keepAlive     *keepAliveConfig
+	localAddr     net.Addr
+	fallbackDelay time.Duration // the head-start of IPv6 by WithHappyEyeballs, zero means disabled
+	fixedOutput   int           // the size of the fixed output buffer by WithFixedOutputBuffer
+	backlog       int           // the backlog of listen(2) by WithBacklog, zero means the default
+	proxyProtocol bool          // parse the PROXY protocol header of accepted connections by WithProxyProtocol
+	recvBuf       int           // SO_RCVBUF by WithRecvBuf, zero means the system default
+	sendBuf       int           // SO_SNDBUF by WithSendBuf, zero means the system default
+	tos           int           // IP_TOS or IPV6_TCLASS by WithTOS, zero means the system default
+	resolver      Resolver      // resolves the host names for NewDialer by WithResolver, nil means net.DefaultResolver
+	connTimeout   time.Duration // the deadline of accepted connections to finish OnConnect by WithConnectTimeout
+	fastOpen      bool          // TCP Fast Open of the listeners and dialers by WithFastOpen
+	maxRequests   int           // the limit of the concurrent connection tasks of EventLoop by WithMaxConcurrentRequests
+	triggerMode   TriggerMode   // the triggering mode of the readable events by WithTriggerMode
+	fdPassing     bool          // receive the fds passed by SCM_RIGHTS of Unix connections by WithFDPassing
+	panicHandler  func(ctx context.Context, connection Connection, r interface{}, stack []byte)
+	middlewares   []func(next OnRequest) OnRequest
+	onState       func(addr net.Addr, state ConnState)
+}
+
+// acceptRateConfig is the token bucket of accepting, refilled by perSecond tokens per second up to burst.
+type acceptRateConfig struct {
+	perSecond, burst int
+}
+
+// keepAliveConfig is the TCP keepalive parameters in seconds, the zero values keep the system defaults.
+type keepAliveConfig struct {
+	idle, interval, count int
 }
 
 // WithOnPrepare registers the OnPrepare method to EventLoop.
@@ -66,9 +104,312 @@ func WithWriteTimeout(timeout time.Duration) Option {
 	}}
 }
 
+// WithGracefulShutdown makes EventLoop.Shutdown drain the connections.
+// Shutdown stops accepting new connections, closes the idle connections immediately,
+// and waits for the active OnRequest and Flush to finish before closing their connections.
+// If ctx is done before, the remaining connections will be closed forcibly,
+// and Shutdown returns a *ShutdownError which reports the number of them.
+func WithGracefulShutdown(graceful bool) Option {
+	return Option{func(op *options) {
+		op.graceful = graceful
+	}}
+}
+
+// WithTCPNoDelay controls whether TCP_NODELAY is set on TCP connections, which is enabled by default.
+// It's applied before the connection is registered into the poller,
+// and can be used by both NewEventLoop for accepted connections and NewDialer for dialed connections.
+func WithTCPNoDelay(noDelay bool) Option {
+	return Option{func(op *options) {
+		op.tcpNoDelay = noDelay
+	}}
+}
+
+// WithMaxConnections limits the number of live connections accepted by EventLoop, a zero value means no limit.
+// Once the limit is reached, EventLoop stops accepting without closing the listener,
+// and resumes after some connections closed.
+//
+// Note that the kernel still completes the handshakes and queues the connections in the accept backlog,
+// so the new dials may succeed but will not be served until accepted.
+// Once the backlog (see net.core.somaxconn on Linux) is full, the new handshakes will be dropped and the dials time out.
+func WithMaxConnections(n int) Option {
+	return Option{func(op *options) {
+		op.maxConns = n
+	}}
+}
+
+// WithAcceptRate limits the rate of accepting connections by EventLoop with a token bucket,
+// which accepts at most burst connections at once and then perSecond connections per second,
+// a zero value of perSecond means no limit. Once the tokens run out, EventLoop stops accepting
+// until the next token is available, so the excess connections wait in the accept backlog.
+//
+// Same as WithMaxConnections, the kernel still completes the handshakes of the waiting connections,
+// and drops the new handshakes once the backlog (see net.core.somaxconn and tcp_max_syn_backlog on Linux) is full,
+// so the backlog should be sized for the expected herd, or the dials will time out or be retried.
+func WithAcceptRate(perSecond int, burst int) Option {
+	return Option{func(op *options) {
+		if perSecond <= 0 {
+			op.acceptRate = nil
+			return
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		op.acceptRate = &acceptRateConfig{perSecond: perSecond, burst: burst}
+	}}
+}
+
+// WithRequestScheduler runs the OnConnect and OnRequest tasks of the connections by schedule,
+// instead of the runner of netpoll (see Config.Runner), e.g. to share a goroutine pool with other work.
+// The tasks of a connection are still serialized, there is at most one OnRequest running at a time per connection.
+// schedule is called by the poller, so it should not block and must not run the task synchronously,
+// and each task must be run eventually, otherwise the connection will not be processed anymore.
+func WithRequestScheduler(schedule func(task func())) Option {
+	return Option{func(op *options) {
+		op.scheduler = schedule
+	}}
+}
+
+// WithMaxConcurrentRequests limits the number of connections processed at the same time across EventLoop to n,
+// e.g. to bound the goroutines, memory and CPU taken by the handlers under a flood of requests.
+// A connection is processed by a task, which runs OnConnect and then OnRequest until its input is drained,
+// and the limit is applied before the task is scheduled, so at most n tasks take a goroutine at any time.
+// Beyond the limit, the tasks are queued in FIFO order and run by the goroutines of the finished tasks,
+// so the pollers are never blocked, and the queue is bounded by the connections since each has at most one task.
+// Meanwhile the pollers keep reading into the input buffer of the queued connections without limit,
+// so SetReadBufferThreshold, e.g. in OnPrepare, should be used to apply the backpressure to the peers.
+// It also applies to the tasks scheduled by WithRequestScheduler. A non-positive n means no limit.
+func WithMaxConcurrentRequests(n int) Option {
+	return Option{func(op *options) {
+		op.maxRequests = n
+	}}
+}
+
+// TriggerMode is the triggering mode of the readable events of the connections, see WithTriggerMode.
+type TriggerMode int
+
+const (
+	// LevelTriggered notifies the poller as long as there is data left in the socket, which is the default.
+	LevelTriggered TriggerMode = iota
+	// EdgeTriggered notifies the poller only when new data arrives.
+	EdgeTriggered
+)
+
+// WithTriggerMode sets the triggering mode of the readable events of the connections accepted by EventLoop,
+// by EPOLLET of epoll(7) on Linux and EV_CLEAR of kqueue(2) on BSD and Darwin, and the default is LevelTriggered.
+// With EdgeTriggered, the poller reads the socket until EAGAIN on each event, since it is not notified again
+// for the data left, which saves the wakeups of the connections receiving continuously at the cost of one more read(2)
+// per event. The connections paused by SetReadBufferThreshold or SetReadLimit are notified again once resumed.
+func WithTriggerMode(mode TriggerMode) Option {
+	return Option{func(op *options) {
+		op.triggerMode = mode
+	}}
+}
+
+// WithKeepAlive enables TCP keepalive on TCP connections before they are registered into the poller,
+// and can be used by both NewEventLoop for accepted connections and NewDialer for dialed connections.
+// The idle time before the first probe, the interval between probes and the count of unacknowledged probes
+// are set by TCP_KEEPIDLE, TCP_KEEPINTVL and TCP_KEEPCNT in seconds, and a zero value keeps the system default.
+// Darwin uses TCP_KEEPALIVE for the idle time, and OpenBSD only supports enabling it with system-wide parameters.
+// Note that the idle time and interval are overridden by WithIdleTimeout if both are set.
+func WithKeepAlive(idle, interval time.Duration, count int) Option {
+	return Option{func(op *options) {
+		op.keepAlive = &keepAliveConfig{
+			idle:     durationToSeconds(idle),
+			interval: durationToSeconds(interval),
+			count:    count,
+		}
+	}}
+}
+
+// durationToSeconds rounds up d to seconds, since the sockopts are in seconds.
+func durationToSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// WithLocalAddr binds the sockets dialed by NewDialer to addr before connecting, e.g. to choose the source IP on multihomed hosts.
+// The addr is a *net.TCPAddr or *net.UDPAddr for the network, a *net.IPAddr for both of them, or a *net.UnixAddr for Unix networks,
+// and a zero port lets the system choose one. The remote addresses of the other IP family are skipped,
+// and the dial fails with a mismatched family error if none of them matches.
+func WithLocalAddr(addr net.Addr) Option {
+	return Option{func(op *options) {
+		op.localAddr = addr
+	}}
+}
+
+// defaultFallbackDelay is the head-start of IPv6 by WithHappyEyeballs, the same as net.Dialer.
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// WithHappyEyeballs enables the dual-stack dialing of RFC 8305 for the "tcp" network of NewDialer.
+// When the host resolves to both IPv6 and IPv4 addresses, the IPv6 addresses are dialed first,
+// and the IPv4 addresses are dialed in parallel after delay or once the IPv6 ones failed,
+// then the first established connection is returned and the other attempt is canceled.
+// A non-positive delay uses the default 300ms, the same as net.Dialer.
+func WithHappyEyeballs(delay time.Duration) Option {
+	return Option{func(op *options) {
+		if delay <= 0 {
+			delay = defaultFallbackDelay
+		}
+		op.fallbackDelay = delay
+	}}
+}
+
+// WithFixedOutputBuffer makes the connections write into a single preallocated ring buffer of size bytes,
+// instead of the output LinkBuffer growing on demand, so that the memory is predictable and
+// the steady small writes don't allocate. It can be used by NewEventLoop and the TCP dialing of NewDialer.
+// The data written but not yet sent must fit in the ring, otherwise the write fails with ErrBufferFull
+// without allocating, and the producer can wait by SetOnWriteReady before writing again.
+// A non-positive size means the default growing buffer.
+func WithFixedOutputBuffer(size int) Option {
+	return Option{func(op *options) {
+		op.fixedOutput = size
+	}}
+}
+
+// WithBacklog sets the backlog of listen(2) for the stream listeners created by CreateListener,
+// which is the length of the queue of the established connections waiting to be accepted, instead of the default
+// of Go that is read from net.core.somaxconn. Once the queue is full, the new SYNs are dropped and the clients retry.
+// The kernel silently clamps n to net.core.somaxconn on Linux (kern.ipc.somaxconn on BSD and Darwin),
+// so the sysctl must be raised as well for a larger queue. A non-positive n means the default.
+func WithBacklog(n int) Option {
+	return Option{func(op *options) {
+		op.backlog = n
+	}}
+}
+
+// WithProxyProtocol makes EventLoop parse the PROXY protocol v1 or v2 header (see haproxy's proxy-protocol.txt)
+// at the start of each accepted connection, which is sent by the L4 load balancers to pass the real client address.
+// The header is read and skipped before OnConnect and OnRequest, so they see only the application data,
+// and RemoteAddr and LocalAddr return the source and destination addresses in the header,
+// while OnPrepare is called before the header is read and still sees the addresses of the load balancer.
+// The addresses are kept for the LOCAL command and the UNKNOWN or unspecified protocols.
+// The connection is closed if the header is malformed or not received within the read timeout, 5s by default.
+// It must only be enabled when all the clients are trusted proxies, since the client can claim any address.
+func WithProxyProtocol(enable bool) Option {
+	return Option{func(op *options) {
+		op.proxyProtocol = enable
+	}}
+}
+
+// WithFastOpen enables TCP Fast Open (RFC 7413), which carries the first data in the SYN to save a round trip
+// of the short-lived connections, see Dialer.DialWithData. It can be used by NewEventLoop and CreateListener
+// to accept the data in the SYN, with the queue length of WithBacklog or 256 by default, and by NewDialer for TCP,
+// so that the first write of the dialed connections, e.g. by DialWithData, is sent with the SYN.
+// The client sends the data in the SYN only after it has got a cookie from the server by a previous connection,
+// and the server may receive the same SYN data more than once, so the first data should be idempotent.
+//
+// It's only supported on Linux, and needs the net.ipv4.tcp_fastopen sysctl enables the client (1) or server (2) side,
+// the dialer needs Linux 4.11+ for TCP_FASTOPEN_CONNECT. The regular handshake is used if it's unsupported.
+func WithFastOpen(enable bool) Option {
+	return Option{func(op *options) {
+		op.fastOpen = enable
+	}}
+}
+
+// WithPanicHandler recovers the panics in OnConnect and OnRequest of EventLoop, and calls fn with the recovered value
+// and the stack of the panic, then the connection is closed and the EventLoop keeps serving the other connections.
+// Without it, the panic is left to the runner of the tasks, e.g. gopool logs it, and the connection is closed as well.
+func WithPanicHandler(fn func(ctx context.Context, connection Connection, r interface{}, stack []byte)) Option {
+	return Option{func(op *options) {
+		op.panicHandler = fn
+	}}
+}
+
+// WithConnectTimeout closes the accepted connections which don't finish OnConnect within timeout,
+// including reading the PROXY protocol header by WithProxyProtocol, e.g. the clients never sending the handshake bytes
+// waited in OnConnect. The reads blocked in OnConnect return ErrConnClosed once it's closed.
+// The timer is stopped when OnConnect returns, regardless of the idle timeout, and a non-positive value means no limit.
+func WithConnectTimeout(timeout time.Duration) Option {
+	return Option{func(op *options) {
+		op.connTimeout = timeout
+	}}
+}
+
+// WithRecvBuf sets SO_RCVBUF of the connections to bytes before they are registered into the poller,
+// and can be used by both NewEventLoop for accepted connections and NewDialer for TCP dialed connections,
+// e.g. to raise the buffer for the links with a high bandwidth-delay product. A non-positive value keeps the default.
+//
+// Linux doubles the value to allow for the bookkeeping overhead, so Connection.RecvBufSize returns twice the bytes,
+// and clamps it to net.core.rmem_max, it also disables the auto-tuning of the buffer (see tcp_rmem) for the socket.
+// BSD and Darwin keep the value as is and limit it by kern.ipc.maxsockbuf.
+func WithRecvBuf(bytes int) Option {
+	return Option{func(op *options) {
+		op.recvBuf = bytes
+	}}
+}
+
+// WithSendBuf sets SO_SNDBUF of the connections to bytes, the same as WithRecvBuf,
+// and Linux doubles the value and clamps it to net.core.wmem_max.
+func WithSendBuf(bytes int) Option {
+	return Option{func(op *options) {
+		op.sendBuf = bytes
+	}}
+}
+
+// WithTOS sets IP_TOS for IPv4 or IPV6_TCLASS for IPv6 to tos, e.g. a DSCP value shifted left by 2 for QoS,
+// on the listening socket of CreateListener, the accepted connections of NewEventLoop and the TCP dialed connections
+// of NewDialer, where the dual-stack IPv6 sockets set both for their IPv4 peers. The value must be in [0, 255],
+// and zero keeps the default. CreateListener fails if it's invalid or the listener is not IP, while the connections
+// only log the failure, the same as WithRecvBuf. See Connection.SetTOS to change it afterwards.
+func WithTOS(tos int) Option {
+	return Option{func(op *options) {
+		op.tos = tos
+	}}
+}
+
+// WithResolver makes NewDialer resolve the host names of the TCP and UDP addresses by r instead of net.DefaultResolver,
+// e.g. from a service registry. The literal IP addresses and the empty host are not passed to r.
+// The addresses returned by r are dialed in order, or in parallel by families if WithHappyEyeballs is also set.
+func WithResolver(r Resolver) Option {
+	return Option{func(op *options) {
+		op.resolver = r
+	}}
+}
+
+// WithMiddleware wraps the OnRequest of EventLoop with mw, e.g. for logging, auth and metrics,
+// mw[0] is the outermost and calls next down to the OnRequest passed to NewEventLoop.
+// The chain is built once by NewEventLoop, and multiple WithMiddleware are chained in order.
+func WithMiddleware(mw ...func(next OnRequest) OnRequest) Option {
+	return Option{func(op *options) {
+		op.middlewares = append(op.middlewares, mw...)
+	}}
+}
+
+// chain wraps onRequest with the middlewares, mw[0] is the outermost.
+func (opts *options) chain(onRequest OnRequest) OnRequest {
+	for i := len(opts.middlewares) - 1; i >= 0; i-- {
+		onRequest = opts.middlewares[i](onRequest)
+	}
+	return onRequest
+}
+
 // WithIdleTimeout sets the idle timeout of connections.
 func WithIdleTimeout(timeout time.Duration) Option {
 	return Option{func(op *options) {
 		op.idleTimeout = timeout
 	}}
 }
+
+// WithPollerAffinity pins the pollers to cpus, the i-th poller runs on a thread locked to cpus[i],
+// and the number of pollers is changed to len(cpus) like Configure with PollerNum.
+// The pollers are shared by all the EventLoops and Dialers, so it should be set before
+// any connection is created, the pollers already running are not pinned.
+//
+// It only works on Linux by sched_setaffinity(2), and only the number of pollers is changed elsewhere.
+func WithPollerAffinity(cpus []int) Option {
+	return Option{func(op *options) {
+		op.pollerCPUs = cpus
+	}}
+}
+
+// WithFDPassing makes the Unix stream connections created by NewDialer and Pipe receive the fds passed by SCM_RIGHTS,
+// which are returned by UnixConnection.ReadWithFDs. The socket is then read by recvmsg(2) with a buffer for the fds,
+// so it should only be enabled for the connections expecting fds. Without it, the socket is read by readv(2) as usual,
+// and the fds passed by the peer are discarded by the kernel, while UnixConnection.WriteWithFDs always works.
+func WithFDPassing(enable bool) Option {
+	return Option{func(op *options) {
+		op.fdPassing = enable
+	}}
+}
@@ -20,6 +20,7 @@ package netpoll
 import (
 	"context"
 	"errors"
+	"os"
 	"strings"
 	"sync"
 	"syscall"
@@ -41,25 +42,66 @@ type server struct {
 	opts        *options
 	onQuit      func(err error)
 	connections sync.Map // key=fd, value=connection
+
+	// used by WithMaxConnections
+	mux    sync.Mutex
+	conns  int  // number of live connections
+	paused bool // whether accepting is paused
+	closed bool // the listener has been closed, so it must not be controlled anymore
+
+	// used by WithAcceptRate
+	tokens    float64     // the available tokens of accepting
+	refilled  time.Time   // the last time that tokens refilled
+	throttled bool        // whether accepting is paused until the next token
+	refill    *time.Timer // resumes accepting once the next token is available
 }
 
 // Run this server.
 func (s *server) Run() (err error) {
+	if s.opts.acceptRate != nil {
+		s.tokens, s.refilled = float64(s.opts.acceptRate.burst), time.Now()
+	}
 	s.operator = FDOperator{
 		FD:     s.ln.Fd(),
 		OnRead: s.OnRead,
 		OnHup:  s.OnHup,
 	}
 	s.operator.poll = pollmanager.Pick()
-	err = s.operator.Control(PollReadable)
+	if ln, ok := s.ln.(*listener); ok && ln.isPacket() {
+		err = s.servePacket()
+	} else {
+		if s.opts.fastOpen {
+			enableFastOpen(s.ln, s.opts.backlog)
+		}
+		err = s.operator.Control(PollReadable)
+	}
 	if err != nil {
 		s.onQuit(err)
 	}
 	return err
 }
 
+// servePacket serves the packet listener as a single connection, since there is nothing to accept.
+// The connection holds a duplicated fd, so that it can be closed independently of the listener.
+func (s *server) servePacket() error {
+	fd, err := syscall.Dup(s.ln.Fd())
+	if err != nil {
+		return os.NewSyscallError("dup", err)
+	}
+	nfd := newNetFD(fd, 0, syscall.SOCK_DGRAM, s.ln.Addr().Network())
+	nfd.localAddr = s.ln.Addr()
+	s.onAccept(nfd)
+	return nil
+}
+
 // Close this server with deadline.
 func (s *server) Close(ctx context.Context) error {
+	s.mux.Lock()
+	s.closed = true
+	if s.refill != nil {
+		s.refill.Stop()
+	}
+	s.mux.Unlock()
 	s.operator.Control(PollDetach)
 	s.ln.Close()
 
@@ -88,6 +130,9 @@ func (s *server) Close(ctx context.Context) error {
 		}
 		select {
 		case <-ctx.Done():
+			if s.opts.graceful {
+				return s.forceClose(ctx.Err())
+			}
 			return ctx.Err()
 		case <-time.After(waitTime):
 			continue
@@ -95,8 +140,28 @@ func (s *server) Close(ctx context.Context) error {
 	}
 }
 
+// forceClose closes all the remaining connections after the graceful shutdown deadline.
+func (s *server) forceClose(err error) error {
+	forced := 0
+	s.connections.Range(func(key, value interface{}) bool {
+		conn := value.(Connection)
+		if conn.IsActive() {
+			forced++
+		}
+		conn.Close()
+		return true
+	})
+	if forced == 0 {
+		return nil
+	}
+	return &ShutdownError{Forced: forced, Err: err}
+}
+
 // OnRead implements FDOperator.
 func (s *server) OnRead(p Poll) error {
+	if s.opts.acceptRate != nil && !s.takeToken() {
+		return nil
+	}
 	// accept socket
 	conn, err := s.ln.Accept()
 	if err == nil {
@@ -163,13 +228,25 @@ func (s *server) OnHup(p Poll) error {
 func (s *server) onAccept(conn Conn) {
 	// store & register connection
 	nconn := new(connection)
+	nconn.proxyHeader = s.opts.proxyProtocol
+	nconn.connectTimeout = s.opts.connTimeout
+	nconn.panicHandler = s.opts.panicHandler
+	nconn.onState = s.opts.onState
+	if nconn.onState != nil {
+		nconn.onState(conn.RemoteAddr(), StateConnecting)
+	}
 	nconn.init(conn, s.opts)
 	if !nconn.IsActive() {
 		return
 	}
+	if nconn.onState != nil {
+		nconn.onState(nconn.RemoteAddr(), StateActive)
+	}
 	fd := conn.Fd()
+	s.acquire()
 	nconn.AddCloseCallback(func(connection Connection) error {
 		s.connections.Delete(fd)
+		s.release()
 		return nil
 	})
 	s.connections.Store(fd, nconn)
@@ -178,6 +255,79 @@ func (s *server) onAccept(conn Conn) {
 	nconn.onConnect()
 }
 
+// acquire counts a new connection, and pauses accepting if the max connections reached.
+func (s *server) acquire() {
+	if s.opts.maxConns <= 0 {
+		return
+	}
+	s.mux.Lock()
+	s.conns++
+	if s.conns >= s.opts.maxConns && !s.paused {
+		s.setPaused(&s.paused, true)
+	}
+	s.mux.Unlock()
+}
+
+// release counts a closed connection, and resumes accepting if below the max connections.
+func (s *server) release() {
+	if s.opts.maxConns <= 0 {
+		return
+	}
+	s.mux.Lock()
+	s.conns--
+	if s.conns < s.opts.maxConns && s.paused {
+		s.setPaused(&s.paused, false)
+	}
+	s.mux.Unlock()
+}
+
+// takeToken takes a token of accepting, or pauses accepting until the next token is available.
+func (s *server) takeToken() bool {
+	rate := s.opts.acceptRate
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.throttled {
+		return false
+	}
+	now := time.Now()
+	s.tokens += now.Sub(s.refilled).Seconds() * float64(rate.perSecond)
+	if s.tokens > float64(rate.burst) {
+		s.tokens = float64(rate.burst)
+	}
+	s.refilled = now
+	if s.tokens >= 1 {
+		s.tokens--
+		return true
+	}
+	s.setPaused(&s.throttled, true)
+	wait := time.Duration((1 - s.tokens) / float64(rate.perSecond) * float64(time.Second))
+	s.refill = time.AfterFunc(wait, func() {
+		s.mux.Lock()
+		// the timer may fire concurrently with Close
+		if !s.closed {
+			s.setPaused(&s.throttled, false)
+		}
+		s.mux.Unlock()
+	})
+	return false
+}
+
+// setPaused sets the pausing reason flag, and pauses or resumes accepting if it's the first or last reason.
+// It must be called with s.mux locked, and does nothing once the server is closed.
+func (s *server) setPaused(flag *bool, paused bool) {
+	if s.closed {
+		return
+	}
+	wasPaused := s.paused || s.throttled
+	*flag = paused
+	switch isPaused := s.paused || s.throttled; {
+	case isPaused && !wasPaused:
+		s.operator.Control(PollR2Hup)
+	case !isPaused && wasPaused:
+		s.operator.Control(PollHup2R)
+	}
+}
+
 func isOutOfFdErr(err error) bool {
 	se, ok := err.(syscall.Errno)
 	return ok && (se == syscall.EMFILE || se == syscall.ENFILE)
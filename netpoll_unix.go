@@ -25,6 +25,7 @@ import (
 	"os"
 	"runtime"
 	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -84,6 +85,12 @@ func SetNumLoops(numLoops int) error {
 	return pollmanager.SetNumLoops(numLoops)
 }
 
+// NumPollers returns the number of the running pollers, which are shared by all EventLoops and Dialers,
+// and indexed in the same order as Stats().Pollers, EventLoop.PollerLoads and Connection.MigrateToPoller.
+func NumPollers() int {
+	return pollmanager.NumPolls()
+}
+
 // SetLoadBalance sets the load balancing method. Load balancing is always a best effort to attempt
 // to distribute the incoming connections between multiple polls.
 // This option only works when numLoops is set.
@@ -117,36 +124,165 @@ func DisableGopool() error {
 // NewEventLoop .
 func NewEventLoop(onRequest OnRequest, ops ...Option) (EventLoop, error) {
 	opts := &options{
-		onRequest: onRequest,
+		onRequest:  onRequest,
+		tcpNoDelay: true,
 	}
 	for _, do := range ops {
 		do.f(opts)
 	}
-	return &eventLoop{
-		opts: opts,
-		stop: make(chan error, 1),
-	}, nil
+	if opts.pollerCPUs != nil {
+		if err := pollmanager.SetAffinity(opts.pollerCPUs); err != nil {
+			return nil, err
+		}
+	}
+	evl := &eventLoop{
+		opts:   opts,
+		stop:   make(chan error, 1),
+		events: make(chan ConnEvent, stateEventsSize),
+	}
+	if opts.maxRequests > 0 {
+		// the tasks beyond the limit are queued before they are scheduled, so they take no goroutine
+		limiter := &taskLimiter{limit: opts.maxRequests, schedule: opts.scheduler}
+		if limiter.schedule == nil {
+			limiter.schedule = func(task func()) { runTask(context.Background(), task) }
+		}
+		opts.scheduler = limiter.submit
+	}
+	// the connections report their states to evl, which are dropped until StateEvents is called
+	opts.onState = evl.onState
+	if opts.onRequest != nil {
+		// the connections call the handler loaded by onRequest, so that it can be replaced by SetOnRequest
+		evl.handler.Store(opts.chain(opts.onRequest))
+		opts.onRequest = evl.onRequest
+	}
+	return evl, nil
 }
 
 type eventLoop struct {
 	sync.Mutex
-	opts *options
-	svr  *server
-	stop chan error
+	opts    *options
+	svrs    []*server
+	stop    chan error
+	handler atomic.Value // OnRequest chained with the middlewares
+
+	// used by StateEvents
+	events   chan ConnEvent
+	watching int32  // StateEvents has been called, updated atomically
+	dropped  uint64 // the number of the dropped events, updated atomically
+}
+
+// stateEventsSize is the buffer size of the channel of StateEvents.
+const stateEventsSize = 1024
+
+// SetOnRequest implements EventLoop.
+func (evl *eventLoop) SetOnRequest(fn OnRequest) error {
+	if fn == nil {
+		return nil
+	}
+	if evl.opts.onRequest == nil {
+		return Exception(ErrUnsupported, "set OnRequest of EventLoop without OnRequest")
+	}
+	evl.handler.Store(evl.opts.chain(fn))
+	return nil
+}
+
+// onRequest is the OnRequest of the connections, which calls the current handler.
+func (evl *eventLoop) onRequest(ctx context.Context, connection Connection) error {
+	return evl.handler.Load().(OnRequest)(ctx, connection)
+}
+
+// taskLimiter limits the running tasks of the connections by WithMaxConcurrentRequests.
+// The tasks are submitted by the pollers, and the ones beyond the limit wait in a FIFO queue,
+// which are run one after another by the goroutines of the finished tasks.
+type taskLimiter struct {
+	mu       sync.Mutex
+	limit    int
+	running  int
+	pending  []func()
+	schedule func(task func())
+}
+
+// submit runs task if the limit is not reached, otherwise queues it, and it never blocks the poller.
+func (l *taskLimiter) submit(task func()) {
+	l.mu.Lock()
+	if l.running >= l.limit {
+		l.pending = append(l.pending, task)
+		l.mu.Unlock()
+		return
+	}
+	l.running++
+	l.mu.Unlock()
+	l.schedule(func() {
+		for ; task != nil; task = l.next() {
+			task()
+		}
+	})
+}
+
+// next pops the oldest queued task, or releases the slot of the finished task if there is none.
+func (l *taskLimiter) next() (task func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.pending) == 0 {
+		l.running--
+		return nil
+	}
+	task = l.pending[0]
+	l.pending[0] = nil
+	l.pending = l.pending[1:]
+	return task
+}
+
+// StateEvents implements EventLoop.
+func (evl *eventLoop) StateEvents() <-chan ConnEvent {
+	atomic.StoreInt32(&evl.watching, 1)
+	return evl.events
+}
+
+// DroppedStateEvents implements EventLoop.
+func (evl *eventLoop) DroppedStateEvents() uint64 {
+	return atomic.LoadUint64(&evl.dropped)
+}
+
+// onState sends the state transition to the channel of StateEvents without blocking.
+func (evl *eventLoop) onState(addr net.Addr, state ConnState) {
+	if atomic.LoadInt32(&evl.watching) == 0 {
+		return
+	}
+	select {
+	case evl.events <- ConnEvent{RemoteAddr: addr, State: state}:
+	default:
+		atomic.AddUint64(&evl.dropped, 1)
+	}
 }
 
 // Serve implements EventLoop.
 func (evl *eventLoop) Serve(ln net.Listener) error {
-	npln, err := ConvertListener(ln)
-	if err != nil {
-		return err
+	return evl.ServeMulti(ln)
+}
+
+// ServeMulti implements EventLoop.
+func (evl *eventLoop) ServeMulti(lns ...net.Listener) error {
+	if len(lns) == 0 {
+		return Exception(ErrUnsupported, "serve without listener")
+	}
+	nplns := make([]Listener, len(lns))
+	for i := range lns {
+		npln, err := ConvertListener(lns[i])
+		if err != nil {
+			return err
+		}
+		nplns[i] = npln
 	}
 	evl.Lock()
-	evl.svr = newServer(npln, evl.opts, evl.quit)
-	evl.svr.Run()
+	for _, npln := range nplns {
+		svr := newServer(npln, evl.opts, evl.quit)
+		evl.svrs = append(evl.svrs, svr)
+		svr.Run()
+	}
 	evl.Unlock()
 
-	err = evl.waitQuit()
+	err := evl.waitQuit()
 	// ensure evl will not be finalized until Serve returns
 	runtime.SetFinalizer(evl, nil)
 	return err
@@ -155,15 +291,108 @@ func (evl *eventLoop) Serve(ln net.Listener) error {
 // Shutdown signals a shutdown a begins server closing.
 func (evl *eventLoop) Shutdown(ctx context.Context) error {
 	evl.Lock()
-	svr := evl.svr
-	evl.svr = nil
+	svrs := evl.svrs
+	evl.svrs = nil
 	evl.Unlock()
 
-	if svr == nil {
+	if len(svrs) == 0 {
 		return nil
 	}
 	evl.quit(nil)
-	return svr.Close(ctx)
+	if len(svrs) == 1 {
+		return svrs[0].Close(ctx)
+	}
+
+	// close all servers concurrently, so that they share the same deadline
+	errs := make([]error, len(svrs))
+	var wg sync.WaitGroup
+	for i := range svrs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = svrs[i].Close(ctx)
+		}(i)
+	}
+	wg.Wait()
+	return mergeShutdownErrors(errs)
+}
+
+// mergeShutdownErrors returns the first error of servers,
+// and the forced connections are summed up if the errors are *ShutdownError.
+func mergeShutdownErrors(errs []error) (err error) {
+	var serr *ShutdownError
+	for _, e := range errs {
+		if e == nil {
+			continue
+		}
+		if se, ok := e.(*ShutdownError); ok {
+			if serr == nil {
+				serr = &ShutdownError{Err: se.Err}
+			}
+			serr.Forced += se.Forced
+			continue
+		}
+		if err == nil {
+			err = e
+		}
+	}
+	if serr != nil {
+		return serr
+	}
+	return err
+}
+
+// Stats implements EventLoop.
+func (evl *eventLoop) Stats() Stats {
+	return pollmanager.Stats()
+}
+
+// PollerLoads implements EventLoop.
+func (evl *eventLoop) PollerLoads() []int {
+	loads := make([]int, pollmanager.NumPolls())
+	evl.Range(func(conn Connection) bool {
+		c, ok := conn.(*connection)
+		if !ok {
+			return true
+		}
+		idx := pollmanager.Index(c.operator.getPoll())
+		if idx >= 0 && idx < len(loads) {
+			loads[idx]++
+		}
+		return true
+	})
+	return loads
+}
+
+// Range implements EventLoop.
+func (evl *eventLoop) Range(fn func(connection Connection) bool) {
+	evl.Lock()
+	svrs := evl.svrs
+	evl.Unlock()
+
+	next := true
+	for _, svr := range svrs {
+		svr.connections.Range(func(key, value interface{}) bool {
+			conn := value.(Connection)
+			if conn.IsActive() {
+				next = fn(conn)
+			}
+			return next
+		})
+		if !next {
+			return
+		}
+	}
+}
+
+// RangeByTag implements EventLoop.
+func (evl *eventLoop) RangeByTag(key, value string, fn func(connection Connection) bool) {
+	evl.Range(func(connection Connection) bool {
+		if v, ok := connection.Tag(key); ok && v == value {
+			return fn(connection)
+		}
+		return true
+	})
 }
 
 // waitQuit waits for a quit signal
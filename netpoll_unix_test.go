@@ -18,11 +18,16 @@
 package netpoll
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"net"
 	"os"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -145,6 +150,102 @@ func TestOnConnectWrite(t *testing.T) {
 	MustNil(t, err)
 }
 
+func TestOnConnectReject(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	var requests int32
+	reasons := make(chan error, 1)
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			atomic.AddInt32(&requests, 1)
+			_, err := connection.Reader().Next(connection.Reader().Len())
+			MustNil(t, err)
+			return nil
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			// authenticate by the first bytes
+			token, err := connection.Reader().Peek(4)
+			if err != nil || string(token) != "pass" {
+				connection.AddCloseReasonCallback(func(connection Connection, reason error) error {
+					reasons <- reason
+					return nil
+				})
+				ctx, cancel := context.WithCancel(ctx)
+				cancel()
+				return ctx
+			}
+			return ctx
+		}),
+	)
+	defer loop.Shutdown(context.Background())
+
+	// rejected
+	conn, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	_, err = conn.Write([]byte("fail and more data"))
+	MustNil(t, err)
+	_, err = conn.Reader().Next(1)
+	MustTrue(t, errors.Is(err, ErrEOF))
+	Equal(t, atomic.LoadInt32(&requests), int32(0))
+	MustTrue(t, errors.Is(<-reasons, context.Canceled))
+	conn.Close()
+
+	// accepted
+	conn, err = DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	_, err = conn.Write([]byte("pass"))
+	MustNil(t, err)
+	for atomic.LoadInt32(&requests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	MustTrue(t, conn.IsActive())
+	conn.Close()
+}
+
+func TestConnectionUserData(t *testing.T) {
+	type session struct {
+		id int
+	}
+	network, address := "tcp", getTestAddress()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	var server Connection
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			sess, ok := connection.GetUserData().(*session)
+			MustTrue(t, ok)
+			Equal(t, sess.id, 1)
+			_, err := connection.Reader().Next(connection.Reader().Len())
+			MustNil(t, err)
+			return connection.Close()
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			server = connection
+			connection.SetUserData(&session{id: 1})
+			connection.AddCloseCallback(func(connection Connection) error {
+				// still available in close callbacks
+				MustTrue(t, connection.GetUserData() != nil)
+				wg.Done()
+				return nil
+			})
+			wg.Done()
+			return ctx
+		}),
+	)
+	defer loop.Shutdown(context.Background())
+
+	conn, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	MustTrue(t, conn.GetUserData() == nil)
+	_, err = conn.Write([]byte("hello"))
+	MustNil(t, err)
+	wg.Wait()
+	// cleared after closed
+	for server.GetUserData() != nil {
+		runtime.Gosched()
+	}
+	conn.Close()
+}
+
 func TestOnDisconnect(t *testing.T) {
 	type ctxKey struct{}
 	network, address := "tcp", getTestAddress()
@@ -242,77 +343,866 @@ func TestOnDisconnectWhenOnConnect(t *testing.T) {
 		}),
 	)
 
-	for i := int32(0); i < conns; i++ {
+	for i := int32(0); i < conns; i++ {
+		conn, err := DialConnection(network, address, time.Second)
+		MustNil(t, err)
+		err = conn.Close()
+		t.Logf("Close: %v", conn.LocalAddr())
+		MustNil(t, err)
+	}
+
+	wg.Wait()
+	err := loop.Shutdown(context.Background())
+	MustNil(t, err)
+}
+
+func TestOnDisconnectByPeer(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	var connected, disconnected int32
+	release, final := make(chan struct{}), make(chan string, 1)
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			// wait for OnDisconnect peeking the final bytes of the first connection
+			<-release
+			buf, err := connection.Reader().Next(connection.Reader().Len())
+			if err != nil {
+				return err
+			}
+			if string(buf) == "quit" {
+				connection.Close()
+			}
+			return nil
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			// reject the second connection
+			if atomic.AddInt32(&connected, 1) == 2 {
+				ctx, cancel := context.WithCancel(ctx)
+				cancel()
+				return ctx
+			}
+			return ctx
+		}),
+		WithOnDisconnect(func(ctx context.Context, connection Connection) {
+			if atomic.AddInt32(&disconnected, 1) == 1 {
+				p, _ := connection.Reader().Peek(connection.Reader().Len())
+				final <- string(p)
+				close(release)
+			}
+		}),
+	)
+	defer loop.Shutdown(context.Background())
+
+	// closed by peer, and the final bytes are readable
+	conn, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	_, err = conn.Write([]byte("pingbye"))
+	MustNil(t, err)
+	MustNil(t, conn.Close())
+	Equal(t, <-final, "pingbye")
+
+	// rejected by OnConnect
+	conn, err = DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	_, err = conn.Reader().Next(1)
+	MustTrue(t, errors.Is(err, ErrEOF))
+	conn.Close()
+
+	// closed by OnRequest
+	conn, err = DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	_, err = conn.Write([]byte("quit"))
+	MustNil(t, err)
+	_, err = conn.Reader().Next(1)
+	MustTrue(t, errors.Is(err, ErrEOF))
+	conn.Close()
+
+	time.Sleep(10 * time.Millisecond)
+	Equal(t, atomic.LoadInt32(&connected), int32(3))
+	Equal(t, atomic.LoadInt32(&disconnected), int32(1))
+}
+
+func TestGracefulExit(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+
+	// exit without processing connections
+	eventLoop1 := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			return nil
+		})
+	_, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	err = eventLoop1.Shutdown(context.Background())
+	MustNil(t, err)
+
+	// exit with processing connections
+	trigger := make(chan struct{})
+	eventLoop2 := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			<-trigger
+			return nil
+		})
+	for i := 0; i < 10; i++ {
+		// connect success
+		conn, err := DialConnection(network, address, time.Second)
+		MustNil(t, err)
+		_, err = conn.Write(make([]byte, 16))
+		MustNil(t, err)
+	}
+	// shutdown timeout
+	ctx2, cancel2 := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel2()
+	err = eventLoop2.Shutdown(ctx2)
+	MustTrue(t, err != nil)
+	Equal(t, err.Error(), ctx2.Err().Error())
+	// shutdown success
+	close(trigger)
+	err = eventLoop2.Shutdown(ctx2)
+	MustTrue(t, err == nil)
+
+	// exit with read connections
+	size := 16
+	eventLoop3 := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			_, err := connection.Reader().Next(size)
+			MustNil(t, err)
+			return nil
+		})
+	for i := 0; i < 10; i++ {
+		conn, err := DialConnection(network, address, time.Second)
+		MustNil(t, err)
+		if i%2 == 0 {
+			_, err := conn.Write(make([]byte, size))
+			MustNil(t, err)
+		}
+	}
+	ctx3, cancel3 := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel3()
+	err = eventLoop3.Shutdown(ctx3)
+	MustNil(t, err)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+
+	// drain the requests in progress
+	size := 16
+	eventLoop1 := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			buf, err := connection.Reader().Next(size)
+			MustNil(t, err)
+			time.Sleep(50 * time.Millisecond)
+			_, err = connection.Writer().WriteBinary(buf)
+			MustNil(t, err)
+			return connection.Writer().Flush()
+		},
+		WithGracefulShutdown(true),
+	)
+	var conns []Connection
+	for i := 0; i < 10; i++ {
+		conn, err := DialConnection(network, address, time.Second)
+		MustNil(t, err)
+		_, err = conn.Write(make([]byte, size))
+		MustNil(t, err)
+		conns = append(conns, conn)
+	}
+	idle, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	time.Sleep(10 * time.Millisecond) // wait for requests received
+	ctx1, cancel1 := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel1()
+	err = eventLoop1.Shutdown(ctx1)
+	MustNil(t, err)
+	for _, conn := range conns {
+		_, err = conn.Reader().Next(size)
+		MustNil(t, err)
+	}
+	// idle connection is closed immediately
+	_, err = idle.Reader().Next(1)
+	MustTrue(t, err != nil)
+
+	// force close the requests in progress after deadline
+	trigger := make(chan struct{})
+	defer close(trigger)
+	eventLoop2 := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			<-trigger
+			return nil
+		},
+		WithGracefulShutdown(true),
+	)
+	for i := 0; i < 5; i++ {
+		conn, err := DialConnection(network, address, time.Second)
+		MustNil(t, err)
+		_, err = conn.Write(make([]byte, size))
+		MustNil(t, err)
+	}
+	for i := 0; i < 5; i++ {
+		_, err := DialConnection(network, address, time.Second)
+		MustNil(t, err)
+	}
+	time.Sleep(10 * time.Millisecond) // wait for requests received
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+	err = eventLoop2.Shutdown(ctx2)
+	var serr *ShutdownError
+	MustTrue(t, errors.As(err, &serr))
+	Equal(t, serr.Forced, 5)
+	MustTrue(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestEventLoopServeMulti(t *testing.T) {
+	tcpAddress, unixAddress := getTestAddress(), "serve_multi.sock"
+	tcpln, err := createTestListener("tcp", tcpAddress)
+	MustNil(t, err)
+	unixln, err := createTestListener("unix", unixAddress)
+	MustNil(t, err)
+	loop, err := NewEventLoop(func(ctx context.Context, connection Connection) error {
+		buf, err := connection.Reader().Next(connection.Reader().Len())
+		if err != nil {
+			return err
+		}
+		_, err = connection.Writer().WriteBinary(buf)
+		if err != nil {
+			return err
+		}
+		return connection.Writer().Flush()
+	})
+	MustNil(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- loop.ServeMulti(tcpln, unixln)
+	}()
+
+	for _, addr := range [][2]string{{"tcp", tcpAddress}, {"unix", unixAddress}} {
+		conn, err := DialConnection(addr[0], addr[1], time.Second)
+		MustNil(t, err)
+		_, err = conn.Writer().WriteString(addr[0])
+		MustNil(t, err)
+		MustNil(t, conn.Writer().Flush())
+		buf, err := conn.Reader().Next(len(addr[0]))
+		MustNil(t, err)
+		Equal(t, string(buf), addr[0])
+		MustNil(t, conn.Close())
+	}
+
+	MustNil(t, loop.Shutdown(context.Background()))
+	<-served
+	for _, addr := range [][2]string{{"tcp", tcpAddress}, {"unix", unixAddress}} {
+		_, err = DialConnection(addr[0], addr[1], time.Second)
+		MustTrue(t, err != nil)
+	}
+}
+
+func TestAcceptRate(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	rate, burst, total := 20, 2, 10
+	var mu sync.Mutex
+	var accepts []time.Time
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			return nil
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			mu.Lock()
+			accepts = append(accepts, time.Now())
+			mu.Unlock()
+			return ctx
+		}),
+		WithAcceptRate(rate, burst),
+	)
+	defer loop.Shutdown(context.Background())
+
+	start := time.Now()
+	for i := 0; i < total; i++ {
+		conn, err := DialConnection(network, address, time.Second)
+		MustNil(t, err)
+		defer conn.Close()
+	}
+	for i := 0; i < 100; i++ {
+		mu.Lock()
+		n := len(accepts)
+		mu.Unlock()
+		if n == total {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	Equal(t, len(accepts), total)
+	// at most burst+rate*elapsed connections are accepted, so the accepts beyond the burst are paced by the rate,
+	// while the scheduling delays only postpone them, which is bounded generously
+	interval := time.Second / time.Duration(rate)
+	for i := burst; i < total; i++ {
+		elapsed := accepts[i].Sub(start)
+		Assert(t, elapsed >= time.Duration(i+1-burst)*interval*3/4, i, elapsed)
+	}
+	elapsed := accepts[total-1].Sub(start)
+	expected := time.Duration(total-burst) * interval
+	Assert(t, elapsed < expected+2*time.Second, elapsed)
+}
+
+func TestRequestScheduler(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	var scheduled, running int32
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			// one OnRequest at a time per connection
+			inflight := ctx.Value("inflight").(*int32)
+			MustTrue(t, atomic.AddInt32(inflight, 1) == 1)
+			defer atomic.AddInt32(inflight, -1)
+			atomic.AddInt32(&running, 1)
+			buf, err := connection.Reader().Next(connection.Reader().Len())
+			if err != nil {
+				return err
+			}
+			connection.Writer().WriteBinary(buf)
+			return connection.Writer().Flush()
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			return context.WithValue(ctx, "inflight", new(int32))
+		}),
+		WithRequestScheduler(func(task func()) {
+			atomic.AddInt32(&scheduled, 1)
+			go task()
+		}),
+	)
+	defer loop.Shutdown(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := DialConnection(network, address, time.Second)
+			MustNil(t, err)
+			defer conn.Close()
+			for j := 0; j < 100; j++ {
+				_, err = conn.Writer().WriteString("ping")
+				MustNil(t, err)
+				MustNil(t, conn.Writer().Flush())
+				s, err := conn.Reader().ReadString(len("ping"))
+				MustNil(t, err)
+				Equal(t, s, "ping")
+			}
+		}()
+	}
+	wg.Wait()
+	// at least the OnConnect tasks, and OnRequest is run by the scheduled tasks only
+	MustTrue(t, atomic.LoadInt32(&scheduled) >= 4)
+	MustTrue(t, atomic.LoadInt32(&running) >= 400)
+}
+
+func TestMiddleware(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	var mu sync.Mutex
+	var calls []string
+	record := func(s string) {
+		mu.Lock()
+		calls = append(calls, s)
+		mu.Unlock()
+	}
+	var built int32
+	middleware := func(name string) func(next OnRequest) OnRequest {
+		return func(next OnRequest) OnRequest {
+			atomic.AddInt32(&built, 1)
+			return func(ctx context.Context, connection Connection) error {
+				record(name + ">")
+				defer record("<" + name)
+				return next(ctx, connection)
+			}
+		}
+	}
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			record("handler")
+			buf, err := connection.Reader().Next(connection.Reader().Len())
+			if err != nil {
+				return err
+			}
+			connection.Writer().WriteBinary(buf)
+			return connection.Writer().Flush()
+		},
+		WithMiddleware(middleware("a")),
+		WithMiddleware(middleware("b")),
+	)
+	defer loop.Shutdown(context.Background())
+
+	conn, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		_, err = conn.Writer().WriteString("ping")
+		MustNil(t, err)
+		MustNil(t, conn.Writer().Flush())
+		s, err := conn.Reader().ReadString(len("ping"))
+		MustNil(t, err)
+		Equal(t, s, "ping")
+	}
+	// the chain is built once, not per request
+	Equal(t, atomic.LoadInt32(&built), int32(2))
+	for i := 0; i < 100; i++ {
+		mu.Lock()
+		n := len(calls)
+		mu.Unlock()
+		if n >= 5 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	Equal(t, strings.Join(calls[:5], " "), "a> b> handler <b <a")
+}
+
+func TestEventLoopSetOnRequest(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	reply := func(s string) OnRequest {
+		return func(ctx context.Context, connection Connection) error {
+			_, err := connection.Reader().Next(connection.Reader().Len())
+			if err != nil {
+				return err
+			}
+			connection.Writer().WriteString(s)
+			return connection.Writer().Flush()
+		}
+	}
+	var calls int32
+	loop := newTestEventLoop(network, address, reply("v1"),
+		WithMiddleware(func(next OnRequest) OnRequest {
+			return func(ctx context.Context, connection Connection) error {
+				atomic.AddInt32(&calls, 1)
+				return next(ctx, connection)
+			}
+		}),
+	)
+	defer loop.Shutdown(context.Background())
+
+	request := func(conn Connection) string {
+		_, err := conn.Writer().WriteString("ping")
+		MustNil(t, err)
+		MustNil(t, conn.Writer().Flush())
+		s, err := conn.Reader().ReadString(2)
+		MustNil(t, err)
+		return s
+	}
+	conn, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	for i := 0; i < 10; i++ {
+		Equal(t, request(conn), "v1")
+	}
+	// the existing connection calls the new handler from the next request
+	MustNil(t, loop.SetOnRequest(reply("v2")))
+	for i := 0; i < 10; i++ {
+		Equal(t, request(conn), "v2")
+	}
+	conn2, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer conn2.Close()
+	Equal(t, request(conn2), "v2")
+	// the middlewares are kept
+	MustTrue(t, atomic.LoadInt32(&calls) >= 21)
+	MustNil(t, loop.SetOnRequest(nil))
+	Equal(t, request(conn2), "v2")
+
+	evl, err := NewEventLoop(nil)
+	MustNil(t, err)
+	err = evl.SetOnRequest(reply("v1"))
+	MustTrue(t, errors.Is(err, ErrUnsupported))
+}
+
+func TestConnectTimeout(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	// the timeout is well above the scheduling delays, so the handshake in time is never closed
+	timeout := time.Second
+	handshake := make(chan error, 2)
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			_, err := connection.Reader().Next(connection.Reader().Len())
+			return err
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			_, err := connection.Reader().Next(len("hello"))
+			handshake <- err
+			return ctx
+		}),
+		WithConnectTimeout(timeout),
+	)
+	defer loop.Shutdown(context.Background())
+
+	// the client sends the handshake, and the timer is stopped once OnConnect returns
+	start := time.Now()
+	conn, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	_, err = conn.Writer().WriteString("hello")
+	MustNil(t, err)
+	MustNil(t, conn.Writer().Flush())
+	MustNil(t, <-handshake)
+
+	// the client never sends the handshake
+	silent, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer silent.Close()
+	silentStart := time.Now()
+	_, err = silent.Reader().Next(1)
+	MustTrue(t, err != nil)
+	Assert(t, time.Since(silentStart) >= timeout*3/4, time.Since(silentStart))
+	MustTrue(t, errors.Is(<-handshake, ErrConnClosed))
+
+	// the first connection outlives the timeout
+	time.Sleep(timeout*3/2 - time.Since(start))
+	MustTrue(t, conn.IsActive())
+}
+
+func TestMaxConnections(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	maxConns := 3
+	var accepted int32
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			buf, err := connection.Reader().Next(connection.Reader().Len())
+			MustNil(t, err)
+			_, err = connection.Writer().WriteBinary(buf)
+			MustNil(t, err)
+			return connection.Writer().Flush()
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			atomic.AddInt32(&accepted, 1)
+			return ctx
+		}),
+		WithMaxConnections(maxConns),
+	)
+	defer loop.Shutdown(context.Background())
+
+	var conns []Connection
+	for i := 0; i < maxConns; i++ {
+		conn, err := DialConnection(network, address, time.Second)
+		MustNil(t, err)
+		conns = append(conns, conn)
+	}
+	// the handshake is completed by the kernel, but it will not be accepted
+	pending, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer pending.Close()
+	time.Sleep(50 * time.Millisecond)
+	Equal(t, atomic.LoadInt32(&accepted), int32(maxConns))
+	_, err = pending.Write([]byte("pending"))
+	MustNil(t, err)
+	pending.SetReadTimeout(50 * time.Millisecond)
+	_, err = pending.Reader().Next(len("pending"))
+	MustTrue(t, errors.Is(err, ErrReadTimeout))
+
+	// existing connections stay healthy
+	for _, conn := range conns {
+		_, err = conn.Write([]byte("ping"))
+		MustNil(t, err)
+		s, err := conn.Reader().ReadString(len("ping"))
+		MustNil(t, err)
+		Equal(t, s, "ping")
+	}
+
+	// resume accepting after a connection closed
+	conns[0].Close()
+	pending.SetReadTimeout(time.Second)
+	s, err := pending.Reader().ReadString(len("pending"))
+	MustNil(t, err)
+	Equal(t, s, "pending")
+	Equal(t, atomic.LoadInt32(&accepted), int32(maxConns+1))
+	for _, conn := range conns[1:] {
+		conn.Close()
+	}
+}
+
+func TestEventLoopStats(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	connected := make(chan struct{}, 16)
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			return nil
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			connected <- struct{}{}
+			return ctx
+		}))
+	defer loop.Shutdown(context.Background())
+	// make sure the listener is served
+	conn, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	<-connected
+
+	waitFDs := func(cond func(fds int64) bool) int64 {
+		for i := 0; i < 1000; i++ {
+			if fds := loop.Stats().FDs; cond(fds) {
+				return fds
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("unexpected fds: %d", loop.Stats().FDs)
+		return 0
+	}
+	base := loop.Stats().FDs
+	MustTrue(t, base >= 3)
+	stats := loop.Stats()
+	MustTrue(t, len(stats.Pollers) > 0)
+	MustTrue(t, stats.Waits > 0)
+	MustTrue(t, stats.Events > 0)
+
+	// client and server connections are both registered
+	conns := 10
+	var clients []Connection
+	for i := 0; i < conns; i++ {
+		conn, err := DialConnection(network, address, time.Second)
+		MustNil(t, err)
+		clients = append(clients, conn)
+	}
+	waitFDs(func(fds int64) bool { return fds >= base+int64(2*conns) })
+	for _, conn := range clients {
+		conn.Close()
+	}
+	waitFDs(func(fds int64) bool { return fds <= base })
+}
+
+func TestEventLoopPollerLoads(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	connected := make(chan struct{}, 64)
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			return nil
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			connected <- struct{}{}
+			return ctx
+		}))
+	defer loop.Shutdown(context.Background())
+
+	conns := 32
+	for i := 0; i < conns; i++ {
 		conn, err := DialConnection(network, address, time.Second)
 		MustNil(t, err)
-		err = conn.Close()
-		t.Logf("Close: %v", conn.LocalAddr())
-		MustNil(t, err)
+		defer conn.Close()
+		<-connected
 	}
+	Equal(t, NumPollers(), len(loop.Stats().Pollers))
+	loads := loop.PollerLoads()
+	Equal(t, len(loads), NumPollers())
+	var total int
+	for _, n := range loads {
+		total += n
+	}
+	Equal(t, total, conns)
 
-	wg.Wait()
-	err := loop.Shutdown(context.Background())
-	MustNil(t, err)
+	// the counts are moved with the migrated connections
+	if NumPollers() > 1 {
+		loop.Range(func(connection Connection) bool {
+			MustNil(t, connection.MigrateToPoller(0))
+			return true
+		})
+		Equal(t, loop.PollerLoads()[0], conns)
+	}
 }
 
-func TestGracefulExit(t *testing.T) {
+func TestEventLoopRange(t *testing.T) {
 	network, address := "tcp", getTestAddress()
-
-	// exit without processing connections
-	eventLoop1 := newTestEventLoop(network, address,
+	connected := make(chan struct{}, 16)
+	loop := newTestEventLoop(network, address,
 		func(ctx context.Context, connection Connection) error {
 			return nil
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			connected <- struct{}{}
+			return ctx
+		}))
+	defer loop.Shutdown(context.Background())
+
+	conns := 6
+	var clients []Connection
+	banned := map[int]bool{}
+	for i := 0; i < conns; i++ {
+		conn, err := DialConnection(network, address, time.Second)
+		MustNil(t, err)
+		defer conn.Close()
+		<-connected
+		clients = append(clients, conn)
+		if i%2 == 0 {
+			banned[conn.LocalAddr().(*net.TCPAddr).Port] = true
+		}
+	}
+	count := func() (n int) {
+		loop.Range(func(connection Connection) bool {
+			n++
+			return true
 		})
-	_, err := DialConnection(network, address, time.Second)
-	MustNil(t, err)
-	err = eventLoop1.Shutdown(context.Background())
-	MustNil(t, err)
+		return n
+	}
+	Equal(t, count(), conns)
+	// stop ranging
+	var visited int
+	loop.Range(func(connection Connection) bool {
+		visited++
+		return visited < 2
+	})
+	Equal(t, visited, 2)
 
-	// exit with processing connections
-	trigger := make(chan struct{})
-	eventLoop2 := newTestEventLoop(network, address,
+	// close the connections from the banned ports
+	var kicked int
+	loop.Range(func(connection Connection) bool {
+		if banned[connection.RemoteAddr().(*net.TCPAddr).Port] {
+			kicked++
+			MustNil(t, connection.Close())
+		}
+		return true
+	})
+	Equal(t, kicked, len(banned))
+	for _, conn := range clients {
+		if banned[conn.LocalAddr().(*net.TCPAddr).Port] {
+			_, err := conn.Reader().Peek(1)
+			MustTrue(t, errors.Is(err, ErrEOF))
+		} else {
+			MustTrue(t, conn.IsActive())
+		}
+	}
+	Equal(t, count(), conns-len(banned))
+}
+
+func TestEventLoopRangeByTag(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	var accepted int32
+	connected := make(chan Connection, 16)
+	loop := newTestEventLoop(network, address,
 		func(ctx context.Context, connection Connection) error {
-			<-trigger
 			return nil
-		})
-	for i := 0; i < 10; i++ {
-		// connect success
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			// the tenants alternate in the order of connecting
+			if atomic.AddInt32(&accepted, 1)%2 == 0 {
+				connection.SetTag("tenant", "a")
+			} else {
+				connection.SetTag("tenant", "b")
+			}
+			connection.SetTag("region", "local")
+			connected <- connection
+			return ctx
+		}))
+	defer loop.Shutdown(context.Background())
+
+	conns := 6
+	var servers []Connection
+	for i := 0; i < conns; i++ {
 		conn, err := DialConnection(network, address, time.Second)
 		MustNil(t, err)
-		_, err = conn.Write(make([]byte, 16))
-		MustNil(t, err)
+		defer conn.Close()
+		servers = append(servers, <-connected)
 	}
-	// shutdown timeout
-	ctx2, cancel2 := context.WithTimeout(context.Background(), time.Millisecond*100)
-	defer cancel2()
-	err = eventLoop2.Shutdown(ctx2)
-	MustTrue(t, err != nil)
-	Equal(t, err.Error(), ctx2.Err().Error())
-	// shutdown success
-	close(trigger)
-	err = eventLoop2.Shutdown(ctx2)
-	MustTrue(t, err == nil)
+	count := func(key, value string) (n int) {
+		loop.RangeByTag(key, value, func(connection Connection) bool {
+			tag, ok := connection.Tag(key)
+			MustTrue(t, ok)
+			Equal(t, tag, value)
+			n++
+			return true
+		})
+		return n
+	}
+	Equal(t, count("tenant", "a"), conns/2)
+	Equal(t, count("tenant", "b"), conns/2)
+	Equal(t, count("region", "local"), conns)
+	Equal(t, count("tenant", "c"), 0)
+	Equal(t, count("user", ""), 0)
 
-	// exit with read connections
-	size := 16
-	eventLoop3 := newTestEventLoop(network, address,
+	// the tag is replaced
+	servers[0].SetTag("tenant", "c")
+	Equal(t, count("tenant", "c"), 1)
+
+	// close a tenant, and the tags are cleared
+	loop.RangeByTag("tenant", "a", func(connection Connection) bool {
+		MustNil(t, connection.Close())
+		return true
+	})
+	Equal(t, count("tenant", "a"), 0)
+	Equal(t, count("region", "local"), conns-conns/2)
+	for _, conn := range servers {
+		if !conn.IsActive() {
+			for i := 0; ; i++ {
+				if _, ok := conn.Tag("region"); !ok {
+					break
+				}
+				MustTrue(t, i < 100)
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+}
+
+func TestSetBufferAllocator(t *testing.T) {
+	var mu sync.Mutex
+	var allocs, frees int
+	bufs := map[*byte]bool{} // allocated buffers, true if in use
+	SetBufferAllocator(func(size int) []byte {
+		buf := make([]byte, size)
+		mu.Lock()
+		allocs++
+		bufs[&buf[:1][0]] = true
+		mu.Unlock()
+		return buf
+	}, func(buf []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		inuse, ok := bufs[&buf[:1][0]]
+		if !ok {
+			return // allocated before SetBufferAllocator
+		}
+		MustTrue(t, inuse)
+		bufs[&buf[:1][0]] = false
+		frees++
+	})
+	balanced := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return allocs == frees
+	}
+
+	network, address := "tcp", getTestAddress()
+	loop := newTestEventLoop(network, address,
 		func(ctx context.Context, connection Connection) error {
-			_, err := connection.Reader().Next(size)
-			MustNil(t, err)
-			return nil
+			buf, err := connection.Reader().Next(connection.Reader().Len())
+			if err != nil {
+				return err
+			}
+			connection.Writer().WriteBinary(buf)
+			connection.Reader().Release()
+			return connection.Writer().Flush()
 		})
-	for i := 0; i < 10; i++ {
+	msg := make([]byte, 10*1024)
+	for i := 0; i < 4; i++ {
 		conn, err := DialConnection(network, address, time.Second)
 		MustNil(t, err)
-		if i%2 == 0 {
-			_, err := conn.Write(make([]byte, size))
+		for j := 0; j < 100; j++ {
+			_, err = conn.Writer().WriteBinary(msg)
 			MustNil(t, err)
+			MustNil(t, conn.Writer().Flush())
+			_, err = conn.Reader().ReadBinary(100)
+			MustNil(t, err)
+			_, err = conn.Reader().Peek(len(msg) - 100)
+			MustNil(t, err)
+			_, err = conn.Reader().Next(len(msg) - 200)
+			MustNil(t, err)
+			MustNil(t, conn.Reader().Skip(100))
+			MustNil(t, conn.Reader().Release())
 		}
+		MustNil(t, conn.Close())
 	}
-	ctx3, cancel3 := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel3()
-	err = eventLoop3.Shutdown(ctx3)
-	MustNil(t, err)
+	MustNil(t, loop.Shutdown(context.Background()))
+	for i := 0; i < 100 && !balanced(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	MustTrue(t, allocs > 0)
+	Equal(t, allocs, frees)
+	mu.Unlock()
+	SetBufferAllocator(nil, nil)
 }
 
 func TestCloseCallbackWhenOnRequest(t *testing.T) {
@@ -471,6 +1361,80 @@ func TestServerPanicAndClose(t *testing.T) {
 	MustNil(t, err)
 }
 
+func TestPanicHandler(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	type recovered struct {
+		conn  Connection
+		r     interface{}
+		stack []byte
+	}
+	recoveries := make(chan recovered, 2)
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			s, err := connection.Reader().ReadString(connection.Reader().Len())
+			if err != nil {
+				return err
+			}
+			if s == "panic" {
+				panic("request panic")
+			}
+			connection.Writer().WriteString(s)
+			return connection.Writer().Flush()
+		},
+		WithPanicHandler(func(ctx context.Context, connection Connection, r interface{}, stack []byte) {
+			recoveries <- recovered{conn: connection, r: r, stack: stack}
+		}),
+	)
+	defer loop.Shutdown(context.Background())
+
+	conn, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	_, err = conn.Writer().WriteString("panic")
+	MustNil(t, err)
+	MustNil(t, conn.Writer().Flush())
+	rec := <-recoveries
+	Equal(t, rec.r, "request panic")
+	MustTrue(t, strings.Contains(string(rec.stack), "TestPanicHandler"))
+	// the connection is closed
+	for rec.conn.IsActive() || conn.IsActive() {
+		runtime.Gosched()
+	}
+
+	// the other connections are still served
+	conn, err = DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	_, err = conn.Writer().WriteString("ping")
+	MustNil(t, err)
+	MustNil(t, conn.Writer().Flush())
+	s, err := conn.Reader().ReadString(len("ping"))
+	MustNil(t, err)
+	Equal(t, s, "ping")
+
+	// the panic in OnConnect
+	address = getTestAddress()
+	loop2 := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			return nil
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			panic("connect panic")
+		}),
+		WithPanicHandler(func(ctx context.Context, connection Connection, r interface{}, stack []byte) {
+			recoveries <- recovered{conn: connection, r: r, stack: stack}
+		}),
+	)
+	defer loop2.Shutdown(context.Background())
+	conn, err = DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	rec = <-recoveries
+	Equal(t, rec.r, "connect panic")
+	_, err = conn.Reader().Next(1)
+	MustTrue(t, err != nil)
+}
+
 func TestClientWriteAndClose(t *testing.T) {
 	var (
 		network, address            = "tcp", getTestAddress()
@@ -609,3 +1573,263 @@ func newTestEventLoop(network, address string, onRequest OnRequest, opts ...Opti
 	go elp.Serve(ln)
 	return elp
 }
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	const limit, conns = 3, 20
+	var running, peak, handled, goroutines, peakGoroutines int32
+	maxInt32 := func(addr *int32, n int32) {
+		for {
+			p := atomic.LoadInt32(addr)
+			if n <= p || atomic.CompareAndSwapInt32(addr, p, n) {
+				return
+			}
+		}
+	}
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			maxInt32(&peak, n)
+			time.Sleep(5 * time.Millisecond)
+			_, err := connection.Reader().Next(connection.Reader().Len())
+			if err != nil {
+				return err
+			}
+			atomic.AddInt32(&handled, 1)
+			connection.Writer().WriteString("pong")
+			return connection.Writer().Flush()
+		},
+		WithMaxConcurrentRequests(limit),
+		// the tasks beyond the limit must not take a goroutine
+		WithRequestScheduler(func(task func()) {
+			maxInt32(&peakGoroutines, atomic.AddInt32(&goroutines, 1))
+			go func() {
+				defer atomic.AddInt32(&goroutines, -1)
+				task()
+			}()
+		}),
+	)
+	defer loop.Shutdown(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := DialConnection(network, address, time.Second)
+			MustNil(t, err)
+			defer conn.Close()
+			for j := 0; j < 5; j++ {
+				_, err = conn.Writer().WriteString("ping")
+				MustNil(t, err)
+				MustNil(t, conn.Writer().Flush())
+				_, err = conn.Reader().Next(4)
+				MustNil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	Equal(t, atomic.LoadInt32(&handled), int32(conns*5))
+	MustTrue(t, atomic.LoadInt32(&peak) <= limit)
+	MustTrue(t, atomic.LoadInt32(&peak) > 1)
+	MustTrue(t, atomic.LoadInt32(&peakGoroutines) <= limit)
+}
+
+func TestTriggerMode(t *testing.T) {
+	for _, mode := range []TriggerMode{LevelTriggered, EdgeTriggered} {
+		for _, threshold := range []int{0, 4096} {
+			testTriggerMode(t, mode, threshold)
+		}
+	}
+}
+
+func testTriggerMode(t *testing.T, mode TriggerMode, threshold int) {
+	network, address := "tcp", getTestAddress()
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			// echo in small pieces, so that the data is left in the socket and the buffer
+			n := connection.Reader().Len()
+			if n > 1024 {
+				n = 1024
+			}
+			buf, err := connection.Reader().Next(n)
+			if err != nil {
+				return err
+			}
+			connection.Writer().WriteBinary(buf)
+			connection.Reader().Release()
+			return connection.Writer().Flush()
+		},
+		WithTriggerMode(mode),
+		WithOnPrepare(func(connection Connection) context.Context {
+			if threshold > 0 {
+				connection.SetReadBufferThreshold(threshold)
+			}
+			return context.Background()
+		}),
+	)
+	defer loop.Shutdown(context.Background())
+
+	const conns, size = 8, 256 * 1024
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.DialTimeout(network, address, time.Second)
+			MustNil(t, err)
+			defer conn.Close()
+			data := make([]byte, size)
+			rand.Read(data)
+			go func() {
+				for off := 0; off < size; {
+					n := 1 + rand.Intn(16*1024)
+					if off+n > size {
+						n = size - off
+					}
+					if _, err := conn.Write(data[off : off+n]); err != nil {
+						return
+					}
+					off += n
+				}
+			}()
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			echo := make([]byte, size)
+			_, err = io.ReadFull(conn, echo)
+			MustNil(t, err)
+			MustTrue(t, bytes.Equal(echo, data))
+		}()
+	}
+	wg.Wait()
+}
+
+func TestConnectionFirstByteAt(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	latency := make(chan time.Duration, 1)
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			MustTrue(t, !connection.EstablishedAt().IsZero())
+			select {
+			case latency <- connection.FirstByteAt().Sub(connection.EstablishedAt()):
+			default:
+			}
+			_, err := connection.Reader().Next(connection.Reader().Len())
+			return err
+		},
+	)
+	defer loop.Shutdown(context.Background())
+
+	conn, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	MustTrue(t, time.Since(conn.EstablishedAt()) < time.Second)
+	MustTrue(t, conn.FirstByteAt().IsZero())
+
+	const delay = 100 * time.Millisecond
+	time.Sleep(delay)
+	_, err = conn.Writer().WriteString("ping")
+	MustNil(t, err)
+	MustNil(t, conn.Writer().Flush())
+	d := <-latency
+	Assert(t, d >= delay, d)
+	Assert(t, d < delay+time.Second, d)
+}
+
+func TestConnectionSetLogger(t *testing.T) {
+	type record struct {
+		level int
+		msg   string
+	}
+	var mu sync.Mutex
+	var records []record
+	capture := func(level int, format string, args ...interface{}) {
+		mu.Lock()
+		records = append(records, record{level, fmt.Sprintf(format, args...)})
+		mu.Unlock()
+	}
+	logged := func(level int, prefix string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, r := range records {
+			if r.level == level && strings.HasPrefix(r.msg, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	network, address := "tcp", getTestAddress()
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			_, err := connection.Reader().Next(connection.Reader().Len())
+			if err != nil {
+				return err
+			}
+			return connection.Close()
+		},
+		WithOnPrepare(func(connection Connection) context.Context {
+			connection.SetLogger(capture)
+			return context.Background()
+		}),
+	)
+	defer loop.Shutdown(context.Background())
+
+	conn, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	closed := make(chan struct{})
+	conn.SetLogger(func(level int, format string, args ...interface{}) {
+		capture(level, format, args...)
+		if format == "closed by peer" {
+			close(closed)
+		}
+	})
+	_, err = conn.Writer().WriteString("ping")
+	MustNil(t, err)
+	MustNil(t, conn.Writer().Flush())
+	<-closed
+	MustNil(t, conn.Close())
+	MustTrue(t, logged(LogLevelDebug, "registered into poller"))
+	MustTrue(t, logged(LogLevelDebug, "read 4 bytes"))
+	MustTrue(t, logged(LogLevelInfo, "closed by user"))
+	MustTrue(t, logged(LogLevelInfo, "closed by peer"))
+
+	// nothing is logged after the logger is removed
+	conn, err = DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	var calls int32
+	conn.SetLogger(func(level int, format string, args ...interface{}) {
+		atomic.AddInt32(&calls, 1)
+	})
+	conn.SetLogger(nil)
+	MustNil(t, conn.Close())
+	Equal(t, atomic.LoadInt32(&calls), int32(0))
+}
+
+func TestStateEvents(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			return connection.Reader().Release()
+		})
+	defer loop.Shutdown(context.Background())
+	events := loop.StateEvents()
+
+	conn, err := net.Dial(network, address)
+	MustNil(t, err)
+	MustNil(t, conn.Close())
+
+	var states []ConnState
+	timeout := time.After(time.Second)
+	for len(states) < 4 {
+		select {
+		case ev := <-events:
+			Equal(t, ev.RemoteAddr.String(), conn.LocalAddr().String())
+			states = append(states, ev.State)
+		case <-timeout:
+			t.Fatalf("events timeout: %v", states)
+		}
+	}
+	Equal(t, fmt.Sprint(states), "[connecting active closing closed]")
+	Equal(t, loop.DroppedStateEvents(), uint64(0))
+}
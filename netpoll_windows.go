@@ -27,8 +27,13 @@ func Configure(config Config) (err error) {
 	return nil
 }
 
+// NumPollers returns 0 on Windows.
+func NumPollers() int {
+	return 0
+}
+
 // NewDialer only support TCP and unix socket now.
-func NewDialer() Dialer {
+func NewDialer(ops ...Option) Dialer {
 	return nil
 }
 
@@ -43,6 +48,16 @@ func ConvertListener(l net.Listener) (nl Listener, err error) {
 }
 
 // CreateListener return a new Listener.
-func CreateListener(network, addr string) (l Listener, err error) {
+func CreateListener(network, addr string, opts ...Option) (l Listener, err error) {
 	return nil, nil
 }
+
+// CreateReusePortListener is not supported on Windows.
+func CreateReusePortListener(network, addr string) (l Listener, err error) {
+	return nil, Exception(ErrUnsupported, "SO_REUSEPORT on windows")
+}
+
+// NewListenerFromFd is not supported on Windows.
+func NewListenerFromFd(fd int) (l Listener, err error) {
+	return nil, Exception(ErrUnsupported, "listener from fd on windows")
+}
@@ -15,8 +15,11 @@
 package netpoll
 
 import (
+	"fmt"
 	"io"
+	"math"
 	"reflect"
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/bytedance/gopkg/lang/dirtmake"
@@ -43,14 +46,63 @@ type Reader interface {
 	// Return: len(p) must be n or 0, and p and error cannot be nil at the same time.
 	Next(n int) (p []byte, err error)
 
+	// TryNext is the non-blocking version of Next, which returns the next n bytes
+	// only if they are already in the buffer, otherwise it returns ErrNotEnough immediately.
+	// It never waits for the socket and does not trigger reading more data,
+	// so that a handler can drain all the buffered messages from one wakeup:
+	//
+	//  for {
+	//      p, err := TryNext(n)
+	//      if err != nil {
+	//          break // ErrNotEnough
+	//      }
+	//      handle(p)...
+	//  }
+	//
+	TryNext(n int) (p []byte, err error)
+
+	// ReadFrame reads a length-prefixed frame, and returns the payload without the header, which works like Next.
+	// The header is a header-byte unsigned integer (1 to 8 bytes) in big or little endian, and it's the length of the payload.
+	// If maxSize is positive, a declared length larger than maxSize is rejected by ErrFrameTooLarge before reading the payload,
+	// and the header is left unread.
+	// It replaces:
+	//
+	//  var h, err = Peek(header)
+	//  var size = decode(h)
+	//  var p, err = Next(header + size)
+	//  return p[header:], err
+	//
+	ReadFrame(header int, bigEndian bool, maxSize int) (p []byte, err error)
+
 	// Peek returns the next n bytes without advancing the reader.
-	// Other behavior is the same as Next.
+	// The data across multiple nodes will be copied into a contiguous slice,
+	// which is valid until the next read operation.
+	// Other behavior is the same as Next, including blocking until n bytes are available.
 	Peek(n int) (buf []byte, err error)
 
 	// Skip the next n bytes and advance the reader, which is
 	// a faster implementation of Next when the next data is not used.
 	Skip(n int) (err error)
 
+	// Discard skips the next n bytes like Skip, and releases the nodes it has passed like Release,
+	// so the slices obtained before are no longer valid after calling it.
+	// Unlike Skip, it doesn't need all the n bytes to be buffered at once, a connection discards the data
+	// as it arrives and blocks until n bytes are skipped, so that a large field won't grow the buffer.
+	// It returns the number of bytes skipped, which is less than n only if err != nil, e.g. ErrEOF.
+	Discard(n int) (skipped int, err error)
+
+	// DiscardAll skips all the buffered bytes and releases them like Discard, without waiting for more data,
+	// e.g. to resync a protocol after an error, and returns the number of bytes skipped.
+	DiscardAll() (skipped int, err error)
+
+	// WriteTo implements io.WriterTo, which drains the reader into w without Next,
+	// and io.Copy(w, conn) uses it since a Connection is also an io.Reader.
+	// The buffered slices are passed to w.Write directly without an intermediate copy,
+	// and the nodes written are released like Release.
+	// A connection continues reading and writing until the peer closed, and ErrEOF is not returned as an error,
+	// while a LinkBuffer has nothing to wait for, so it only writes the buffered data.
+	WriteTo(w io.Writer) (n int64, err error)
+
 	// Until reads until the first occurrence of delim in the input,
 	// returning a slice stops with delim in the input buffer.
 	// If Until encounters an error before finding a delimiter,
@@ -75,8 +127,19 @@ type Reader interface {
 	//  copy(b, p)
 	//  return b, err
 	//
+	// Unlike Next, the returned slice is owned by the caller, and stays valid after the following reads and Release,
+	// so it's suitable for the payload that outlives the request. The cost is an allocation and a copy of n bytes,
+	// except that with Feature.AlwaysNoCopyRead, a large slice in a single node is returned without copying,
+	// and the node is not reused instead.
 	ReadBinary(n int) (p []byte, err error)
 
+	// ReadFull copies exactly len(p) bytes into p like io.ReadFull, which is owned by the caller,
+	// and avoids the intermediate slice of Next when the data is already in the buffer.
+	// It blocks until p is filled, and returns the number of bytes copied with the error (often ErrEOF or ErrConnClosed)
+	// if the connection is closed first. The copied bytes are consumed, as with ReadBinary.
+	// LinkBuffer has nothing to wait for, so it fails with ErrNotEnough without consuming if there are fewer than len(p) bytes.
+	ReadFull(p []byte) (n int, err error)
+
 	// ReadByte is a faster implementation of Next when a byte needs to be returned.
 	// It replaces:
 	//
@@ -98,6 +161,21 @@ type Reader interface {
 	//
 	Slice(n int) (r Reader, err error)
 
+	// Clone returns a new Reader over all the readable data of this Reader without consuming it,
+	// and the reads of either are independent, e.g. to try to parse a frame and fall back to another format on failure.
+	// The clone doesn't wait for more data. To commit the parse, Skip the bytes read from the clone on this Reader:
+	//
+	//  var clone = this.Clone()
+	//  var n = clone.Len()
+	//  if err := parse(clone); err == nil {
+	//      this.Skip(n - clone.Len())
+	//  }
+	//  clone.Release()
+	//
+	// The operation is zero-copy, so the memory of the data is pinned until the clone is released,
+	// even if it's read and released by this Reader.
+	Clone() (r Reader)
+
 	// Release the memory space occupied by all read slices. This method needs to be executed actively to
 	// recycle the memory after confirming that the previously read data is no longer in use.
 	// After invoking Release, the slices obtained by the method such as Next, Peek, Skip will
@@ -106,6 +184,12 @@ type Reader interface {
 
 	// Len returns the total length of the readable data in the reader.
 	Len() (length int)
+
+	// WaitReadSize blocks until there are at least n bytes readable in the reader, without advancing the reader,
+	// so that the caller can check Len and size the allocation before reading.
+	// It's the same as Peek except that no data is copied, and it returns the error such as ErrEOF,
+	// ErrConnClosed or ErrReadTimeout if the connection is closed or timed out before n bytes are available.
+	WaitReadSize(n int) (err error)
 }
 
 // Writer is a collection of operations for nocopy writes.
@@ -128,6 +212,20 @@ type Writer interface {
 	// Therefore, please make sure that all data has been written into the slice before submission.
 	Malloc(n int) (buf []byte, err error)
 
+	// TryMalloc is a fast path of Malloc for small and frequent writes.
+	// It only reserves n bytes from the remaining capacity of the current buffer without growing,
+	// and returns nil if the capacity is exhausted, so the caller should fall back to Malloc:
+	//
+	//  buf := TryMalloc(n)
+	//  if buf == nil {
+	//      buf, _ = Malloc(n)
+	//  }
+	//
+	// The returned slice has the same lifecycle as Malloc. There is no separate preallocated arena per connection,
+	// since it would be held by every connection whether it's used or not, while the fallback Malloc takes
+	// the nodes of the buffer from a pool, so the exhaustion costs no more than a normal growth.
+	TryMalloc(n int) (buf []byte)
+
 	// WriteString is a faster implementation of Malloc when a string needs to be written.
 	// It replaces:
 	//
@@ -173,6 +271,14 @@ type Writer interface {
 	// where buf[:nA] = bufA, buf[nA:nA+nB] = bufB.
 	WriteDirect(p []byte, remainCap int) error
 
+	// WritevDirect appends the slices to the current write stream without copying,
+	// so that they can be sent with the already written data by a single writev after Flush.
+	// Empty slices are ignored.
+	//
+	// The slices will be referenced based on the original address,
+	// so make sure that they will not be changed until Flush finished or the connection closed.
+	WritevDirect(bufs [][]byte) error
+
 	// MallocAck will keep the first n malloc bytes and discard the rest.
 	// The following behavior:
 	//
@@ -189,12 +295,42 @@ type Writer interface {
 	// the operation is zero-copy, similar to p = append(p, w.p).
 	Append(w Writer) (err error)
 
+	// AppendBuffer moves the next n bytes of r to the tail of this writer, which is zero-copy if r is
+	// a LinkBuffer or Connection, e.g. to forward a frame from one connection to another.
+	// The bytes are consumed from r by r.Slice, so the previous data of r is released as Slice does,
+	// while the moved memory is still held by this writer until it's sent or released.
+	AppendBuffer(r Reader, n int) (err error)
+
 	// Flush will submit all malloc data and must confirm that the allocated bytes have been correctly assigned.
 	// Its behavior is equivalent to the io.Writer hat already has parameters(slice b).
 	Flush() (err error)
 
+	// FlushSync is the same as Flush, but for connections it also waits until the data in the socket send queue is sent,
+	// e.g. acknowledged by the peer for TCP or read by the peer for Unix sockets, so that the data is not lost by
+	// closing or resetting the connection immediately after. It costs at least a round trip more than Flush,
+	// which only waits until the data is written to the socket, and the queue is polled since there is no event for it.
+	// The wait is limited by the write timeout, or 5s if not set, after which it returns ErrWriteTimeout,
+	// while the connection is kept since the data has been written to the socket.
+	// The send queue is only observable on Linux by SIOCOUTQ and macOS by SO_NWRITE, and elsewhere,
+	// e.g. FreeBSD and the other BSDs, it returns once the data is written to the socket like Flush.
+	FlushSync() (err error)
+
+	// SetAutoFlush makes the writes flush once the unflushed bytes reach threshold, a zero value disables it,
+	// so that the handlers streaming a large response don't have to Flush periodically to bound the memory.
+	// It's triggered by WriteBinary, WriteString, WriteByte, Append and AppendBuffer after the bytes are written,
+	// but not by Malloc, WriteDirect and WritevDirect. It's suspended from a Malloc or TryMalloc until the next Flush,
+	// since the malloc bytes may be filled after the later writes, e.g. a length header, and must not be sent before.
+	// The flushed bytes are sent before the bytes written later, the same as calling Flush, and it returns the error of Flush.
+	// It's supported by the Writer of a Connection and NewWriter, while LinkBuffer ignores it.
+	SetAutoFlush(threshold int) (err error)
+
 	// MallocLen returns the total length of the writable data that has not yet been submitted in the writer.
 	MallocLen() (length int)
+
+	// ReadFrom implements io.ReaderFrom, which reads from r into the malloc buffer directly and flushes after each read,
+	// until r returns io.EOF or an error, and io.Copy(conn, r) uses it since a Connection is also an io.Writer.
+	// The data malloc before is flushed together, and io.EOF is not returned as an error.
+	ReadFrom(r io.Reader) (n int64, err error)
 }
 
 // ReadWriter is a combination of Reader and Writer.
@@ -270,6 +406,120 @@ const (
 	nocopyReadMask uint8 = 1 << 1 // 0000 0010
 )
 
+// checkReadSize returns ErrMessageTooLarge if n exceeds the positive limit of Connection.SetMaxReadSize.
+func checkReadSize(n int, limit *int64) error {
+	if max := atomic.LoadInt64(limit); max > 0 && int64(n) > max {
+		return Exception(ErrMessageTooLarge, fmt.Sprintf("read size[%d], limit[%d]", n, max))
+	}
+	return nil
+}
+
+// readFrame implements Reader.ReadFrame by Peek and Next.
+func readFrame(r Reader, header int, bigEndian bool, maxSize int) (p []byte, err error) {
+	if header < 1 || header > 8 {
+		return p, Exception(ErrUnsupported, fmt.Sprintf("frame header[%d]", header))
+	}
+	h, err := r.Peek(header)
+	if err != nil {
+		return p, err
+	}
+	var size uint64
+	for i := 0; i < header; i++ {
+		if bigEndian {
+			size = size<<8 | uint64(h[i])
+		} else {
+			size |= uint64(h[i]) << (8 * i)
+		}
+	}
+	if (maxSize > 0 && size > uint64(maxSize)) || size > uint64(math.MaxInt32) {
+		return p, Exception(ErrFrameTooLarge, fmt.Sprintf("frame size[%d]", size))
+	}
+	p, err = r.Next(header + int(size))
+	if err != nil {
+		return p, err
+	}
+	return p[header:], nil
+}
+
+// readFromSize is the size of each read of Writer.ReadFrom.
+const readFromSize = 64 * 1024
+
+// readFrom implements Writer.ReadFrom by Malloc and Flush.
+func readFrom(w Writer, r io.Reader) (n int64, err error) {
+	return readFromSized(w, r, readFromSize)
+}
+
+// readFromSized is readFrom with the size of each read.
+func readFromSized(w Writer, r io.Reader, size int) (n int64, err error) {
+	for empty := 0; ; {
+		base := w.MallocLen()
+		buf, err := w.Malloc(size)
+		if err != nil {
+			return n, err
+		}
+		m, rerr := r.Read(buf)
+		if m < 0 || m > len(buf) {
+			m = 0
+		}
+		w.MallocAck(base + m)
+		n += int64(m)
+		if rerr != nil {
+			if err = w.Flush(); err == nil && rerr != io.EOF {
+				err = rerr
+			}
+			return n, err
+		}
+		if m == 0 {
+			if empty++; empty >= maxReadCycle {
+				return n, io.ErrNoProgress
+			}
+			continue
+		}
+		empty = 0
+		if err = w.Flush(); err != nil {
+			return n, err
+		}
+	}
+}
+
+// autoFlusher is the state of SetAutoFlush shared by the writers that send on Flush.
+type autoFlusher struct {
+	threshold int64 // zero means disabled, updated atomically
+	malloced  int32 // a Malloc is outstanding until the next Flush, updated atomically
+}
+
+func (f *autoFlusher) set(threshold int) {
+	if threshold >= 0 {
+		atomic.StoreInt64(&f.threshold, int64(threshold))
+	}
+}
+
+// malloc suspends the auto flush, since the bytes returned by Malloc may be filled after the later writes.
+func (f *autoFlusher) malloc() {
+	if atomic.LoadInt32(&f.malloced) == 0 {
+		atomic.StoreInt32(&f.malloced, 1)
+	}
+}
+
+// flush resumes the auto flush, since all the malloc bytes must be filled before Flush.
+func (f *autoFlusher) flush() {
+	if atomic.LoadInt32(&f.malloced) > 0 {
+		atomic.StoreInt32(&f.malloced, 0)
+	}
+}
+
+// flushIfFull flushes w once its unflushed bytes reach the threshold and no Malloc is outstanding.
+func (f *autoFlusher) flushIfFull(w Writer, err error) error {
+	if err != nil {
+		return err
+	}
+	threshold := atomic.LoadInt64(&f.threshold)
+	if threshold > 0 && atomic.LoadInt32(&f.malloced) == 0 && int64(w.MallocLen()) >= threshold {
+		return w.Flush()
+	}
+	return nil
+}
+
 // zero-copy slice convert to string
 func unsafeSliceToString(b []byte) string {
 	return *(*string)(unsafe.Pointer(&b))
@@ -285,8 +535,65 @@ func unsafeStringToSlice(s string) (b []byte) {
 	return b
 }
 
+// the custom allocator set by SetBufferAllocator, the mcache is used if nil.
+var (
+	bufferAlloc func(size int) []byte
+	bufferFree  func(buf []byte)
+)
+
+// SetBufferAllocator replaces the allocator of the LinkBuffer nodes and the other reusable buffers,
+// which is used to allocate the memory out of the Go heap, e.g. by an arena or mmap, to reduce the GC pressure.
+// alloc must return a buffer whose cap is at least size, and each buffer is passed to free exactly once
+// when it's released by Release or Close of LinkBuffer, or the connection closed.
+// The buffers returned by alloc may be referred by the returned bytes of Next, Peek, etc. until Release,
+// and the nocopy read of Feature.AlwaysNoCopyRead is disabled, since the bytes is never released.
+// The default mcache allocator is restored if alloc or free is nil.
+//
+// PLEASE NOTE: it's not concurrent-safe, and must be called before any LinkBuffer or connection is created.
+func SetBufferAllocator(alloc func(size int) []byte, free func(buf []byte)) {
+	if alloc == nil || free == nil {
+		alloc, free = nil, nil
+	}
+	bufferAlloc, bufferFree = alloc, free
+}
+
+// PrewarmBufferPool allocates nodes buffers of nodeSize bytes with the nodes of LinkBuffer, and puts them back to the pools,
+// so that the first connections at startup don't pay for the allocations. A non-positive nodeSize means the default size
+// of the input buffer of connections, and the buffers larger than 8MB are not pooled at all.
+// The pools are based on sync.Pool, so the prewarmed memory is not retained and is collected after two GC cycles if unused,
+// which means it should be called right before serving. It does nothing for the buffers of SetBufferAllocator.
+func PrewarmBufferPool(nodes, nodeSize int) {
+	if nodes <= 0 {
+		return
+	}
+	if nodeSize <= 0 {
+		nodeSize = defaultLinkBufferSize
+	}
+	// hold all of them before putting back, otherwise the same one is reused
+	list := make([]*linkBufferNode, nodes)
+	for i := range list {
+		list[i] = linkedPool.Get().(*linkBufferNode)
+	}
+	for i := range list {
+		linkedPool.Put(list[i])
+	}
+	if bufferAlloc != nil || nodeSize > mallocMax {
+		return
+	}
+	bufs := make([][]byte, nodes)
+	for i := range bufs {
+		bufs[i] = malloc(0, nodeSize)
+	}
+	for i := range bufs {
+		free(bufs[i])
+	}
+}
+
 // malloc limits the cap of the buffer from mcache.
 func malloc(size, capacity int) []byte {
+	if bufferAlloc != nil {
+		return bufferAlloc(capacity)[:size]
+	}
 	if capacity > mallocMax {
 		return dirtmake.Bytes(size, capacity)
 	}
@@ -295,6 +602,10 @@ func malloc(size, capacity int) []byte {
 
 // free limits the cap of the buffer from mcache.
 func free(buf []byte) {
+	if bufferFree != nil {
+		bufferFree(buf)
+		return
+	}
 	if cap(buf) > mallocMax {
 		return
 	}
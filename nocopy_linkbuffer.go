@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"sync"
 	"sync/atomic"
 
@@ -64,6 +65,9 @@ type UnsafeLinkBuffer struct {
 	// for `Peek` only, avoid creating too many []byte in `caches`
 	// fix the issue when we have a large buffer and we call `Peek` multiple times
 	cachePeek []byte
+
+	// the preallocated memory of fixed mode, see newFixedLinkBuffer
+	ring []byte
 }
 
 // Len implements Reader.
@@ -117,6 +121,28 @@ func (b *UnsafeLinkBuffer) Next(n int) (p []byte, err error) {
 	return p, nil
 }
 
+// TryNext implements Reader.
+func (b *UnsafeLinkBuffer) TryNext(n int) (p []byte, err error) {
+	if b.Len() < n {
+		return p, Exception(ErrNotEnough, fmt.Sprintf("link buffer try next[%d]", n))
+	}
+	return b.Next(n)
+}
+
+// WaitReadSize implements Reader.
+// LinkBuffer has nothing to wait for, so it fails immediately if there are fewer than n bytes.
+func (b *UnsafeLinkBuffer) WaitReadSize(n int) (err error) {
+	if b.Len() < n {
+		return fmt.Errorf("link buffer wait read size[%d] not enough", n)
+	}
+	return nil
+}
+
+// ReadFrame implements Reader.
+func (b *UnsafeLinkBuffer) ReadFrame(header int, bigEndian bool, maxSize int) (p []byte, err error) {
+	return readFrame(b, header, bigEndian, maxSize)
+}
+
 // Peek does not have an independent lifecycle, and there is no signal to
 // indicate that Peek content can be released, so Peek will not introduce mcache for now.
 func (b *UnsafeLinkBuffer) Peek(n int) (p []byte, err error) {
@@ -200,6 +226,68 @@ func (b *UnsafeLinkBuffer) Skip(n int) (err error) {
 	return nil
 }
 
+// Discard implements Reader.
+// LinkBuffer has nothing to wait for, so it discards all the bytes and fails if there are fewer than n bytes.
+func (b *UnsafeLinkBuffer) Discard(n int) (skipped int, err error) {
+	if n <= 0 {
+		return 0, nil
+	}
+	skipped = n
+	if l := b.Len(); l < n {
+		skipped, err = l, Exception(ErrNotEnough, fmt.Sprintf("link buffer discard[%d]", n))
+	}
+	b.Skip(skipped)
+	b.Release()
+	return skipped, err
+}
+
+// DiscardAll implements Reader.
+func (b *UnsafeLinkBuffer) DiscardAll() (skipped int, err error) {
+	skipped = b.Len()
+	b.Skip(skipped)
+	b.Release()
+	return skipped, nil
+}
+
+// ReadFrom implements Writer.
+func (b *UnsafeLinkBuffer) ReadFrom(r io.Reader) (n int64, err error) {
+	return readFrom(b, r)
+}
+
+// WriteTo implements Reader.
+func (b *UnsafeLinkBuffer) WriteTo(w io.Writer) (n int64, err error) {
+	n, err = b.writeTo(w)
+	b.Release()
+	return n, err
+}
+
+// writeTo writes the readable data to w node by node without releasing it.
+func (b *UnsafeLinkBuffer) writeTo(w io.Writer) (n int64, err error) {
+	for l := b.Len(); l > 0; l = b.Len() {
+		for b.read.Len() == 0 {
+			b.read = b.read.next
+		}
+		size := b.read.Len()
+		if size > l {
+			size = l
+		}
+		m, err := w.Write(b.read.Peek(size))
+		if m < 0 || m > size {
+			m = 0
+		}
+		b.recalLen(-m)
+		b.read.off += m
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+		if m < size {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
 // Release the node that has been read.
 // b.flush == nil indicates that this LinkBuffer is created by LinkBuffer.Slice
 func (b *UnsafeLinkBuffer) Release() (err error) {
@@ -247,6 +335,32 @@ func (b *UnsafeLinkBuffer) ReadBinary(n int) (p []byte, err error) {
 	return b.readBinary(n), nil
 }
 
+// ReadFull implements Reader.
+func (b *UnsafeLinkBuffer) ReadFull(p []byte) (n int, err error) {
+	n = len(p)
+	if n == 0 {
+		return 0, nil
+	}
+	// check whether enough or not.
+	if b.Len() < n {
+		return 0, Exception(ErrNotEnough, fmt.Sprintf("link buffer read full[%d]", n))
+	}
+	b.recalLen(-n) // re-cal length
+
+	var pIdx, l int
+	for ack := n; ack > 0; ack = ack - l {
+		l = b.read.Len()
+		if l >= ack {
+			pIdx += copy(p[pIdx:], b.read.Next(ack))
+			break
+		} else if l > 0 {
+			pIdx += copy(p[pIdx:], b.read.Next(l))
+		}
+		b.read = b.read.next
+	}
+	return n, nil
+}
+
 // readBinary cannot use mcache, because the memory allocated by readBinary will not be recycled.
 func (b *UnsafeLinkBuffer) readBinary(n int) (p []byte) {
 	b.recalLen(-n) // re-cal length
@@ -262,7 +376,7 @@ func (b *UnsafeLinkBuffer) readBinary(n int) (p []byte) {
 			if b.read.getMode(nocopyReadMask) {
 				return b.read.Next(n)
 			}
-			if featureAlwaysNoCopyRead && n >= minReuseBytes {
+			if featureAlwaysNoCopyRead && n >= minReuseBytes && bufferFree == nil {
 				b.read.setMode(nocopyReadMask, true)
 				return b.read.Next(n)
 			}
@@ -365,6 +479,37 @@ func (b *UnsafeLinkBuffer) Slice(n int) (r Reader, err error) {
 	return p, b.Release()
 }
 
+// Clone implements Reader.
+func (b *UnsafeLinkBuffer) Clone() (r Reader) {
+	n := b.Len()
+	if n <= 0 {
+		return NewLinkBuffer(0)
+	}
+	// the nodes refer to the readable nodes of b like Slice, but the read position of b is not moved
+	p := new(LinkBuffer)
+	p.length = int64(n)
+	dummy := newLinkBufferNode(0)
+	p.flush = dummy
+	for node, ack := b.read, n; ack > 0; node = node.next {
+		l := node.Len()
+		if l > ack {
+			l = ack
+		}
+		if l > 0 {
+			p.flush.next = node.ReferPeek(l)
+			p.flush = p.flush.next
+			ack -= l
+		}
+	}
+	// skip the dummy head, and set to read-only
+	p.head, p.read = dummy.next, dummy.next
+	dummy.next = nil
+	dummy.Release()
+	p.flush = p.flush.next
+	p.write = p.flush
+	return p
+}
+
 // ------------------------------------------ implement zero-copy writer ------------------------------------------
 
 // Malloc pre-allocates memory, which is not readable, and becomes readable data after submission(e.g. Flush).
@@ -372,11 +517,28 @@ func (b *UnsafeLinkBuffer) Malloc(n int) (buf []byte, err error) {
 	if n <= 0 {
 		return
 	}
+	if b.ring != nil {
+		if err = b.ringGrowth(n); err != nil {
+			return nil, err
+		}
+		b.mallocSize += n
+		return b.write.Malloc(n), nil
+	}
 	b.mallocSize += n
 	b.growth(n)
 	return b.write.Malloc(n), nil
 }
 
+// TryMalloc implements Writer.
+func (b *UnsafeLinkBuffer) TryMalloc(n int) (buf []byte) {
+	// the memory of readonly node if not malloc by us so cannot be used
+	if n <= 0 || b.write.getMode(readonlyMask) || cap(b.write.buf)-b.write.malloc < n {
+		return nil
+	}
+	b.mallocSize += n
+	return b.write.Malloc(n)
+}
+
 // MallocLen implements Writer.
 func (b *UnsafeLinkBuffer) MallocLen() (length int) {
 	return b.mallocSize
@@ -400,6 +562,16 @@ func (b *UnsafeLinkBuffer) MallocAck(n int) (err error) {
 		b.write = b.write.next
 	}
 	// discard the rest
+	if b.ring != nil {
+		// the memory of the rest may be taken by the next growth of ring, so they must be released
+		for node := b.write.next; node != nil; {
+			nd := node
+			node = node.next
+			nd.Release()
+		}
+		b.write.next = nil
+		return nil
+	}
 	for node := b.write.next; node != nil; node = node.next {
 		node.off, node.malloc, node.refer, node.buf = 0, 0, 1, node.buf[:0]
 	}
@@ -410,7 +582,7 @@ func (b *UnsafeLinkBuffer) MallocAck(n int) (err error) {
 func (b *UnsafeLinkBuffer) Flush() (err error) {
 	b.mallocSize = 0
 	// FIXME: The tail node must not be larger than 8KB to prevent Out Of Memory.
-	if cap(b.write.buf) > pagesize {
+	if cap(b.write.buf) > pagesize && b.ring == nil {
 		b.write.next = newLinkBufferNode(0)
 		b.write = b.write.next
 	}
@@ -428,6 +600,18 @@ func (b *UnsafeLinkBuffer) Flush() (err error) {
 	return nil
 }
 
+// FlushSync implements Writer.
+// LinkBuffer has no socket to wait for, so it's the same as Flush.
+func (b *UnsafeLinkBuffer) FlushSync() (err error) {
+	return b.Flush()
+}
+
+// SetAutoFlush implements Writer.
+// LinkBuffer has nothing to send, and its Flush only makes the data readable, so it's ignored.
+func (b *UnsafeLinkBuffer) SetAutoFlush(threshold int) (err error) {
+	return nil
+}
+
 // Append implements Writer.
 func (b *UnsafeLinkBuffer) Append(w Writer) (err error) {
 	buf, ok := w.(*LinkBuffer)
@@ -437,6 +621,48 @@ func (b *UnsafeLinkBuffer) Append(w Writer) (err error) {
 	return b.WriteBuffer(buf)
 }
 
+// AppendBuffer implements Writer.
+func (b *UnsafeLinkBuffer) AppendBuffer(r Reader, n int) (err error) {
+	if n <= 0 {
+		return nil
+	}
+	sr, err := r.Slice(n)
+	if err != nil {
+		return err
+	}
+	buf, ok := sr.(*LinkBuffer)
+	if !ok {
+		p, err := sr.Next(n)
+		if err != nil {
+			return err
+		}
+		if b.ring != nil {
+			if _, err = b.ringWrite(p); err != nil {
+				return err
+			}
+			return sr.Release()
+		}
+		b.growth(n)
+		b.mallocSize += n
+		copy(b.write.Malloc(n), p)
+		return sr.Release()
+	}
+	b.mallocSize += n
+	// the nodes of the slice are readonly and refer to the nodes of r,
+	// so they are released independently like the nodes of WritevDirect.
+	for node := buf.head; node != nil; {
+		next := node.next
+		node.next = nil
+		node.buf, node.malloc = node.buf[node.off:node.off], len(node.buf)-node.off
+		node.off = 0
+		b.write.next = node
+		b.write = node
+		node = next
+	}
+	buf.length, buf.head, buf.read, buf.flush, buf.write = 0, nil, nil, nil, nil
+	return nil
+}
+
 // WriteBuffer will not submit(e.g. Flush) data to ensure normal use of MallocLen.
 // you must actively submit before read the data.
 // The argument buf can't be used after calling WriteBuffer. (set it to nil)
@@ -478,7 +704,31 @@ func (b *UnsafeLinkBuffer) WriteBuffer(buf *LinkBuffer) (err error) {
 	return nil
 }
 
+// Transfer moves all the data of this buffer, including the malloc data, to the tail of w by Append
+// and resets this buffer to empty, so that it can be reused to build the next batch, e.g. double-buffering a
+// Connection by conn.Writer() as w followed by Flush. The nodes are linked without copying the data.
+// It calls Release first, so the slices returned by Next, Peek, etc. before are invalid after Transfer,
+// the same as after Release, and the read data is never moved to w.
+func (b *UnsafeLinkBuffer) Transfer(w Writer) (err error) {
+	b.Release()
+	if b.Len()+b.MallocLen() <= 0 {
+		return nil
+	}
+	buf := &LinkBuffer{}
+	buf.length, buf.mallocSize = b.length, b.mallocSize
+	buf.head, buf.read, buf.flush, buf.write = b.head, b.read, b.flush, b.write
+	if err = w.Append(buf); err != nil {
+		return err
+	}
+	node := newLinkBufferNode(0)
+	b.length, b.mallocSize = 0, 0
+	b.head, b.read, b.flush, b.write = node, node, node, node
+	return nil
+}
+
 // WriteString implements Writer.
+// The string is never converted by []byte(s), it's copied into the buffer directly,
+// or referred by a readonly node without copying if it's larger than BinaryInplaceThreshold.
 func (b *UnsafeLinkBuffer) WriteString(s string) (n int, err error) {
 	if len(s) == 0 {
 		return
@@ -493,6 +743,9 @@ func (b *UnsafeLinkBuffer) WriteBinary(p []byte) (n int, err error) {
 	if n == 0 {
 		return
 	}
+	if b.ring != nil {
+		return b.ringWrite(p)
+	}
 	b.mallocSize += n
 
 	// TODO: Verify that all nocopy is possible under mcache.
@@ -509,6 +762,39 @@ func (b *UnsafeLinkBuffer) WriteBinary(p []byte) (n int, err error) {
 	return copy(buf, p), nil
 }
 
+// WritevDirect implements Writer.
+func (b *UnsafeLinkBuffer) WritevDirect(bufs [][]byte) error {
+	for _, p := range bufs {
+		n := len(p)
+		if n == 0 {
+			continue
+		}
+		b.mallocSize += n
+		// expand buffer directly with nocopy
+		b.write.next = newLinkBufferNode(0)
+		b.write = b.write.next
+		b.write.buf, b.write.malloc = p[:0], n
+	}
+	return nil
+}
+
+// writeRelease appends p to the write stream without copying like WritevDirect, and calls release once the node of p is released.
+func (b *UnsafeLinkBuffer) writeRelease(p []byte, release func()) {
+	n := len(p)
+	if n == 0 {
+		release()
+		return
+	}
+	b.mallocSize += n
+	node := newLinkBufferNode(0)
+	node.buf, node.malloc = p[:0], n
+	node.onFree = release
+	// the empty tail makes sure that the node is released once it's read, instead of being kept as the last flushed node
+	node.next = newLinkBufferNode(0)
+	b.write.next = node
+	b.write = node.next
+}
+
 // WriteDirect cannot be mixed with WriteString or WriteBinary functions.
 func (b *UnsafeLinkBuffer) WriteDirect(extra []byte, remainLen int) error {
 	n := len(extra)
@@ -541,6 +827,7 @@ func (b *UnsafeLinkBuffer) WriteDirect(extra []byte, remainLen int) error {
 		newNode.buf = origin.buf[:malloc]
 		newNode.malloc = origin.malloc
 		newNode.setMode(readonlyMask, false)
+		newNode.setMode(fixedMask, origin.getMode(fixedMask))
 		origin.malloc = malloc
 		origin.setMode(readonlyMask, true)
 
@@ -809,6 +1096,7 @@ type linkBufferNode struct {
 	mode   uint8           // mode store all bool bit status
 	origin *linkBufferNode // the root node of the extends
 	next   *linkBufferNode // the next node of the linked buffer
+	onFree func()          // called when the node is released, e.g. to unmap the buf of WriteMmap
 }
 
 func (node *linkBufferNode) Len() (l int) {
@@ -846,8 +1134,18 @@ func (node *linkBufferNode) Malloc(n int) (buf []byte) {
 // Refer holds a reference count at the same time as Next, and releases the real buffer after Release.
 // The node obtained by Refer is read-only.
 func (node *linkBufferNode) Refer(n int) (p *linkBufferNode) {
+	return node.referTo(node.Next(n))
+}
+
+// ReferPeek is the same as Refer, but doesn't move the read position of node.
+func (node *linkBufferNode) ReferPeek(n int) (p *linkBufferNode) {
+	return node.referTo(node.Peek(n))
+}
+
+// referTo creates a readonly node of buf, which is a part of node, and holds the reference of node.
+func (node *linkBufferNode) referTo(buf []byte) (p *linkBufferNode) {
 	p = newLinkBufferNode(0)
-	p.buf = node.Next(n)
+	p.buf = buf
 
 	if node.origin != nil {
 		p.origin = node.origin
@@ -871,7 +1169,10 @@ func (node *linkBufferNode) Release() (err error) {
 		if node.reusable() {
 			free(node.buf)
 		}
-		node.buf, node.origin, node.next = nil, nil, nil
+		if node.onFree != nil {
+			node.onFree()
+		}
+		node.buf, node.origin, node.next, node.onFree = nil, nil, nil, nil
 		linkedPool.Put(node)
 	}
 	return nil
@@ -891,5 +1192,5 @@ func (node *linkBufferNode) setMode(mask uint8, enable bool) {
 
 // only non-readonly and copied-read node should be reusable
 func (node *linkBufferNode) reusable() bool {
-	return node.mode&(readonlyMask|nocopyReadMask) == 0
+	return node.mode&(readonlyMask|nocopyReadMask|fixedMask) == 0
 }
@@ -0,0 +1,154 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netpoll
+
+import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"unsafe"
+)
+
+// fixedMask is used to set fixed mode, which indicates that the buffer node memory is a part of
+// the preallocated ring of a fixed LinkBuffer, so it's never recycled to mcache.
+const fixedMask uint8 = 1 << 2 // 0000 0100
+
+// newFixedLinkBuffer creates a LinkBuffer writing into a single preallocated ring of size bytes,
+// the new nodes are carved out of the free space of the ring instead of allocated,
+// and the writes fail with ErrBufferFull if the ring would overflow.
+// The nodes are at most a quarter of the ring up to 8KB, so the sent ones can be released while writing the others.
+// The memory referred by WriteDirect, WritevDirect and Append is linked as usual, without taking the ring.
+func newFixedLinkBuffer(size int) *LinkBuffer {
+	buf := &LinkBuffer{}
+	buf.ring = make([]byte, size)
+	node := newFixedNode(buf.ringSlice(0, size, 0))
+	buf.head, buf.read, buf.flush, buf.write = node, node, node, node
+	return buf
+}
+
+func newFixedNode(p []byte) *linkBufferNode {
+	node := linkedPool.Get().(*linkBufferNode)
+	node.off, node.malloc, node.refer, node.mode = 0, 0, 1, fixedMask
+	node.buf = p
+	return node
+}
+
+// ringSlice returns the memory of a new node starting from off, which is at least n bytes and limited by limit.
+func (b *UnsafeLinkBuffer) ringSlice(off, limit, n int) []byte {
+	chunk := len(b.ring) / 4
+	if chunk > pagesize {
+		chunk = pagesize
+	}
+	if chunk < n {
+		chunk = n
+	}
+	if off+chunk < limit {
+		limit = off + chunk
+	}
+	return b.ring[off:off:limit]
+}
+
+// ringOffset returns the offset of the node memory in the ring.
+func (b *UnsafeLinkBuffer) ringOffset(node *linkBufferNode) int {
+	data := (*reflect.SliceHeader)(unsafe.Pointer(&node.buf)).Data
+	return int(data - (*reflect.SliceHeader)(unsafe.Pointer(&b.ring)).Data)
+}
+
+// ringBounds returns the offset of the first byte in use, and the offset next to the last byte in use,
+// which wraps around the ring if wrapped. The memory is in use until the node is released.
+func (b *UnsafeLinkBuffer) ringBounds() (start, end int, wrapped, empty bool) {
+	var first, last *linkBufferNode
+	for node := b.head; node != nil; node = node.next {
+		if node.getMode(fixedMask) {
+			if first == nil {
+				first = node
+			}
+			last = node
+		}
+	}
+	if first == nil {
+		return 0, 0, false, true
+	}
+	// reuse the ring from the beginning if all the data has been sent
+	if first == last && b.head == b.write && first.off == first.malloc && atomic.LoadInt32(&first.refer) == 1 {
+		first.buf, first.off, first.malloc = b.ringSlice(0, len(b.ring), 0), 0, 0
+	}
+	start, end = b.ringOffset(first), b.ringOffset(last)+last.malloc
+	return start, end, b.ringOffset(last) < start, false
+}
+
+// ringFree returns the number of free bytes in the ring.
+func (b *UnsafeLinkBuffer) ringFree() int {
+	start, end, wrapped, empty := b.ringBounds()
+	switch {
+	case empty:
+		return len(b.ring)
+	case wrapped:
+		return start - end
+	default:
+		return len(b.ring) - end + start
+	}
+}
+
+// ringGrowth makes the write node have n contiguous bytes, a new node is carved out of the ring if needed.
+func (b *UnsafeLinkBuffer) ringGrowth(n int) (err error) {
+	start, end, wrapped, empty := b.ringBounds()
+	if b.write.getMode(fixedMask) && !b.write.getMode(readonlyMask) && cap(b.write.buf)-b.write.malloc >= n {
+		return nil
+	}
+	var p []byte
+	switch {
+	case empty && n <= len(b.ring):
+		p = b.ringSlice(0, len(b.ring), n)
+	case wrapped:
+		if start-end >= n {
+			p = b.ringSlice(end, start, n)
+		}
+	case len(b.ring)-end >= n:
+		p = b.ringSlice(end, len(b.ring), n)
+	case start >= n:
+		p = b.ringSlice(0, start, n)
+	}
+	if p == nil {
+		return Exception(ErrBufferFull, fmt.Sprintf("fixed link buffer malloc[%d]", n))
+	}
+	b.write.next = newFixedNode(p)
+	b.write = b.write.next
+	return nil
+}
+
+// ringWrite copies p into the ring, which may be split into two nodes if it wraps around.
+func (b *UnsafeLinkBuffer) ringWrite(p []byte) (n int, err error) {
+	n = len(p)
+	if b.ringFree() < n {
+		return 0, Exception(ErrBufferFull, fmt.Sprintf("fixed link buffer write[%d]", n))
+	}
+	for len(p) > 0 {
+		l := cap(b.write.buf) - b.write.malloc
+		if !b.write.getMode(fixedMask) || b.write.getMode(readonlyMask) || l == 0 {
+			if err = b.ringGrowth(1); err != nil {
+				return 0, err
+			}
+			l = cap(b.write.buf) - b.write.malloc
+		}
+		if l > len(p) {
+			l = len(p)
+		}
+		copy(b.write.Malloc(l), p[:l])
+		p = p[l:]
+	}
+	b.mallocSize += n
+	return n, nil
+}
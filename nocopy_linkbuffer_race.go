@@ -18,6 +18,7 @@
 package netpoll
 
 import (
+	"io"
 	"sync"
 )
 
@@ -38,6 +39,27 @@ func (b *SafeLinkBuffer) Next(n int) (p []byte, err error) {
 	return b.UnsafeLinkBuffer.Next(n)
 }
 
+// TryNext implements Reader.
+func (b *SafeLinkBuffer) TryNext(n int) (p []byte, err error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.UnsafeLinkBuffer.TryNext(n)
+}
+
+// WaitReadSize implements Reader.
+func (b *SafeLinkBuffer) WaitReadSize(n int) (err error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.UnsafeLinkBuffer.WaitReadSize(n)
+}
+
+// ReadFrame implements Reader.
+func (b *SafeLinkBuffer) ReadFrame(header int, bigEndian bool, maxSize int) (p []byte, err error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.UnsafeLinkBuffer.ReadFrame(header, bigEndian, maxSize)
+}
+
 // Peek implements Reader.
 func (b *SafeLinkBuffer) Peek(n int) (p []byte, err error) {
 	b.Lock()
@@ -52,6 +74,32 @@ func (b *SafeLinkBuffer) Skip(n int) (err error) {
 	return b.UnsafeLinkBuffer.Skip(n)
 }
 
+// Discard implements Reader.
+func (b *SafeLinkBuffer) Discard(n int) (skipped int, err error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.UnsafeLinkBuffer.Discard(n)
+}
+
+// DiscardAll implements Reader.
+func (b *SafeLinkBuffer) DiscardAll() (skipped int, err error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.UnsafeLinkBuffer.DiscardAll()
+}
+
+// ReadFrom implements Writer.
+func (b *SafeLinkBuffer) ReadFrom(r io.Reader) (n int64, err error) {
+	return readFrom(b, r)
+}
+
+// WriteTo implements Reader.
+func (b *SafeLinkBuffer) WriteTo(w io.Writer) (n int64, err error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.UnsafeLinkBuffer.WriteTo(w)
+}
+
 // Until implements Reader.
 func (b *SafeLinkBuffer) Until(delim byte) (line []byte, err error) {
 	b.Lock()
@@ -80,6 +128,13 @@ func (b *SafeLinkBuffer) ReadBinary(n int) (p []byte, err error) {
 	return b.UnsafeLinkBuffer.ReadBinary(n)
 }
 
+// ReadFull implements Reader.
+func (b *SafeLinkBuffer) ReadFull(p []byte) (n int, err error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.UnsafeLinkBuffer.ReadFull(p)
+}
+
 // ReadByte implements Reader.
 func (b *SafeLinkBuffer) ReadByte() (p byte, err error) {
 	b.Lock()
@@ -94,6 +149,13 @@ func (b *SafeLinkBuffer) Slice(n int) (r Reader, err error) {
 	return b.UnsafeLinkBuffer.Slice(n)
 }
 
+// Clone implements Reader.
+func (b *SafeLinkBuffer) Clone() (r Reader) {
+	b.Lock()
+	defer b.Unlock()
+	return b.UnsafeLinkBuffer.Clone()
+}
+
 // ------------------------------------------ implement zero-copy writer ------------------------------------------
 
 // Malloc implements Writer.
@@ -103,6 +165,13 @@ func (b *SafeLinkBuffer) Malloc(n int) (buf []byte, err error) {
 	return b.UnsafeLinkBuffer.Malloc(n)
 }
 
+// TryMalloc implements Writer.
+func (b *SafeLinkBuffer) TryMalloc(n int) (buf []byte) {
+	b.Lock()
+	defer b.Unlock()
+	return b.UnsafeLinkBuffer.TryMalloc(n)
+}
+
 // MallocLen implements Writer.
 func (b *SafeLinkBuffer) MallocLen() (length int) {
 	b.Lock()
@@ -124,6 +193,13 @@ func (b *SafeLinkBuffer) Flush() (err error) {
 	return b.UnsafeLinkBuffer.Flush()
 }
 
+// FlushSync implements Writer.
+func (b *SafeLinkBuffer) FlushSync() (err error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.UnsafeLinkBuffer.FlushSync()
+}
+
 // Append implements Writer.
 func (b *SafeLinkBuffer) Append(w Writer) (err error) {
 	b.Lock()
@@ -131,6 +207,13 @@ func (b *SafeLinkBuffer) Append(w Writer) (err error) {
 	return b.UnsafeLinkBuffer.Append(w)
 }
 
+// AppendBuffer implements Writer.
+func (b *SafeLinkBuffer) AppendBuffer(r Reader, n int) (err error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.UnsafeLinkBuffer.AppendBuffer(r, n)
+}
+
 // WriteBuffer implements Writer.
 func (b *SafeLinkBuffer) WriteBuffer(buf *LinkBuffer) (err error) {
 	b.Lock()
@@ -138,6 +221,13 @@ func (b *SafeLinkBuffer) WriteBuffer(buf *LinkBuffer) (err error) {
 	return b.UnsafeLinkBuffer.WriteBuffer(buf)
 }
 
+// Transfer moves all the data of this buffer to the tail of w, see UnsafeLinkBuffer.Transfer.
+func (b *SafeLinkBuffer) Transfer(w Writer) (err error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.UnsafeLinkBuffer.Transfer(w)
+}
+
 // WriteString implements Writer.
 func (b *SafeLinkBuffer) WriteString(s string) (n int, err error) {
 	b.Lock()
@@ -152,6 +242,20 @@ func (b *SafeLinkBuffer) WriteBinary(p []byte) (n int, err error) {
 	return b.UnsafeLinkBuffer.WriteBinary(p)
 }
 
+// writeRelease is the same as UnsafeLinkBuffer.writeRelease.
+func (b *SafeLinkBuffer) writeRelease(p []byte, release func()) {
+	b.Lock()
+	defer b.Unlock()
+	b.UnsafeLinkBuffer.writeRelease(p, release)
+}
+
+// WritevDirect implements Writer.
+func (b *SafeLinkBuffer) WritevDirect(bufs [][]byte) error {
+	b.Lock()
+	defer b.Unlock()
+	return b.UnsafeLinkBuffer.WritevDirect(bufs)
+}
+
 // WriteDirect cannot be mixed with WriteString or WriteBinary functions.
 func (b *SafeLinkBuffer) WriteDirect(p []byte, remainLen int) error {
 	b.Lock()
@@ -223,6 +327,12 @@ func (b *SafeLinkBuffer) resetTail(maxSize int) {
 	b.UnsafeLinkBuffer.resetTail(maxSize)
 }
 
+func (b *SafeLinkBuffer) writeTo(w io.Writer) (n int64, err error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.UnsafeLinkBuffer.writeTo(w)
+}
+
 func (b *SafeLinkBuffer) indexByte(c byte, skip int) int {
 	b.Lock()
 	defer b.Unlock()
@@ -20,8 +20,11 @@ package netpoll
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"runtime"
+	"strings"
 	"sync/atomic"
 	"testing"
 )
@@ -423,6 +426,27 @@ func TestLinkBufferWriteBuffer(t *testing.T) {
 	MustTrue(t, bytes.Equal(buf1.Bytes(), []byte{2, 3}))
 }
 
+func TestLinkBufferTransfer(t *testing.T) {
+	buf := NewLinkBuffer()
+	buf.WriteString("read")
+	buf.Flush()
+	p, err := buf.Next(4)
+	MustNil(t, err)
+	Equal(t, string(p), "read")
+	buf.WriteString("unread")
+	buf.Flush()
+	buf.WriteString("malloc")
+
+	// the read data is released, and only the rest is moved
+	dst := NewLinkBuffer()
+	MustNil(t, buf.Transfer(dst))
+	Equal(t, buf.Len(), 0)
+	Equal(t, buf.MallocLen(), 0)
+	MustTrue(t, buf.head == buf.read)
+	dst.Flush()
+	Equal(t, string(dst.Bytes()), "unreadmalloc")
+}
+
 func TestLinkBufferCheckSingleNode(t *testing.T) {
 	buf := NewLinkBuffer(block4k)
 	_, err := buf.Malloc(block8k)
@@ -522,6 +546,447 @@ func TestLinkBufferWriteDirect(t *testing.T) {
 	}
 }
 
+func TestLinkBufferWritevDirect(t *testing.T) {
+	buf := NewLinkBuffer()
+	header, _ := buf.Malloc(4)
+	copy(header, "head")
+	bufs := [][]byte{[]byte("a"), nil, []byte("bb"), make([]byte, block8k)}
+	err := buf.WritevDirect(bufs)
+	MustNil(t, err)
+	Equal(t, buf.MallocLen(), 4+1+2+block8k)
+	buf.Flush()
+	Equal(t, buf.Len(), 4+1+2+block8k)
+
+	// all the slices are referenced without copying, and will be sent by one writev
+	bs := buf.GetBytes(make([][]byte, barriercap))
+	Equal(t, len(bs), 4)
+	Equal(t, string(bs[0]), "head")
+	for i, b := range [][]byte{bufs[0], bufs[2], bufs[3]} {
+		Equal(t, len(bs[i+1]), len(b))
+		MustTrue(t, &bs[i+1][0] == &b[0])
+	}
+
+	// malloc after WritevDirect will not write into user slices
+	bt, _ := buf.Malloc(2)
+	copy(bt, "cd")
+	buf.Flush()
+	Equal(t, string(bufs[0]), "a")
+	Equal(t, string(bufs[2]), "bb")
+	_, err = buf.Next(4 + 1 + 2 + block8k)
+	MustNil(t, err)
+	s, err := buf.ReadString(2)
+	MustNil(t, err)
+	Equal(t, s, "cd")
+}
+
+func TestLinkBufferTryNext(t *testing.T) {
+	buf := NewLinkBuffer()
+	_, err := buf.TryNext(1)
+	MustTrue(t, errors.Is(err, ErrNotEnough))
+
+	buf.WriteString("hello")
+	buf.Flush()
+	p, err := buf.TryNext(6)
+	MustTrue(t, errors.Is(err, ErrNotEnough))
+	Equal(t, len(p), 0)
+	Equal(t, buf.Len(), 5)
+	p, err = buf.TryNext(5)
+	MustNil(t, err)
+	Equal(t, string(p), "hello")
+	Equal(t, buf.Len(), 0)
+}
+
+func TestLinkBufferWaitReadSize(t *testing.T) {
+	buf := NewLinkBuffer(2)
+	MustNil(t, buf.WaitReadSize(0))
+	MustTrue(t, buf.WaitReadSize(1) != nil)
+
+	// the readable data spans multiple nodes
+	buf.WriteString("he")
+	buf.Flush()
+	buf.WriteString("llo")
+	buf.Flush()
+	MustNil(t, buf.WaitReadSize(5))
+	MustTrue(t, buf.WaitReadSize(6) != nil)
+	Equal(t, buf.Len(), 5)
+	p, err := buf.Next(5)
+	MustNil(t, err)
+	Equal(t, string(p), "hello")
+}
+
+func TestLinkBufferDiscard(t *testing.T) {
+	buf := NewLinkBuffer(2)
+	buf.WriteString("hd")
+	buf.Flush()
+	// the skipped field spans multiple nodes
+	for i := 0; i < 4; i++ {
+		buf.WriteString("ext")
+		buf.Flush()
+	}
+	buf.WriteString("body")
+	buf.Flush()
+
+	p, err := buf.Next(2)
+	MustNil(t, err)
+	Equal(t, string(p), "hd")
+	n, err := buf.Discard(12)
+	MustNil(t, err)
+	Equal(t, n, 12)
+	// the passed nodes are released
+	MustTrue(t, buf.head == buf.read)
+	p, err = buf.Next(4)
+	MustNil(t, err)
+	Equal(t, string(p), "body")
+
+	// it discards all the bytes if not enough
+	buf.WriteString("abc")
+	buf.Flush()
+	n, err = buf.Discard(5)
+	MustTrue(t, errors.Is(err, ErrNotEnough))
+	Equal(t, n, 3)
+	Equal(t, buf.Len(), 0)
+}
+
+func TestLinkBufferDiscardAll(t *testing.T) {
+	buf := NewLinkBuffer(2)
+	// the data spans multiple nodes
+	for i := 0; i < 4; i++ {
+		buf.WriteString("ext")
+		buf.Flush()
+	}
+	p, err := buf.Next(1)
+	MustNil(t, err)
+	Equal(t, string(p), "e")
+	n, err := buf.DiscardAll()
+	MustNil(t, err)
+	Equal(t, n, 11)
+	Equal(t, buf.Len(), 0)
+	// the passed nodes are released
+	MustTrue(t, buf.head == buf.read)
+
+	// nothing to discard
+	n, err = buf.DiscardAll()
+	MustNil(t, err)
+	Equal(t, n, 0)
+	buf.WriteString("body")
+	buf.Flush()
+	p, err = buf.Next(4)
+	MustNil(t, err)
+	Equal(t, string(p), "body")
+}
+
+func TestLinkBufferWriteTo(t *testing.T) {
+	buf := NewLinkBuffer(2)
+	// the data spans multiple nodes
+	for i := 0; i < 4; i++ {
+		buf.WriteString("ext")
+		buf.Flush()
+	}
+	var sink bytes.Buffer
+	n, err := buf.WriteTo(&sink)
+	MustNil(t, err)
+	Equal(t, n, int64(12))
+	Equal(t, sink.String(), "extextextext")
+	Equal(t, buf.Len(), 0)
+	MustTrue(t, buf.head == buf.read)
+
+	// a short write stops with the data left
+	buf.WriteString("abcdef")
+	buf.Flush()
+	n, err = buf.WriteTo(&shortWriter{max: 4})
+	MustTrue(t, errors.Is(err, io.ErrShortWrite))
+	Equal(t, n, int64(4))
+	s, err := buf.ReadString(buf.Len())
+	MustNil(t, err)
+	Equal(t, s, "ef")
+}
+
+func TestLinkBufferClone(t *testing.T) {
+	buf := NewLinkBuffer(2)
+	// the data spans multiple nodes, and the first one is partially read
+	for i := 0; i < 4; i++ {
+		buf.WriteString("ext")
+		buf.Flush()
+	}
+	buf.Skip(1)
+	clone := buf.Clone()
+	Equal(t, clone.Len(), 11)
+	s, err := clone.ReadString(5)
+	MustNil(t, err)
+	Equal(t, s, "xtext")
+	// the original is not consumed
+	Equal(t, buf.Len(), 11)
+	s, err = buf.ReadString(2)
+	MustNil(t, err)
+	Equal(t, s, "xt")
+	MustNil(t, buf.Release())
+
+	// the data is pinned by the clone after the original is released
+	buf.Skip(buf.Len())
+	MustNil(t, buf.Release())
+	s, err = clone.ReadString(clone.Len())
+	MustNil(t, err)
+	Equal(t, s, "extext")
+	MustNil(t, clone.Release())
+
+	Equal(t, NewLinkBuffer().Clone().Len(), 0)
+}
+
+func TestLinkBufferReadFull(t *testing.T) {
+	buf := NewLinkBuffer(2)
+	for i := 0; i < 4; i++ {
+		buf.WriteString("ext")
+		buf.Flush()
+	}
+	buf.Skip(1)
+	p := make([]byte, 8)
+	n, err := buf.ReadFull(p)
+	MustNil(t, err)
+	Equal(t, n, 8)
+	Equal(t, string(p), "xtextext")
+	Equal(t, buf.Len(), 3)
+
+	// not enough, nothing is consumed
+	n, err = buf.ReadFull(p)
+	MustTrue(t, errors.Is(err, ErrNotEnough))
+	Equal(t, n, 0)
+	Equal(t, buf.Len(), 3)
+	n, err = buf.ReadFull(p[:0])
+	MustNil(t, err)
+	Equal(t, n, 0)
+	n, err = buf.ReadFull(p[:3])
+	MustNil(t, err)
+	Equal(t, string(p[:n]), "ext")
+	MustNil(t, buf.Release())
+}
+
+func TestLinkBufferReadFrom(t *testing.T) {
+	buf := NewLinkBuffer()
+	buf.WriteString("hd")
+	payload := strings.Repeat("netpoll", 32*1024)
+	n, err := buf.ReadFrom(strings.NewReader(payload))
+	MustNil(t, err)
+	Equal(t, n, int64(len(payload)))
+	s, err := buf.ReadString(buf.Len())
+	MustNil(t, err)
+	Equal(t, s, "hd"+payload)
+
+	// the error of r is returned after flushing the data read
+	errRead := errors.New("read failed")
+	n, err = buf.ReadFrom(io.MultiReader(strings.NewReader("abc"), &errReader{err: errRead}))
+	Equal(t, err, errRead)
+	Equal(t, n, int64(3))
+	s, err = buf.ReadString(buf.Len())
+	MustNil(t, err)
+	Equal(t, s, "abc")
+}
+
+// errReader always fails with err.
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(p []byte) (n int, err error) {
+	return 0, r.err
+}
+
+// shortWriter writes at most max bytes in total.
+type shortWriter struct {
+	max int
+}
+
+func (w *shortWriter) Write(p []byte) (n int, err error) {
+	n = len(p)
+	if n > w.max {
+		n = w.max
+	}
+	w.max -= n
+	return n, nil
+}
+
+func TestLinkBufferFixed(t *testing.T) {
+	buf := newFixedLinkBuffer(64)
+	msg := make([]byte, 64)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	// the ring is full
+	_, err := buf.WriteBinary(msg[:48])
+	MustNil(t, err)
+	MustNil(t, buf.Flush())
+	_, err = buf.Malloc(32)
+	MustTrue(t, errors.Is(err, ErrBufferFull))
+	_, err = buf.WriteBinary(msg[:32])
+	MustTrue(t, errors.Is(err, ErrBufferFull))
+	p, err := buf.Malloc(16)
+	MustNil(t, err)
+	copy(p, msg[48:])
+	MustNil(t, buf.Flush())
+	MustTrue(t, buf.WriteByte(0) != nil)
+
+	// the released nodes are reused by the writes wrapping around the ring
+	MustNil(t, buf.Skip(40))
+	MustNil(t, buf.Release())
+	_, err = buf.WriteBinary(msg[:32])
+	MustNil(t, err)
+	MustNil(t, buf.Flush())
+	Equal(t, buf.Len(), 56)
+	p, err = buf.Next(24)
+	MustNil(t, err)
+	MustTrue(t, bytes.Equal(p, msg[40:]))
+	p, err = buf.Next(32)
+	MustNil(t, err)
+	MustTrue(t, bytes.Equal(p, msg[:32]))
+	MustNil(t, buf.Release())
+	for node := buf.head; node != nil; node = node.next {
+		off := buf.ringOffset(node)
+		MustTrue(t, off >= 0 && off+cap(node.buf) <= len(buf.ring))
+	}
+
+	// it never allocates
+	allocs := testing.AllocsPerRun(100, func() {
+		buf.WriteBinary(msg[:24])
+		buf.Flush()
+		buf.Skip(24)
+		buf.Release()
+	})
+	Equal(t, allocs, float64(0))
+	MustNil(t, buf.Close())
+}
+
+func TestLinkBufferReadFrame(t *testing.T) {
+	buf := NewLinkBuffer()
+	hdr := make([]byte, 4)
+	binary.BigEndian.PutUint32(hdr, 5)
+	buf.WriteBinary(hdr)
+	buf.WriteString("hello")
+	binary.LittleEndian.PutUint16(hdr, 5)
+	buf.WriteBinary(hdr[:2])
+	buf.WriteString("world")
+	buf.WriteBinary([]byte{0})
+	buf.Flush()
+
+	p, err := buf.ReadFrame(4, true, 0)
+	MustNil(t, err)
+	Equal(t, string(p), "hello")
+	p, err = buf.ReadFrame(2, false, 5)
+	MustNil(t, err)
+	Equal(t, string(p), "world")
+	// empty frame
+	p, err = buf.ReadFrame(1, true, 5)
+	MustNil(t, err)
+	Equal(t, len(p), 0)
+	Equal(t, buf.Len(), 0)
+
+	// the oversized frame is rejected, and the header is left unread
+	binary.BigEndian.PutUint32(hdr, 1<<30)
+	buf.WriteBinary(hdr)
+	buf.Flush()
+	_, err = buf.ReadFrame(4, true, 1024)
+	MustTrue(t, errors.Is(err, ErrFrameTooLarge))
+	Equal(t, buf.Len(), 4)
+	_, err = buf.ReadFrame(4, true, 0)
+	MustTrue(t, err != nil)
+	_, err = buf.ReadFrame(9, true, 0)
+	MustTrue(t, errors.Is(err, ErrUnsupported))
+	Equal(t, buf.Len(), 4)
+}
+
+func TestLinkBufferTryMalloc(t *testing.T) {
+	buf := NewLinkBuffer(block1k)
+	MustTrue(t, buf.TryMalloc(0) == nil)
+	p, _ := buf.Malloc(16) // init the first node
+	total := len(p)
+	for {
+		p = buf.TryMalloc(16)
+		if p == nil {
+			break
+		}
+		Equal(t, len(p), 16)
+		total += len(p)
+	}
+	// exhausted without growing
+	Equal(t, total, cap(buf.write.buf))
+	Equal(t, buf.MallocLen(), total)
+
+	// readonly node cannot be used
+	_, err := buf.WriteBinary(make([]byte, BinaryInplaceThreshold+1))
+	MustNil(t, err)
+	MustTrue(t, buf.TryMalloc(1) == nil)
+	p, err = buf.Malloc(1)
+	MustNil(t, err)
+	p[0] = 'a'
+	MustTrue(t, buf.TryMalloc(1) != nil)
+	buf.Flush()
+	Equal(t, buf.Len(), total+BinaryInplaceThreshold+1+2)
+}
+
+func BenchmarkLinkBufferMalloc16(b *testing.B) {
+	buf := NewLinkBuffer()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p, _ := buf.Malloc(16)
+		p[0] = 'a'
+		if i%256 == 255 {
+			buf.Flush()
+			buf.Skip(buf.Len())
+			buf.Release()
+		}
+	}
+}
+
+// BenchmarkPrewarmBufferPool measures the first requests of the connections after the pools are emptied by GC.
+func BenchmarkPrewarmBufferPool(b *testing.B) {
+	const conns = 256
+	for _, prewarm := range []bool{false, true} {
+		b.Run(fmt.Sprintf("prewarm=%v", prewarm), func(b *testing.B) {
+			bufs := make([]*LinkBuffer, conns)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				// sync.Pool is cleared after two GC cycles
+				runtime.GC()
+				runtime.GC()
+				if prewarm {
+					PrewarmBufferPool(conns, 0)
+				}
+				b.StartTimer()
+				for j := range bufs {
+					bufs[j] = NewLinkBuffer(defaultLinkBufferSize)
+					p, _ := bufs[j].Malloc(1024)
+					p[0] = 'a'
+					bufs[j].Flush()
+				}
+				b.StopTimer()
+				for j := range bufs {
+					bufs[j].Close()
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func BenchmarkLinkBufferTryMalloc16(b *testing.B) {
+	buf := NewLinkBuffer()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := buf.TryMalloc(16)
+		if p == nil {
+			p, _ = buf.Malloc(16)
+		}
+		p[0] = 'a'
+		if i%256 == 255 {
+			buf.Flush()
+			buf.Skip(buf.Len())
+			buf.Release()
+		}
+	}
+}
+
 func TestLinkBufferNoCopyWriteAndRead(t *testing.T) {
 	err := Configure(Config{Feature: Feature{AlwaysNoCopyRead: true}})
 	MustNil(t, err)
@@ -778,6 +1243,42 @@ func TestLinkBufferPeekOutOfMemory(t *testing.T) {
 	}
 }
 
+func TestLinkBufferWriteStringAllocs(t *testing.T) {
+	s := strings.Repeat("a", block1k)
+	buf := NewLinkBuffer(block8k)
+	// the buffer has enough capacity, and the string is copied into it without converting
+	allocs := testing.AllocsPerRun(100, func() {
+		buf.WriteString(s)
+		buf.Flush()
+		buf.Skip(len(s))
+		buf.Release()
+	})
+	Equal(t, allocs, float64(0))
+	Equal(t, buf.Len(), 0)
+
+	// the same as WriteBinary
+	buf.WriteString(s)
+	buf.WriteBinary([]byte(s))
+	buf.Flush()
+	p, err := buf.Next(2 * len(s))
+	MustNil(t, err)
+	Equal(t, string(p), s+s)
+}
+
+func BenchmarkLinkBufferWriteString(b *testing.B) {
+	s := strings.Repeat("a", block1k)
+	buf := NewLinkBuffer(block8k)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(s)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.WriteString(s)
+		buf.Flush()
+		buf.Skip(len(s))
+		buf.Release()
+	}
+}
+
 func BenchmarkStringToSliceByte(b *testing.B) {
 	b.StopTimer()
 	s := "hello world"
@@ -882,3 +1383,70 @@ func BenchmarkLinkBufferNoCopyRead(b *testing.B) {
 		}
 	})
 }
+
+func TestLinkBufferUntil(t *testing.T) {
+	buf := NewLinkBuffer()
+	// the delimiter is in the last node
+	buf.Append(NewLinkBuffer())
+	for _, s := range []string{"ab", "cd", "e\nf"} {
+		node := NewLinkBuffer()
+		node.WriteString(s)
+		node.Flush()
+		buf.Append(node)
+	}
+	MustNil(t, buf.Flush())
+	line, err := buf.Until('\n')
+	MustNil(t, err)
+	Equal(t, string(line), "abcde\n")
+	Equal(t, buf.Len(), 1)
+
+	_, err = buf.Until('\n')
+	MustTrue(t, err != nil)
+	Equal(t, buf.Len(), 1)
+}
+
+func TestLinkBufferAppendBuffer(t *testing.T) {
+	frame := make([]byte, 1024*1024)
+	for i := range frame {
+		frame[i] = byte(i)
+	}
+	src, dst := NewLinkBuffer(), NewLinkBuffer()
+	src.WriteString("header")
+	src.WriteBinary(frame)
+	src.WriteString("tail")
+	MustNil(t, src.Flush())
+	_, err := src.Next(6)
+	MustNil(t, err)
+
+	MustNil(t, dst.AppendBuffer(src, len(frame)))
+	Equal(t, src.Len(), 4)
+	Equal(t, dst.MallocLen(), len(frame))
+	// the nodes are still held by dst after src closed
+	MustNil(t, src.Close())
+	MustNil(t, dst.Flush())
+	Equal(t, dst.Len(), len(frame))
+	p, err := dst.Next(len(frame))
+	MustNil(t, err)
+	// zero copy
+	MustTrue(t, &p[0] == &frame[0])
+	MustTrue(t, bytes.Equal(p, frame))
+	MustNil(t, dst.Release())
+
+	// appended across nodes and followed by other writes
+	src = NewLinkBuffer()
+	for i := 0; i < 3; i++ {
+		src.WriteString("hello")
+		src.Flush()
+	}
+	MustNil(t, dst.AppendBuffer(src, 12))
+	dst.WriteString(" world")
+	MustNil(t, dst.Flush())
+	p, err = dst.Next(dst.Len())
+	MustNil(t, err)
+	Equal(t, string(p), "hellohellohe world")
+	Equal(t, src.Len(), 3)
+
+	// not enough
+	MustTrue(t, dst.AppendBuffer(src, 4) != nil)
+	Equal(t, src.Len(), 3)
+}
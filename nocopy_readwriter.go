@@ -15,6 +15,7 @@
 package netpoll
 
 import (
+	"errors"
 	"fmt"
 	"io"
 )
@@ -44,6 +45,16 @@ func (r *zcReader) Next(n int) (p []byte, err error) {
 	return r.buf.Next(n)
 }
 
+// TryNext implements Reader.
+func (r *zcReader) TryNext(n int) (p []byte, err error) {
+	return r.buf.TryNext(n)
+}
+
+// ReadFrame implements Reader.
+func (r *zcReader) ReadFrame(header int, bigEndian bool, maxSize int) (p []byte, err error) {
+	return readFrame(r, header, bigEndian, maxSize)
+}
+
 // Peek implements Reader.
 func (r *zcReader) Peek(n int) (buf []byte, err error) {
 	if err = r.waitRead(n); err != nil {
@@ -60,6 +71,45 @@ func (r *zcReader) Skip(n int) (err error) {
 	return r.buf.Skip(n)
 }
 
+// Discard implements Reader.
+func (r *zcReader) Discard(n int) (skipped int, err error) {
+	for skipped < n {
+		if err = r.waitRead(1); err != nil {
+			return skipped, err
+		}
+		l := r.buf.Len()
+		if l > n-skipped {
+			l = n - skipped
+		}
+		r.buf.Skip(l)
+		r.buf.Release()
+		skipped += l
+	}
+	return skipped, nil
+}
+
+// DiscardAll implements Reader, the data not read into the buffer yet is not discarded.
+func (r *zcReader) DiscardAll() (skipped int, err error) {
+	return r.buf.DiscardAll()
+}
+
+// WriteTo implements Reader.
+func (r *zcReader) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		if err = r.waitRead(1); err != nil {
+			if errors.Is(err, ErrEOF) {
+				err = nil
+			}
+			return n, err
+		}
+		m, err := r.buf.WriteTo(w)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
 // Release implements Reader.
 func (r *zcReader) Release() (err error) {
 	return r.buf.Release()
@@ -73,11 +123,21 @@ func (r *zcReader) Slice(n int) (reader Reader, err error) {
 	return r.buf.Slice(n)
 }
 
+// Clone implements Reader, the data not read into the buffer yet is not cloned.
+func (r *zcReader) Clone() (reader Reader) {
+	return r.buf.Clone()
+}
+
 // Len implements Reader.
 func (r *zcReader) Len() (length int) {
 	return r.buf.Len()
 }
 
+// WaitReadSize implements Reader.
+func (r *zcReader) WaitReadSize(n int) (err error) {
+	return r.waitRead(n)
+}
+
 // ReadString implements Reader.
 func (r *zcReader) ReadString(n int) (s string, err error) {
 	if err = r.waitRead(n); err != nil {
@@ -94,6 +154,14 @@ func (r *zcReader) ReadBinary(n int) (p []byte, err error) {
 	return r.buf.ReadBinary(n)
 }
 
+// ReadFull implements Reader.
+func (r *zcReader) ReadFull(p []byte) (n int, err error) {
+	if err = r.waitRead(len(p)); err != nil {
+		return 0, err
+	}
+	return r.buf.ReadFull(p)
+}
+
 // ReadByte implements Reader.
 func (r *zcReader) ReadByte() (b byte, err error) {
 	if err = r.waitRead(1); err != nil {
@@ -155,15 +223,23 @@ var _ Writer = &zcWriter{}
 
 // zcWriter implements Writer.
 type zcWriter struct {
-	w   io.Writer
-	buf *LinkBuffer
+	w         io.Writer
+	buf       *LinkBuffer
+	autoFlush autoFlusher
 }
 
 // Malloc implements Writer.
 func (w *zcWriter) Malloc(n int) (buf []byte, err error) {
+	w.autoFlush.malloc()
 	return w.buf.Malloc(n)
 }
 
+// TryMalloc implements Writer.
+func (w *zcWriter) TryMalloc(n int) (buf []byte) {
+	w.autoFlush.malloc()
+	return w.buf.TryMalloc(n)
+}
+
 // MallocLen implements Writer.
 func (w *zcWriter) MallocLen() (length int) {
 	return w.buf.MallocLen()
@@ -171,6 +247,7 @@ func (w *zcWriter) MallocLen() (length int) {
 
 // Flush implements Writer.
 func (w *zcWriter) Flush() (err error) {
+	w.autoFlush.flush()
 	w.buf.Flush()
 	n, err := w.w.Write(w.buf.Bytes())
 	if n > 0 {
@@ -180,6 +257,17 @@ func (w *zcWriter) Flush() (err error) {
 	return err
 }
 
+// FlushSync implements Writer.
+func (w *zcWriter) FlushSync() (err error) {
+	return w.Flush()
+}
+
+// SetAutoFlush implements Writer.
+func (w *zcWriter) SetAutoFlush(threshold int) error {
+	w.autoFlush.set(threshold)
+	return nil
+}
+
 // MallocAck implements Writer.
 func (w *zcWriter) MallocAck(n int) (err error) {
 	return w.buf.MallocAck(n)
@@ -187,17 +275,24 @@ func (w *zcWriter) MallocAck(n int) (err error) {
 
 // Append implements Writer.
 func (w *zcWriter) Append(w2 Writer) (err error) {
-	return w.buf.Append(w2)
+	return w.autoFlush.flushIfFull(w, w.buf.Append(w2))
+}
+
+// AppendBuffer implements Writer.
+func (w *zcWriter) AppendBuffer(r Reader, n int) (err error) {
+	return w.autoFlush.flushIfFull(w, w.buf.AppendBuffer(r, n))
 }
 
 // WriteString implements Writer.
 func (w *zcWriter) WriteString(s string) (n int, err error) {
-	return w.buf.WriteString(s)
+	n, err = w.buf.WriteString(s)
+	return n, w.autoFlush.flushIfFull(w, err)
 }
 
 // WriteBinary implements Writer.
 func (w *zcWriter) WriteBinary(b []byte) (n int, err error) {
-	return w.buf.WriteBinary(b)
+	n, err = w.buf.WriteBinary(b)
+	return n, w.autoFlush.flushIfFull(w, err)
 }
 
 // WriteDirect implements Writer.
@@ -205,9 +300,19 @@ func (w *zcWriter) WriteDirect(p []byte, remainCap int) error {
 	return w.buf.WriteDirect(p, remainCap)
 }
 
+// WritevDirect implements Writer.
+func (w *zcWriter) WritevDirect(bufs [][]byte) error {
+	return w.buf.WritevDirect(bufs)
+}
+
+// ReadFrom implements Writer.
+func (w *zcWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	return readFrom(w, r)
+}
+
 // WriteByte implements Writer.
 func (w *zcWriter) WriteByte(b byte) (err error) {
-	return w.buf.WriteByte(b)
+	return w.autoFlush.flushIfFull(w, w.buf.WriteByte(b))
 }
 
 // zcWriter implements ReadWriter.
@@ -281,6 +386,21 @@ func (w *ioWriter) Write(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// eofReader implements io.Reader of Connection.AsReader, which converts ErrEOF to io.EOF,
+// since the standard decoders compare the error with io.EOF directly.
+type eofReader struct {
+	r io.Reader
+}
+
+// Read implements io.Reader.
+func (r *eofReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	if err != nil && errors.Is(err, ErrEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
 // ioReadWriter implements io.ReadWriter.
 type ioReadWriter struct {
 	*ioReader
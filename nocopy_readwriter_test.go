@@ -81,6 +81,37 @@ func TestZCWriter(t *testing.T) {
 	Equal(t, w.buf.Len(), 0)
 }
 
+func TestZCWriterAutoFlush(t *testing.T) {
+	var written int
+	writer := &MockIOReadWriter{
+		write: func(p []byte) (n int, err error) {
+			written += len(p)
+			return len(p), nil
+		},
+	}
+	w := newZCWriter(writer)
+	MustNil(t, w.SetAutoFlush(block2k))
+
+	_, err := w.WriteBinary(make([]byte, block1k))
+	MustNil(t, err)
+	Equal(t, written, 0)
+	_, err = w.WriteBinary(make([]byte, block1k))
+	MustNil(t, err)
+	Equal(t, written, block2k)
+
+	// suspended by Malloc until Flush
+	_, err = w.Malloc(4)
+	MustNil(t, err)
+	_, err = w.WriteBinary(make([]byte, block4k))
+	MustNil(t, err)
+	Equal(t, written, block2k)
+	MustNil(t, w.Flush())
+	Equal(t, written, block2k+block4k+4)
+	_, err = w.WriteBinary(make([]byte, block2k))
+	MustNil(t, err)
+	Equal(t, written, 2*block2k+block4k+4)
+}
+
 func TestZCEOF(t *testing.T) {
 	reader := &MockIOReadWriter{
 		read: func(p []byte) (n int, err error) {
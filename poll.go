@@ -42,6 +42,19 @@ type Poll interface {
 	Free(operator *FDOperator)
 }
 
+// PollStats is the statistics of a poller.
+type PollStats struct {
+	FDs    int64  // number of registered fds
+	Waits  uint64 // number of epoll_wait or kevent calls
+	Events uint64 // number of dispatched events
+}
+
+// Stats is the statistics of all the pollers, see EventLoop.Stats.
+type Stats struct {
+	PollStats             // the sum of all pollers
+	Pollers   []PollStats // the statistics of each poller
+}
+
 // PollEvent defines the operation of poll.Control.
 type PollEvent int
 
@@ -63,4 +76,11 @@ const (
 
 	// PollRW2R is used to remove the writable monitor of FDOperator, generally used with PollR2RW.
 	PollRW2R PollEvent = 0x6
+
+	// PollR2Hup is used to remove the readable monitor of FDOperator, but keep monitoring hup and writable,
+	// which is called when the input buffer exceeds the threshold.
+	PollR2Hup PollEvent = 0x7
+
+	// PollHup2R is used to recover the readable monitor of FDOperator, generally used with PollR2Hup.
+	PollHup2R PollEvent = 0x8
 )
@@ -17,6 +17,69 @@
 
 package netpoll
 
+import (
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// pollStats records the statistics of a poller, which are updated atomically.
+type pollStats struct {
+	fds    int64
+	waits  uint64
+	events uint64
+}
+
+// onWait is called after each wait returns n events.
+func (s *pollStats) onWait(n int) {
+	atomic.AddUint64(&s.waits, 1)
+	if n > 0 {
+		atomic.AddUint64(&s.events, uint64(n))
+	}
+}
+
+// onControl is called after the event of an operator is changed successfully.
+func (s *pollStats) onControl(event PollEvent) {
+	switch event {
+	case PollReadable, PollWritable:
+		atomic.AddInt64(&s.fds, 1)
+	case PollDetach:
+		atomic.AddInt64(&s.fds, -1)
+	}
+}
+
+// pollerEventHook is the *func set by SetPollerEventHook, which is nil if not set.
+var pollerEventHook unsafe.Pointer
+
+// SetPollerEventHook sets a probe which is called by the pollers after handling each batch of events,
+// with the number of events returned by epoll_wait or kevent and the time spent in handling them,
+// e.g. to trace the wakeups of pollers. It's called on the poller goroutine, so it must be fast and not block,
+// otherwise all the connections of the poller are delayed. A nil fn removes the hook, and there is
+// only an atomic load per wakeup when the hook is not set. It's safe to be called at any time.
+func SetPollerEventHook(fn func(events int, dur time.Duration)) {
+	if fn == nil {
+		atomic.StorePointer(&pollerEventHook, nil)
+		return
+	}
+	atomic.StorePointer(&pollerEventHook, unsafe.Pointer(&fn))
+}
+
+// loadPollerEventHook returns the hook set by SetPollerEventHook or nil.
+func loadPollerEventHook() func(events int, dur time.Duration) {
+	if hook := (*func(int, time.Duration))(atomic.LoadPointer(&pollerEventHook)); hook != nil {
+		return *hook
+	}
+	return nil
+}
+
+func (p *defaultPoll) stats() PollStats {
+	return PollStats{
+		FDs:    atomic.LoadInt64(&p.pstats.fds),
+		Waits:  atomic.LoadUint64(&p.pstats.waits),
+		Events: atomic.LoadUint64(&p.pstats.events),
+	}
+}
+
 func (p *defaultPoll) Alloc() (operator *FDOperator) {
 	op := p.opcache.alloc()
 	op.poll = p
@@ -24,10 +87,17 @@ func (p *defaultPoll) Alloc() (operator *FDOperator) {
 }
 
 func (p *defaultPoll) Free(operator *FDOperator) {
+	// the operator may be migrated from another poll, so it's returned to where it was allocated
+	if operator.cache != nil {
+		operator.cache.freeable(operator)
+		return
+	}
 	p.opcache.freeable(operator)
 }
 
-func (p *defaultPoll) appendHup(operator *FDOperator) {
+// appendHup detaches the operator and calls OnHup later, err is the reason of hanging up, nil if unknown.
+func (p *defaultPoll) appendHup(operator *FDOperator, err error) {
+	operator.setHupErr(err)
 	p.hups = append(p.hups, operator.OnHup)
 	p.detach(operator)
 	operator.done()
@@ -54,6 +124,25 @@ func (p *defaultPoll) onhups() {
 	}(hups)
 }
 
+// readEvent reads the socket of op into the buffers of Inputs on a readable event, once if level-triggered,
+// and until EAGAIN if edge-triggered, since the data left in the socket will not be notified again.
+// If Inputs stops the reading, the connection pauses the readable events, and is notified again by PollHup2R.
+func readEvent(op *FDOperator, br barrier) (total int, err error) {
+	var n int
+	for {
+		bs := op.Inputs(br.bs)
+		if len(bs) == 0 {
+			return total, nil
+		}
+		n, err = readInputs(op, bs, br.ivs)
+		op.InputAck(n)
+		total += n
+		if err != nil || n == 0 || !op.edge {
+			return total, err
+		}
+	}
+}
+
 // readall read all left data before close connection
 func readall(op *FDOperator, br barrier) (total int, err error) {
 	ivs := br.ivs
@@ -65,7 +154,7 @@ func readall(op *FDOperator, br barrier) (total int, err error) {
 		}
 
 	TryRead:
-		n, err = ioread(op.FD, bs, ivs)
+		n, err = readInputs(op, bs, ivs)
 		op.InputAck(n)
 		total += n
 		if err != nil {
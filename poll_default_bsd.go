@@ -22,6 +22,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -50,6 +51,7 @@ func openDefaultPoll() (*defaultPoll, error) {
 }
 
 type defaultPoll struct {
+	pstats  pollStats // must be the first field for 64-bit alignment of atomic operations
 	fd      int
 	trigger uint32
 	m       sync.Map       // only used in go:race
@@ -77,6 +79,12 @@ func (p *defaultPoll) Wait() error {
 			}
 			return err
 		}
+		p.pstats.onWait(n)
+		hook := loadPollerEventHook()
+		var start time.Time
+		if hook != nil && n > 0 {
+			start = time.Now()
+		}
 		for i := 0; i < n; i++ {
 			fd := int(events[i].Ident)
 			// trigger
@@ -91,6 +99,7 @@ func (p *defaultPoll) Wait() error {
 			}
 
 			var totalRead int
+			var err error
 			evt := events[i]
 			triggerRead = evt.Filter == syscall.EVFILT_READ && evt.Flags&syscall.EV_ENABLE != 0
 			triggerWrite = evt.Filter == syscall.EVFILT_WRITE && evt.Flags&syscall.EV_ENABLE != 0
@@ -102,15 +111,11 @@ func (p *defaultPoll) Wait() error {
 					operator.OnRead(p)
 				} else {
 					// only for connection
-					bs := operator.Inputs(barriers[i].bs)
-					if len(bs) > 0 {
-						n, err := ioread(operator.FD, bs, barriers[i].ivs)
-						operator.InputAck(n)
-						totalRead += n
-						if err != nil {
-							p.appendHup(operator)
-							continue
-						}
+					n, err := readEvent(operator, barriers[i])
+					totalRead += n
+					if err != nil {
+						p.appendHup(operator, err)
+						continue
 					}
 				}
 			}
@@ -125,7 +130,11 @@ func (p *defaultPoll) Wait() error {
 				}
 				// only close connection if no further read bytes
 				if totalRead == 0 {
-					p.appendHup(operator)
+					// EV_EOF carries the pending error of the socket in fflags, e.g. ECONNRESET
+					if err == nil && evt.Fflags != 0 {
+						err = syscall.Errno(evt.Fflags)
+					}
+					p.appendHup(operator, err)
 					continue
 				}
 			}
@@ -141,7 +150,7 @@ func (p *defaultPoll) Wait() error {
 						n, err := iosend(operator.FD, bs, barriers[i].ivs, false && supportZeroCopy)
 						operator.OutputAck(n)
 						if err != nil {
-							p.appendHup(operator)
+							p.appendHup(operator, err)
 							continue
 						}
 					}
@@ -151,6 +160,9 @@ func (p *defaultPoll) Wait() error {
 		}
 		// hup conns together to avoid blocking the poll.
 		p.onhups()
+		if hook != nil && n > 0 {
+			hook(n, time.Since(start))
+		}
 		p.opcache.free()
 	}
 }
@@ -176,6 +188,15 @@ func (p *defaultPoll) Trigger() error {
 
 // Control implements Poll.
 func (p *defaultPoll) Control(operator *FDOperator, event PollEvent) error {
+	if event != PollReadable && event != PollWritable {
+		// the mux excludes the migration, after which the control is redirected to the new poll
+		operator.mux.Lock()
+		if to := operator.getPoll(); to != Poll(p) {
+			operator.mux.Unlock()
+			return to.Control(operator, event)
+		}
+		defer operator.mux.Unlock()
+	}
 	evs := make([]syscall.Kevent_t, 1)
 	evs[0].Ident = uint64(operator.FD)
 	p.setOperator(unsafe.Pointer(&evs[0].Udata), operator)
@@ -183,6 +204,9 @@ func (p *defaultPoll) Control(operator *FDOperator, event PollEvent) error {
 	case PollReadable:
 		operator.inuse()
 		evs[0].Filter, evs[0].Flags = syscall.EVFILT_READ, syscall.EV_ADD|syscall.EV_ENABLE
+		if operator.edge {
+			evs[0].Flags |= syscall.EV_CLEAR
+		}
 	case PollWritable:
 		operator.inuse()
 		evs[0].Filter, evs[0].Flags = syscall.EVFILT_WRITE, syscall.EV_ADD|syscall.EV_ENABLE
@@ -194,10 +218,67 @@ func (p *defaultPoll) Control(operator *FDOperator, event PollEvent) error {
 		}
 		p.delOperator(operator)
 	case PollR2RW:
+		atomic.StoreInt32(&operator.writing, 1)
 		evs[0].Filter, evs[0].Flags = syscall.EVFILT_WRITE, syscall.EV_ADD|syscall.EV_ENABLE
 	case PollRW2R:
+		atomic.StoreInt32(&operator.writing, 0)
 		evs[0].Filter, evs[0].Flags = syscall.EVFILT_WRITE, syscall.EV_DELETE
+	case PollR2Hup:
+		// EOF is notified by EVFILT_READ, so it will not be notified until PollHup2R
+		atomic.StoreInt32(&operator.paused, 1)
+		evs[0].Filter, evs[0].Flags = syscall.EVFILT_READ, syscall.EV_DISABLE
+	case PollHup2R:
+		atomic.StoreInt32(&operator.paused, 0)
+		evs[0].Filter, evs[0].Flags = syscall.EVFILT_READ, syscall.EV_ENABLE
+		if operator.edge {
+			// EV_ADD re-evaluates the filter, so the data left while paused is notified
+			evs[0].Flags |= syscall.EV_ADD | syscall.EV_CLEAR
+		}
 	}
 	_, err := syscall.Kevent(p.fd, evs, nil, nil)
+	if err == nil {
+		p.pstats.onControl(event)
+	}
 	return err
 }
+
+// migrate moves the registration of operator to another poll with the same monitored events,
+// the operator must be held by do() so that it will not be handled by both polls during the migration.
+func (p *defaultPoll) migrate(operator *FDOperator, to *defaultPoll) error {
+	operator.mux.Lock()
+	defer operator.mux.Unlock()
+	if atomic.LoadInt32(&operator.detached) > 0 {
+		return ErrConnClosed
+	}
+	evs := make([]syscall.Kevent_t, 1, 2)
+	evs[0].Ident = uint64(operator.FD)
+	evs[0].Filter, evs[0].Flags = syscall.EVFILT_READ, syscall.EV_ADD|syscall.EV_ENABLE
+	if atomic.LoadInt32(&operator.paused) == 1 {
+		evs[0].Flags = syscall.EV_ADD | syscall.EV_DISABLE
+	}
+	if operator.edge {
+		evs[0].Flags |= syscall.EV_CLEAR
+	}
+	if atomic.LoadInt32(&operator.writing) == 1 {
+		evs = append(evs, syscall.Kevent_t{Ident: uint64(operator.FD), Filter: syscall.EVFILT_WRITE, Flags: syscall.EV_ADD | syscall.EV_ENABLE})
+	}
+	// register into the new poll first, so that no event is lost in between
+	for i := range evs {
+		to.setOperator(unsafe.Pointer(&evs[i].Udata), operator)
+	}
+	if _, err := syscall.Kevent(to.fd, evs, nil, nil); err != nil {
+		to.delOperator(operator)
+		return err
+	}
+	p.delOperator(operator)
+	for i := range evs {
+		evs[i].Flags = syscall.EV_DELETE
+	}
+	if _, err := syscall.Kevent(p.fd, evs, nil, nil); err != nil {
+		logger.Printf("NETPOLL: poller migrate operator failed: %v", err)
+	}
+	operator.setPoll(to)
+	p.pstats.onControl(PollDetach)
+	to.pstats.onControl(PollReadable)
+	return nil
+}
@@ -20,6 +20,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -58,6 +59,7 @@ func openDefaultPoll() (*defaultPoll, error) {
 }
 
 type defaultPoll struct {
+	pstats pollStats // must be the first field for 64-bit alignment of atomic operations
 	pollArgs
 	fd      int            // epoll fd
 	wop     *FDOperator    // eventfd, wake epoll_wait
@@ -101,13 +103,23 @@ func (p *defaultPoll) Wait() (err error) {
 		if err != nil && err != syscall.EINTR {
 			return err
 		}
+		p.pstats.onWait(n)
 		if n <= 0 {
 			msec = -1
 			runtime.Gosched()
 			continue
 		}
 		msec = 0
-		if p.Handler(p.events[:n]) {
+		hook := loadPollerEventHook()
+		var start time.Time
+		if hook != nil {
+			start = time.Now()
+		}
+		closed := p.Handler(p.events[:n])
+		if hook != nil {
+			hook(n, time.Since(start))
+		}
+		if closed {
 			return nil
 		}
 		// we can make sure that there is no op remaining if Handler finished
@@ -117,7 +129,6 @@ func (p *defaultPoll) Wait() (err error) {
 
 func (p *defaultPoll) handler(events []epollevent) (closed bool) {
 	var triggerRead, triggerWrite, triggerHup, triggerError bool
-	var err error
 	for i := range events {
 		operator := p.getOperator(0, unsafe.Pointer(&events[i].data))
 		if operator == nil || !operator.do() {
@@ -125,6 +136,7 @@ func (p *defaultPoll) handler(events []epollevent) (closed bool) {
 		}
 
 		var totalRead int
+		var err error
 		evt := events[i].events
 		triggerRead = evt&syscall.EPOLLIN != 0
 		triggerWrite = evt&syscall.EPOLLOUT != 0
@@ -153,22 +165,19 @@ func (p *defaultPoll) handler(events []epollevent) (closed bool) {
 				operator.OnRead(p)
 			} else if operator.Inputs != nil {
 				// for connection
-				bs := operator.Inputs(p.barriers[i].bs)
-				if len(bs) > 0 {
-					n, err := ioread(operator.FD, bs, p.barriers[i].ivs)
-					operator.InputAck(n)
-					totalRead += n
-					if err != nil {
-						p.appendHup(operator)
-						continue
-					}
+				n, err := readEvent(operator, p.barriers[i])
+				totalRead += n
+				if err != nil {
+					p.appendHup(operator, err)
+					continue
 				}
 			} else {
 				logger.Printf("NETPOLL: operator has critical problem! event=%d operator=%v", evt, operator)
 			}
 		}
 		if triggerHup {
-			if triggerRead && operator.Inputs != nil {
+			// the left data must be read even if the readable monitor is paused
+			if (triggerRead || operator.isPaused()) && operator.Inputs != nil {
 				// read all left data if peer send and close
 				var leftRead int
 				// read all left data if peer send and close
@@ -179,7 +188,7 @@ func (p *defaultPoll) handler(events []epollevent) (closed bool) {
 			}
 			// only close connection if no further read bytes
 			if totalRead == 0 {
-				p.appendHup(operator)
+				p.appendHup(operator, err)
 				continue
 			}
 		}
@@ -187,7 +196,7 @@ func (p *defaultPoll) handler(events []epollevent) (closed bool) {
 			// Under block-zerocopy, the kernel may give an error callback, which is not a real error, just an EAGAIN.
 			// So here we need to check this error, if it is EAGAIN then do nothing, otherwise still mark as hup.
 			if _, _, _, _, err := syscall.Recvmsg(operator.FD, nil, nil, syscall.MSG_ERRQUEUE); err != syscall.EAGAIN {
-				p.appendHup(operator)
+				p.appendHup(operator, err)
 			} else {
 				operator.done()
 			}
@@ -205,7 +214,7 @@ func (p *defaultPoll) handler(events []epollevent) (closed bool) {
 					n, err := iosend(operator.FD, bs, p.barriers[i].ivs, false && supportZeroCopy)
 					operator.OutputAck(n)
 					if err != nil {
-						p.appendHup(operator)
+						p.appendHup(operator, err)
 						continue
 					}
 				}
@@ -244,6 +253,16 @@ func (p *defaultPoll) Control(operator *FDOperator, event PollEvent) error {
 	// op.FD  -- T1     op.FD = 0  -- T2
 	// T1 and T2 may happen together
 	fd := operator.FD
+	if event != PollReadable && event != PollWritable {
+		// readable and writable are changed independently, so the events must be modified atomically,
+		// and the mux excludes the migration, after which the control is redirected to the new poll.
+		operator.mux.Lock()
+		if to := operator.getPoll(); to != Poll(p) {
+			operator.mux.Unlock()
+			return to.Control(operator, event)
+		}
+		defer operator.mux.Unlock()
+	}
 	var op int
 	var evt epollevent
 	p.setOperator(unsafe.Pointer(&evt.data), operator)
@@ -251,16 +270,76 @@ func (p *defaultPoll) Control(operator *FDOperator, event PollEvent) error {
 	case PollReadable: // server accept a new connection and wait read
 		operator.inuse()
 		op, evt.events = syscall.EPOLL_CTL_ADD, syscall.EPOLLIN|syscall.EPOLLRDHUP|syscall.EPOLLERR
+		if operator.edge {
+			evt.events |= EPOLLET
+		}
 	case PollWritable: // client create a new connection and wait connect finished
 		operator.inuse()
 		op, evt.events = syscall.EPOLL_CTL_ADD, EPOLLET|syscall.EPOLLOUT|syscall.EPOLLRDHUP|syscall.EPOLLERR
 	case PollDetach: // deregister
 		p.delOperator(operator)
 		op, evt.events = syscall.EPOLL_CTL_DEL, syscall.EPOLLIN|syscall.EPOLLOUT|syscall.EPOLLRDHUP|syscall.EPOLLERR
-	case PollR2RW: // connection wait read/write
-		op, evt.events = syscall.EPOLL_CTL_MOD, syscall.EPOLLIN|syscall.EPOLLOUT|syscall.EPOLLRDHUP|syscall.EPOLLERR
-	case PollRW2R: // connection wait read
-		op, evt.events = syscall.EPOLL_CTL_MOD, syscall.EPOLLIN|syscall.EPOLLRDHUP|syscall.EPOLLERR
+	case PollR2RW, PollRW2R, PollR2Hup, PollHup2R: // connection modify read/write
+		switch event {
+		case PollR2RW:
+			atomic.StoreInt32(&operator.writing, 1)
+		case PollRW2R:
+			atomic.StoreInt32(&operator.writing, 0)
+		case PollR2Hup:
+			atomic.StoreInt32(&operator.paused, 1)
+		case PollHup2R:
+			atomic.StoreInt32(&operator.paused, 0)
+		}
+		op, evt.events = syscall.EPOLL_CTL_MOD, syscall.EPOLLRDHUP|syscall.EPOLLERR
+		if atomic.LoadInt32(&operator.paused) == 0 {
+			evt.events |= syscall.EPOLLIN
+		}
+		if atomic.LoadInt32(&operator.writing) == 1 {
+			evt.events |= syscall.EPOLLOUT
+		}
+		// MOD re-arms the edge-triggered events, so the data left while paused is notified
+		if operator.edge {
+			evt.events |= EPOLLET
+		}
+	}
+	err := EpollCtl(p.fd, op, fd, &evt)
+	if err == nil && operator != p.wop {
+		p.pstats.onControl(event)
+	}
+	return err
+}
+
+// migrate moves the registration of operator to another poll with the same monitored events,
+// the operator must be held by do() so that it will not be handled by both polls during the migration.
+func (p *defaultPoll) migrate(operator *FDOperator, to *defaultPoll) error {
+	operator.mux.Lock()
+	defer operator.mux.Unlock()
+	if atomic.LoadInt32(&operator.detached) > 0 {
+		return ErrConnClosed
+	}
+	var evt epollevent
+	evt.events = syscall.EPOLLRDHUP | syscall.EPOLLERR
+	if atomic.LoadInt32(&operator.paused) == 0 {
+		evt.events |= syscall.EPOLLIN
+	}
+	if atomic.LoadInt32(&operator.writing) == 1 {
+		evt.events |= syscall.EPOLLOUT
+	}
+	if operator.edge {
+		evt.events |= EPOLLET
+	}
+	// register into the new poll first, so that no event is lost in between
+	to.setOperator(unsafe.Pointer(&evt.data), operator)
+	if err := EpollCtl(to.fd, syscall.EPOLL_CTL_ADD, operator.FD, &evt); err != nil {
+		to.delOperator(operator)
+		return err
+	}
+	p.delOperator(operator)
+	if err := EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, operator.FD, &evt); err != nil {
+		logger.Printf("NETPOLL: poller migrate operator failed: %v", err)
 	}
-	return EpollCtl(p.fd, op, fd, &evt)
+	operator.setPoll(to)
+	p.pstats.onControl(PollDetach)
+	to.pstats.onControl(PollReadable)
+	return nil
 }
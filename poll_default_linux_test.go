@@ -20,6 +20,7 @@ package netpoll
 import (
 	"context"
 	"errors"
+	"runtime"
 	"syscall"
 	"testing"
 
@@ -350,3 +351,23 @@ WAIT:
 	}
 	return n, err
 }
+
+func TestSetAffinity(t *testing.T) {
+	cpu := runtime.NumCPU() - 1
+	done := make(chan error, 1)
+	go func() {
+		// the thread is terminated with the locked goroutine, so the affinity will not leak
+		runtime.LockOSThread()
+		if err := setAffinity(cpu); err != nil {
+			done <- err
+			return
+		}
+		var set unix.CPUSet
+		err := unix.SchedGetaffinity(0, &set)
+		MustNil(t, err)
+		Equal(t, set.Count(), 1)
+		MustTrue(t, set.IsSet(cpu))
+		done <- nil
+	}()
+	MustNil(t, <-done)
+}
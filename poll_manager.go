@@ -43,6 +43,7 @@ type manager struct {
 	status   int32       // 0: uninitialized, 1: initializing, 2: initialized
 	balance  loadbalance // load balancing method
 	polls    []Poll      // all the polls
+	affinity []int       // the cpus which the new polls are pinned to
 }
 
 // SetNumLoops will return error when set numLoops < 1
@@ -56,6 +57,21 @@ func (m *manager) SetNumLoops(numLoops int) (err error) {
 	return nil
 }
 
+// SetAffinity pins the polls to cpus one by one, and the number of polls is changed to len(cpus).
+// Only the polls started later are pinned, since a running poll cannot be moved to another thread.
+func (m *manager) SetAffinity(cpus []int) error {
+	if len(cpus) == 0 {
+		return fmt.Errorf("set empty affinity")
+	}
+	for _, cpu := range cpus {
+		if cpu < 0 {
+			return fmt.Errorf("set invalid affinity cpu[%d]", cpu)
+		}
+	}
+	m.affinity = append([]int(nil), cpus...)
+	return m.SetNumLoops(len(cpus))
+}
+
 // SetLoadBalance set load balance.
 func (m *manager) SetLoadBalance(lb LoadBalance) error {
 	if m.balance != nil && m.balance.LoadBalance() == lb {
@@ -108,7 +124,11 @@ func (m *manager) Run() (err error) {
 				return err
 			}
 			polls[idx] = poll
-			go poll.Wait()
+			if len(m.affinity) > 0 {
+				go waitOnCPU(poll, m.affinity[idx%len(m.affinity)])
+			} else {
+				go poll.Wait()
+			}
 		}
 	}
 	m.polls = polls
@@ -118,6 +138,15 @@ func (m *manager) Run() (err error) {
 	return nil
 }
 
+// waitOnCPU locks the poll to an OS thread and pins the thread to the cpu.
+func waitOnCPU(poll Poll, cpu int) {
+	runtime.LockOSThread()
+	if err := setAffinity(cpu); err != nil {
+		logger.Printf("NETPOLL: pin poller to cpu[%d] failed: %v\n", cpu, err)
+	}
+	poll.Wait()
+}
+
 // Reset pollers, this operation is very dangerous, please make sure to do this when calling !
 func (m *manager) Reset() error {
 	for _, poll := range m.polls {
@@ -127,6 +156,51 @@ func (m *manager) Reset() error {
 	return m.Run()
 }
 
+// Stats gathers the statistics of all pollers.
+func (m *manager) Stats() (stats Stats) {
+	polls := m.polls
+	stats.Pollers = make([]PollStats, 0, len(polls))
+	for _, poll := range polls {
+		sp, ok := poll.(interface{ stats() PollStats })
+		if !ok {
+			continue
+		}
+		ps := sp.stats()
+		stats.FDs += ps.FDs
+		stats.Waits += ps.Waits
+		stats.Events += ps.Events
+		stats.Pollers = append(stats.Pollers, ps)
+	}
+	return stats
+}
+
+// Poller returns the poller at index, which is in the same order as Stats.Pollers.
+func (m *manager) Poller(index int) (Poll, error) {
+	polls := m.polls
+	if index < 0 || index >= len(polls) {
+		return nil, fmt.Errorf("invalid poller index[%d] of %d pollers", index, len(polls))
+	}
+	return polls[index], nil
+}
+
+// NumPolls returns the number of running polls, or the number to run if the polls are not adjusted yet.
+func (m *manager) NumPolls() int {
+	if atomic.LoadInt32(&m.status) != managerInitialized {
+		return int(atomic.LoadInt32(&m.numLoops))
+	}
+	return len(m.polls)
+}
+
+// Index returns the index of poll, which is in the same order as Stats.Pollers, or -1 if not found.
+func (m *manager) Index(poll Poll) int {
+	for i, p := range m.polls {
+		if p == poll {
+			return i
+		}
+	}
+	return -1
+}
+
 // Pick will select the poller for use each time based on the LoadBalance.
 func (m *manager) Pick() Poll {
 START:
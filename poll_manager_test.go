@@ -18,6 +18,7 @@
 package netpoll
 
 import (
+	"fmt"
 	"runtime"
 	"sync"
 	"testing"
@@ -88,3 +89,28 @@ func TestPollManagerSetNumLoops(t *testing.T) {
 	wg.Wait()
 	close(finish)
 }
+
+func TestPollManagerSetAffinity(t *testing.T) {
+	pm := newManager(1)
+	MustTrue(t, pm.SetAffinity(nil) != nil)
+	MustTrue(t, pm.SetAffinity([]int{0, -1}) != nil)
+
+	cpus := []int{0, runtime.NumCPU() - 1, 0}
+	MustNil(t, pm.SetAffinity(cpus))
+	Assert(t, pm.Pick() != nil)
+	Equal(t, len(pm.polls), len(cpus))
+	MustNil(t, pm.Close())
+
+	// the option is accepted by NewEventLoop
+	numLoops, affinity := pollmanager.numLoops, pollmanager.affinity
+	defer func() {
+		pollmanager.affinity = affinity
+		MustNil(t, pollmanager.SetNumLoops(int(numLoops)))
+	}()
+	_, err := NewEventLoop(nil, WithPollerAffinity([]int{-1}))
+	MustTrue(t, err != nil)
+	_, err = NewEventLoop(nil, WithPollerAffinity(cpus))
+	MustNil(t, err)
+	Equal(t, int(pollmanager.numLoops), len(cpus))
+	Equal(t, fmt.Sprint(pollmanager.affinity), fmt.Sprint(cpus))
+}
@@ -18,6 +18,7 @@
 package netpoll
 
 import (
+	"context"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -141,3 +142,54 @@ func BenchmarkPollMod(b *testing.B) {
 		p.Control(operator, PollR2RW)
 	}
 }
+
+func TestSetPollerEventHook(t *testing.T) {
+	var calls, events, invalid int64
+	SetPollerEventHook(func(n int, dur time.Duration) {
+		atomic.AddInt64(&calls, 1)
+		atomic.AddInt64(&events, int64(n))
+		if n <= 0 || dur < 0 {
+			atomic.AddInt64(&invalid, 1)
+		}
+	})
+	defer SetPollerEventHook(nil)
+
+	network, address := "tcp", getTestAddress()
+	loop := newTestEventLoop(network, address, func(ctx context.Context, connection Connection) error {
+		p, err := connection.Reader().Next(connection.Reader().Len())
+		if err != nil {
+			return err
+		}
+		_, err = connection.Writer().WriteBinary(p)
+		if err != nil {
+			return err
+		}
+		return connection.Writer().Flush()
+	})
+	defer loop.Shutdown(context.Background())
+
+	conn, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = conn.Writer().WriteString("ping")
+		MustNil(t, err)
+		MustNil(t, conn.Writer().Flush())
+		s, err := conn.Reader().ReadString(4)
+		MustNil(t, err)
+		Equal(t, s, "ping")
+	}
+	MustNil(t, conn.Close())
+	MustTrue(t, atomic.LoadInt64(&calls) > 0)
+	MustTrue(t, atomic.LoadInt64(&events) >= atomic.LoadInt64(&calls))
+	Equal(t, atomic.LoadInt64(&invalid), int64(0))
+
+	// no more calls after removed
+	SetPollerEventHook(nil)
+	time.Sleep(10 * time.Millisecond)
+	before := atomic.LoadInt64(&calls)
+	conn, err = DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	MustNil(t, conn.Close())
+	time.Sleep(10 * time.Millisecond)
+	Equal(t, atomic.LoadInt64(&calls), before)
+}
@@ -19,9 +19,12 @@ package netpoll
 
 import (
 	"math"
+	"net"
 	"os"
 	"syscall"
 	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 // GetSysFdPairs creates and returns the fds of a pair of sockets.
@@ -30,11 +33,53 @@ func GetSysFdPairs() (r, w int) {
 	return fds[0], fds[1]
 }
 
+// setReusePort set the SO_REUSEPORT flag on socket
+func setReusePort(fd int) (err error) {
+	return os.NewSyscallError("setsockopt", syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, unix.SO_REUSEPORT, 1))
+}
+
 // setTCPNoDelay set the TCP_NODELAY flag on socket
 func setTCPNoDelay(fd int, b bool) (err error) {
 	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, boolint(b))
 }
 
+// setSockBuf sets SO_RCVBUF or SO_SNDBUF on socket
+func setSockBuf(fd, opt, bytes int) (err error) {
+	return os.NewSyscallError("setsockopt", syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, opt, bytes))
+}
+
+// getSockBuf gets SO_RCVBUF or SO_SNDBUF of socket
+func getSockBuf(fd, opt int) (bytes int, err error) {
+	bytes, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, opt)
+	return bytes, os.NewSyscallError("getsockopt", err)
+}
+
+// setTOS sets IP_TOS for IPv4 or IPV6_TCLASS for IPv6 on socket, by the family of its local address.
+func setTOS(fd, tos int) (err error) {
+	if tos < 0 || tos > 0xff {
+		return Exception(syscall.EINVAL, "when set TOS out of [0, 255]")
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return os.NewSyscallError("getsockname", err)
+	}
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return os.NewSyscallError("setsockopt", syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos))
+	case *syscall.SockaddrInet6:
+		if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, unix.IPV6_TCLASS, tos); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+		// the IPv4 packets of the dual-stack sockets are marked by IP_TOS
+		if net.IP(sa.Addr[:]).To4() != nil {
+			return os.NewSyscallError("setsockopt", syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos))
+		}
+		return nil
+	}
+	// not an IP socket
+	return ErrUnsupported
+}
+
 // Wrapper around the socket system call that marks the returned file
 // descriptor as nonblocking and close-on-exec.
 func sysSocket(family, sotype, proto int) (int, error) {
@@ -55,6 +100,21 @@ func sysSocket(family, sotype, proto int) (int, error) {
 	return s, nil
 }
 
+// sysSocketpair is the same as sysSocket but creates a pair of connected sockets.
+func sysSocketpair(family, sotype, proto int) (fds [2]int, err error) {
+	syscall.ForkLock.RLock()
+	fds, err = syscall.Socketpair(family, sotype, proto)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return fds, os.NewSyscallError("socketpair", err)
+	}
+	return fds, nil
+}
+
 const barriercap = 32
 
 type barrier struct {
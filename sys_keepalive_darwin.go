@@ -14,7 +14,11 @@
 
 package netpoll
 
-import "syscall"
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
 
 // SetKeepAlive sets the keepalive for the connection
 func SetKeepAlive(fd, secs int) error {
@@ -28,3 +32,25 @@ func SetKeepAlive(fd, secs int) error {
 	}
 	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPALIVE, secs)
 }
+
+// setKeepAliveConfig enables keepalive, and the zero values of idle, interval (in seconds) and count
+// keep the system defaults. Darwin uses TCP_KEEPALIVE for the idle time instead of TCP_KEEPIDLE.
+func setKeepAliveConfig(fd, idle, interval, count int) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1); err != nil {
+		return err
+	}
+	if idle > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPALIVE, idle); err != nil {
+			return err
+		}
+	}
+	if interval > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, unix.TCP_KEEPINTVL, interval); err != nil {
+			return err
+		}
+	}
+	if count > 0 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, unix.TCP_KEEPCNT, count)
+	}
+	return nil
+}
@@ -14,8 +14,15 @@
 
 package netpoll
 
+import "syscall"
+
 // SetKeepAlive sets the keepalive for the connection
 func SetKeepAlive(fd, secs int) error {
 	// OpenBSD has no user-settable per-socket TCP keepalive options.
 	return nil
 }
+
+// setKeepAliveConfig only enables keepalive, the parameters are system-wide on OpenBSD.
+func setKeepAliveConfig(fd, idle, interval, count int) error {
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1)
+}
@@ -36,3 +36,25 @@ func SetKeepAlive(fd, secs int) error {
 	// tcp_keepalive_time
 	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, secs)
 }
+
+// setKeepAliveConfig enables keepalive, and the zero values of idle, interval (in seconds) and count
+// keep the system defaults.
+func setKeepAliveConfig(fd, idle, interval, count int) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1); err != nil {
+		return err
+	}
+	if idle > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, idle); err != nil {
+			return err
+		}
+	}
+	if interval > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, interval); err != nil {
+			return err
+		}
+	}
+	if count > 0 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package netpoll
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWithKeepAlive(t *testing.T) {
+	getsockopts := func(fd int) (opts [4]int) {
+		var err error
+		opts[0], err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		MustNil(t, err)
+		opts[1], err = syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		MustNil(t, err)
+		opts[2], err = syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)
+		MustNil(t, err)
+		opts[3], err = syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT)
+		MustNil(t, err)
+		return opts
+	}
+
+	network, address := "tcp", getTestAddress()
+	accepted := make(chan [4]int, 1)
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			return nil
+		},
+		WithOnConnect(func(ctx context.Context, connection Connection) context.Context {
+			accepted <- getsockopts(connection.(Conn).Fd())
+			return ctx
+		}),
+		WithKeepAlive(30*time.Second, 5*time.Second, 3),
+	)
+	defer loop.Shutdown(context.Background())
+
+	// the idle time is rounded up to seconds, and the zero count keeps the default
+	dialer := NewDialer(WithKeepAlive(1500*time.Millisecond, 2*time.Second, 0))
+	conn, err := dialer.DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	opts := getsockopts(conn.(Conn).Fd())
+	Equal(t, opts[0], 1)
+	Equal(t, opts[1], 2)
+	Equal(t, opts[2], 2)
+	MustTrue(t, opts[3] > 0)
+	Equal(t, <-accepted, [4]int{1, 30, 5, 3})
+}
+
+func TestSetIdleTimeout(t *testing.T) {
+	network, address := "tcp", getTestAddress()
+	loop := newTestEventLoop(network, address,
+		func(ctx context.Context, connection Connection) error {
+			return nil
+		},
+	)
+	defer loop.Shutdown(context.Background())
+
+	conn, err := DialConnection(network, address, time.Second)
+	MustNil(t, err)
+	defer conn.Close()
+	fd := conn.(Conn).Fd()
+	for _, c := range []struct {
+		timeout time.Duration
+		secs    int
+	}{{2500 * time.Millisecond, 2}, {100 * time.Millisecond, 1}} {
+		MustNil(t, conn.SetIdleTimeout(c.timeout))
+		idle, err := syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		MustNil(t, err)
+		Equal(t, idle, c.secs)
+		interval, err := syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)
+		MustNil(t, err)
+		Equal(t, interval, c.secs)
+	}
+}
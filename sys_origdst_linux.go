@@ -0,0 +1,104 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netpoll
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST of SOL_IP and IP6T_SO_ORIGINAL_DST of SOL_IPV6 in netfilter.
+const soOriginalDst = 80
+
+// getOriginalDst gets the destination of the socket before it was redirected by the NAT of netfilter.
+func getOriginalDst(fd int) (net.Addr, error) {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return nil, os.NewSyscallError("getsockname", err)
+	}
+	var local *net.TCPAddr
+	var raw []byte
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		local = &net.TCPAddr{IP: sa.Addr[:], Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		local = &net.TCPAddr{IP: sa.Addr[:], Port: sa.Port}
+	default:
+		// not an IP socket
+		return nil, ErrUnsupported
+	}
+	if local.IP.To4() != nil {
+		// the IPv4 clients of the dual-stack sockets are tracked by IPv4 as well,
+		// and struct sockaddr_in fits in the 20 bytes of struct ipv6_mreq
+		var mreq *unix.IPv6Mreq
+		if mreq, err = unix.GetsockoptIPv6Mreq(fd, unix.SOL_IP, soOriginalDst); err == nil {
+			raw = (*[unix.SizeofIPv6Mreq]byte)(unsafe.Pointer(mreq))[:]
+		}
+	} else {
+		// struct sockaddr_in6 is the head of struct ip6_mtuinfo
+		var info *unix.IPv6MTUInfo
+		if info, err = unix.GetsockoptIPv6MTUInfo(fd, unix.SOL_IPV6, soOriginalDst); err == nil {
+			raw = (*[unix.SizeofIPv6MTUInfo]byte)(unsafe.Pointer(info))[:]
+		}
+	}
+	switch err {
+	case nil:
+	case syscall.ENOENT, syscall.ENOPROTOOPT:
+		// the connection is not tracked, or netfilter is not loaded at all
+		return nil, ErrNotRedirected
+	default:
+		return nil, os.NewSyscallError("getsockopt", err)
+	}
+	addr, err := parseOriginalDst(raw)
+	if err != nil {
+		return nil, err
+	}
+	// the connections tracked without NAT report the local address
+	if dst := addr.(*net.TCPAddr); dst.Port == local.Port && dst.IP.Equal(local.IP) {
+		return nil, ErrNotRedirected
+	}
+	return addr, nil
+}
+
+// parseOriginalDst parses the struct sockaddr_in or sockaddr_in6 returned by getsockopt(SO_ORIGINAL_DST).
+func parseOriginalDst(raw []byte) (net.Addr, error) {
+	if len(raw) < 2 {
+		return nil, syscall.EINVAL
+	}
+	// the family is in host byte order, while the port is in network byte order
+	switch family := *(*uint16)(unsafe.Pointer(&raw[0])); family {
+	case syscall.AF_INET:
+		if len(raw) < syscall.SizeofSockaddrInet4 {
+			return nil, syscall.EINVAL
+		}
+		sa := &syscall.SockaddrInet4{Port: int(raw[2])<<8 | int(raw[3])}
+		copy(sa.Addr[:], raw[4:8])
+		return sockaddrToAddr(sa), nil
+	case syscall.AF_INET6:
+		if len(raw) < syscall.SizeofSockaddrInet6 {
+			return nil, syscall.EINVAL
+		}
+		sa := &syscall.SockaddrInet6{Port: int(raw[2])<<8 | int(raw[3])}
+		copy(sa.Addr[:], raw[8:24])
+		sa.ZoneId = *(*uint32)(unsafe.Pointer(&raw[24]))
+		return sockaddrToAddr(sa), nil
+	default:
+		return nil, syscall.EAFNOSUPPORT
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package netpoll
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseOriginalDst(t *testing.T) {
+	// the port is in network byte order
+	htons := func(port uint16) uint16 {
+		b := (*[2]byte)(unsafe.Pointer(&port))
+		b[0], b[1] = byte(port>>8), byte(port)
+		return port
+	}
+
+	sa4 := unix.RawSockaddrInet4{Family: unix.AF_INET, Port: htons(8080), Addr: [4]byte{10, 0, 0, 1}}
+	raw := (*[unix.SizeofSockaddrInet4]byte)(unsafe.Pointer(&sa4))[:]
+	addr, err := parseOriginalDst(raw)
+	MustNil(t, err)
+	Equal(t, addr.String(), "10.0.0.1:8080")
+	Equal(t, addr.Network(), "tcp")
+
+	sa6 := unix.RawSockaddrInet6{Family: unix.AF_INET6, Port: htons(443), Scope_id: 1}
+	copy(sa6.Addr[:], net.ParseIP("fe80::1"))
+	raw = (*[unix.SizeofSockaddrInet6]byte)(unsafe.Pointer(&sa6))[:]
+	addr, err = parseOriginalDst(raw)
+	MustNil(t, err)
+	Equal(t, addr.(*net.TCPAddr).IP.String(), "fe80::1")
+	Equal(t, addr.(*net.TCPAddr).Port, 443)
+	Equal(t, addr.(*net.TCPAddr).Zone, zoneToString(1))
+
+	// truncated or unknown
+	_, err = parseOriginalDst(raw[:unix.SizeofSockaddrInet6-1])
+	Equal(t, err, syscall.EINVAL)
+	_, err = parseOriginalDst(nil)
+	Equal(t, err, syscall.EINVAL)
+	sa4.Family = unix.AF_UNIX
+	_, err = parseOriginalDst((*[unix.SizeofSockaddrInet4]byte)(unsafe.Pointer(&sa4))[:])
+	Equal(t, err, syscall.EAFNOSUPPORT)
+}
@@ -0,0 +1,39 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netpoll
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// getPeerCred gets the credentials of the peer process by LOCAL_PEERCRED as getpeereid(3), and LOCAL_PEERPID.
+func getPeerCred(fd int) (*Ucred, error) {
+	xucred, err := unix.GetsockoptXucred(fd, unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	if err != nil {
+		return nil, os.NewSyscallError("getsockopt", err)
+	}
+	pid, err := unix.GetsockoptInt(fd, unix.SOL_LOCAL, unix.LOCAL_PEERPID)
+	if err != nil {
+		return nil, os.NewSyscallError("getsockopt", err)
+	}
+	// the first group is the effective gid
+	cred := &Ucred{Pid: int32(pid), Uid: xucred.Uid}
+	if xucred.Ngroups > 0 {
+		cred.Gid = xucred.Groups[0]
+	}
+	return cred, nil
+}
@@ -0,0 +1,27 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netpoll
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// sendQueueLen returns the number of bytes in the socket send queue which have not been sent,
+// for TCP it includes the bytes sent but not acknowledged by the peer.
+func sendQueueLen(fd int) (int, error) {
+	return syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, unix.SO_NWRITE)
+}
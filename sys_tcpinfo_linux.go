@@ -0,0 +1,45 @@
+// Copyright 2024 CloudWeGo Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netpoll
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// getTCPInfo gets TCP_INFO of the socket, the times are in microseconds.
+func getTCPInfo(fd int) (*TCPInfo, error) {
+	ti, err := unix.GetsockoptTCPInfo(fd, unix.IPPROTO_TCP, unix.TCP_INFO)
+	if err != nil {
+		return nil, os.NewSyscallError("getsockopt", err)
+	}
+	return &TCPInfo{
+		State:        ti.State,
+		RTT:          time.Duration(ti.Rtt) * time.Microsecond,
+		RTTVar:       time.Duration(ti.Rttvar) * time.Microsecond,
+		RTO:          time.Duration(ti.Rto) * time.Microsecond,
+		SndMSS:       ti.Snd_mss,
+		RcvMSS:       ti.Rcv_mss,
+		SndCwnd:      ti.Snd_cwnd,
+		SndSsthresh:  ti.Snd_ssthresh,
+		Unacked:      ti.Unacked,
+		Lost:         ti.Lost,
+		Retransmits:  ti.Retransmits,
+		Retrans:      ti.Retrans,
+		TotalRetrans: ti.Total_retrans,
+	}, nil
+}